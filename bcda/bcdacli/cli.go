@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/CMSgov/bcda-app/bcda/auth"
@@ -17,13 +20,17 @@ import (
 	cclfUtils "github.com/CMSgov/bcda-app/bcda/cclf/testutils"
 	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/etl"
 	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/models/postgres"
+	"github.com/CMSgov/bcda-app/bcda/queue"
 	"github.com/CMSgov/bcda-app/bcda/servicemux"
+	"github.com/CMSgov/bcda-app/bcda/storage"
 	"github.com/CMSgov/bcda-app/bcda/suppression"
 	"github.com/CMSgov/bcda-app/bcda/utils"
 	"github.com/CMSgov/bcda-app/bcda/web"
-	"github.com/bgentry/que-go"
-	"github.com/jackc/pgx"
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -33,8 +40,6 @@ import (
 const Name = "bcda"
 const Usage = "Beneficiary Claims Data API CLI"
 
-var qc *que.Client
-
 func GetApp() *cli.App {
 	return setUpApp()
 }
@@ -44,31 +49,22 @@ func setUpApp() *cli.App {
 	app.Name = Name
 	app.Usage = Usage
 	app.Version = constants.Version
-	var acoName, acoCMSID, acoID, accessToken, threshold, acoSize, filePath, dirToDelete, environment, groupID, groupName string
+	var acoName, acoCMSID, acoID, accessToken, threshold, acoSize, filePath, dirToDelete, environment, groupID, groupName, deadLetterID, usageMonth, reportPath, fromFileID, toFileID, outputFormat, cclfFileName string
+	var dryRun bool
+	var keepFiles, keepDays, jobDays, batchSize int
 	app.Commands = []cli.Command{
 		{
 			Name:  "start-api",
 			Usage: "Start the API",
 			Action: func(c *cli.Context) error {
 				// Worker queue connection
-				queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-				pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-				if err != nil {
-					return err
-				}
-
-				pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-					ConnConfig:   pgxcfg,
-					AfterConnect: que.PrepareStatements,
-				})
+				q, err := queue.New()
 				if err != nil {
 					log.Fatal(err)
 				}
-				defer pgxpool.Close()
+				defer q.Close()
 
-				qc = que.NewClient(pgxpool)
-
-				web.SetQC(qc)
+				web.SetQueue(q)
 
 				fmt.Fprintf(app.Writer, "%s\n", "Starting bcda...")
 				if os.Getenv("DEBUG") == "true" {
@@ -323,6 +319,165 @@ func setUpApp() *cli.App {
 				return cleanupArchive(th)
 			},
 		},
+		{
+			Name:     "purge-cclf-data",
+			Category: "Cleanup",
+			Usage:    "Delete the CCLF files, beneficiaries and suppressions that are no longer needed",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:        "keep-files",
+					Usage:       "Number of the newest imported CCLF files of each type to keep for each ACO (at least 2)",
+					Value:       2,
+					Destination: &keepFiles,
+				},
+				cli.IntFlag{
+					Name:        "keep-days",
+					Usage:       "Keep CCLF and suppression files newer than this many days",
+					Value:       90,
+					Destination: &keepDays,
+				},
+				cli.IntFlag{
+					Name:        "job-days",
+					Usage:       "Keep the CCLF files used by jobs requested in this many days, or still running",
+					Value:       30,
+					Destination: &jobDays,
+				},
+				cli.IntFlag{
+					Name:        "batch-size",
+					Usage:       "Number of rows deleted by each statement",
+					Value:       10000,
+					Destination: &batchSize,
+				},
+				cli.BoolFlag{
+					Name:        "dry-run",
+					Usage:       "Report what would be deleted without deleting it",
+					Destination: &dryRun,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return purgeCCLFData(app.Writer, models.RetentionPolicy{
+					KeepFiles:               keepFiles,
+					KeepDays:                keepDays,
+					JobDays:                 jobDays,
+					SuppressionLookbackDays: utils.GetEnvInt("BCDA_SUPPRESSION_LOOKBACK_DAYS", 60),
+					BatchSize:               batchSize,
+					DryRun:                  dryRun,
+				})
+			},
+		},
+		{
+			Name:     "list-dead-letter-jobs",
+			Category: "Job queue",
+			Usage:    "List the queued jobs that were dead-lettered after exhausting their attempts",
+			Action: func(c *cli.Context) error {
+				return listDeadLetterJobs(app.Writer)
+			},
+		},
+		{
+			Name:     "inspect-dead-letter-job",
+			Category: "Job queue",
+			Usage:    "Show the arguments and last error of a dead-lettered job",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "id",
+					Usage:       "ID of the dead-lettered job",
+					Destination: &deadLetterID,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return inspectDeadLetterJob(app.Writer, deadLetterID)
+			},
+		},
+		{
+			Name:     "requeue-dead-letter-job",
+			Category: "Job queue",
+			Usage:    "Put a dead-lettered job back on the queue",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "id",
+					Usage:       "ID of the dead-lettered job",
+					Destination: &deadLetterID,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				queJobID, err := requeueDeadLetterJob(deadLetterID)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(app.Writer, "Requeued dead-lettered job %s as job %d\n", deadLetterID, queJobID)
+				return nil
+			},
+		},
+		{
+			Name:     "discard-dead-letter-job",
+			Category: "Job queue",
+			Usage:    "Remove a dead-lettered job without retrying it",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "id",
+					Usage:       "ID of the dead-lettered job",
+					Destination: &deadLetterID,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if err := discardDeadLetterJob(deadLetterID); err != nil {
+					return err
+				}
+				fmt.Fprintf(app.Writer, "Discarded dead-lettered job %s\n", deadLetterID)
+				return nil
+			},
+		},
+		{
+			Name:     "report-usage",
+			Category: "Reports",
+			Usage:    "Report the Blue Button requests, resources, bytes and time used by each ACO's jobs per month",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "month",
+					Usage:       "Only report jobs requested in this month (YYYY-MM)",
+					Destination: &usageMonth,
+				},
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "Only report jobs requested by the ACO with this CMS ID",
+					Destination: &acoCMSID,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return reportUsage(app.Writer, usageMonth, acoCMSID)
+			},
+		},
+		{
+			Name:     "attribution-diff",
+			Category: "Reports",
+			Usage:    "Report the beneficiaries added to, removed from and retained in an ACO's attribution between two of its CCLF8 files",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "CMS ID of the ACO",
+					Destination: &acoCMSID,
+				},
+				cli.StringFlag{
+					Name:        "from",
+					Usage:       "ID of the earlier CCLF8 file (defaults to the file before the later one)",
+					Destination: &fromFileID,
+				},
+				cli.StringFlag{
+					Name:        "to",
+					Usage:       "ID of the later CCLF8 file (defaults to the ACO's latest file)",
+					Destination: &toFileID,
+				},
+				cli.StringFlag{
+					Name:        "format",
+					Usage:       "Report as 'json' or as FHIR Groups in 'ndjson'",
+					Value:       "json",
+					Destination: &outputFormat,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return reportAttributionDiff(app.Writer, acoCMSID, fromFileID, toFileID, outputFormat)
+			},
+		},
 		{
 			Name:     "import-cclf-directory",
 			Category: "Data import",
@@ -333,13 +488,118 @@ func setUpApp() *cli.App {
 					Usage:       "Directory where CCLF files are located",
 					Destination: &filePath,
 				},
+				cli.BoolFlag{
+					Name:        "dry-run",
+					Usage:       "Validate the files and report the results as JSON instead of importing them",
+					Destination: &dryRun,
+				},
+				cli.StringFlag{
+					Name:        "report",
+					Usage:       "File to write the dry run report to, instead of standard output",
+					Destination: &reportPath,
+				},
 			},
 			Action: func(c *cli.Context) error {
+				if dryRun {
+					return validateCCLFDirectory(app.Writer, filePath, reportPath)
+				}
 				success, failure, skipped, err := cclf.ImportCCLFDirectory(filePath)
 				fmt.Fprintf(app.Writer, "Completed CCLF import.  Successfully imported %v files.  Failed to import %v files.  Skipped %v files.  See logs for more details.", success, failure, skipped)
 				return err
 			},
 		},
+		{
+			Name:     "list-failed-cclf-imports",
+			Category: "Data import",
+			Usage:    "List the CCLF files that failed to import",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "cms-id",
+					Usage:       "Only list the files of the ACO with this CMS ID",
+					Destination: &acoCMSID,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return listFailedCCLFImports(app.Writer, acoCMSID)
+			},
+		},
+		{
+			Name:     "reimport-cclf-file",
+			Category: "Data import",
+			Usage:    "Import a CCLF8 or CCLF9 file that failed to import again, replacing the failed import",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "name",
+					Usage:       "Name of the CCLF file",
+					Destination: &cclfFileName,
+				},
+				cli.StringFlag{
+					Name:        "directory",
+					Usage:       "Directory where the CCLF archives with the file and its CCLF0 file are located",
+					Destination: &filePath,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if cclfFileName == "" {
+					return errors.New("CCLF file name (--name) is required")
+				}
+				if filePath == "" {
+					return errors.New("directory (--directory) is required")
+				}
+				if err := cclf.ReimportCCLFFile(cclfFileName, filePath); err != nil {
+					return err
+				}
+				fmt.Fprintf(app.Writer, "Re-imported CCLF file %s\n", cclfFileName)
+				return nil
+			},
+		},
+		{
+			Name:     "supersede-cclf-file",
+			Category: "Data import",
+			Usage:    "Mark a CCLF file as superseded by another delivery, so it is no longer used or listed as failed",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "name",
+					Usage:       "Name of the CCLF file",
+					Destination: &cclfFileName,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if err := supersedeCCLFFile(cclfFileName); err != nil {
+					return err
+				}
+				fmt.Fprintf(app.Writer, "Marked CCLF file %s as superseded\n", cclfFileName)
+				return nil
+			},
+		},
+		{
+			Name:     "start-etl",
+			Category: "Data import",
+			Usage:    "Watch the inbound directories and import CCLF and suppression files as they are delivered (requires BCDA_ETL_MODE=true)",
+			Action: func(c *cli.Context) error {
+				return startETL(app.Writer)
+			},
+		},
+		{
+			Name:     "validate-cclf-directory",
+			Category: "Data import",
+			Usage:    "Validate all CCLF files in the specified directory without importing or moving them, and report the results as JSON",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "directory",
+					Usage:       "Directory where CCLF files are located",
+					Destination: &filePath,
+				},
+				cli.StringFlag{
+					Name:        "report",
+					Usage:       "File to write the report to, instead of standard output",
+					Destination: &reportPath,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return validateCCLFDirectory(app.Writer, filePath, reportPath)
+			},
+		},
 		{
 			Name:     "import-suppression-directory",
 			Category: "Data import",
@@ -531,18 +791,20 @@ func archiveExpiring(hrThreshold int) error {
 		return err
 	}
 
+	store, err := storage.New()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
 	var lastJobError error
 	for _, j := range jobs {
 		t := j.UpdatedAt
 		elapsed := time.Since(t).Hours()
 		if int(elapsed) >= hrThreshold {
 
-			id := int(j.ID)
-			jobDir := fmt.Sprintf("%s/%d", os.Getenv("FHIR_PAYLOAD_DIR"), id)
-			expDir := fmt.Sprintf("%s/%d", os.Getenv("FHIR_ARCHIVE_DIR"), id)
-
-			err = os.Rename(jobDir, expDir)
-			if err != nil {
+			jobDir := strconv.Itoa(int(j.ID))
+			if err = moveJobFiles(store, storage.Payload, storage.Archive, jobDir); err != nil {
 				log.Error(err)
 				lastJobError = err
 				continue
@@ -560,6 +822,23 @@ func archiveExpiring(hrThreshold int) error {
 	return lastJobError
 }
 
+// moveJobFiles moves all of the files for a job between locations. The job's directory is only removed
+// from the source location once all of its files have been moved.
+func moveJobFiles(store storage.Storage, from, to storage.Location, jobDir string) error {
+	files, err := store.List(from, jobDir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err = store.Move(from, to, fmt.Sprintf("%s/%s", jobDir, f)); err != nil {
+			return err
+		}
+	}
+
+	return store.DeleteAll(from, jobDir)
+}
+
 func cleanupArchive(hrThreshold int) error {
 	db := database.GetGORMDbConnection()
 	defer database.Close(db)
@@ -577,15 +856,19 @@ func cleanupArchive(hrThreshold int) error {
 		return nil
 	}
 
+	store, err := storage.New()
+	if err != nil {
+		return err
+	}
+
 	for _, job := range jobs {
 		t := job.UpdatedAt
 		elapsed := time.Since(t).Hours()
 		if int(elapsed) >= hrThreshold {
 
-			id := int(job.ID)
-			jobArchiveDir := fmt.Sprintf("%s/%d", os.Getenv("FHIR_ARCHIVE_DIR"), id)
+			jobArchiveDir := strconv.Itoa(int(job.ID))
 
-			err = os.RemoveAll(jobArchiveDir)
+			err = store.DeleteAll(storage.Archive, jobArchiveDir)
 			if err != nil {
 				e := fmt.Sprintf("Unable to remove %s because %s", jobArchiveDir, err)
 				log.Error(e)
@@ -608,3 +891,386 @@ func cleanupArchive(hrThreshold int) error {
 
 	return nil
 }
+
+func purgeCCLFData(w io.Writer, policy models.RetentionPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	report, err := models.PurgeCCLFData(db, policy, time.Now())
+	// Whatever was purged before an error is still reported
+	if report != nil {
+		verb := "Purged"
+		if report.DryRun {
+			verb = "Would purge"
+		}
+
+		var benes, xrefs, rejected int64
+		for _, f := range report.CCLFFiles {
+			fmt.Fprintf(w, "%s CCLF%d file %d\t%s\t%s\t%s\t%s\t%d beneficiaries\t%d cross references\t%d rejected records\n", verb,
+				f.CCLFNum, f.ID, f.ACOCMSID, f.Name, f.Timestamp.Format(time.RFC3339), f.ImportStatus, f.Beneficiaries, f.Xrefs, f.RejectedRecords)
+			benes += f.Beneficiaries
+			xrefs += f.Xrefs
+			rejected += f.RejectedRecords
+		}
+		for _, f := range report.SuppressionFiles {
+			fmt.Fprintf(w, "%s suppression file %d\t%s\t%s\n", verb, f.ID, f.Name, f.Timestamp.Format(time.RFC3339))
+		}
+		fmt.Fprintf(w, "%s %d CCLF files, %d beneficiaries, %d cross references, %d rejected records, %d suppressions and %d suppression files\n",
+			verb, len(report.CCLFFiles), benes, xrefs, rejected, report.Suppressions, len(report.SuppressionFiles))
+	}
+	return err
+}
+
+func listDeadLetterJobs(w io.Writer) error {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var dls []models.DeadLetterJob
+	if err := db.Order("id").Find(&dls).Error; err != nil {
+		return err
+	}
+
+	if len(dls) == 0 {
+		fmt.Fprintf(w, "No dead-lettered jobs\n")
+		return nil
+	}
+
+	for _, dl := range dls {
+		lastError := dl.LastError
+		if len(lastError) > 80 {
+			lastError = lastError[:77] + "..."
+		}
+		fmt.Fprintf(w, "%d\tjob %d\t%s\t%d attempts\t%s\t%s\n", dl.ID, dl.JobID, dl.Type, dl.ErrorCount,
+			dl.CreatedAt.Format(time.RFC3339), lastError)
+	}
+	return nil
+}
+
+func inspectDeadLetterJob(w io.Writer, id string) error {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	dl, err := getDeadLetterJob(db, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "ID: %d\nJob ID: %d\nQueued job ID: %d\nQueue: %q\nPriority: %d\nType: %s\nAttempts: %d\nDead-lettered: %s\nArgs: %s\nLast error: %s\n",
+		dl.ID, dl.JobID, dl.QueJobID, dl.Queue, dl.Priority, dl.Type, dl.ErrorCount, dl.CreatedAt.Format(time.RFC3339), dl.Args, dl.LastError)
+	return nil
+}
+
+// requeueDeadLetterJob puts the dead-lettered job back on the queue and reopens its parent job.
+// The job's checkpoint is carried over so it resumes from where it stopped. It returns the ID of the queued job.
+func requeueDeadLetterJob(id string) (int64, error) {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	dl, err := getDeadLetterJob(db, id)
+	if err != nil {
+		return 0, err
+	}
+
+	q, err := queue.New()
+	if err != nil {
+		return 0, err
+	}
+	defer q.Close()
+
+	j := &queue.Job{Queue: dl.Queue, Priority: dl.Priority, Type: dl.Type, Args: []byte(dl.Args)}
+	if err = q.Enqueue(j); err != nil {
+		return 0, errors.Wrap(err, "could not enqueue job")
+	}
+	queJobID := j.ID
+
+	tx := db.Begin()
+	err = tx.Model(&models.JobCheckpoint{}).Where("que_job_id = ?", dl.QueJobID).Update("que_job_id", queJobID).Error
+	if err == nil && dl.JobID != 0 {
+		err = tx.Model(&models.Job{}).Where("id = ? AND status = ?", dl.JobID, "Failed").
+			Updates(map[string]interface{}{"status": "In Progress", "failure_reason": ""}).Error
+	}
+	if err == nil {
+		err = tx.Unscoped().Delete(&dl).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return queJobID, errors.Wrapf(err, "job was requeued as %d, but dead-lettered job %d could not be updated", queJobID, dl.ID)
+	}
+
+	return queJobID, tx.Commit().Error
+}
+
+// discardDeadLetterJob removes the dead-lettered job along with its checkpoint. Its parent job remains Failed.
+func discardDeadLetterJob(id string) error {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	dl, err := getDeadLetterJob(db, id)
+	if err != nil {
+		return err
+	}
+
+	tx := db.Begin()
+	err = tx.Unscoped().Where("que_job_id = ?", dl.QueJobID).Delete(&models.JobCheckpoint{}).Error
+	if err == nil {
+		err = tx.Unscoped().Delete(&dl).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// reportUsage writes the usage of each ACO's jobs per month, optionally limited to a single month and ACO.
+func reportUsage(w io.Writer, month, cmsID string) error {
+	var from, to time.Time
+	if month != "" {
+		var err error
+		if from, err = time.Parse("2006-01", month); err != nil {
+			return errors.New("month (--month) must be in the format YYYY-MM")
+		}
+		to = from.AddDate(0, 1, 0)
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	usage, err := models.GetACOMonthlyUsage(db, from, to, cmsID)
+	if err != nil {
+		return err
+	}
+
+	if len(usage) == 0 {
+		fmt.Fprintf(w, "No job usage recorded\n")
+		return nil
+	}
+
+	fmt.Fprintf(w, "Month\tACO\tJobs\tBB requests\tResources\tBytes\tSeconds\n")
+	for _, u := range usage {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%.1f\n", u.Month, u.CMSID, u.Jobs, u.BBRequests, u.Resources, u.Bytes, u.Seconds)
+	}
+	return nil
+}
+
+func listFailedCCLFImports(w io.Writer, cmsID string) error {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	query := db.Where("import_status = ?", constants.ImportFail)
+	if cmsID != "" {
+		query = query.Where("aco_cms_id = ?", cmsID)
+	}
+	var files []models.CCLFFile
+	if err := query.Order("timestamp, id").Find(&files).Error; err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		fmt.Fprintf(w, "No failed CCLF imports\n")
+		return nil
+	}
+
+	for _, f := range files {
+		var rejected int
+		if err := db.Model(&models.CCLFRejectedRecord{}).Where("file_id = ?", f.ID).Count(&rejected).Error; err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\tCCLF%d\t%s\t%s\timported %s\t%d rejected records\n", f.ID, f.ACOCMSID, f.CCLFNum, f.Name,
+			f.Timestamp.Format(time.RFC3339), f.CreatedAt.Format(time.RFC3339), rejected)
+	}
+	return nil
+}
+
+func supersedeCCLFFile(name string) error {
+	if name == "" {
+		return errors.New("CCLF file name (--name) is required")
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var f models.CCLFFile
+	err := db.Where("name = ?", name).First(&f).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("no CCLF file found with name %s", name)
+	} else if err != nil {
+		return err
+	}
+
+	if f.ImportStatus != constants.ImportComplete && f.ImportStatus != constants.ImportFail {
+		return fmt.Errorf("CCLF file %s has import status %s; only imported and failed files can be superseded", name, f.ImportStatus)
+	}
+	// The status is only changed if the file has not been re-imported or purged in the meantime
+	result := db.Model(&models.CCLFFile{}).Where("id = ? AND import_status = ?", f.ID, f.ImportStatus).
+		Update("import_status", constants.ImportSuperseded)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("CCLF file %s changed while it was being superseded", name)
+	}
+	return nil
+}
+
+// etlSources returns the inbound directories set in BCDA_ETL_CCLF_DIR and BCDA_ETL_SUPPRESSION_DIR.
+func etlSources() ([]etl.Source, error) {
+	var sources []etl.Source
+	if dir := os.Getenv("BCDA_ETL_CCLF_DIR"); dir != "" {
+		sources = append(sources, etl.Source{Name: "cclf", Dir: dir, Import: cclf.ImportCCLFDirectory, LockID: 1})
+	}
+	if dir := os.Getenv("BCDA_ETL_SUPPRESSION_DIR"); dir != "" {
+		sources = append(sources, etl.Source{Name: "suppression", Dir: dir, Import: suppression.ImportSuppressionDirectory, LockID: 2})
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("BCDA_ETL_CCLF_DIR or BCDA_ETL_SUPPRESSION_DIR is required")
+	}
+	return sources, nil
+}
+
+// startETL watches the inbound directories until the process is stopped, serving the watcher's status at /_health.
+func startETL(w io.Writer) error {
+	if os.Getenv("BCDA_ETL_MODE") != "true" {
+		return errors.New("start-etl requires BCDA_ETL_MODE=true")
+	}
+
+	sources, err := etlSources()
+	if err != nil {
+		return err
+	}
+
+	db := database.GetDbConnection()
+	defer db.Close()
+
+	watcher := etl.NewWatcher(etl.NewPostgresLocker(db),
+		time.Duration(utils.GetEnvInt("BCDA_ETL_POLL_INTERVAL_SEC", 60))*time.Second,
+		time.Duration(utils.GetEnvInt("BCDA_ETL_FILE_STABLE_SEC", 300))*time.Second,
+		sources...)
+
+	r := chi.NewRouter()
+	r.Get("/_health", watcher.HealthCheck)
+	addr := os.Getenv("BCDA_ETL_HEALTH_ADDR")
+	if addr == "" {
+		addr = ":3006"
+	}
+	srv := &http.Server{
+		Handler:      r,
+		Addr:         addr,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		close(stop)
+	}()
+
+	fmt.Fprintf(w, "Watching %d inbound directories; status at %s/_health\n", len(sources), addr)
+	watcher.Run(stop)
+	return srv.Close()
+}
+
+// validateCCLFDirectory writes the validation report for the CCLF files in the directory to w, or to the report file
+// when there is one. The files being validated print their progress to standard output, so a report file keeps the
+// report apart from it. It returns an error if any of the files are invalid.
+func validateCCLFDirectory(w io.Writer, directory, reportPath string) error {
+	if directory == "" {
+		return errors.New("directory (--directory) is required")
+	}
+
+	report, err := cclf.ValidateCCLFDirectory(directory)
+	if err != nil {
+		return err
+	}
+
+	if reportPath != "" {
+		f, err := os.Create(filepath.Clean(reportPath))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+
+	if !report.Valid {
+		return errors.New("one or more CCLF files are invalid")
+	}
+	return nil
+}
+
+// reportAttributionDiff writes the differences between the beneficiaries attributed to the ACO by two of its CCLF8 files.
+func reportAttributionDiff(w io.Writer, cmsID, from, to, format string) error {
+	if cmsID == "" {
+		return errors.New("ACO CMS ID (--cms-id) is required")
+	}
+	if format != "json" && format != "ndjson" {
+		return errors.New("format (--format) must be json or ndjson")
+	}
+
+	var fileIDs [2]uint
+	for i, id := range []string{from, to} {
+		if id == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return fmt.Errorf("CCLF8 file ID %s is not a number", id)
+		}
+		fileIDs[i] = uint(v)
+	}
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	// The service is shared with the API, which creates it when the web package is initialized
+	svc := models.GetService(postgres.NewRepository(db), time.Duration(utils.GetEnvInt("CCLF_CUTOFF_DATE_DAYS", 45)*24)*time.Hour,
+		utils.GetEnvInt("BCDA_SUPPRESSION_LOOKBACK_DAYS", 60))
+	diff, err := svc.GetAttributionDiff(cmsID, fileIDs[0], fileIDs[1])
+	if err != nil {
+		return err
+	}
+
+	if format == "ndjson" {
+		return diff.WriteNDJSON(w)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(diff)
+}
+
+func getDeadLetterJob(db *gorm.DB, id string) (models.DeadLetterJob, error) {
+	var dl models.DeadLetterJob
+	if id == "" {
+		return dl, errors.New("ID (--id) is required")
+	}
+
+	dlID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return dl, errors.New("ID (--id) must be a number")
+	}
+
+	err = db.First(&dl, dlID).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return dl, fmt.Errorf("no dead-lettered job found with ID %d", dlID)
+	}
+	return dl, err
+}
@@ -2,6 +2,8 @@ package bcdacli
 
 import (
 	"bytes"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -23,6 +25,8 @@ import (
 	"github.com/urfave/cli"
 
 	"github.com/CMSgov/bcda-app/bcda/auth"
+	"github.com/CMSgov/bcda-app/bcda/cclf"
+	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/models"
 	"github.com/CMSgov/bcda-app/bcda/testUtils"
@@ -627,6 +631,128 @@ func (s *CLITestSuite) TestCreateACO() {
 	buf.Reset()
 }
 
+func (s *CLITestSuite) TestDeadLetterJobs() {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+	assert := assert.New(s.T())
+
+	j := models.Job{
+		ACOID:      uuid.Parse(constants.DevACOUUID),
+		RequestURL: "/api/v1/ExplanationOfBenefit/$export",
+		Status:     "In Progress",
+		JobCount:   2,
+	}
+	assert.NoError(db.Save(&j).Error)
+	defer db.Unscoped().Delete(&j)
+
+	args := fmt.Sprintf(`{"ID":%d,"ResourceType":"ExplanationOfBenefit"}`, j.ID)
+	requeued := models.DeadLetterJob{QueJobID: time.Now().UnixNano(), JobID: j.ID, Priority: 100, Type: "ProcessJob", Args: args, ErrorCount: 10, LastError: "Blue Button request failed"}
+	discarded := models.DeadLetterJob{QueJobID: time.Now().UnixNano() + 1, JobID: j.ID, Priority: 100, Type: "ProcessJob", Args: args, ErrorCount: 10, LastError: "Blue Button request failed"}
+	for _, dl := range []*models.DeadLetterJob{&requeued, &discarded} {
+		assert.NoError(models.AddDeadLetterJob(db, dl))
+		defer db.Unscoped().Delete(dl)
+	}
+
+	// The parent job is failed along with its chunk
+	assert.NoError(db.First(&j, j.ID).Error)
+	assert.Equal("Failed", j.Status)
+	assert.Contains(j.FailureReason, "Blue Button request failed")
+
+	assert.NoError(s.testApp.Run([]string{"bcda", "list-dead-letter-jobs"}))
+	assert.Contains(buf.String(), fmt.Sprintf("%d\tjob %d\tProcessJob\t10 attempts", requeued.ID, j.ID))
+	assert.Contains(buf.String(), fmt.Sprintf("%d\tjob %d\tProcessJob\t10 attempts", discarded.ID, j.ID))
+	buf.Reset()
+
+	assert.NoError(s.testApp.Run([]string{"bcda", "inspect-dead-letter-job", "--id", fmt.Sprint(requeued.ID)}))
+	assert.Contains(buf.String(), "Args: "+args)
+	assert.Contains(buf.String(), "Last error: Blue Button request failed")
+	buf.Reset()
+
+	err := s.testApp.Run([]string{"bcda", "inspect-dead-letter-job", "--id", "abc"})
+	assert.EqualError(err, "ID (--id) must be a number")
+
+	// A requeued job is put back on the queue and its parent job reopened
+	cp := models.JobCheckpoint{QueJobID: requeued.QueJobID, JobID: j.ID}
+	assert.NoError(db.Create(&cp).Error)
+	defer db.Unscoped().Delete(&cp)
+
+	assert.NoError(s.testApp.Run([]string{"bcda", "requeue-dead-letter-job", "--id", fmt.Sprint(requeued.ID)}))
+	assert.Contains(buf.String(), fmt.Sprintf("Requeued dead-lettered job %d as job", requeued.ID))
+	buf.Reset()
+
+	assert.True(db.First(&models.DeadLetterJob{}, requeued.ID).RecordNotFound())
+	assert.NoError(db.First(&j, j.ID).Error)
+	assert.Equal("In Progress", j.Status)
+	assert.Equal("", j.FailureReason)
+	assert.NoError(db.First(&cp, cp.ID).Error)
+	assert.NotEqual(requeued.QueJobID, cp.QueJobID)
+
+	queueDB, err := sql.Open("postgres", os.Getenv("QUEUE_DATABASE_URL"))
+	assert.NoError(err)
+	defer queueDB.Close()
+	var queuedArgs string
+	assert.NoError(queueDB.QueryRow("SELECT args FROM que_jobs WHERE job_id = $1", cp.QueJobID).Scan(&queuedArgs))
+	assert.JSONEq(args, queuedArgs)
+	_, err = queueDB.Exec("DELETE FROM que_jobs WHERE job_id = $1", cp.QueJobID)
+	assert.NoError(err)
+
+	// A discarded job is removed, leaving its parent job as it is
+	assert.NoError(s.testApp.Run([]string{"bcda", "discard-dead-letter-job", "--id", fmt.Sprint(discarded.ID)}))
+	assert.True(db.First(&models.DeadLetterJob{}, discarded.ID).RecordNotFound())
+
+	err = s.testApp.Run([]string{"bcda", "discard-dead-letter-job", "--id", fmt.Sprint(discarded.ID)})
+	assert.EqualError(err, fmt.Sprintf("no dead-lettered job found with ID %d", discarded.ID))
+}
+
+func (s *CLITestSuite) TestReportUsage() {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+	assert := assert.New(s.T())
+
+	// Two jobs requested in the same month are reported together, the third in the next month
+	var queJobID = time.Now().UnixNano()
+	for _, createdAt := range []time.Time{
+		time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC),
+		time.Date(2001, 2, 28, 0, 0, 0, 0, time.UTC),
+		time.Date(2001, 3, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		j := models.Job{ACOID: uuid.Parse(constants.DevACOUUID), RequestURL: "/api/v1/Patient/$export", Status: "Completed", JobCount: 2}
+		j.CreatedAt = createdAt
+		assert.NoError(db.Save(&j).Error)
+		defer db.Unscoped().Delete(&j)
+		defer db.Unscoped().Where("job_id = ?", j.ID).Delete(&models.JobUsage{})
+
+		for _, resourceType := range []string{"Patient", "Coverage"} {
+			queJobID++
+			u := models.JobUsage{QueJobID: queJobID, JobID: j.ID, ResourceType: resourceType, BBRequests: 10, Resources: 20, Bytes: 300, DurationMS: 2500}
+			assert.NoError(models.AddJobUsage(db, u))
+		}
+	}
+
+	// A retried chunk adds to its usage
+	assert.NoError(models.AddJobUsage(db, models.JobUsage{QueJobID: queJobID, BBRequests: 5, DurationMS: 500}))
+
+	assert.NoError(s.testApp.Run([]string{"bcda", "report-usage", "--month", "2001-02", "--cms-id", "A9994"}))
+	assert.Equal("Month\tACO\tJobs\tBB requests\tResources\tBytes\tSeconds\n2001-02\tA9994\t2\t40\t80\t1200\t10.0\n", buf.String())
+	buf.Reset()
+
+	assert.NoError(s.testApp.Run([]string{"bcda", "report-usage", "--month", "2001-03"}))
+	assert.Contains(buf.String(), "2001-03\tA9994\t1\t25\t40\t600\t5.5\n")
+	buf.Reset()
+
+	assert.NoError(s.testApp.Run([]string{"bcda", "report-usage", "--month", "2001-04"}))
+	assert.Equal("No job usage recorded\n", buf.String())
+
+	err := s.testApp.Run([]string{"bcda", "report-usage", "--month", "March"})
+	assert.EqualError(err, "month (--month) must be in the format YYYY-MM")
+}
+
 func (s *CLITestSuite) TestImportCCLFDirectory() {
 	assert := assert.New(s.T())
 
@@ -648,7 +774,7 @@ func (s *CLITestSuite) TestImportCCLFDirectory() {
 	err := s.testApp.Run(args)
 	assert.Nil(err)
 	assert.Contains(buf.String(), "Completed CCLF import.")
-	assert.Contains(buf.String(), "Successfully imported 6 files.")
+	assert.Contains(buf.String(), "Successfully imported 7 files.")
 	assert.Contains(buf.String(), "Failed to import 0 files.")
 	assert.Contains(buf.String(), "Skipped 1 files.")
 
@@ -674,6 +800,169 @@ func (s *CLITestSuite) TestImportCCLFDirectory() {
 	testUtils.ResetFiles(s.Suite, "../../shared_files/cclf/mixed/with_invalid_filenames/")
 }
 
+func (s *CLITestSuite) TestPurgeCCLFData() {
+	assert := assert.New(s.T())
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	// The files are older than any others in the database, which keep-days keeps
+	cmsID := "A9992"
+	keepDays := strconv.Itoa(int(time.Since(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).Hours() / 24))
+	var files []models.CCLFFile
+	for i := 0; i < 3; i++ {
+		f := models.CCLFFile{CCLFNum: 8, Name: fmt.Sprintf("T.BCD.%s.ZC8Y99.D99010%d.T1000000", cmsID, i+1), ACOCMSID: cmsID,
+			Timestamp: time.Date(1999, 1, i+1, 0, 0, 0, 0, time.UTC), PerformanceYear: 99, ImportStatus: constants.ImportComplete}
+		assert.NoError(db.Create(&f).Error)
+		for j := 0; j < 3; j++ {
+			assert.NoError(db.Create(&models.CCLFBeneficiary{FileID: f.ID, MBI: fmt.Sprintf("1A0000AA%03d", j), HICN: "HICN"}).Error)
+		}
+		files = append(files, f)
+		defer func() { assert.NoError(f.Delete()) }()
+	}
+	countBenes := func(fileID uint) (count int) {
+		db.Model(&models.CCLFBeneficiary{}).Where("file_id = ?", fileID).Count(&count)
+		return count
+	}
+
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+
+	assert.EqualError(s.testApp.Run([]string{"bcda", "purge-cclf-data", "--keep-files", "1"}), "at least 2 CCLF files must be kept for each ACO")
+
+	assert.NoError(s.testApp.Run([]string{"bcda", "purge-cclf-data", "--keep-days", keepDays, "--dry-run"}))
+	assert.Contains(buf.String(), fmt.Sprintf("Would purge CCLF8 file %d\t%s\t%s", files[0].ID, cmsID, files[0].Name))
+	assert.Contains(buf.String(), "3 beneficiaries")
+	assert.Equal(3, countBenes(files[0].ID))
+
+	buf.Reset()
+	assert.NoError(s.testApp.Run([]string{"bcda", "purge-cclf-data", "--keep-days", keepDays, "--batch-size", "2"}))
+	assert.Contains(buf.String(), fmt.Sprintf("Purged CCLF8 file %d\t%s\t%s", files[0].ID, cmsID, files[0].Name))
+	assert.Contains(buf.String(), "Purged 1 CCLF files, 3 beneficiaries")
+	assert.Equal(0, countBenes(files[0].ID))
+	assert.True(db.First(&models.CCLFFile{}, files[0].ID).RecordNotFound())
+	assert.Equal(3, countBenes(files[1].ID))
+	assert.Equal(3, countBenes(files[2].ID))
+}
+
+func (s *CLITestSuite) TestFailedCCLFImports() {
+	assert := assert.New(s.T())
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	cmsID := "A9993"
+	failed := models.CCLFFile{CCLFNum: 8, Name: "T.BCD.A9993.ZC8Y20.D201001.T1000000", ACOCMSID: cmsID, Timestamp: time.Now(),
+		PerformanceYear: 20, ImportStatus: constants.ImportFail}
+	assert.NoError(db.Create(&failed).Error)
+	defer func() { assert.NoError(failed.Delete()) }()
+	assert.NoError(db.Create(&models.CCLFRejectedRecord{FileID: failed.ID, LineNumber: 1, Record: "1A69B98CD30", Reason: "missing HICN"}).Error)
+
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+
+	assert.NoError(s.testApp.Run([]string{"bcda", "list-failed-cclf-imports", "--cms-id", cmsID}))
+	assert.Regexp(fmt.Sprintf("^%d\t%s\tCCLF8\t%s\t.*\t1 rejected records\n$", failed.ID, cmsID, failed.Name), buf.String())
+
+	assert.EqualError(s.testApp.Run([]string{"bcda", "reimport-cclf-file", "--directory", "dir"}), "CCLF file name (--name) is required")
+	assert.EqualError(s.testApp.Run([]string{"bcda", "reimport-cclf-file", "--name", failed.Name}), "directory (--directory) is required")
+
+	buf.Reset()
+	assert.NoError(s.testApp.Run([]string{"bcda", "supersede-cclf-file", "--name", failed.Name}))
+	assert.Equal(fmt.Sprintf("Marked CCLF file %s as superseded\n", failed.Name), buf.String())
+	var file models.CCLFFile
+	assert.NoError(db.First(&file, failed.ID).Error)
+	assert.Equal(constants.ImportSuperseded, file.ImportStatus)
+
+	buf.Reset()
+	assert.NoError(s.testApp.Run([]string{"bcda", "list-failed-cclf-imports", "--cms-id", cmsID}))
+	assert.Equal("No failed CCLF imports\n", buf.String())
+
+	assert.EqualError(s.testApp.Run([]string{"bcda", "supersede-cclf-file", "--name", failed.Name}),
+		"CCLF file T.BCD.A9993.ZC8Y20.D201001.T1000000 has import status Superseded; only imported and failed files can be superseded")
+	assert.EqualError(s.testApp.Run([]string{"bcda", "supersede-cclf-file", "--name", "unknown"}), "no CCLF file found with name unknown")
+	assert.EqualError(s.testApp.Run([]string{"bcda", "supersede-cclf-file"}), "CCLF file name (--name) is required")
+}
+
+func (s *CLITestSuite) TestAttributionDiff() {
+	assert := assert.New(s.T())
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	cmsID := "A9991"
+	now := time.Now().Round(time.Second)
+	for i, mbis := range [][]string{{"1A0000AA001", "1A0000AA002"}, {"1A0000AA002", "1A0000AA003"}} {
+		f := models.CCLFFile{CCLFNum: 8, Name: fmt.Sprintf("T.BCD.%s.ZC8Y20.D2010%02d.T1000000", cmsID, i+1), ACOCMSID: cmsID,
+			Timestamp: now.AddDate(0, i-1, 0), PerformanceYear: 20, ImportStatus: constants.ImportComplete}
+		assert.NoError(db.Create(&f).Error)
+		for _, mbi := range mbis {
+			assert.NoError(db.Create(&models.CCLFBeneficiary{FileID: f.ID, MBI: mbi}).Error)
+		}
+		defer func() { assert.NoError(f.Delete()) }()
+	}
+
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+
+	assert.NoError(s.testApp.Run([]string{"bcda", "attribution-diff", "--cms-id", cmsID}))
+	var diff models.AttributionDiff
+	assert.NoError(json.Unmarshal(buf.Bytes(), &diff))
+	assert.Equal([]string{"1A0000AA003"}, diff.Added)
+	assert.Equal([]string{"1A0000AA001"}, diff.Removed)
+	assert.Equal([]string{"1A0000AA002"}, diff.Retained)
+
+	buf.Reset()
+	assert.NoError(s.testApp.Run([]string{"bcda", "attribution-diff", "--cms-id", cmsID, "--format", "ndjson"}))
+	assert.Len(strings.Split(strings.TrimSpace(buf.String()), "\n"), 3)
+
+	assert.EqualError(s.testApp.Run([]string{"bcda", "attribution-diff"}), "ACO CMS ID (--cms-id) is required")
+	assert.EqualError(s.testApp.Run([]string{"bcda", "attribution-diff", "--cms-id", cmsID, "--format", "xml"}), "format (--format) must be json or ndjson")
+	assert.EqualError(s.testApp.Run([]string{"bcda", "attribution-diff", "--cms-id", cmsID, "--from", "abc"}), "CCLF8 file ID abc is not a number")
+}
+
+func (s *CLITestSuite) TestValidateCCLFDirectory() {
+	assert := assert.New(s.T())
+
+	buf := new(bytes.Buffer)
+	s.testApp.Writer = buf
+
+	dir := "../../shared_files/cclf/archives/valid/"
+	args := []string{"bcda", "validate-cclf-directory", "--directory", dir}
+	err := s.testApp.Run(args)
+	assert.Nil(err)
+
+	var report cclf.ValidationReport
+	assert.NoError(json.Unmarshal(buf.Bytes(), &report))
+	assert.True(report.Valid)
+	assert.Len(report.ACOs, 3)
+	assert.Len(report.Skipped, 1)
+
+	// The dry run of an import reports the same, and imports nothing
+	buf.Reset()
+	args = []string{"bcda", "import-cclf-directory", "--directory", dir, "--dry-run"}
+	err = s.testApp.Run(args)
+	assert.Nil(err)
+	assert.NotContains(buf.String(), "Completed CCLF import.")
+	var dryRun cclf.ValidationReport
+	assert.NoError(json.Unmarshal(buf.Bytes(), &dryRun))
+	assert.Equal(report, dryRun)
+
+	// The report can be written to a file
+	buf.Reset()
+	f, err := ioutil.TempFile("", "cclf-report")
+	assert.NoError(err)
+	f.Close()
+	defer os.Remove(f.Name())
+	args = []string{"bcda", "validate-cclf-directory", "--directory", dir, "--report", f.Name()}
+	assert.Nil(s.testApp.Run(args))
+	assert.Empty(buf.String())
+	b, err := ioutil.ReadFile(f.Name())
+	assert.NoError(err)
+	assert.Contains(string(b), `"valid": true`)
+
+	args = []string{"bcda", "validate-cclf-directory"}
+	err = s.testApp.Run(args)
+	assert.EqualError(err, "directory (--directory) is required")
+}
+
 func (s *CLITestSuite) TestDeleteDirectoryContents() {
 	assert := assert.New(s.T())
 	buf := new(bytes.Buffer)
@@ -6,11 +6,13 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -62,12 +64,6 @@ func importCCLF0(ctx context.Context, fileMetadata *cclfFileMetadata) (map[strin
 	}
 	defer r.Close()
 
-	const (
-		fileNumStart, fileNumEnd           = 0, 7
-		totalRecordStart, totalRecordEnd   = 52, 63
-		recordLengthStart, recordLengthEnd = 64, 69
-	)
-
 	close := metrics.NewChild(ctx, "importCCLF0")
 	defer close()
 
@@ -98,72 +94,93 @@ func importCCLF0(ctx context.Context, fileMetadata *cclfFileMetadata) (map[strin
 		return nil, err
 	}
 	defer rc.Close()
-	sc := bufio.NewScanner(rc)
+	validator, err = parseCCLF0(rc, fileMetadata)
+	if err != nil {
+		fmt.Printf("Failed to import CCLF0 file %s: %s.\n", fileMetadata, err)
+		log.Error(err)
+		return nil, err
+	}
+	fmt.Printf("Successfully imported CCLF0 file %s.\n", fileMetadata)
+	log.Infof("Successfully imported CCLF0 file %s.", fileMetadata)
+
+	return validator, nil
+}
+
+// parseCCLF0 reads the record count and length of the CCLF8 and CCLF9 files from the CCLF0 file.
+func parseCCLF0(r io.Reader, fileMetadata *cclfFileMetadata) (map[string]cclfFileValidator, error) {
+	var validator map[string]cclfFileValidator
+	sc := bufio.NewScanner(r)
 	for sc.Scan() {
 		b := sc.Bytes()
 		if len(bytes.TrimSpace(b)) > 0 {
-			filetype := string(bytes.TrimSpace(b[fileNumStart:fileNumEnd]))
+			// The header line and the lines of other files are not parsed any further
+			record, err := cclf0Layout.Parse(b)
+			filetype := record.String("fileNumber")
 
-			if filetype == "CCLF8" {
+			// CCLF8 is required; CCLF9 is only validated when the ACO receives one
+			if filetype == "CCLF8" || filetype == "CCLF9" {
 				if validator == nil {
 					validator = make(map[string]cclfFileValidator)
 				}
 
 				if _, ok := validator[filetype]; ok {
-					fmt.Printf("Duplicate %v file type found from CCLF0 file.\n", filetype)
-					err := fmt.Errorf("duplicate %v file type found from CCLF0 file", filetype)
-					log.Error(err)
-					return nil, err
+					return nil, fmt.Errorf("duplicate %v file type found from CCLF0 file", filetype)
 				}
 
-				count, err := strconv.Atoi(string(bytes.TrimSpace(b[totalRecordStart:totalRecordEnd])))
 				if err != nil {
-					fmt.Printf("Failed to parse %s record count from CCLF0 file.\n", filetype)
-					err = errors.Wrapf(err, "failed to parse %s record count from CCLF0 file", filetype)
-					log.Error(err)
-					return nil, err
+					return nil, errors.Wrapf(err, "failed to parse %s record from CCLF0 file", filetype)
 				}
-				length, err := strconv.Atoi(string(bytes.TrimSpace(b[recordLengthStart:recordLengthEnd])))
-				if err != nil {
-					fmt.Printf("Failed to parse %s record length from CCLF0 file.\n", filetype)
-					err = errors.Wrapf(err, "failed to parse %s record length from CCLF0 file", filetype)
-					log.Error(err)
-					return nil, err
-				}
-				validator[filetype] = cclfFileValidator{totalRecordCount: count, maxRecordLength: length}
+				validator[filetype] = cclfFileValidator{totalRecordCount: record.Int("totalRecordCount"), maxRecordLength: record.Int("recordLength")}
 			}
 		}
 	}
 
-	if _, ok := validator["CCLF8"]; !ok {
-		fmt.Printf("Failed to parse CCLF8 from CCLF0 file %s.\n", fileMetadata)
-		err := fmt.Errorf("failed to parse CCLF8 from CCLF0 file %s", fileMetadata)
-		log.Error(err)
-		return nil, err
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrapf(err, "could not read CCLF0 file %s", fileMetadata)
 	}
-	fmt.Printf("Successfully imported CCLF0 file %s.\n", fileMetadata)
-	log.Infof("Successfully imported CCLF0 file %s.", fileMetadata)
 
+	if _, ok := validator["CCLF8"]; !ok {
+		return nil, fmt.Errorf("failed to parse CCLF8 from CCLF0 file %s", fileMetadata)
+	}
 	return validator, nil
 }
 
-func importCCLF8(ctx context.Context, fileMetadata *cclfFileMetadata) error {
+// importCCLF8 imports the records of a CCLF8 file. Records longer than maxRecordLength, or with an invalid MBI or no
+// HICN, are rejected rather than imported.
+func importCCLF8(ctx context.Context, db *gorm.DB, fileMetadata *cclfFileMetadata, maxRecordLength int) error {
 	importer := &cclf8Importer{
 		logger:            log.StandardLogger(),
 		maxPendingQueries: utils.GetEnvInt("STATEMENT_EXEC_COUNT", 200000),
+		maxRecordLength:   maxRecordLength,
+	}
+
+	err := importCCLF(ctx, db, fileMetadata, importer)
+
+	if err != nil {
+		updateImportStatus(db, fileMetadata, constants.ImportFail)
+		return err
+	}
+	updateImportStatus(db, fileMetadata, constants.ImportComplete)
+	return nil
+}
+
+func importCCLF9(ctx context.Context, db *gorm.DB, fileMetadata *cclfFileMetadata) error {
+	importer := &cclf9Importer{
+		logger:            log.StandardLogger(),
+		maxPendingQueries: utils.GetEnvInt("STATEMENT_EXEC_COUNT", 200000),
 	}
 
-	err := importCCLF(ctx, fileMetadata, importer)
+	err := importCCLF(ctx, db, fileMetadata, importer)
 
 	if err != nil {
-		updateImportStatus(fileMetadata, constants.ImportFail)
+		updateImportStatus(db, fileMetadata, constants.ImportFail)
 		return err
 	}
-	updateImportStatus(fileMetadata, constants.ImportComplete)
+	updateImportStatus(db, fileMetadata, constants.ImportComplete)
 	return nil
 }
 
-func importCCLF(ctx context.Context, fileMetadata *cclfFileMetadata, importer importer) (err error) {
+func importCCLF(ctx context.Context, db *gorm.DB, fileMetadata *cclfFileMetadata, importer importer) (err error) {
 	if fileMetadata == nil {
 		fmt.Println("CCLF file not found.")
 		err := errors.New("CCLF file not found")
@@ -202,9 +219,6 @@ func importCCLF(ctx context.Context, fileMetadata *cclfFileMetadata, importer im
 		ImportStatus:    constants.ImportInprog,
 	}
 
-	db := database.GetGORMDbConnection()
-	defer database.Close(db)
-
 	err = db.Create(&cclfFile).Error
 	if err != nil {
 		fmt.Printf("Could not create CCLF%d file record.\n", fileMetadata.cclfNum)
@@ -244,6 +258,9 @@ func importCCLF(ctx context.Context, fileMetadata *cclfFileMetadata, importer im
 	defer rc.Close()
 	sc := bufio.NewScanner(rc)
 
+	maxRejected := maxRejectedRecords()
+	var rejected []models.CCLFRejectedRecord
+
 	// Open transaction to encompass entire CCLF file ingest.
 	txn, err := db.DB().Begin()
 	if err != nil {
@@ -253,27 +270,59 @@ func importCCLF(ctx context.Context, fileMetadata *cclfFileMetadata, importer im
 		if err == nil {
 			err = importer.flush(ctx)
 		}
+		if err == nil {
+			err = insertRejectedRecords(ctx, txn, rejected)
+		}
 
 		if err != nil {
-			err = txn.Rollback()
+			if rollbackErr := txn.Rollback(); rollbackErr != nil {
+				log.Errorf("Could not roll back import of CCLF%d file %s: %s", fileMetadata.cclfNum, fileMetadata, rollbackErr.Error())
+			}
+			// The rejected records explain why the import failed, so they are kept even though nothing was imported
+			if len(rejected) > 0 {
+				if saveErr := saveRejectedRecords(ctx, db, rejected); saveErr != nil {
+					log.Errorf("Could not save rejected records of CCLF%d file %s: %s", fileMetadata.cclfNum, fileMetadata, saveErr.Error())
+				}
+			}
+			return
 		}
 
 		if err = txn.Commit(); err == nil {
 			successMsg := fmt.Sprintf("Successfully imported %d records from CCLF%d file %s.", importedCount, fileMetadata.cclfNum, fileMetadata)
+			if len(rejected) > 0 {
+				successMsg = fmt.Sprintf("Successfully imported %d records from CCLF%d file %s, rejected %d records.", importedCount, fileMetadata.cclfNum, fileMetadata, len(rejected))
+			}
 			fmt.Println(successMsg)
 			log.Infof(successMsg)
 		}
 	}()
 
+	validator, validates := importer.(recordValidator)
+	line := 0
 	for sc.Scan() {
 		close := metrics.NewChild(ctx, fmt.Sprintf("importCCLF%d-readlines", cclfFile.CCLFNum))
 		b := sc.Bytes()
 		close()
+		line++
 
 		if len(bytes.TrimSpace(b)) == 0 {
 			continue
 		}
 
+		if validates {
+			if reason := validator.validateRecord(b); reason != nil {
+				log.Warnf("Rejected line %d of CCLF%d file %s: %s", line, fileMetadata.cclfNum, fileMetadata, reason.Error())
+				rejected = append(rejected, models.CCLFRejectedRecord{FileID: cclfFile.ID, LineNumber: line, Record: string(b), Reason: reason.Error()})
+				if len(rejected) > maxRejected {
+					fmt.Printf("Too many records rejected from CCLF%d file %s, maximum: %d.\n", fileMetadata.cclfNum, fileMetadata, maxRejected)
+					err = fmt.Errorf("too many records rejected from CCLF%d file %s (maximum: %d)", fileMetadata.cclfNum, fileMetadata, maxRejected)
+					log.Error(err)
+					return err
+				}
+				continue
+			}
+		}
+
 		err = importer.do(ctx, txn, cclfFile.ID, b)
 		if err != nil {
 			log.Error(err)
@@ -291,8 +340,8 @@ func importCCLF(ctx context.Context, fileMetadata *cclfFileMetadata, importer im
 
 func getCCLFFileMetadata(fileName string) (cclfFileMetadata, error) {
 	var metadata cclfFileMetadata
-	// CCLF filename convention for SSP with BCD identifier: P.BCD.A****.ZC[0|8][Y]**.Dyymmdd.Thhmmsst
-	filenameRegexp := regexp.MustCompile(`(T|P)\.BCD\.((?:A|T)\d{4})\.ZC(0|8)Y(\d{2})\.(D\d{6}\.T\d{6})\d`)
+	// CCLF filename convention for SSP with BCD identifier: P.BCD.A****.ZC[0|8|9][Y]**.Dyymmdd.Thhmmsst
+	filenameRegexp := regexp.MustCompile(`(T|P)\.BCD\.((?:A|T)\d{4})\.ZC(0|8|9)Y(\d{2})\.(D\d{6}\.T\d{6})\d`)
 	filenameMatches := filenameRegexp.FindStringSubmatch(fileName)
 
 	if len(filenameMatches) < 5 {
@@ -391,48 +440,33 @@ func ImportCCLFDirectory(filePath string) (success, failure, skipped int, err er
 
 	acoOrder := orderACOs(&cclfMap)
 
-	for _, acoID := range acoOrder {
-		func() {
-			ctx, c := metrics.NewParent(ctx, "ImportCCLFDirectory#processACOs")
-			defer c()
-			for _, cclfFiles := range cclfMap[acoID] {
-				var cclf0, cclf8 *cclfFileMetadata
-				for _, cclf := range cclfFiles {
-					if cclf.cclfNum == 0 {
-						cclf0 = cclf
-					} else if cclf.cclfNum == 8 {
-						cclf8 = cclf
-					}
-				}
-				cclfvalidator, err := importCCLF0(ctx, cclf0)
-				if err != nil {
-					fmt.Printf("Failed to import CCLF0 file: %s, Skipping CCLF8 file: %s.\n ", cclf0, cclf8)
-					log.Errorf("Failed to import CCLF0 file: %s, Skipping CCLF8 file: %s ", cclf0, cclf8)
-					failure++
-					skipped += 2
-					continue
-				} else {
-					success++
-				}
-				err = validate(ctx, cclf8, cclfvalidator)
-				if err != nil {
-					fmt.Printf("Failed to validate CCLF8 file: %s.\n", cclf8)
-					log.Errorf("Failed to validate CCLF8 file: %s", cclf8)
-					failure++
-				} else {
-					if err = importCCLF8(ctx, cclf8); err != nil {
-						fmt.Printf("Failed to import CCLF8 file: %s.\n", cclf8)
-						log.Errorf("Failed to import CCLF8 file: %s ", cclf8)
-						failure++
-					} else {
-						cclf8.imported = true
-						success++
-					}
-				}
-				cclf0.imported = cclf8 != nil && cclf8.imported
+	// ACOs are handed to the workers in order, so the priority ACOs are imported first
+	acoIDs := make(chan string)
+	results := make(chan acoImportResult)
+	var wg sync.WaitGroup
+	for i := 0; i < importWorkers(len(acoOrder)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for acoID := range acoIDs {
+				results <- importACO(ctx, cclfMap[acoID])
 			}
 		}()
 	}
+	go func() {
+		for _, acoID := range acoOrder {
+			acoIDs <- acoID
+		}
+		close(acoIDs)
+		wg.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		success += result.success
+		failure += result.failure
+		skipped += result.skipped
+	}
 
 	if err = func() error {
 		ctx, c := metrics.NewParent(ctx, "ImportCCLFDirectory#cleanupCCLF")
@@ -452,7 +486,127 @@ func ImportCCLFDirectory(filePath string) (success, failure, skipped int, err er
 	return success, failure, skipped, err
 }
 
+// importWorkers is the number of ACOs imported concurrently, from CCLF_IMPORT_WORKERS
+func importWorkers(acoCount int) int {
+	workers := utils.GetEnvInt("CCLF_IMPORT_WORKERS", 4)
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > acoCount {
+		workers = acoCount
+	}
+	return workers
+}
+
+// maxRejectedRecords is the number of records that an import may reject before the whole file fails to import
+func maxRejectedRecords() int {
+	maxRejected := utils.GetEnvInt("CCLF_MAX_REJECTED_RECORDS", 0)
+	if maxRejected < 0 {
+		return 0
+	}
+	return maxRejected
+}
+
+// saveRejectedRecords saves the records rejected by an import that failed, outside of the import's transaction
+func saveRejectedRecords(ctx context.Context, db *gorm.DB, records []models.CCLFRejectedRecord) error {
+	txn, err := db.DB().Begin()
+	if err != nil {
+		return err
+	}
+	if err = insertRejectedRecords(ctx, txn, records); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// acoImportResult counts the files of an ACO that were imported, failed to import and were skipped
+type acoImportResult struct {
+	success, failure, skipped int
+}
+
+// importACO imports the files of each of an ACO's performance years. The ACO's files are imported over their own
+// database connection, so the ACOs imported concurrently are independent of each other.
+func importACO(ctx context.Context, perfYearFiles map[int][]*cclfFileMetadata) (result acoImportResult) {
+	ctx, c := metrics.NewParent(ctx, "ImportCCLFDirectory#processACOs")
+	defer c()
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	for _, cclfFiles := range perfYearFiles {
+		var cclf0, cclf8, cclf9 *cclfFileMetadata
+		for _, cclf := range cclfFiles {
+			if cclf.cclfNum == 0 {
+				cclf0 = cclf
+			} else if cclf.cclfNum == 8 {
+				cclf8 = cclf
+			} else if cclf.cclfNum == 9 {
+				cclf9 = cclf
+			}
+		}
+		cclfvalidator, err := importCCLF0(ctx, cclf0)
+		if err != nil {
+			fmt.Printf("Failed to import CCLF0 file: %s, Skipping CCLF8 file: %s.\n ", cclf0, cclf8)
+			log.Errorf("Failed to import CCLF0 file: %s, Skipping CCLF8 file: %s ", cclf0, cclf8)
+			result.failure++
+			result.skipped += 2
+			if cclf9 != nil {
+				result.skipped++
+			}
+			continue
+		} else {
+			result.success++
+		}
+		err = validate(ctx, cclf8, cclfvalidator)
+		if err != nil {
+			fmt.Printf("Failed to validate CCLF8 file: %s.\n", cclf8)
+			log.Errorf("Failed to validate CCLF8 file: %s", cclf8)
+			result.failure++
+		} else {
+			if err = importCCLF8(ctx, db, cclf8, cclfvalidator["CCLF8"].maxRecordLength); err != nil {
+				fmt.Printf("Failed to import CCLF8 file: %s.\n", cclf8)
+				log.Errorf("Failed to import CCLF8 file: %s ", cclf8)
+				result.failure++
+			} else {
+				cclf8.imported = true
+				result.success++
+			}
+		}
+		cclf0.imported = cclf8 != nil && cclf8.imported
+
+		// The cross references are optional; they let exports follow beneficiaries whose MBI has changed
+		if cclf9 == nil {
+			continue
+		}
+		err = validate(ctx, cclf9, cclfvalidator)
+		if err != nil {
+			fmt.Printf("Failed to validate CCLF9 file: %s.\n", cclf9)
+			log.Errorf("Failed to validate CCLF9 file: %s", cclf9)
+			result.failure++
+		} else {
+			if err = importCCLF9(ctx, db, cclf9); err != nil {
+				fmt.Printf("Failed to import CCLF9 file: %s.\n", cclf9)
+				log.Errorf("Failed to import CCLF9 file: %s ", cclf9)
+				result.failure++
+			} else {
+				cclf9.imported = true
+				result.success++
+			}
+		}
+	}
+	return result
+}
+
 func sortCCLFArchives(cclfMap *map[string]map[int][]*cclfFileMetadata, skipped *int) filepath.WalkFunc {
+	return walkCCLFArchives(cclfMap, skipped, nil)
+}
+
+// walkCCLFArchives sorts the files of the CCLF archives it walks by ACO and performance year.
+// Misnamed archives that are older than BCDA_ETL_FILE_ARCHIVE_THRESHOLD_HR are moved to the pending deletion
+// directory, unless there is a report (i.e. for a dry run), in which case nothing is moved and the archives and
+// files that are skipped are recorded in the report instead.
+func walkCCLFArchives(cclfMap *map[string]map[int][]*cclfFileMetadata, skipped *int, report *ValidationReport) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			var fileName = "nil"
@@ -466,6 +620,9 @@ func sortCCLFArchives(cclfMap *map[string]map[int][]*cclfFileMetadata, skipped *
 		}
 
 		if info.IsDir() {
+			if report != nil {
+				return nil
+			}
 			msg := fmt.Sprintf("Unable to sort %s: directory, not a CCLF archive.", path)
 			fmt.Println(msg)
 			log.Warn(msg)
@@ -475,6 +632,10 @@ func sortCCLFArchives(cclfMap *map[string]map[int][]*cclfFileMetadata, skipped *
 		zipReader, err := zip.OpenReader(filepath.Clean(path))
 		if err != nil {
 			*skipped = *skipped + 1
+			if report != nil {
+				report.skip(path, "not a CCLF archive")
+				return nil
+			}
 			msg := fmt.Sprintf("Skipping %s: file is not a CCLF archive.", path)
 			fmt.Println(msg)
 			log.Warn(msg)
@@ -486,6 +647,10 @@ func sortCCLFArchives(cclfMap *map[string]map[int][]*cclfFileMetadata, skipped *
 		err = validateCCLFFolderName(info.Name())
 		if err != nil {
 			*skipped = *skipped + 1
+			if report != nil {
+				report.skip(path, err.Error())
+				return nil
+			}
 			msg := fmt.Sprintf("Skipping CCLF archive: %s.", info.Name())
 			fmt.Println(msg)
 			log.Warn(msg)
@@ -506,6 +671,10 @@ func sortCCLFArchives(cclfMap *map[string]map[int][]*cclfFileMetadata, skipped *
 
 			if err != nil {
 				// skipping files with a bad name.  An unknown file in this dir isn't a blocker
+				if report != nil {
+					report.skip(filepath.Join(path, f.Name), err.Error())
+					continue
+				}
 				fmt.Printf("Unknown file found: %s.\n", f.Name)
 				log.Errorf("Unknown file found: %s", f.Name)
 				continue
@@ -590,8 +759,8 @@ func validate(ctx context.Context, fileMetadata *cclfFileMetadata, cclfFileValid
 	log.Infof("Validating CCLF%d file %s...", fileMetadata.cclfNum, fileMetadata)
 
 	var key string
-	if fileMetadata.cclfNum == 8 {
-		key = "CCLF8"
+	if fileMetadata.cclfNum == 8 || fileMetadata.cclfNum == 9 {
+		key = fmt.Sprintf("CCLF%d", fileMetadata.cclfNum)
 	} else {
 		fmt.Printf("Unknown file type when validating file: %s.\n", fileMetadata)
 		err := fmt.Errorf("unknown file type when validating file: %s", fileMetadata)
@@ -612,7 +781,13 @@ func validate(ctx context.Context, fileMetadata *cclfFileMetadata, cclfFileValid
 	defer close()
 
 	count := 0
-	validator := cclfFileValidator[key]
+	validator, ok := cclfFileValidator[key]
+	if !ok {
+		fmt.Printf("No %s record found in CCLF0 file to validate file %s against.\n", key, fileMetadata)
+		err := fmt.Errorf("no %s record found in CCLF0 file to validate file %s against", key, fileMetadata)
+		log.Error(err)
+		return err
+	}
 	var rawFile *zip.File
 
 	for _, f := range r.File {
@@ -642,7 +817,8 @@ func validate(ctx context.Context, fileMetadata *cclfFileMetadata, cclfFileValid
 	for sc.Scan() {
 		b := sc.Bytes()
 		bytelength := len(bytes.TrimSpace(b))
-		if bytelength > 0 && bytelength <= validator.maxRecordLength {
+		// CCLF8 records of the wrong length are rejected one at a time when the file is imported
+		if bytelength > 0 && (bytelength <= validator.maxRecordLength || fileMetadata.cclfNum == 8) {
 			count++
 
 			// currently only errors if there are more records than we expect.
@@ -743,15 +919,12 @@ func (m cclfFileMetadata) String() string {
 	return m.filePath
 }
 
-func updateImportStatus(m *cclfFileMetadata, status string) {
+func updateImportStatus(db *gorm.DB, m *cclfFileMetadata, status string) {
 	if m == nil {
 		return
 	}
 	var cclfFile models.CCLFFile
 
-	db := database.GetGORMDbConnection()
-	defer database.Close(db)
-
 	err := db.Model(&cclfFile).Where("id = ?", m.fileID).Update("import_status", status).Error
 	if err != nil {
 		fmt.Printf("Could not update cclf file record for file: %s. \n", m)
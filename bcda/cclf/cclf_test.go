@@ -66,6 +66,9 @@ func (s *CCLFTestSuite) TestImportCCLFDirectory_PriorityACOs() {
 	var aco1, aco2, aco3 = "A9989", "A9988", "A0001"
 
 	os.Setenv("CCLF_REF_DATE", "181201")
+	// With a single worker, each ACO is imported after the one before it
+	defer os.Unsetenv("CCLF_IMPORT_WORKERS")
+	os.Setenv("CCLF_IMPORT_WORKERS", "1")
 
 	assert := assert.New(s.T())
 
@@ -81,7 +84,7 @@ func (s *CCLFTestSuite) TestImportCCLFDirectory_PriorityACOs() {
 
 	sc, f, sk, err := ImportCCLFDirectory(BASE_FILE_PATH + "cclf/archives/valid/")
 	assert.Nil(err)
-	assert.Equal(6, sc)
+	assert.Equal(7, sc)
 	assert.Equal(0, f)
 	assert.Equal(1, sk)
 
@@ -96,6 +99,55 @@ func (s *CCLFTestSuite) TestImportCCLFDirectory_PriorityACOs() {
 	testUtils.ResetFiles(s.Suite, BASE_FILE_PATH+"cclf/archives/valid/")
 }
 
+func (s *CCLFTestSuite) TestImportCCLFDirectory_Parallel() {
+	acoIDs := []string{"A9989", "A9988", "A0001"}
+	os.Setenv("CCLF_REF_DATE", "181201")
+	defer os.Unsetenv("CCLF_IMPORT_WORKERS")
+	os.Setenv("CCLF_IMPORT_WORKERS", "3")
+
+	assert := assert.New(s.T())
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var fs []models.CCLFFile
+	db.Where("aco_cms_id in (?)", acoIDs).Find(&fs)
+	for _, f := range fs {
+		assert.Nil(f.Delete())
+	}
+
+	sc, f, sk, err := ImportCCLFDirectory(BASE_FILE_PATH + "cclf/archives/valid/")
+	assert.Nil(err)
+	assert.Equal(7, sc)
+	assert.Equal(0, f)
+	assert.Equal(1, sk)
+
+	for _, acoID := range acoIDs {
+		var files []models.CCLFFile
+		db.Where("aco_cms_id = ?", acoID).Find(&files)
+		assert.NotEmpty(files, acoID)
+		for _, file := range files {
+			assert.Equal(constants.ImportComplete, file.ImportStatus, file.Name)
+		}
+	}
+
+	testUtils.ResetFiles(s.Suite, BASE_FILE_PATH+"cclf/archives/valid/")
+}
+
+func TestImportWorkers(t *testing.T) {
+	defer os.Unsetenv("CCLF_IMPORT_WORKERS")
+
+	os.Unsetenv("CCLF_IMPORT_WORKERS")
+	assert.Equal(t, 4, importWorkers(10))
+	assert.Equal(t, 2, importWorkers(2))
+
+	os.Setenv("CCLF_IMPORT_WORKERS", "8")
+	assert.Equal(t, 8, importWorkers(10))
+
+	os.Setenv("CCLF_IMPORT_WORKERS", "0")
+	assert.Equal(t, 1, importWorkers(10))
+}
+
 func (s *CCLFTestSuite) TestImportCCLF0() {
 	ctx := context.Background()
 	assert := assert.New(s.T())
@@ -107,6 +159,7 @@ func (s *CCLFTestSuite) TestImportCCLF0() {
 	validator, err := importCCLF0(ctx, cclf0metadata)
 	assert.Nil(err)
 	assert.Equal(cclfFileValidator{totalRecordCount: 6, maxRecordLength: 549}, validator["CCLF8"])
+	assert.Equal(cclfFileValidator{totalRecordCount: 6, maxRecordLength: 54}, validator["CCLF9"])
 
 	// negative
 	cclf0metadata = &cclfFileMetadata{}
@@ -153,6 +206,17 @@ func (s *CCLFTestSuite) TestValidate() {
 	cclfvalidator = map[string]cclfFileValidator{"CCLF8": {totalRecordCount: 2, maxRecordLength: 549}}
 	err = validate(ctx, cclf8metadata, cclfvalidator)
 	assert.EqualError(err, "maximum record count reached for file CCLF8 (expected: 2, actual: 3)")
+
+	cclf9filePath := BASE_FILE_PATH + "cclf/archives/valid/T.BCD.A0001.ZCY18.D181122.T1000000"
+	cclf9metadata := &cclfFileMetadata{env: "test", acoID: "A0001", cclfNum: 9, timestamp: time.Now(), filePath: cclf9filePath, perfYear: 18, name: "T.BCD.A0001.ZC9Y18.D181120.T1000010"}
+	cclfvalidator = map[string]cclfFileValidator{"CCLF8": {totalRecordCount: 6, maxRecordLength: 549}, "CCLF9": {totalRecordCount: 6, maxRecordLength: 54}}
+	err = validate(ctx, cclf9metadata, cclfvalidator)
+	assert.Nil(err)
+
+	// CCLF0 did not describe the file
+	delete(cclfvalidator, "CCLF9")
+	err = validate(ctx, cclf9metadata, cclfvalidator)
+	assert.EqualError(err, "no CCLF9 record found in CCLF0 file to validate file T.BCD.A0001.ZC9Y18.D181120.T1000010 against")
 }
 
 func (s *CCLFTestSuite) TestValidate_FolderName() {
@@ -204,7 +268,7 @@ func (s *CCLFTestSuite) TestImportCCLF8() {
 		filePath:  BASE_FILE_PATH + "cclf/archives/valid/T.BCD.A0001.ZCY18.D181121.T1000000",
 	}
 
-	err = importCCLF8(context.Background(), metadata)
+	err = importCCLF8(context.Background(), db, metadata, 549)
 	if err != nil {
 		s.FailNow("importCCLF8() error: %s", err.Error())
 	}
@@ -238,11 +302,164 @@ func (s *CCLFTestSuite) TestImportCCLF8() {
 	assert.Nil(err)
 }
 
+func (s *CCLFTestSuite) TestImportCCLF9() {
+	assert := assert.New(s.T())
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	err := deleteFilesByACO("A0001", db)
+	assert.Nil(err)
+
+	fileTime, _ := time.Parse(time.RFC3339, "2018-11-20T10:00:00Z")
+	metadata := &cclfFileMetadata{
+		name:      "T.BCD.A0001.ZC9Y18.D181120.T1000010",
+		env:       "test",
+		acoID:     "A0001",
+		cclfNum:   9,
+		perfYear:  18,
+		timestamp: fileTime,
+		filePath:  BASE_FILE_PATH + "cclf/archives/valid/T.BCD.A0001.ZCY18.D181122.T1000000",
+	}
+
+	err = importCCLF9(context.Background(), db, metadata)
+	if err != nil {
+		s.FailNow("importCCLF9() error: %s", err.Error())
+	}
+
+	file := models.CCLFFile{}
+	db.First(&file, "name = ?", metadata.name)
+	assert.Equal(9, file.CCLFNum)
+	assert.Equal(constants.ImportComplete, file.ImportStatus)
+
+	var xrefs []models.CCLFBeneficiaryXref
+	db.Order("id").Find(&xrefs, "file_id = ?", file.ID)
+	assert.Equal(6, len(xrefs))
+	assert.Equal("H", xrefs[0].XrefIndicator)
+	assert.Equal("203031401M", xrefs[0].CurrentNum)
+	assert.Equal("203031401A", xrefs[0].PrevNum)
+	assert.Equal("1959-12-31", xrefs[0].PrevsEfctDt)
+	assert.Equal("2016-12-31", xrefs[0].PrevsObsltDt)
+	assert.Equal("M", xrefs[3].XrefIndicator)
+	assert.Equal("1A69B98CD33", xrefs[3].CurrentNum)
+	assert.Equal("1A69B98CD32", xrefs[3].PrevNum)
+
+	previous, err := models.GetPreviousMBIs(db, "A0001", []string{"1A69B98CD33", "1A69B98CD35", "1A69B98CD30"})
+	assert.Nil(err)
+	assert.Equal(map[string][]string{"1A69B98CD33": {"1A69B98CD32"}, "1A69B98CD35": {"1A69B98CD34"}}, previous)
+
+	err = deleteFilesByACO("A0001", db)
+	assert.Nil(err)
+}
+
+func (s *CCLFTestSuite) TestImportCCLF8_RejectedRecords() {
+	assert := assert.New(s.T())
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+	defer os.Unsetenv("CCLF_MAX_REJECTED_RECORDS")
+
+	dir, err := ioutil.TempDir("", "cclf")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	acoID := "A0001"
+	assert.NoError(deleteFilesByACO(acoID, db))
+	defer func() { assert.NoError(deleteFilesByACO(acoID, db)) }()
+
+	archive := filepath.Join(dir, "T.BCD.A0001.ZCY18.D181121.T1000000")
+	writeArchive(s.T(), archive, "T.BCD.A0001.ZC8Y18.D181120.T1000009", "1A69B98CD30203031401M\n"+
+		"0A69B98CD31203031402A\n"+
+		"\n"+
+		"1A69B98CD32203031403A\n"+
+		"1A69B98CD33\n")
+	metadata := func() *cclfFileMetadata {
+		return &cclfFileMetadata{name: "T.BCD.A0001.ZC8Y18.D181120.T1000009", env: "test", acoID: acoID, cclfNum: 8, perfYear: 18,
+			timestamp: time.Now(), filePath: archive}
+	}
+	rejectedRecords := func(fileID uint) []models.CCLFRejectedRecord {
+		var rejected []models.CCLFRejectedRecord
+		assert.NoError(db.Order("line_number").Find(&rejected, "file_id = ?", fileID).Error)
+		return rejected
+	}
+
+	// Over the budget, nothing is imported but the rejected records are kept
+	os.Setenv("CCLF_MAX_REJECTED_RECORDS", "1")
+	failed := metadata()
+	assert.EqualError(importCCLF8(context.Background(), db, failed, 30),
+		"too many records rejected from CCLF8 file T.BCD.A0001.ZC8Y18.D181120.T1000009 (maximum: 1)")
+	var file models.CCLFFile
+	assert.NoError(db.First(&file, failed.fileID).Error)
+	assert.Equal(constants.ImportFail, file.ImportStatus)
+	var count int
+	db.Model(&models.CCLFBeneficiary{}).Where("file_id = ?", failed.fileID).Count(&count)
+	assert.Equal(0, count)
+	rejected := rejectedRecords(failed.fileID)
+	assert.Len(rejected, 2)
+
+	os.Setenv("CCLF_MAX_REJECTED_RECORDS", "2")
+	imported := metadata()
+	assert.NoError(importCCLF8(context.Background(), db, imported, 30))
+	assert.NoError(db.First(&file, imported.fileID).Error)
+	assert.Equal(constants.ImportComplete, file.ImportStatus)
+	var benes []models.CCLFBeneficiary
+	db.Order("mbi").Find(&benes, "file_id = ?", imported.fileID)
+	assert.Len(benes, 2)
+	assert.Equal("1A69B98CD30", benes[0].MBI)
+	assert.Equal("1A69B98CD32", benes[1].MBI)
+
+	rejected = rejectedRecords(imported.fileID)
+	assert.Len(rejected, 2)
+	assert.Equal(2, rejected[0].LineNumber)
+	assert.Equal("0A69B98CD31203031402A", rejected[0].Record)
+	assert.Equal("invalid MBI '0A69B98CD31'", rejected[0].Reason)
+	assert.Equal(5, rejected[1].LineNumber)
+	assert.Equal("missing HICN", rejected[1].Reason)
+}
+
+func (s *CCLFTestSuite) TestReimportCCLFFile() {
+	assert := assert.New(s.T())
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+	defer os.Setenv("CCLF_REF_DATE", os.Getenv("CCLF_REF_DATE"))
+	os.Setenv("CCLF_REF_DATE", "181201")
+
+	acoID := "A0001"
+	name := "T.BCD.A0001.ZC8Y18.D181120.T1000009"
+	dir := BASE_FILE_PATH + "cclf/archives/valid/"
+	assert.NoError(deleteFilesByACO(acoID, db))
+	defer func() { assert.NoError(deleteFilesByACO(acoID, db)) }()
+
+	// A failed attempt that imported some of the records
+	failed := models.CCLFFile{CCLFNum: 8, Name: name, ACOCMSID: acoID, Timestamp: time.Now(), PerformanceYear: 18, ImportStatus: constants.ImportFail}
+	assert.NoError(db.Create(&failed).Error)
+	assert.NoError(db.Create(&models.CCLFBeneficiary{FileID: failed.ID, MBI: "1A69B98CD30", HICN: "203031401M"}).Error)
+
+	assert.NoError(ReimportCCLFFile(name, dir))
+
+	var files []models.CCLFFile
+	db.Find(&files, "name = ?", name)
+	assert.Len(files, 1)
+	assert.NotEqual(failed.ID, files[0].ID)
+	assert.Equal(constants.ImportComplete, files[0].ImportStatus)
+	var count int
+	db.Model(&models.CCLFBeneficiary{}).Where("file_id = ?", failed.ID).Count(&count)
+	assert.Equal(0, count)
+	db.Model(&models.CCLFBeneficiary{}).Where("file_id = ?", files[0].ID).Count(&count)
+	assert.Equal(6, count)
+
+	// Imported files are not replaced
+	err := ReimportCCLFFile(name, dir)
+	assert.EqualError(err, "CCLF file T.BCD.A0001.ZC8Y18.D181120.T1000009 has import status Completed; only failed imports can be re-imported")
+
+	// The archives are left where they are
+	_, err = os.Stat(dir + "T.BCD.A0001.ZCY18.D181121.T1000000")
+	assert.NoError(err)
+}
+
 func (s *CCLFTestSuite) TestImportCCLF8_InvalidMetadata() {
 	assert := assert.New(s.T())
 
 	var metadata *cclfFileMetadata
-	err := importCCLF8(context.Background(), metadata)
+	err := importCCLF8(context.Background(), nil, metadata, 549)
 	assert.EqualError(err, "CCLF file not found")
 }
 
@@ -352,7 +569,7 @@ func (s *CCLFTestSuite) TestSortCCLFArchives() {
 	filePath := BASE_FILE_PATH + "cclf/archives/valid/"
 	err := filepath.Walk(filePath, sortCCLFArchives(&cclfmap, &skipped))
 	assert.Nil(err)
-	assert.Equal(2, len(cclfmap["A0001"][18]))
+	assert.Equal(3, len(cclfmap["A0001"][18]))
 	assert.Equal(1, skipped)
 	testUtils.ResetFiles(s.Suite, filePath)
 
@@ -5,9 +5,12 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"regexp"
+	"time"
 
 	"github.com/CMSgov/bcda-app/bcda/cclf/metrics"
 	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/utils"
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -21,6 +24,48 @@ type importer interface {
 	flush(ctx context.Context) error
 }
 
+// A recordValidator is an importer that checks each record before it is imported. The import rejects the records
+// that fail the check instead of importing them, and only fails once more records are rejected than it allows.
+type recordValidator interface {
+	validateRecord(b []byte) error
+}
+
+// mbiFormat is the format of an MBI given by
+// https://www.cms.gov/Medicare/New-Medicare-Card/Understanding-the-MBI-with-Format.pdf, whose letters exclude
+// S, L, O, I, B and Z.
+var mbiFormat = regexp.MustCompile(`^[1-9][AC-HJKMNP-RT-Y][AC-HJKMNP-RT-Y0-9][0-9][AC-HJKMNP-RT-Y][AC-HJKMNP-RT-Y0-9][0-9][AC-HJKMNP-RT-Y]{2}[0-9]{2}$`)
+
+// syntheticMBIFormat also allows the excluded letters, which the synthetic beneficiaries' MBIs use. It is only used
+// when CCLF_ALLOW_SYNTHETIC_MBIS is set, which test environments do.
+var syntheticMBIFormat = regexp.MustCompile(`^[1-9][A-Z][A-Z0-9][0-9][A-Z][A-Z0-9][0-9][A-Z]{2}[0-9]{2}$`)
+
+func validMBI(mbi string) bool {
+	if utils.GetEnvBool("CCLF_ALLOW_SYNTHETIC_MBIS", false) {
+		return syntheticMBIFormat.MatchString(mbi)
+	}
+	return mbiFormat.MatchString(mbi)
+}
+
+// validateCCLF8Record returns the reason the CCLF8 record cannot be imported, if any. The record length is not
+// checked when maxRecordLength is 0.
+func validateCCLF8Record(b []byte, maxRecordLength int) error {
+	if length := len(bytes.TrimSpace(b)); maxRecordLength > 0 && length > maxRecordLength {
+		return fmt.Errorf("incorrect record length (expected: %d, actual: %d)", maxRecordLength, length)
+	}
+
+	record, err := cclf8Layout.Parse(b)
+	if err != nil {
+		return err
+	}
+	if mbi := record.String("mbi"); !validMBI(mbi) {
+		return fmt.Errorf("invalid MBI '%s'", mbi)
+	}
+	if record.String("hicn") == "" {
+		return errors.New("missing HICN")
+	}
+	return nil
+}
+
 // A cclf8Importer is not safe for concurrent use by multiple goroutines.
 // It should be scoped to a single *sql.Tx
 type cclf8Importer struct {
@@ -30,12 +75,26 @@ type cclf8Importer struct {
 
 	pendingQueries    int
 	maxPendingQueries int
+
+	// maxRecordLength is the CCLF8 record length given by the CCLF0 file
+	maxRecordLength int
 }
 
-// validates that cclf8Importer implements the interface
+// validates that cclf8Importer implements the interfaces
 var _ importer = &cclf8Importer{}
+var _ recordValidator = &cclf8Importer{}
+
+func (cclfImporter *cclf8Importer) validateRecord(b []byte) error {
+	return validateCCLF8Record(b, cclfImporter.maxRecordLength)
+}
 
 func (cclfImporter *cclf8Importer) do(ctx context.Context, tx *sql.Tx, fileID uint, b []byte) error {
+	record, err := cclf8Layout.Parse(b)
+	if err != nil {
+		cclfImporter.logger.Error(err)
+		return err
+	}
+
 	if cclfImporter.inprogress == nil {
 		if err := cclfImporter.refreshStatement(ctx, tx); err != nil {
 			return errors.Wrap(err, "failed to refresh statement")
@@ -54,16 +113,12 @@ func (cclfImporter *cclf8Importer) do(ctx context.Context, tx *sql.Tx, fileID ui
 
 	close := metrics.NewChild(ctx, "importCCLF8-benecreate")
 	defer close()
-	const (
-		mbiStart, mbiEnd   = 0, 11
-		hicnStart, hicnEnd = 11, 22
-	)
 	cclfBeneficiary := &models.CCLFBeneficiary{
 		FileID: fileID,
-		MBI:    string(bytes.TrimSpace(b[mbiStart:mbiEnd])),
-		HICN:   string(bytes.TrimSpace(b[hicnStart:hicnEnd])),
+		MBI:    record.String("mbi"),
+		HICN:   record.String("hicn"),
 	}
-	_, err := cclfImporter.inprogress.Exec(cclfBeneficiary.FileID, cclfBeneficiary.HICN, cclfBeneficiary.MBI)
+	_, err = cclfImporter.inprogress.Exec(cclfBeneficiary.FileID, cclfBeneficiary.HICN, cclfBeneficiary.MBI)
 	if err != nil {
 		fmt.Println("Could not create CCLF8 beneficiary record.")
 		err = errors.Wrap(err, "could not create CCLF8 beneficiary record")
@@ -101,3 +156,114 @@ func (cclfImporter *cclf8Importer) refreshStatement(ctx context.Context, tx *sql
 	cclfImporter.inprogress = stmt
 	return nil
 }
+
+// A cclf9Importer is not safe for concurrent use by multiple goroutines.
+// It should be scoped to a single *sql.Tx
+type cclf9Importer struct {
+	logger *logrus.Logger
+
+	inprogress *sql.Stmt
+
+	pendingQueries    int
+	maxPendingQueries int
+}
+
+// validates that cclf9Importer implements the interface
+var _ importer = &cclf9Importer{}
+
+func (cclfImporter *cclf9Importer) do(ctx context.Context, tx *sql.Tx, fileID uint, b []byte) error {
+	record, err := cclf9Layout.Parse(b)
+	if err != nil {
+		cclfImporter.logger.Error(err)
+		return err
+	}
+
+	if cclfImporter.inprogress == nil {
+		if err := cclfImporter.refreshStatement(ctx, tx); err != nil {
+			return errors.Wrap(err, "failed to refresh statement")
+		}
+	}
+
+	if cclfImporter.pendingQueries >= cclfImporter.maxPendingQueries {
+		if err := cclfImporter.flush(ctx); err != nil {
+			return errors.Wrap(err, "failed to flush statement")
+		}
+		if err := cclfImporter.refreshStatement(ctx, tx); err != nil {
+			return errors.Wrap(err, "failed to refresh statement")
+		}
+		cclfImporter.pendingQueries = 0
+	}
+
+	close := metrics.NewChild(ctx, "importCCLF9-xrefcreate")
+	defer close()
+	xref := &models.CCLFBeneficiaryXref{
+		FileID:        fileID,
+		XrefIndicator: record.String("xrefIndicator"),
+		CurrentNum:    record.String("currentNum"),
+		PrevNum:       record.String("previousNum"),
+		PrevsEfctDt:   record.String("previousEffectiveDate"),
+		PrevsObsltDt:  record.String("previousObsoleteDate"),
+	}
+	_, err = cclfImporter.inprogress.Exec(xref.FileID, xref.XrefIndicator, xref.CurrentNum, xref.PrevNum, xref.PrevsEfctDt, xref.PrevsObsltDt)
+	if err != nil {
+		fmt.Println("Could not create CCLF9 cross reference record.")
+		err = errors.Wrap(err, "could not create CCLF9 cross reference record")
+		cclfImporter.logger.Error(err)
+		return err
+	}
+	cclfImporter.pendingQueries++
+	return nil
+}
+
+func (cclfImporter *cclf9Importer) flush(ctx context.Context) error {
+	stmt := cclfImporter.inprogress
+	if stmt == nil {
+		cclfImporter.logger.Warn("No statement to flush.")
+		return nil
+	}
+
+	if _, err := stmt.Exec(); err != nil {
+		return err
+	}
+
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (cclfImporter *cclf9Importer) refreshStatement(ctx context.Context, tx *sql.Tx) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("cclf_beneficiary_xrefs", "file_id", "xref_indicator", "current_num", "prev_num", "prevs_efct_dt", "prevs_obslt_dt"))
+	if err != nil {
+		return err
+	}
+
+	cclfImporter.inprogress = stmt
+	return nil
+}
+
+// insertRejectedRecords saves the records that an import rejected
+func insertRejectedRecords(ctx context.Context, tx *sql.Tx, records []models.CCLFRejectedRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("cclf_rejected_records", "file_id", "line_number", "record", "reason", "created_at", "updated_at"))
+	if err != nil {
+		return errors.Wrap(err, "could not prepare rejected record statement")
+	}
+
+	now := time.Now()
+	for _, r := range records {
+		if _, err = stmt.Exec(r.FileID, r.LineNumber, r.Record, r.Reason, now, now); err != nil {
+			stmt.Close()
+			return errors.Wrap(err, "could not create rejected record")
+		}
+	}
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		return errors.Wrap(err, "could not create rejected records")
+	}
+	return stmt.Close()
+}
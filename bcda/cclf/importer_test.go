@@ -5,7 +5,9 @@ import (
 	"database/sql"
 	"fmt"
 	"math/rand"
+	"os"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/CMSgov/bcda-app/bcda/models"
@@ -191,6 +193,72 @@ func (s *ImporterTestSuite) TestCCLF8ImporterErrorPaths() {
 	}
 }
 
+func (s *ImporterTestSuite) TestCCLF8ImporterInvalidRecord() {
+	importer := &cclf8Importer{
+		logger:            logrus.New(),
+		maxPendingQueries: 1,
+	}
+	err := importer.do(context.Background(), s.tx, uint(rand.Uint32()), []byte("           203031401M"))
+	assert.EqualError(s.T(), err, "invalid CCLF8 record: field mbi (offset 0, length 11) value '': value is required")
+}
+
+func TestValidateCCLF8Record(t *testing.T) {
+	tests := []struct {
+		name           string
+		record         string
+		expectedReason string
+	}{
+		{"Valid", "1EG4TE5MK73203031401M", ""},
+		{"Padded", "1EG4TE5MK73203031401M         ", ""},
+		{"TooLong", "1EG4TE5MK73203031401M" + strings.Repeat("X", 10), "incorrect record length (expected: 30, actual: 31)"},
+		{"NoMBI", "           203031401M", "invalid CCLF8 record: field mbi (offset 0, length 11) value '': value is required"},
+		{"MBIStartsWithZero", "0EG4TE5MK73203031401M", "invalid MBI '0EG4TE5MK73'"},
+		{"MBIDigitForLetter", "1EG49E5MK73203031401M", "invalid MBI '1EG49E5MK73'"},
+		{"LowerCaseMBI", "1eg4te5mk73203031401M", "invalid MBI '1eg4te5mk73'"},
+		{"ShortMBI", "1EG4TE5MK", "invalid MBI '1EG4TE5MK'"},
+		{"ExcludedLetter", "1A69B98CD30203031401M", "invalid MBI '1A69B98CD30'"},
+		{"NoHICN", "1EG4TE5MK73", "missing HICN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCCLF8Record([]byte(tt.record), 30)
+			if tt.expectedReason == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.expectedReason)
+		})
+	}
+
+	// Without a length from the CCLF0 file, only the fields are checked
+	assert.NoError(t, validateCCLF8Record([]byte("1EG4TE5MK73203031401M"+strings.Repeat("X", 10)), 0))
+
+	// Test environments allow the synthetic beneficiaries' MBIs, which use the excluded letters
+	defer os.Setenv("CCLF_ALLOW_SYNTHETIC_MBIS", os.Getenv("CCLF_ALLOW_SYNTHETIC_MBIS"))
+	os.Setenv("CCLF_ALLOW_SYNTHETIC_MBIS", "true")
+	assert.NoError(t, validateCCLF8Record([]byte("1A69B98CD30203031401M"), 30))
+	assert.EqualError(t, validateCCLF8Record([]byte("0A69B98CD30203031401M"), 30), "invalid MBI '0A69B98CD30'")
+}
+
+func (s *ImporterTestSuite) TestInsertRejectedRecords() {
+	records := []models.CCLFRejectedRecord{
+		{FileID: 1, LineNumber: 3, Record: "1A69B98CD33", Reason: "missing HICN"},
+		{FileID: 1, LineNumber: 7, Record: "0A69B98CD37203031407M", Reason: "invalid MBI '0A69B98CD37'"},
+	}
+
+	prepare := s.mock.ExpectPrepare(regexp.QuoteMeta(`COPY "cclf_rejected_records" ("file_id", "line_number", "record", "reason", "created_at", "updated_at")`))
+	for _, r := range records {
+		prepare.ExpectExec().WithArgs(r.FileID, r.LineNumber, r.Record, r.Reason, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	prepare.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(1, 1))
+	prepare.WillBeClosed()
+	assert.NoError(s.T(), insertRejectedRecords(context.Background(), s.tx, records))
+
+	// Nothing is prepared when no records were rejected
+	assert.NoError(s.T(), insertRejectedRecords(context.Background(), s.tx, nil))
+}
+
 func (s *ImporterTestSuite) TestFlushOnNoExistingStatement() {
 	importer := &cclf8Importer{
 		logger:            logrus.New(),
@@ -199,6 +267,34 @@ func (s *ImporterTestSuite) TestFlushOnNoExistingStatement() {
 	assert.NoError(s.T(), importer.flush(context.Background()))
 }
 
+func (s *ImporterTestSuite) TestCCLF9Importer() {
+	importer := &cclf9Importer{
+		logger:            logrus.New(),
+		maxPendingQueries: 1,
+	}
+	fileID := uint(rand.Uint32())
+	copyStmt := regexp.QuoteMeta(`COPY "cclf_beneficiary_xrefs" ("file_id", "xref_indicator", "current_num", "prev_num", "prevs_efct_dt", "prevs_obslt_dt")`)
+
+	prepare := s.mock.ExpectPrepare(copyStmt)
+	prepare.ExpectExec().WithArgs(fileID, "M", "1A69B98CD33", "1A69B98CD32", "1960-01-01", "2017-06-11").WillReturnResult(sqlmock.NewResult(1, 1))
+	prepare.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(1, 1))
+	prepare.WillBeClosed()
+	assert.NoError(s.T(), importer.do(context.Background(), s.tx, fileID, []byte("M1A69B98CD331A69B98CD321960-01-012017-06-11            ")))
+
+	// The second record flushes the first
+	prepare = s.mock.ExpectPrepare(copyStmt)
+	prepare.ExpectExec().WithArgs(fileID, "H", "203031401M", "203031401A", "1959-12-31", "2016-12-31").WillReturnResult(sqlmock.NewResult(1, 1))
+	prepare.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(1, 1))
+	prepare.WillBeClosed()
+	assert.NoError(s.T(), importer.do(context.Background(), s.tx, fileID, []byte("H203031401M 203031401A 1959-12-312016-12-31")))
+
+	// Short records are rejected before they reach the statement
+	err := importer.do(context.Background(), s.tx, fileID, []byte("M1A69B98CD33"))
+	assert.EqualError(s.T(), err, "invalid CCLF9 record: field previousNum (offset 12, length 11) value '': line is too short (12 bytes)")
+
+	assert.NoError(s.T(), importer.flush(context.Background()))
+}
+
 func getBeneficiary(fileID uint) *models.CCLFBeneficiary {
 	return &models.CCLFBeneficiary{
 		FileID: fileID,
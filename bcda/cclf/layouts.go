@@ -0,0 +1,25 @@
+package cclf
+
+import "github.com/CMSgov/bcda-app/bcda/fixedwidth"
+
+// cclf0Layout describes a line of the CCLF0 summary file, which lists the record count and length of each CCLF file
+var cclf0Layout = fixedwidth.MustLayout("CCLF0",
+	fixedwidth.Field{Name: "fileNumber", Offset: 0, Length: 7, Required: true},
+	fixedwidth.Field{Name: "totalRecordCount", Offset: 52, Length: 11, Type: fixedwidth.Int, Required: true},
+	fixedwidth.Field{Name: "recordLength", Offset: 64, Length: 5, Type: fixedwidth.Int, Required: true},
+)
+
+// cclf8Layout describes the fields of a CCLF8 (beneficiary demographics) record that are imported
+var cclf8Layout = fixedwidth.MustLayout("CCLF8",
+	fixedwidth.Field{Name: "mbi", Offset: 0, Length: 11, Required: true},
+	fixedwidth.Field{Name: "hicn", Offset: 11, Length: 11},
+)
+
+// cclf9Layout describes a CCLF9 (beneficiary cross reference) record
+var cclf9Layout = fixedwidth.MustLayout("CCLF9",
+	fixedwidth.Field{Name: "xrefIndicator", Offset: 0, Length: 1, Required: true},
+	fixedwidth.Field{Name: "currentNum", Offset: 1, Length: 11, Required: true},
+	fixedwidth.Field{Name: "previousNum", Offset: 12, Length: 11, Required: true},
+	fixedwidth.Field{Name: "previousEffectiveDate", Offset: 23, Length: 10},
+	fixedwidth.Field{Name: "previousObsoleteDate", Offset: 33, Length: 10},
+)
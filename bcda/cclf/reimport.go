@@ -0,0 +1,115 @@
+package cclf
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/CMSgov/bcda-app/bcda/constants"
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReimportCCLFFile imports a CCLF8 or CCLF9 file whose import failed again. The file, and the CCLF0 file it is
+// validated against, are found in the CCLF archives under filePath, e.g. the PENDING_DELETION_DIR they were moved to
+// after the failed import. The records of every failed attempt are deleted before the file is imported; the archives
+// are left where they are.
+func ReimportCCLFFile(name, filePath string) error {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	var prior []models.CCLFFile
+	if err := db.Where("name = ?", name).Order("id").Find(&prior).Error; err != nil {
+		return err
+	}
+	for _, f := range prior {
+		if f.ImportStatus != constants.ImportFail {
+			return fmt.Errorf("CCLF file %s has import status %s; only failed imports can be re-imported", name, f.ImportStatus)
+		}
+	}
+
+	cclfFile, cclf0, err := findCCLFFile(name, filePath)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	validator, err := importCCLF0(ctx, cclf0)
+	if err != nil {
+		return err
+	}
+	if err = validate(ctx, cclfFile, validator); err != nil {
+		return err
+	}
+
+	for _, f := range prior {
+		log.Infof("Deleting failed import %d of CCLF file %s", f.ID, name)
+		if err = f.Delete(); err != nil {
+			return errors.Wrapf(err, "could not delete failed import of CCLF file %s", name)
+		}
+	}
+
+	if cclfFile.cclfNum == 8 {
+		return importCCLF8(ctx, db, cclfFile, validator["CCLF8"].maxRecordLength)
+	}
+	return importCCLF9(ctx, db, cclfFile)
+}
+
+// findCCLFFile returns the CCLF8 or CCLF9 file with the name from the archives under filePath, along with the CCLF0
+// file that was delivered with it
+func findCCLFFile(name, filePath string) (cclfFile, cclf0 *cclfFileMetadata, err error) {
+	var cclfMap = make(map[string]map[int][]*cclfFileMetadata)
+	// Walking the archives as a validation does not move any of them
+	report := &ValidationReport{}
+	var skipped int
+	if err := filepath.Walk(filePath, walkCCLFArchives(&cclfMap, &skipped, report)); err != nil {
+		return nil, nil, err
+	}
+
+	var deliveredWith []*cclfFileMetadata
+	for _, perfYearFiles := range cclfMap {
+		for _, files := range perfYearFiles {
+			for _, m := range files {
+				if m.name == name {
+					cclfFile, deliveredWith = m, files
+				}
+			}
+		}
+	}
+	if cclfFile == nil {
+		for _, s := range report.Skipped {
+			if strings.HasSuffix(s.Path, name) {
+				return nil, nil, fmt.Errorf("CCLF file %s cannot be imported: %s", name, s.Reason)
+			}
+		}
+		return nil, nil, fmt.Errorf("CCLF file %s not found in %s", name, filePath)
+	}
+	if cclfFile.cclfNum != 8 && cclfFile.cclfNum != 9 {
+		return nil, nil, fmt.Errorf("CCLF file %s is not a CCLF8 or CCLF9 file", name)
+	}
+
+	// The CCLF0 file is in the same archive, or for split deliveries one with the same date. The parts of a split
+	// file share its name.
+	sameDate := make(map[string]*cclfFileMetadata)
+	for _, m := range deliveredWith {
+		if m.cclfNum != 0 {
+			continue
+		}
+		if m.filePath == cclfFile.filePath {
+			return cclfFile, m, nil
+		}
+		if m.timestamp.Format("060102") == cclfFile.timestamp.Format("060102") {
+			sameDate[m.name] = m
+		}
+	}
+	if len(sameDate) != 1 {
+		return nil, nil, fmt.Errorf("found %d CCLF0 files delivered with CCLF file %s; expected 1", len(sameDate), name)
+	}
+	for _, m := range sameDate {
+		cclf0 = m
+	}
+	return cclfFile, cclf0, nil
+}
@@ -0,0 +1,49 @@
+package cclf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindCCLFFile(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Setenv("CCLF_REF_DATE", os.Getenv("CCLF_REF_DATE"))
+	os.Setenv("CCLF_REF_DATE", "181201")
+
+	// The CCLF0 file of a split delivery is in another archive with the same date
+	cclf8, cclf0, err := findCCLFFile("T.BCD.A0001.ZC8Y18.D181120.T1000009", BASE_FILE_PATH+"cclf/archives/split/")
+	assert.NoError(err)
+	assert.Equal(8, cclf8.cclfNum)
+	assert.Equal("A0001", cclf8.acoID)
+	assert.Equal(0, cclf0.cclfNum)
+	assert.Equal("T.BCD.A0001.ZC0Y18.D181120.T1000011", cclf0.name)
+
+	cclf9, cclf0, err := findCCLFFile("T.BCD.A0001.ZC9Y18.D181120.T1000010", BASE_FILE_PATH+"cclf/archives/valid/")
+	assert.NoError(err)
+	assert.Equal(9, cclf9.cclfNum)
+	assert.Equal("T.BCD.A0001.ZC0Y18.D181120.T1000011", cclf0.name)
+
+	_, _, err = findCCLFFile("T.BCD.A0001.ZC8Y18.D181120.T1000099", BASE_FILE_PATH+"cclf/archives/valid/")
+	assert.EqualError(err, "CCLF file T.BCD.A0001.ZC8Y18.D181120.T1000099 not found in ../../shared_files/cclf/archives/valid/")
+
+	_, _, err = findCCLFFile("T.BCD.A0001.ZC0Y18.D181120.T1000011", BASE_FILE_PATH+"cclf/archives/valid/")
+	assert.EqualError(err, "CCLF file T.BCD.A0001.ZC0Y18.D181120.T1000011 is not a CCLF8 or CCLF9 file")
+
+	// No CCLF0 file was delivered with it
+	dir, err := ioutil.TempDir("", "cclf")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	writeArchive(t, filepath.Join(dir, "T.BCD.A0002.ZCY18.D181121.T1000000"), "T.BCD.A0002.ZC8Y18.D181120.T1000009", "1A69B98CD30203031401M\n")
+	_, _, err = findCCLFFile("T.BCD.A0002.ZC8Y18.D181120.T1000009", dir)
+	assert.EqualError(err, "found 0 CCLF0 files delivered with CCLF file T.BCD.A0002.ZC8Y18.D181120.T1000009; expected 1")
+
+	// Too old to be imported
+	os.Setenv("CCLF_REF_DATE", "190601")
+	_, _, err = findCCLFFile("T.BCD.A0002.ZC8Y18.D181120.T1000009", dir)
+	assert.Error(err)
+	assert.Contains(err.Error(), "CCLF file T.BCD.A0002.ZC8Y18.D181120.T1000009 cannot be imported: date 'D181120.T100000' from file")
+}
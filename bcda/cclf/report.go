@@ -0,0 +1,289 @@
+package cclf
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/CMSgov/bcda-app/bcda/fixedwidth"
+)
+
+// maxReportedErrors is the number of errors kept for each file; the rest are only counted
+const maxReportedErrors = 10
+
+// ValidationReport is the result of validating a directory of CCLF archives without importing them.
+type ValidationReport struct {
+	Directory string        `json:"directory"`
+	Valid     bool          `json:"valid"`
+	ACOs      []*ACOReport  `json:"acos"`
+	Skipped   []SkippedFile `json:"skipped"`
+}
+
+// SkippedFile is an archive, or a file in an archive, that an import would skip.
+type SkippedFile struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// ACOReport holds the results for the files an ACO delivered for a performance year.
+type ACOReport struct {
+	ACOID           string        `json:"aco_id"`
+	PerformanceYear int           `json:"performance_year"`
+	Valid           bool          `json:"valid"`
+	Errors          []string      `json:"errors"`
+	Files           []*FileReport `json:"files"`
+}
+
+// FileReport holds the results of validating one CCLF file.
+type FileReport struct {
+	Name      string `json:"name"`
+	Archive   string `json:"archive"`
+	CCLFNum   int    `json:"cclf_num"`
+	Timestamp string `json:"timestamp"`
+	Valid     bool   `json:"valid"`
+	// ExpectedRecords and MaxRecordLength are taken from the CCLF0 file
+	ExpectedRecords int      `json:"expected_records,omitempty"`
+	MaxRecordLength int      `json:"max_record_length,omitempty"`
+	Records         int      `json:"records"`
+	InvalidRecords  int      `json:"invalid_records"`
+	Errors          []string `json:"errors"`
+}
+
+func (r *ValidationReport) skip(path, reason string) {
+	r.Skipped = append(r.Skipped, SkippedFile{Path: path, Reason: reason})
+}
+
+func (r *ACOReport) fail(msg string, args ...interface{}) {
+	r.Valid = false
+	r.Errors = append(r.Errors, fmt.Sprintf(msg, args...))
+}
+
+func (r *FileReport) fail(msg string, args ...interface{}) {
+	r.Valid = false
+	r.note(msg, args...)
+}
+
+// note records an error that does not make the file invalid on its own, like a record the import would reject
+func (r *FileReport) note(msg string, args ...interface{}) {
+	if len(r.Errors) < maxReportedErrors {
+		r.Errors = append(r.Errors, fmt.Sprintf(msg, args...))
+	}
+}
+
+// ValidateCCLFDirectory runs the checks ImportCCLFDirectory makes before importing the CCLF archives in the
+// directory, and parses every CCLF8 and CCLF9 record, without touching the database or moving any files.
+func ValidateCCLFDirectory(filePath string) (*ValidationReport, error) {
+	var cclfMap = make(map[string]map[int][]*cclfFileMetadata)
+	report := &ValidationReport{Directory: filePath, Valid: true, ACOs: []*ACOReport{}, Skipped: []SkippedFile{}}
+
+	var skipped int
+	if err := filepath.Walk(filePath, walkCCLFArchives(&cclfMap, &skipped, report)); err != nil {
+		return nil, err
+	}
+
+	// ACOs are reported in order of ID; orderACOs would query the database for the ACOs to import first
+	var acoIDs []string
+	for acoID := range cclfMap {
+		acoIDs = append(acoIDs, acoID)
+	}
+	sort.Strings(acoIDs)
+
+	for _, acoID := range acoIDs {
+		var perfYears []int
+		for perfYear := range cclfMap[acoID] {
+			perfYears = append(perfYears, perfYear)
+		}
+		sort.Ints(perfYears)
+
+		for _, perfYear := range perfYears {
+			acoReport := validateACOFiles(acoID, perfYear, cclfMap[acoID][perfYear])
+			report.Valid = report.Valid && acoReport.Valid
+			report.ACOs = append(report.ACOs, acoReport)
+		}
+	}
+	return report, nil
+}
+
+// validateACOFiles checks the CCLF8 and CCLF9 files of an ACO against its CCLF0 file, as the import would.
+func validateACOFiles(acoID string, perfYear int, cclfFiles []*cclfFileMetadata) *ACOReport {
+	acoReport := &ACOReport{ACOID: acoID, PerformanceYear: perfYear, Valid: true, Errors: []string{}, Files: []*FileReport{}}
+
+	var cclf0, cclf8 *cclfFileMetadata
+	for _, cclf := range cclfFiles {
+		switch cclf.cclfNum {
+		case 0:
+			cclf0 = cclf
+		case 8:
+			cclf8 = cclf
+		}
+	}
+	if cclf0 == nil {
+		acoReport.fail("CCLF0 file not found")
+	}
+	if cclf8 == nil {
+		acoReport.fail("CCLF8 file not found")
+	}
+
+	var validator map[string]cclfFileValidator
+	if cclf0 != nil {
+		fileReport := newFileReport(cclf0)
+		acoReport.Files = append(acoReport.Files, fileReport)
+
+		rc, err := openArchivedFile(cclf0)
+		if err == nil {
+			validator, err = parseCCLF0(rc, cclf0)
+			rc.Close()
+		}
+		if err != nil {
+			fileReport.fail("%s", err)
+			acoReport.fail("CCLF0 file %s is invalid, so the other files cannot be validated", cclf0)
+		}
+	}
+
+	for _, cclf := range cclfFiles {
+		if cclf.cclfNum == 0 {
+			continue
+		}
+		fileReport := newFileReport(cclf)
+		acoReport.Files = append(acoReport.Files, fileReport)
+
+		if validator == nil {
+			fileReport.fail("no valid CCLF0 file to validate against")
+		} else {
+			validateCCLFRecords(cclf, validator, fileReport)
+		}
+	}
+
+	for _, f := range acoReport.Files {
+		acoReport.Valid = acoReport.Valid && f.Valid
+	}
+	return acoReport
+}
+
+// validateCCLFRecords checks the record count and length of the file against the CCLF0 file and parses each record.
+// CCLF8 records are also checked for a valid MBI and a HICN.
+// Unlike validate, it carries on after an invalid record so every problem in the file is counted.
+func validateCCLFRecords(m *cclfFileMetadata, validator map[string]cclfFileValidator, fileReport *FileReport) {
+	key := fmt.Sprintf("CCLF%d", m.cclfNum)
+	var layout *fixedwidth.Layout
+	switch m.cclfNum {
+	case 8:
+		layout = cclf8Layout
+	case 9:
+		layout = cclf9Layout
+	default:
+		fileReport.fail("unknown file type %s", key)
+		return
+	}
+
+	v, ok := validator[key]
+	if !ok {
+		fileReport.fail("no %s record found in CCLF0 file to validate file %s against", key, m)
+		return
+	}
+	fileReport.ExpectedRecords = v.totalRecordCount
+	fileReport.MaxRecordLength = v.maxRecordLength
+
+	rc, err := openArchivedFile(m)
+	if err != nil {
+		fileReport.fail("%s", err)
+		return
+	}
+	defer rc.Close()
+
+	sc := bufio.NewScanner(rc)
+	line := 0
+	for sc.Scan() {
+		line++
+		b := sc.Bytes()
+		length := len(bytes.TrimSpace(b))
+		if length == 0 {
+			fileReport.InvalidRecords++
+			fileReport.fail("line %d: empty record", line)
+			continue
+		}
+
+		fileReport.Records++
+		// CCLF8 records are checked as the import checks them, and only make the file invalid when the import would
+		// reject more of them than it allows
+		if m.cclfNum == 8 {
+			if err := validateCCLF8Record(b, v.maxRecordLength); err != nil {
+				fileReport.InvalidRecords++
+				fileReport.note("line %d: %s", line, err)
+			}
+			continue
+		}
+
+		invalid := false
+		if length > v.maxRecordLength {
+			invalid = true
+			fileReport.fail("line %d: incorrect record length (expected: %d, actual: %d)", line, v.maxRecordLength, length)
+		}
+		if _, err := layout.Parse(b); err != nil {
+			invalid = true
+			fileReport.fail("line %d: %s", line, err)
+		}
+		if invalid {
+			fileReport.InvalidRecords++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		fileReport.fail("could not read file %s: %s", m, err)
+	}
+
+	if maxRejected := maxRejectedRecords(); m.cclfNum == 8 && fileReport.InvalidRecords > maxRejected {
+		fileReport.fail("too many records rejected (maximum: %d, actual: %d)", maxRejected, fileReport.InvalidRecords)
+	}
+	if fileReport.Records > v.totalRecordCount {
+		fileReport.fail("maximum record count reached (expected: %d, actual: %d)", v.totalRecordCount, fileReport.Records)
+	}
+}
+
+func newFileReport(m *cclfFileMetadata) *FileReport {
+	return &FileReport{
+		Name:      m.name,
+		Archive:   m.filePath,
+		CCLFNum:   m.cclfNum,
+		Timestamp: m.timestamp.Format("2006-01-02T15:04:05"),
+		Valid:     true,
+		Errors:    []string{},
+	}
+}
+
+// openArchivedFile opens the CCLF file in its archive. Closing the returned reader closes the archive.
+func openArchivedFile(m *cclfFileMetadata) (io.ReadCloser, error) {
+	r, err := zip.OpenReader(filepath.Clean(m.filePath))
+	if err != nil {
+		return nil, fmt.Errorf("could not read archive %s: %s", m.filePath, err)
+	}
+
+	for _, f := range r.File {
+		if f.Name == m.name {
+			rc, err := f.Open()
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("could not read file %s in archive %s: %s", m.name, m.filePath, err)
+			}
+			return archivedFile{ReadCloser: rc, archive: r}, nil
+		}
+	}
+	r.Close()
+	return nil, fmt.Errorf("file %s not found in archive %s", m.name, m.filePath)
+}
+
+type archivedFile struct {
+	io.ReadCloser
+	archive *zip.ReadCloser
+}
+
+func (f archivedFile) Close() error {
+	err := f.ReadCloser.Close()
+	if aerr := f.archive.Close(); err == nil {
+		err = aerr
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package cclf
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCCLFDirectory(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Setenv("CCLF_REF_DATE", os.Getenv("CCLF_REF_DATE"))
+	os.Setenv("CCLF_REF_DATE", "181201")
+	// The fixtures use the synthetic beneficiaries' MBIs
+	defer os.Setenv("CCLF_ALLOW_SYNTHETIC_MBIS", os.Getenv("CCLF_ALLOW_SYNTHETIC_MBIS"))
+	os.Setenv("CCLF_ALLOW_SYNTHETIC_MBIS", "true")
+
+	dir := BASE_FILE_PATH + "cclf/archives/valid/"
+	before, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+
+	report, err := ValidateCCLFDirectory(dir)
+	assert.NoError(err)
+	assert.True(report.Valid)
+	assert.Len(report.Skipped, 1)
+	assert.Contains(report.Skipped[0].Path, "T.BCD.ACOB.ZC0Y18.D181120.T0001000")
+
+	assert.Len(report.ACOs, 3)
+	for _, aco := range report.ACOs {
+		assert.True(aco.Valid, aco.ACOID)
+		assert.Equal(18, aco.PerformanceYear)
+		assert.Empty(aco.Errors)
+	}
+
+	a0001 := report.ACOs[0]
+	assert.Equal("A0001", a0001.ACOID)
+	assert.Len(a0001.Files, 3)
+	assert.Equal(0, a0001.Files[0].CCLFNum)
+	for _, f := range a0001.Files[1:] {
+		assert.True(f.Valid, f.Name)
+		assert.Equal(6, f.ExpectedRecords)
+		assert.Equal(6, f.Records)
+		assert.Equal(0, f.InvalidRecords)
+	}
+
+	// Nothing is moved
+	after, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+	assert.Equal(len(before), len(after))
+}
+
+func TestValidateCCLFDirectory_Invalid(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Setenv("CCLF_REF_DATE", os.Getenv("CCLF_REF_DATE"))
+	os.Setenv("CCLF_REF_DATE", "181201")
+
+	dir, err := ioutil.TempDir("", "cclf")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cclf0 := "File Number  |File Description    |Total Records Count |Record Length\n" +
+		"CCLF8  |Beneficiary Demographics File              |          2|   30\n"
+	var cclf8 strings.Builder
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(&cclf8, "%-30s\n", fmt.Sprintf("1EG4TE5MK3%d203031401M", i))
+	}
+	// Too long, and with a blank MBI
+	cclf8.WriteString(strings.Repeat(" ", 11) + strings.Repeat("X", 35) + "\n")
+
+	writeArchive(t, filepath.Join(dir, "T.BCD.A0001.ZCY18.D181120.T1000000"), "T.BCD.A0001.ZC0Y18.D181120.T1000011", cclf0)
+	writeArchive(t, filepath.Join(dir, "T.BCD.A0001.ZCY18.D181121.T1000000"), "T.BCD.A0001.ZC8Y18.D181120.T1000009", cclf8.String())
+	// No CCLF0 for this ACO
+	writeArchive(t, filepath.Join(dir, "T.BCD.A0002.ZCY18.D181121.T1000000"), "T.BCD.A0002.ZC8Y18.D181120.T1000009", cclf8.String())
+
+	report, err := ValidateCCLFDirectory(dir)
+	assert.NoError(err)
+	assert.False(report.Valid)
+	assert.Len(report.ACOs, 2)
+
+	a0001 := report.ACOs[0]
+	assert.Equal("A0001", a0001.ACOID)
+	assert.False(a0001.Valid)
+	assert.Len(a0001.Files, 2)
+	assert.True(a0001.Files[0].Valid)
+	f := a0001.Files[1]
+	assert.False(f.Valid)
+	assert.Equal(4, f.Records)
+	assert.Equal(1, f.InvalidRecords)
+	assert.Equal([]string{
+		"line 4: incorrect record length (expected: 30, actual: 35)",
+		"too many records rejected (maximum: 0, actual: 1)",
+		"maximum record count reached (expected: 2, actual: 4)",
+	}, f.Errors)
+
+	a0002 := report.ACOs[1]
+	assert.Equal("A0002", a0002.ACOID)
+	assert.False(a0002.Valid)
+	assert.Equal([]string{"CCLF0 file not found"}, a0002.Errors)
+	assert.Len(a0002.Files, 1)
+	assert.Equal([]string{"no valid CCLF0 file to validate against"}, a0002.Files[0].Errors)
+}
+
+func TestValidateCCLFDirectory_RejectedRecords(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Setenv("CCLF_REF_DATE", os.Getenv("CCLF_REF_DATE"))
+	os.Setenv("CCLF_REF_DATE", "181201")
+	defer os.Unsetenv("CCLF_MAX_REJECTED_RECORDS")
+
+	dir, err := ioutil.TempDir("", "cclf")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cclf0 := "File Number  |File Description    |Total Records Count |Record Length\n" +
+		"CCLF8  |Beneficiary Demographics File              |          4|   30\n"
+	cclf8 := "1EG4TE5MK30203031401M\n" +
+		"1EG4TE5MK31203031402A\n" +
+		"1EG4TE5M031203031403A\n" +
+		"1EG4TE5MK33\n"
+	writeArchive(t, filepath.Join(dir, "T.BCD.A0001.ZCY18.D181120.T1000000"), "T.BCD.A0001.ZC0Y18.D181120.T1000011", cclf0)
+	writeArchive(t, filepath.Join(dir, "T.BCD.A0001.ZCY18.D181121.T1000000"), "T.BCD.A0001.ZC8Y18.D181120.T1000009", cclf8)
+
+	os.Setenv("CCLF_MAX_REJECTED_RECORDS", "1")
+	report, err := ValidateCCLFDirectory(dir)
+	assert.NoError(err)
+	assert.False(report.Valid)
+	f := report.ACOs[0].Files[1]
+	assert.Equal(2, f.InvalidRecords)
+	assert.Equal([]string{
+		"line 3: invalid MBI '1EG4TE5M031'",
+		"line 4: missing HICN",
+		"too many records rejected (maximum: 1, actual: 2)",
+	}, f.Errors)
+
+	// The import would import the other records
+	os.Setenv("CCLF_MAX_REJECTED_RECORDS", "2")
+	report, err = ValidateCCLFDirectory(dir)
+	assert.NoError(err)
+	assert.True(report.Valid)
+	f = report.ACOs[0].Files[1]
+	assert.True(f.Valid)
+	assert.Equal(4, f.Records)
+	assert.Equal(2, f.InvalidRecords)
+	assert.Len(f.Errors, 2)
+}
+
+func writeArchive(t *testing.T, path, name, content string) {
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	w, err := zw.Create(name)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -39,13 +41,24 @@ type APIClient interface {
 	GetPatient(patientID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error)
 	GetCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error)
 	GetPatientByIdentifierHash(hashedIdentifier string) (string, error)
+
+	// The Stream* methods retrieve the same data as their Get* counterparts, but hand each resource to the handler
+	// page by page rather than accumulating every page into a single bundle.
+	StreamExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, handler fhir.ResourceHandler) error
+	StreamPatient(patientID, jobID, cmsID, since string, transactionTime time.Time, handler fhir.ResourceHandler) error
+	StreamCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time, handler fhir.ResourceHandler) error
 }
 
 type BlueButtonClient struct {
+	// requests is the number of requests sent by this client. It is first so that it is aligned for atomic access.
+	requests int64
+
 	client fhir.Client
 
 	maxTries      uint64
 	retryInterval time.Duration
+	breaker       *circuitBreaker
+	limiter       *rateLimiter
 }
 
 // Ensure BlueButtonClient satisfies the interface
@@ -71,12 +84,18 @@ func NewBlueButtonClient() (*BlueButtonClient, error) {
 	certFile := os.Getenv("BB_CLIENT_CERT_FILE")
 	keyFile := os.Getenv("BB_CLIENT_KEY_FILE")
 	pageSize := utils.GetEnvInt("BB_CLIENT_PAGE_SIZE", 0)
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return nil, errors.Wrap(err, "could not load Blue Button keypair")
-	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
 
-	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	// BFD requires a client certificate, but servers standing in for it (e.g. test/fakebfd) do not
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load Blue Button keypair")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else {
+		logger.Warn("No Blue Button client certificate configured")
+	}
 
 	if strings.ToLower(os.Getenv("BB_CHECK_CERT")) != "false" {
 		caFile := os.Getenv("BB_CLIENT_CA_FILE")
@@ -102,8 +121,8 @@ func NewBlueButtonClient() (*BlueButtonClient, error) {
 		// See: https://golang.org/src/net/http/transport.go?s=3396:10950#L182 for more information
 		DisableCompression: false,
 	}
-	var timeout int
-	if timeout, err = strconv.Atoi(os.Getenv("BB_TIMEOUT_MS")); err != nil {
+	timeout, err := strconv.Atoi(os.Getenv("BB_TIMEOUT_MS"))
+	if err != nil {
 		logger.Info("Could not get Blue Button timeout from environment variable; using default value of 500.")
 		timeout = 500
 	}
@@ -113,16 +132,26 @@ func NewBlueButtonClient() (*BlueButtonClient, error) {
 	client := fhir.NewClient(httpClient, pageSize)
 	maxTries := uint64(utils.GetEnvInt("BB_REQUEST_MAX_TRIES", 3))
 	retryInterval := time.Duration(utils.GetEnvInt("BB_REQUEST_RETRY_INTERVAL_MS", 1000)) * time.Millisecond
-	return &BlueButtonClient{client, maxTries, retryInterval}, nil
+	return &BlueButtonClient{client: client, maxTries: maxTries, retryInterval: retryInterval, breaker: sharedBreaker(), limiter: sharedLimiter()}, nil
 }
 
 type BeneDataFunc func(string, string, string, string, time.Time) (*models.Bundle, error)
 
+type BeneDataStreamFunc func(string, string, string, string, time.Time, fhir.ResourceHandler) error
+
 func (bbc *BlueButtonClient) GetPatient(patientID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error) {
+	return bbc.getBundleData(blueButtonBasePath+"/Patient/", patientParams(patientID, since, transactionTime), jobID, cmsID)
+}
+
+func (bbc *BlueButtonClient) StreamPatient(patientID, jobID, cmsID, since string, transactionTime time.Time, handler fhir.ResourceHandler) error {
+	return bbc.streamBundleData(blueButtonBasePath+"/Patient/", patientParams(patientID, since, transactionTime), jobID, cmsID, handler)
+}
+
+func patientParams(patientID, since string, transactionTime time.Time) url.Values {
 	params := GetDefaultParams()
 	params.Set("_id", patientID)
 	updateParamWithLastUpdated(&params, since, transactionTime)
-	return bbc.getBundleData(blueButtonBasePath+"/Patient/", params, jobID, cmsID)
+	return params
 }
 
 func (bbc *BlueButtonClient) GetPatientByIdentifierHash(hashedIdentifier string) (string, error) {
@@ -134,18 +163,34 @@ func (bbc *BlueButtonClient) GetPatientByIdentifierHash(hashedIdentifier string)
 }
 
 func (bbc *BlueButtonClient) GetCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error) {
+	return bbc.getBundleData(blueButtonBasePath+"/Coverage/", coverageParams(beneficiaryID, since, transactionTime), jobID, cmsID)
+}
+
+func (bbc *BlueButtonClient) StreamCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time, handler fhir.ResourceHandler) error {
+	return bbc.streamBundleData(blueButtonBasePath+"/Coverage/", coverageParams(beneficiaryID, since, transactionTime), jobID, cmsID, handler)
+}
+
+func coverageParams(beneficiaryID, since string, transactionTime time.Time) url.Values {
 	params := GetDefaultParams()
 	params.Set("beneficiary", beneficiaryID)
 	updateParamWithLastUpdated(&params, since, transactionTime)
-	return bbc.getBundleData(blueButtonBasePath+"/Coverage/", params, jobID, cmsID)
+	return params
 }
 
 func (bbc *BlueButtonClient) GetExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time) (*models.Bundle, error) {
+	return bbc.getBundleData(blueButtonBasePath+"/ExplanationOfBenefit/", eobParams(patientID, since, transactionTime), jobID, cmsID)
+}
+
+func (bbc *BlueButtonClient) StreamExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, handler fhir.ResourceHandler) error {
+	return bbc.streamBundleData(blueButtonBasePath+"/ExplanationOfBenefit/", eobParams(patientID, since, transactionTime), jobID, cmsID, handler)
+}
+
+func eobParams(patientID, since string, transactionTime time.Time) url.Values {
 	params := GetDefaultParams()
 	params.Set("patient", patientID)
 	params.Set("excludeSAMHSA", "true")
 	updateParamWithLastUpdated(&params, since, transactionTime)
-	return bbc.getBundleData(blueButtonBasePath+"/ExplanationOfBenefit/", params, jobID, cmsID)
+	return params
 }
 
 func (bbc *BlueButtonClient) GetMetadata() (string, error) {
@@ -178,7 +223,58 @@ func (bbc *BlueButtonClient) getBundleData(path string, params url.Values, jobID
 	return b, nil
 }
 
+// streamBundleData retrieves the bundle one page at a time. Each page is buffered as raw JSON until it has been
+// read in full so a retried request never hands a resource to the handler twice.
+// Memory usage is bound by the page size (BB_CLIENT_PAGE_SIZE) rather than the size of the entire bundle.
+func (bbc *BlueButtonClient) streamBundleData(path string, params url.Values, jobID, cmsID string, handler fhir.ResourceHandler) error {
+	req, err := getRequest(path, params)
+	if err != nil {
+		return err
+	}
+
+	var page []json.RawMessage
+	collect := func(resource json.RawMessage) error {
+		page = append(page, resource)
+		return nil
+	}
+
+	for req != nil {
+		nextReq, err := bbc.retryBundleRequest(req, jobID, cmsID, func(req *http.Request) (*http.Request, error) {
+			// Discard anything collected by a previous attempt
+			page = page[:0]
+			return bbc.client.DoBundleStreamRequest(req, collect)
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, resource := range page {
+			if err := handler(resource); err != nil {
+				return err
+			}
+		}
+
+		page = nil
+		req = nextReq
+	}
+
+	return nil
+}
+
 func (bbc *BlueButtonClient) tryBundleRequest(req *http.Request, jobID, cmsID string) (*models.Bundle, *http.Request, error) {
+	var result *models.Bundle
+	nextReq, err := bbc.retryBundleRequest(req, jobID, cmsID, func(req *http.Request) (nextReq *http.Request, err error) {
+		result, nextReq, err = bbc.client.DoBundleRequest(req)
+		return nextReq, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result, nextReq, nil
+}
+
+func (bbc *BlueButtonClient) retryBundleRequest(req *http.Request, jobID, cmsID string, do func(req *http.Request) (*http.Request, error)) (*http.Request, error) {
 	m := monitoring.GetMonitor()
 	txn := m.Start(req.URL.Path, nil, nil)
 	defer m.End(txn)
@@ -186,34 +282,16 @@ func (bbc *BlueButtonClient) tryBundleRequest(req *http.Request, jobID, cmsID st
 	queryID := uuid.NewRandom()
 	addRequestHeaders(req, queryID, jobID, cmsID)
 
-	var (
-		result  *models.Bundle
-		nextReq *http.Request
-		err     error
-	)
-
-	eb := backoff.NewExponentialBackOff()
-	eb.InitialInterval = bbc.retryInterval
-	b := backoff.WithMaxRetries(eb, bbc.maxTries)
-
-	err = backoff.RetryNotify(func() error {
-		result, nextReq, err = bbc.client.DoBundleRequest(req)
-		if err != nil {
-			logger.Error(err)
-		}
+	var nextReq *http.Request
+	err := bbc.retry(queryID, budgetFor(req.URL.Path), func() (err error) {
+		nextReq, err = do(req)
 		return err
-	},
-		b,
-		func(err error, d time.Duration) {
-			logger.Infof("Blue Button request %s retry in %s ms...", queryID, d.String())
-		},
-	)
-
+	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("Blue Button request %s failed %d time(s)", queryID, bbc.maxTries)
+		return nil, err
 	}
 
-	return result, nextReq, nil
+	return nextReq, nil
 }
 
 func (bbc *BlueButtonClient) getRawData(path string, params url.Values, jobID, cmsID string) (string, error) {
@@ -229,16 +307,37 @@ func (bbc *BlueButtonClient) getRawData(path string, params url.Values, jobID, c
 	queryID := uuid.NewRandom()
 	addRequestHeaders(req, queryID, jobID, cmsID)
 
+	var result string
+	err = bbc.retry(queryID, budgetFor(path), func() (err error) {
+		result, err = bbc.client.DoRaw(req)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return result, nil
+}
+
+// retry sends a request until it succeeds, fails with an error that is not retryable, or BB_REQUEST_MAX_TRIES
+// retries have been made. Any Retry-After requested by Blue Button is honored by the rate limiter.
+func (bbc *BlueButtonClient) retry(queryID uuid.UUID, budget string, do func() error) error {
 	eb := backoff.NewExponentialBackOff()
 	eb.InitialInterval = bbc.retryInterval
 	b := backoff.WithMaxRetries(eb, bbc.maxTries)
 
-	var result string
-
-	err = backoff.RetryNotify(func() error {
-		result, err = bbc.client.DoRaw(req)
+	attempts := 0
+	err := backoff.RetryNotify(func() error {
+		err := bbc.attempt(budget, func() error {
+			attempts++
+			return do()
+		})
 		if err != nil {
 			logger.Error(err)
+			if category := Categorize(err); !category.Retryable() {
+				logger.Infof("Blue Button request %s failed with %s error, not retrying", queryID, category)
+				return backoff.Permanent(err)
+			}
 		}
 		return err
 	},
@@ -248,11 +347,35 @@ func (bbc *BlueButtonClient) getRawData(path string, params url.Values, jobID, c
 		},
 	)
 
+	if err == ErrCircuitOpen {
+		return fmt.Errorf("Blue Button request %s not sent: %w", queryID, err)
+	}
 	if err != nil {
-		return "", fmt.Errorf("Blue Button request %s failed %d time(s)", queryID, bbc.maxTries)
+		return &RequestError{QueryID: queryID.String(), Attempts: attempts, Category: Categorize(err), Err: err}
 	}
+	return nil
+}
 
-	return result, nil
+// attempt makes a single request, provided the circuit breaker is closed and the request fits within its rate limit budget.
+// Only errors that suggest Blue Button is unhealthy count towards opening the breaker.
+func (bbc *BlueButtonClient) attempt(budget string, do func() error) error {
+	if !bbc.breaker.allow() {
+		return backoff.Permanent(ErrCircuitOpen)
+	}
+	bbc.limiter.wait(budget)
+
+	atomic.AddInt64(&bbc.requests, 1)
+	err := do()
+	bbc.breaker.record(err == nil || !Categorize(err).Retryable())
+	if d := retryAfter(err); d > 0 {
+		bbc.limiter.pause(budget, d)
+	}
+	return err
+}
+
+// RequestCount returns the number of requests the client has sent to Blue Button.
+func (bbc *BlueButtonClient) RequestCount() int64 {
+	return atomic.LoadInt64(&bbc.requests)
 }
 
 func getRequest(path string, params url.Values) (*http.Request, error) {
@@ -2,6 +2,7 @@ package client_test
 
 import (
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
@@ -42,6 +43,8 @@ func (s *BBTestSuite) SetupSuite() {
 	os.Setenv("BB_CLIENT_KEY_FILE", "../../shared_files/decrypted/bfd-dev-test-key.pem")
 	os.Setenv("BB_CLIENT_CA_FILE", "../../shared_files/localhost.crt")
 	os.Setenv("BB_REQUEST_RETRY_INTERVAL_MS", "10")
+	// The 500 tests fail on purpose; keep them from opening the shared circuit breaker for the rest of the suite
+	os.Setenv("BB_BREAKER_MIN_REQUESTS", "1000000")
 }
 
 func (s *BBRequestTestSuite) SetupSuite() {
@@ -87,6 +90,19 @@ func (s *BBTestSuite) TestNewBlueButtonClientNoCertFile() {
 	assert.EqualError(err, "could not load Blue Button keypair: open foo.pem: no such file or directory")
 }
 
+func (s *BBTestSuite) TestNewBlueButtonClientNoKeypair() {
+	origCertFile, origKeyFile := os.Getenv("BB_CLIENT_CERT_FILE"), os.Getenv("BB_CLIENT_KEY_FILE")
+	defer os.Setenv("BB_CLIENT_CERT_FILE", origCertFile)
+	defer os.Setenv("BB_CLIENT_KEY_FILE", origKeyFile)
+
+	// Servers standing in for BFD do not need a client certificate
+	os.Unsetenv("BB_CLIENT_CERT_FILE")
+	os.Unsetenv("BB_CLIENT_KEY_FILE")
+	bbc, err := client.NewBlueButtonClient()
+	assert.NotNil(s.T(), bbc)
+	assert.NoError(s.T(), err)
+}
+
 func (s *BBTestSuite) TestNewBlueButtonClientInvalidCertFile() {
 	origCertFile := os.Getenv("BB_CLIENT_CERT_FILE")
 	defer os.Setenv("BB_CLIENT_CERT_FILE", origCertFile)
@@ -227,6 +243,78 @@ func (s *BBRequestTestSuite) TestGetExplanationOfBenefit_500() {
 	e, err := s.bbClient.GetExplanationOfBenefit("012345", "543210", "A0000", "", now)
 	assert.Regexp(s.T(), `Blue Button request .+ failed \d+ time\(s\)`, err.Error())
 	assert.Nil(s.T(), e)
+	assert.Equal(s.T(), client.ServerError, client.Categorize(err))
+}
+
+func (s *BBRequestTestSuite) TestStreamExplanationOfBenefit() {
+	var ids []interface{}
+	err := s.bbClient.StreamExplanationOfBenefit("012345", "543210", "A0000", "", now, func(resource json.RawMessage) error {
+		var r map[string]interface{}
+		assert.NoError(s.T(), json.Unmarshal(resource, &r))
+		ids = append(ids, r["id"])
+		return nil
+	})
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 33, len(ids))
+	assert.Equal(s.T(), "carrier-10525061996", ids[3])
+}
+
+func (s *BBRequestTestSuite) TestStreamExplanationOfBenefit_500() {
+	err := s.bbClient.StreamExplanationOfBenefit("012345", "543210", "A0000", "", now, func(resource json.RawMessage) error {
+		assert.Fail(s.T(), "no resources should be received")
+		return nil
+	})
+	assert.Regexp(s.T(), `Blue Button request .+ failed \d+ time\(s\)`, err.Error())
+}
+
+func (s *BBRequestTestSuite) TestStreamPatientAndCoverage() {
+	var patients, coverage int
+	assert.NoError(s.T(), s.bbClient.StreamPatient("012345", "543210", "A0000", "", now, func(resource json.RawMessage) error {
+		patients++
+		return nil
+	}))
+	assert.NoError(s.T(), s.bbClient.StreamCoverage("012345", "543210", "A0000", since, now, func(resource json.RawMessage) error {
+		coverage++
+		return nil
+	}))
+	assert.Equal(s.T(), 1, patients)
+	assert.Equal(s.T(), 3, coverage)
+}
+
+// A page that fails part way through must not hand any of its resources to the handler more than once.
+func (s *BBRequestTestSuite) TestStreamRetriedPage() {
+	var attempts int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "" {
+			fmt.Fprintf(w, `{"link":[{"relation":"next","url":"https://%s%s?page=2"}],"entry":[{"resource":{"id":"1"}}]}`, r.Host, r.URL.Path)
+			return
+		}
+
+		attempts++
+		if attempts == 1 {
+			// Truncated response
+			fmt.Fprint(w, `{"entry":[{"resource":{"id":"2"}},{"resource":`)
+			return
+		}
+		fmt.Fprint(w, `{"entry":[{"resource":{"id":"2"}},{"resource":{"id":"3"}}]}`)
+	}))
+	defer ts.Close()
+
+	os.Setenv("BB_SERVER_LOCATION", ts.URL)
+	os.Setenv("BB_CLIENT_PAGE_SIZE", "2")
+	defer os.Unsetenv("BB_CLIENT_PAGE_SIZE")
+
+	bbClient, err := client.NewBlueButtonClient()
+	assert.NoError(s.T(), err)
+
+	var resources []string
+	err = bbClient.StreamExplanationOfBenefit("012345", "543210", "A0000", "", now, func(resource json.RawMessage) error {
+		resources = append(resources, string(resource))
+		return nil
+	})
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 2, attempts)
+	assert.Equal(s.T(), []string{`{"id":"1"}`, `{"id":"2"}`, `{"id":"3"}`}, resources)
 }
 
 func (s *BBRequestTestSuite) TestGetMetadata() {
@@ -0,0 +1,202 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// ErrCircuitOpen is returned when a Blue Button request is not sent because the circuit breaker is open.
+var ErrCircuitOpen = errors.New("Blue Button circuit breaker is open")
+
+// IsCircuitOpen reports whether err was caused by the circuit breaker rejecting a request.
+func IsCircuitOpen(err error) bool {
+	return errors.Is(err, ErrCircuitOpen)
+}
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// circuitBreaker stops requests from being sent to Blue Button while it is failing.
+//
+// The outcome of every request attempt is counted in one second buckets over a sliding window. Once the window holds
+// at least minRequests attempts and the share of failures reaches errorPct, the breaker opens and rejects requests
+// for openDuration. It then lets a single trial request through (half-open), closing again if the request succeeds
+// and re-opening if it fails.
+type circuitBreaker struct {
+	window       time.Duration
+	minRequests  int
+	errorPct     int
+	openDuration time.Duration
+	now          func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	openedAt time.Time
+	trial    bool
+	buckets  []breakerBucket
+}
+
+type breakerBucket struct {
+	second    int64
+	successes int
+	failures  int
+}
+
+var (
+	breaker     *circuitBreaker
+	breakerOnce sync.Once
+)
+
+// sharedBreaker returns the circuit breaker shared by every Blue Button client in the process.
+func sharedBreaker() *circuitBreaker {
+	breakerOnce.Do(func() {
+		breaker = newCircuitBreaker(
+			time.Duration(utils.GetEnvInt("BB_BREAKER_WINDOW_SEC", 60))*time.Second,
+			utils.GetEnvInt("BB_BREAKER_MIN_REQUESTS", 20),
+			utils.GetEnvInt("BB_BREAKER_ERROR_PCT", 50),
+			time.Duration(utils.GetEnvInt("BB_BREAKER_OPEN_SEC", 30))*time.Second,
+		)
+	})
+	return breaker
+}
+
+func newCircuitBreaker(window time.Duration, minRequests, errorPct int, openDuration time.Duration) *circuitBreaker {
+	if window < time.Second {
+		window = time.Second
+	}
+	return &circuitBreaker{
+		window:       window,
+		minRequests:  minRequests,
+		errorPct:     errorPct,
+		openDuration: openDuration,
+		now:          time.Now,
+		state:        BreakerClosed,
+		buckets:      make([]breakerBucket, int(window/time.Second)),
+	}
+}
+
+// CircuitBreakerState returns the current state of the Blue Button circuit breaker.
+func CircuitBreakerState() string {
+	return sharedBreaker().currentState()
+}
+
+// CircuitBreakerRetryAfter returns how long until the Blue Button circuit breaker lets a request through.
+// It is zero when the breaker is not open.
+func CircuitBreakerRetryAfter() time.Duration {
+	return sharedBreaker().retryAfter()
+}
+
+func (b *circuitBreaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && !b.now().Before(b.openedAt.Add(b.openDuration)) {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerOpen {
+		return 0
+	}
+	if d := b.openedAt.Add(b.openDuration).Sub(b.now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// allow reports whether a request may be sent. A request that is allowed must have its outcome recorded.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Before(b.openedAt.Add(b.openDuration)) {
+			return false
+		}
+		b.transition(BreakerHalfOpen)
+		b.trial = true
+		return true
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record counts the outcome of a request that was allowed by the breaker.
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if b.state == BreakerHalfOpen && b.trial {
+		b.trial = false
+		if success {
+			b.reset()
+			b.transition(BreakerClosed)
+		} else {
+			b.openedAt = now
+			b.transition(BreakerOpen)
+		}
+		return
+	}
+
+	second := now.Unix()
+	bucket := &b.buckets[int(second%int64(len(b.buckets)))]
+	if bucket.second != second {
+		*bucket = breakerBucket{second: second}
+	}
+	if success {
+		bucket.successes++
+	} else {
+		bucket.failures++
+	}
+
+	if b.state != BreakerClosed || success {
+		return
+	}
+
+	var total, failures int
+	for _, bk := range b.buckets {
+		if second-bk.second < int64(len(b.buckets)) {
+			total += bk.successes + bk.failures
+			failures += bk.failures
+		}
+	}
+	if total >= b.minRequests && failures*100 >= total*b.errorPct {
+		b.openedAt = now
+		b.reset()
+		logger.WithFields(logrus.Fields{"requests": total, "failures": failures}).Warn("Blue Button error rate exceeded threshold")
+		b.transition(BreakerOpen)
+	}
+}
+
+func (b *circuitBreaker) reset() {
+	for i := range b.buckets {
+		b.buckets[i] = breakerBucket{}
+	}
+}
+
+func (b *circuitBreaker) transition(state string) {
+	if b.state == state {
+		return
+	}
+	logger.WithFields(logrus.Fields{"from": b.state, "to": state}).Infof("Blue Button circuit breaker %s", state)
+	b.state = state
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/CMSgov/bcda-app/bcda/client/fhir"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func testBreaker(clock *fakeClock) *circuitBreaker {
+	b := newCircuitBreaker(10*time.Second, 4, 50, 30*time.Second)
+	b.now = clock.now
+	return b
+}
+
+func TestCircuitBreakerOpensOnErrorRate(t *testing.T) {
+	clock := &fakeClock{time.Unix(1600000000, 0)}
+	b := testBreaker(clock)
+
+	// Below the minimum number of requests
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.allow())
+		b.record(false)
+	}
+	assert.Equal(t, BreakerClosed, b.currentState())
+
+	assert.True(t, b.allow())
+	b.record(false)
+	assert.Equal(t, BreakerOpen, b.currentState())
+	assert.False(t, b.allow())
+	assert.Equal(t, 30*time.Second, b.retryAfter())
+}
+
+func TestCircuitBreakerStaysClosedBelowErrorRate(t *testing.T) {
+	clock := &fakeClock{time.Unix(1600000000, 0)}
+	b := testBreaker(clock)
+
+	for i := 0; i < 10; i++ {
+		b.record(true)
+		b.record(i%3 != 0)
+	}
+	assert.Equal(t, BreakerClosed, b.currentState())
+	assert.True(t, b.allow())
+}
+
+func TestCircuitBreakerForgetsOldErrors(t *testing.T) {
+	clock := &fakeClock{time.Unix(1600000000, 0)}
+	b := testBreaker(clock)
+
+	for i := 0; i < 3; i++ {
+		b.record(false)
+	}
+	clock.advance(10 * time.Second)
+	b.record(false)
+	assert.Equal(t, BreakerClosed, b.currentState())
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	clock := &fakeClock{time.Unix(1600000000, 0)}
+	b := testBreaker(clock)
+	for i := 0; i < 4; i++ {
+		b.record(false)
+	}
+	assert.Equal(t, BreakerOpen, b.currentState())
+
+	// A failed trial request re-opens the breaker
+	clock.advance(30 * time.Second)
+	assert.Equal(t, BreakerHalfOpen, b.currentState())
+	assert.True(t, b.allow())
+	assert.False(t, b.allow(), "only one trial request should be allowed")
+	b.record(false)
+	assert.Equal(t, BreakerOpen, b.currentState())
+	assert.False(t, b.allow())
+
+	// A successful trial request closes it
+	clock.advance(30 * time.Second)
+	assert.True(t, b.allow())
+	b.record(true)
+	assert.Equal(t, BreakerClosed, b.currentState())
+	assert.True(t, b.allow())
+	assert.Equal(t, time.Duration(0), b.retryAfter())
+}
+
+func TestBlueButtonClientOpenBreaker(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "Some server error", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	origLocation := os.Getenv("BB_SERVER_LOCATION")
+	defer os.Setenv("BB_SERVER_LOCATION", origLocation)
+	os.Setenv("BB_SERVER_LOCATION", ts.URL)
+
+	clock := &fakeClock{time.Unix(1600000000, 0)}
+	bbc := &BlueButtonClient{
+		client:        fhir.NewClient(ts.Client(), 0),
+		maxTries:      5,
+		retryInterval: time.Millisecond,
+		breaker:       testBreaker(clock),
+		limiter:       newRateLimiter(nil, nil),
+	}
+
+	_, err := bbc.getRawData("/metadata", url.Values{}, "", "")
+	assert.True(t, IsCircuitOpen(err), "unexpected error %v", err)
+	assert.EqualValues(t, 4, requests, "requests should stop once the breaker opens")
+
+	_, err = bbc.getBundleData("/Patient", url.Values{}, "", "")
+	assert.True(t, IsCircuitOpen(err), "unexpected error %v", err)
+	assert.EqualValues(t, 4, requests)
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/CMSgov/bcda-app/bcda/client/fhir"
+)
+
+// ErrorCategory describes why a Blue Button request failed.
+type ErrorCategory string
+
+const (
+	// TransportError is a failure to connect to Blue Button or to read its response
+	TransportError ErrorCategory = "transport"
+	// TimeoutError is a request that did not complete within BB_TIMEOUT_MS
+	TimeoutError ErrorCategory = "timeout"
+	// ThrottledError is a 429 response
+	ThrottledError ErrorCategory = "throttled"
+	// ServerError is a 5xx response
+	ServerError ErrorCategory = "server"
+	// ClientError is any other 4xx response, e.g. a request for a resource that does not exist
+	ClientError ErrorCategory = "client"
+	// DecodeError is a response that could not be decoded
+	DecodeError ErrorCategory = "decode"
+	// UnknownError is any other failure
+	UnknownError ErrorCategory = "unknown"
+)
+
+// Retryable reports whether a request that failed with this category of error may succeed if it is sent again.
+func (c ErrorCategory) Retryable() bool {
+	switch c {
+	case ClientError, DecodeError:
+		return false
+	default:
+		return true
+	}
+}
+
+// RequestError is returned when a Blue Button request does not succeed.
+type RequestError struct {
+	QueryID  string
+	Attempts int
+	Category ErrorCategory
+	Err      error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Blue Button request %s failed %d time(s): %s error", e.QueryID, e.Attempts, e.Category)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Categorize returns the category of a Blue Button request error.
+func Categorize(err error) ErrorCategory {
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.Category
+	}
+
+	var statusErr *fhir.StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusTooManyRequests:
+			return ThrottledError
+		case statusErr.StatusCode >= http.StatusInternalServerError:
+			return ServerError
+		default:
+			return ClientError
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		return TimeoutError
+	}
+	// A response that ends part way through was cut off rather than malformed
+	if netErr != nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		return TransportError
+	}
+
+	var (
+		decodeErr *fhir.DecodeError
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	if errors.As(err, &decodeErr) || errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return DecodeError
+	}
+
+	return UnknownError
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/CMSgov/bcda-app/bcda/client/fhir"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestCategorize(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected ErrorCategory
+	}{
+		{&url.Error{Op: "Get", URL: "https://bfd", Err: errors.New("connection refused")}, TransportError},
+		{&url.Error{Op: "Get", URL: "https://bfd", Err: timeoutError{}}, TimeoutError},
+		{fmt.Errorf("failed to stream bundle response: %w", io.ErrUnexpectedEOF), TransportError},
+		{&fhir.StatusError{StatusCode: http.StatusTooManyRequests}, ThrottledError},
+		{&fhir.StatusError{StatusCode: http.StatusServiceUnavailable}, ServerError},
+		{fmt.Errorf("failed to get response: %w", &fhir.StatusError{StatusCode: http.StatusNotFound}), ClientError},
+		{&fhir.DecodeError{Err: errors.New("unexpected token")}, DecodeError},
+		{json.Unmarshal([]byte("{"), &struct{}{}), DecodeError},
+		{&RequestError{Category: TimeoutError, Err: errors.New("error")}, TimeoutError},
+		{errors.New("error"), UnknownError},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, Categorize(tt.err), tt.err.Error())
+	}
+
+	assert.False(t, ClientError.Retryable())
+	assert.False(t, DecodeError.Retryable())
+	assert.True(t, ServerError.Retryable())
+	assert.True(t, ThrottledError.Retryable())
+}
+
+func TestBlueButtonClientRetries(t *testing.T) {
+	tests := []struct {
+		status   int
+		attempts int32
+		category ErrorCategory
+	}{
+		{http.StatusNotFound, 1, ClientError},
+		{http.StatusBadRequest, 1, ClientError},
+		{http.StatusInternalServerError, 3, ServerError},
+		{http.StatusTooManyRequests, 3, ThrottledError},
+	}
+
+	for _, tt := range tests {
+		var requests int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			http.Error(w, http.StatusText(tt.status), tt.status)
+		}))
+
+		origLocation := os.Getenv("BB_SERVER_LOCATION")
+		os.Setenv("BB_SERVER_LOCATION", ts.URL)
+
+		bbc := &BlueButtonClient{
+			client:        fhir.NewClient(ts.Client(), 0),
+			maxTries:      2,
+			retryInterval: time.Millisecond,
+			breaker:       newCircuitBreaker(time.Minute, 1000, 100, time.Minute),
+			limiter:       newRateLimiter(nil, nil),
+		}
+		_, err := bbc.getBundleData(blueButtonBasePath+"/ExplanationOfBenefit/", url.Values{}, "", "")
+
+		var reqErr *RequestError
+		if assert.True(t, errors.As(err, &reqErr), "status %d: unexpected error %v", tt.status, err) {
+			assert.Equal(t, tt.category, reqErr.Category)
+			assert.EqualValues(t, tt.attempts, reqErr.Attempts)
+		}
+		assert.Equal(t, tt.attempts, requests, "status %d", tt.status)
+		assert.EqualValues(t, tt.attempts, bbc.RequestCount(), "status %d", tt.status)
+
+		os.Setenv("BB_SERVER_LOCATION", origLocation)
+		ts.Close()
+	}
+}
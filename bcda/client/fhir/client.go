@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	models "github.com/CMSgov/bcda-app/bcda/models/fhir"
 )
@@ -15,12 +16,20 @@ import (
 type Client interface {
 	DoBundleRequest(req *http.Request) (bundle *models.Bundle, nextReq *http.Request, err error)
 
+	// DoBundleStreamRequest makes a request and passes each resource contained in the bundle response to the handler.
+	// The response is decoded as it is read so the bundle is never held in memory.
+	DoBundleStreamRequest(req *http.Request, handler ResourceHandler) (nextReq *http.Request, err error)
+
 	// DoRaw makes a request and return the raw response from the service
 	DoRaw(req *http.Request) (string, error)
 }
 
 type BundleEntry map[string]interface{}
 
+// ResourceHandler receives the raw JSON of a single resource found in a bundle response.
+// Returning an error stops the processing of the response.
+type ResourceHandler func(resource json.RawMessage) error
+
 func NewClient(httpClient *http.Client, pageSize int) Client {
 	if pageSize == 0 {
 		return &singleClient{httpClient}
@@ -51,6 +60,19 @@ func (c *singleClient) DoBundleRequest(req *http.Request) (bundle *models.Bundle
 	return b, nil, nil
 }
 
+func (c *singleClient) DoBundleStreamRequest(req *http.Request, handler ResourceHandler) (nextReq *http.Request, err error) {
+
+	// Ensure that we'll receive the entire bundle response in a single request
+	vals := req.URL.Query()
+	vals.Del("_count")
+	req.URL.RawQuery = vals.Encode()
+
+	if _, err := streamBundleResponse(c.httpClient, req, handler); err != nil {
+		return nil, fmt.Errorf("failed to stream bundle response: %w", err)
+	}
+	return nil, nil
+}
+
 func (c *singleClient) DoRaw(req *http.Request) (string, error) {
 	resp, err := getResponse(c.httpClient, req)
 	if err != nil {
@@ -69,21 +91,46 @@ type client struct {
 var _ Client = &client{}
 
 func (c *client) DoBundleRequest(req *http.Request) (bundle *models.Bundle, nextReq *http.Request, err error) {
-	const (
-		nextRelation = "next" // Relation that contains the next URL that we should be requesting
-	)
-	// Set page size to our configured value
-	vals := req.URL.Query()
-	vals.Set("_count", c.pageSize)
-	req.URL.RawQuery = vals.Encode()
+	c.setPageSize(req)
 
 	b, err := getBundleResponse(c.httpClient, req)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to get bundle response: %w", err)
 	}
 
+	nextReq, err = nextRequest(req, b.Links)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, nextReq, nil
+}
+
+func (c *client) DoBundleStreamRequest(req *http.Request, handler ResourceHandler) (nextReq *http.Request, err error) {
+	c.setPageSize(req)
+
+	links, err := streamBundleResponse(c.httpClient, req, handler)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream bundle response: %w", err)
+	}
+
+	return nextRequest(req, links)
+}
+
+// setPageSize sets page size to our configured value
+func (c *client) setPageSize(req *http.Request) {
+	vals := req.URL.Query()
+	vals.Set("_count", c.pageSize)
+	req.URL.RawQuery = vals.Encode()
+}
+
+// nextRequest returns the request for the page following req or nil if req is for the last page.
+func nextRequest(req *http.Request, links []models.Link) (*http.Request, error) {
+	const (
+		nextRelation = "next" // Relation that contains the next URL that we should be requesting
+	)
+
 	var nextURL string
-	for _, link := range b.Links {
+	for _, link := range links {
 		if link.Relation == nextRelation {
 			nextURL = link.URL
 			break
@@ -92,18 +139,18 @@ func (c *client) DoBundleRequest(req *http.Request) (bundle *models.Bundle, next
 
 	// We've reached the last page
 	if nextURL == "" {
-		return b, nil, nil
+		return nil, nil
 	}
 
 	url, err := url.Parse(nextURL)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse URL %s: %w", nextURL, err)
+		return nil, fmt.Errorf("failed to parse URL %s: %w", nextURL, err)
 	}
 
 	newReq := req.Clone(req.Context())
 	newReq.URL = url
 
-	return b, newReq, nil
+	return newReq, nil
 }
 
 func (c *client) DoRaw(req *http.Request) (string, error) {
@@ -122,14 +169,16 @@ func getBundleResponse(c *http.Client, req *http.Request) (*models.Bundle, error
 
 	var b models.Bundle
 	if err := json.Unmarshal(body, &b); err != nil {
-		return nil, err
+		return nil, &DecodeError{err}
 	}
 
 	return &b, nil
 }
 
-func getResponse(c *http.Client, req *http.Request) (body []byte, err error) {
-	resp, err := c.Do(req)
+// streamBundleResponse decodes the bundle one entry at a time, passing each resource to the handler.
+// The bundle's links are returned once the entire response has been read.
+func streamBundleResponse(c *http.Client, req *http.Request, handler ResourceHandler) (links []models.Link, err error) {
+	resp, err := doRequest(c, req)
 	if resp != nil {
 		/* #nosec -- it's OK for us to ignore errors when attempt to cleanup response body */
 		defer func() {
@@ -141,12 +190,99 @@ func getResponse(c *http.Client, req *http.Request) (body []byte, err error) {
 		return nil, err
 	}
 
-	if resp.StatusCode >= http.StatusBadRequest {
-		// Attempt to read the body in case it offers valuable troubleshooting info
-		body, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("received incorrect status code %d body %s",
-			resp.StatusCode, string(body))
+	dec := json.NewDecoder(resp.Body)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t {
+		case "link":
+			if err := dec.Decode(&links); err != nil {
+				return nil, err
+			}
+		case "entry":
+			if err := streamEntries(dec, handler); err != nil {
+				return nil, err
+			}
+		default:
+			// Skip over any fields that we do not need
+			var ignored json.RawMessage
+			if err := dec.Decode(&ignored); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+func streamEntries(dec *json.Decoder, handler ResourceHandler) error {
+	// The entry field may be explicitly set to null when there are no entries
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
 	}
+	if t != json.Delim('[') {
+		return &DecodeError{fmt.Errorf("unexpected token %v, expected array of entries", t)}
+	}
+
+	for dec.More() {
+		var entry struct {
+			Resource json.RawMessage `json:"resource"`
+		}
+		if err := dec.Decode(&entry); err != nil {
+			return err
+		}
+
+		if len(entry.Resource) == 0 || string(entry.Resource) == "null" {
+			continue
+		}
+
+		if err := handler(entry.Resource); err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return &DecodeError{fmt.Errorf("unexpected token %v, expected %v", t, delim)}
+	}
+	return nil
+}
+
+func getResponse(c *http.Client, req *http.Request) (body []byte, err error) {
+	resp, err := doRequest(c, req)
+	if resp != nil {
+		/* #nosec -- it's OK for us to ignore errors when attempt to cleanup response body */
+		defer func() {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	body, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -154,3 +290,67 @@ func getResponse(c *http.Client, req *http.Request) (body []byte, err error) {
 
 	return body, nil
 }
+
+// doRequest makes the request and verifies that the service responded successfully.
+// The caller is responsible for closing the body of any non-nil response.
+func doRequest(c *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := c.Do(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		// Attempt to read the body in case it offers valuable troubleshooting info
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, &StatusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+			Body:       string(body),
+		}
+	}
+
+	return resp, nil
+}
+
+// StatusError is returned when the service responds with an error status code.
+type StatusError struct {
+	StatusCode int
+	// RetryAfter is how long the service asked us to wait before making another request, or zero if it did not say
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("received incorrect status code %d body %s", e.StatusCode, e.Body)
+}
+
+// DecodeError is returned when the service's response is not the JSON that was expected.
+// Malformed JSON found while streaming a response is reported by encoding/json's own error types instead.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header, which holds either a number of seconds or a date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
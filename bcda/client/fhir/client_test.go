@@ -2,6 +2,7 @@ package fhir
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,6 +13,7 @@ import (
 	"path"
 	"strconv"
 	"testing"
+	"time"
 
 	models "github.com/CMSgov/bcda-app/bcda/models/fhir"
 	"github.com/stretchr/testify/assert"
@@ -86,6 +88,136 @@ func TestMultipleRequestBundle(t *testing.T) {
 	assertEqualsBundle(t, "./testdata/bundlePartialComplete.json", bundle)
 }
 
+func TestStreamSingleRequestBundle(t *testing.T) {
+	const eobPath = "../../../shared_files/synthetic_beneficiary_data/ExplanationOfBenefit"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.URL.Query().Get("_count"))
+		http.ServeFile(w, r, eobPath)
+	}))
+	defer s.Close()
+
+	client := NewClient(http.DefaultClient, 0)
+
+	req, err := http.NewRequest("GET", s.URL, nil)
+	assert.NoError(t, err)
+
+	var resources []json.RawMessage
+	nextReq, err := client.DoBundleStreamRequest(req, func(resource json.RawMessage) error {
+		resources = append(resources, resource)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, nextReq)
+
+	data, err := ioutil.ReadFile(eobPath)
+	assert.NoError(t, err)
+	var expected models.Bundle
+	assert.NoError(t, json.Unmarshal(data, &expected))
+
+	assert.Len(t, resources, len(expected.Entries))
+	for i, entry := range expected.Entries {
+		expectedResource, err := json.Marshal(entry["resource"])
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(expectedResource), string(resources[i]))
+	}
+}
+
+func TestStreamMultipleRequestBundle(t *testing.T) {
+	count := 10
+	r := &requestHandler{
+		countChecker: func(r *http.Request) {
+			assert.Equal(t, strconv.Itoa(count), r.URL.Query().Get("_count"))
+		},
+	}
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	client := NewClient(http.DefaultClient, count)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/bundlePartial1.json", s.URL), nil)
+	assert.NoError(t, err)
+
+	for req != nil {
+		// None of the partial bundles contain resources
+		next, err := client.DoBundleStreamRequest(req, func(resource json.RawMessage) error {
+			assert.Fail(t, "unexpected resource %s", string(resource))
+			return nil
+		})
+		assert.NoError(t, err)
+
+		// The partial files do not know the correct port, so we'll update the request
+		// to point to the test server
+		if next != nil {
+			next.URL.Host = u.Host
+		}
+		req = next
+	}
+
+	assert.Equal(t, 3, r.numRequestsReceived)
+}
+
+func TestStreamBundleEntries(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []string
+		errMsg   string
+	}{
+		{"Resources", `{"resourceType":"Bundle","entry":[{"resource":{"id":"1"}},{"fullUrl":"2"},{"resource":null},{"resource":{"id":"3"}}]}`,
+			[]string{`{"id":"1"}`, `{"id":"3"}`}, ""},
+		{"NullEntries", `{"resourceType":"Bundle","entry":null}`, nil, ""},
+		{"NoEntries", `{"resourceType":"Bundle","total":0}`, nil, ""},
+		{"InvalidEntries", `{"resourceType":"Bundle","entry":{}}`, nil, "expected array of entries"},
+		{"Truncated", `{"resourceType":"Bundle","entry":[{"resource":{"id":"1"}},`, []string{`{"id":"1"}`}, "failed to stream bundle response"},
+		{"NotAnObject", `[]`, nil, "unexpected token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tt.body)
+			}))
+			defer s.Close()
+
+			req, err := http.NewRequest("GET", s.URL, nil)
+			assert.NoError(t, err)
+
+			var resources []string
+			_, err = NewClient(http.DefaultClient, 0).DoBundleStreamRequest(req, func(resource json.RawMessage) error {
+				resources = append(resources, string(resource))
+				return nil
+			})
+			if tt.errMsg != "" {
+				assert.Contains(t, err.Error(), tt.errMsg)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected, resources)
+		})
+	}
+}
+
+func TestStreamBundleHandlerError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"entry":[{"resource":{"id":"1"}},{"resource":{"id":"2"}}]}`)
+	}))
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", s.URL, nil)
+	assert.NoError(t, err)
+
+	calls := 0
+	_, err = NewClient(http.DefaultClient, 0).DoBundleStreamRequest(req, func(resource json.RawMessage) error {
+		calls++
+		return errors.New("handler failed")
+	})
+	assert.Contains(t, err.Error(), "handler failed")
+	assert.Equal(t, 1, calls)
+}
+
 func TestRawRequest(t *testing.T) {
 	msg := "Hello world!"
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -103,6 +235,34 @@ func TestRawRequest(t *testing.T) {
 	assert.Equal(t, msg, resp)
 }
 
+func TestStatusError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", s.URL, nil)
+	assert.NoError(t, err)
+
+	_, err = NewClient(http.DefaultClient, 0).DoRaw(req)
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusTooManyRequests, statusErr.StatusCode)
+	assert.Equal(t, 7*time.Second, statusErr.RetryAfter)
+	assert.Contains(t, err.Error(), "received incorrect status code 429 body slow down")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-1", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
+
 func assertEqualsBundle(t *testing.T, pathToExpected string, actual *models.Bundle) {
 	data, err := ioutil.ReadFile(pathToExpected)
 	assert.NoError(t, err)
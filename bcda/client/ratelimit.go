@@ -0,0 +1,200 @@
+package client
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/client/fhir"
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// Blue Button requests are rate limited against separate budgets so that beneficiary lookups are not starved
+// by the much larger number of EOB requests.
+const (
+	patientBudget = "patient"
+	eobBudget     = "eob"
+	defaultBudget = "default"
+)
+
+// budgetFor returns the name of the budget that a request to the path is charged against.
+func budgetFor(path string) string {
+	switch {
+	case strings.Contains(path, "/Patient"):
+		return patientBudget
+	case strings.Contains(path, "/ExplanationOfBenefit"):
+		return eobBudget
+	default:
+		return defaultBudget
+	}
+}
+
+type rateBudget struct {
+	// interval is the time between requests when sending at the budget's rate
+	interval time.Duration
+	burst    int
+}
+
+// limiterStore tracks the state of every budget's token bucket where it can be shared by all of the workers.
+//
+// Each bucket is stored as the theoretical arrival time (TAT) of the next request (i.e. the generic cell rate
+// algorithm), which is equivalent to a token bucket but can be updated atomically in a single statement.
+type limiterStore interface {
+	// reserve takes a token from the bucket, returning how long until the bucket has refilled enough to cover it
+	reserve(name string, b rateBudget) (time.Duration, error)
+	// pause prevents any tokens from being taken from the bucket for the duration
+	pause(name string, b rateBudget, d time.Duration) error
+}
+
+// rateLimiter keeps the requests sent to Blue Button by every worker under the configured requests-per-second budgets.
+type rateLimiter struct {
+	budgets map[string]rateBudget
+	store   limiterStore
+	sleep   func(time.Duration)
+	now     func() time.Time
+
+	// pausedUntil holds the pauses of the unlimited budgets, which are not tracked by the store
+	mu          sync.Mutex
+	pausedUntil map[string]time.Time
+}
+
+var (
+	limiter     *rateLimiter
+	limiterOnce sync.Once
+)
+
+// sharedLimiter returns the rate limiter used by every Blue Button client in the process.
+// Budgets are set in requests per second by BB_RATE_LIMIT_PATIENT_RPS, BB_RATE_LIMIT_EOB_RPS and
+// BB_RATE_LIMIT_RPS (all other requests). A budget of 0 is unlimited.
+func sharedLimiter() *rateLimiter {
+	limiterOnce.Do(func() {
+		burst := utils.GetEnvInt("BB_RATE_LIMIT_BURST", 0)
+		budgets := make(map[string]rateBudget)
+		for name, env := range map[string]string{
+			patientBudget: "BB_RATE_LIMIT_PATIENT_RPS",
+			eobBudget:     "BB_RATE_LIMIT_EOB_RPS",
+			defaultBudget: "BB_RATE_LIMIT_RPS",
+		} {
+			if rps := utils.GetEnvInt(env, 0); rps > 0 {
+				b := rateBudget{interval: time.Second / time.Duration(rps), burst: burst}
+				// By default allow up to a second's worth of requests at once
+				if b.burst < 1 {
+					b.burst = rps
+				}
+				budgets[name] = b
+			}
+		}
+		limiter = newRateLimiter(budgets, &pgLimiterStore{})
+	})
+	return limiter
+}
+
+func newRateLimiter(budgets map[string]rateBudget, store limiterStore) *rateLimiter {
+	return &rateLimiter{
+		budgets:     budgets,
+		store:       store,
+		sleep:       time.Sleep,
+		now:         time.Now,
+		pausedUntil: make(map[string]time.Time),
+	}
+}
+
+// wait blocks until a request can be sent using the budget.
+// If the shared state cannot be reached, the request is allowed rather than halting every export.
+func (l *rateLimiter) wait(name string) {
+	b, ok := l.budgets[name]
+	if !ok {
+		l.mu.Lock()
+		d := l.pausedUntil[name].Sub(l.now())
+		l.mu.Unlock()
+		if d > 0 {
+			l.sleep(d)
+		}
+		return
+	}
+
+	d, err := l.store.reserve(name, b)
+	if err != nil {
+		logger.Errorf("Unable to reserve Blue Button %s request: %s", name, err.Error())
+		return
+	}
+	if d > 0 {
+		l.sleep(d)
+	}
+}
+
+// pause stops every worker from sending requests using the budget for the duration, e.g. when asked to by
+// a Retry-After header. Budgets without a limit are not shared, so they are only paused within this process.
+func (l *rateLimiter) pause(name string, d time.Duration) {
+	logger.WithFields(logrus.Fields{"budget": name, "retry_after": d.String()}).Warn("Blue Button asked us to slow down")
+
+	b, ok := l.budgets[name]
+	if !ok {
+		until := l.now().Add(d)
+		l.mu.Lock()
+		if until.After(l.pausedUntil[name]) {
+			l.pausedUntil[name] = until
+		}
+		l.mu.Unlock()
+		return
+	}
+
+	if err := l.store.pause(name, b, d); err != nil {
+		logger.Errorf("Unable to pause Blue Button %s requests: %s", name, err.Error())
+	}
+}
+
+// retryAfter returns how long Blue Button asked us to wait before sending another request, if the error says.
+func retryAfter(err error) time.Duration {
+	var statusErr *fhir.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// pgLimiterStore keeps the buckets in the bb_rate_limits table (models.BBRateLimit) so they are shared by every
+// worker instance.
+type pgLimiterStore struct {
+	once sync.Once
+	db   *sql.DB
+}
+
+func (s *pgLimiterStore) conn() *sql.DB {
+	s.once.Do(func() {
+		s.db = database.GetDbConnection()
+	})
+	return s.db
+}
+
+func (s *pgLimiterStore) reserve(name string, b rateBudget) (time.Duration, error) {
+	// The request may be sent once the TAT is within burst intervals of now
+	var seconds float64
+	err := s.conn().QueryRow(`INSERT INTO bb_rate_limits AS l (name, tat) VALUES ($1::text, now() + $2::float8 * interval '1 microsecond')
+		ON CONFLICT (name) DO UPDATE SET tat = GREATEST(l.tat, now()) + $2::float8 * interval '1 microsecond'
+		RETURNING EXTRACT(EPOCH FROM (tat - now()))`,
+		name, b.interval.Microseconds()).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+
+	d := time.Duration(seconds*float64(time.Second)) - time.Duration(b.burst)*b.interval
+	if d < 0 {
+		d = 0
+	}
+	return d, nil
+}
+
+func (s *pgLimiterStore) pause(name string, b rateBudget, d time.Duration) error {
+	// Move the TAT so that the next request can be sent once the pause is over, then at the budget's steady rate
+	offset := d + time.Duration(b.burst-1)*b.interval
+	_, err := s.conn().Exec(`INSERT INTO bb_rate_limits AS l (name, tat) VALUES ($1::text, now() + $2::float8 * interval '1 microsecond')
+		ON CONFLICT (name) DO UPDATE SET tat = GREATEST(l.tat, now() + $2::float8 * interval '1 microsecond')`,
+		name, offset.Microseconds())
+	return err
+}
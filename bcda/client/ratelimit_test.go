@@ -0,0 +1,141 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/CMSgov/bcda-app/bcda/client/fhir"
+)
+
+type fakeLimiterStore struct {
+	reserved map[string]int
+	paused   map[string]time.Duration
+	wait     time.Duration
+	err      error
+}
+
+func newFakeLimiterStore() *fakeLimiterStore {
+	return &fakeLimiterStore{reserved: make(map[string]int), paused: make(map[string]time.Duration)}
+}
+
+func (s *fakeLimiterStore) reserve(name string, b rateBudget) (time.Duration, error) {
+	s.reserved[name]++
+	return s.wait, s.err
+}
+
+func (s *fakeLimiterStore) pause(name string, b rateBudget, d time.Duration) error {
+	s.paused[name] = d
+	return s.err
+}
+
+func TestBudgetFor(t *testing.T) {
+	assert.Equal(t, patientBudget, budgetFor("/v1/fhir/Patient/"))
+	assert.Equal(t, eobBudget, budgetFor("/v1/fhir/ExplanationOfBenefit/"))
+	assert.Equal(t, defaultBudget, budgetFor("/v1/fhir/Coverage/"))
+	assert.Equal(t, defaultBudget, budgetFor("/v1/fhir/metadata/"))
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	store := newFakeLimiterStore()
+	store.wait = 250 * time.Millisecond
+	l := newRateLimiter(map[string]rateBudget{eobBudget: {interval: 100 * time.Millisecond, burst: 1}}, store)
+	var slept []time.Duration
+	l.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	l.wait(eobBudget)
+	assert.Equal(t, 1, store.reserved[eobBudget])
+	assert.Equal(t, []time.Duration{250 * time.Millisecond}, slept)
+
+	// Unlimited budgets never reach the store
+	l.wait(patientBudget)
+	assert.Equal(t, 0, store.reserved[patientBudget])
+	assert.Len(t, slept, 1)
+
+	// Requests are allowed when the store is unavailable
+	store.err = errors.New("database unavailable")
+	l.wait(eobBudget)
+	assert.Len(t, slept, 1)
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	store := newFakeLimiterStore()
+	l := newRateLimiter(map[string]rateBudget{eobBudget: {interval: 100 * time.Millisecond, burst: 1}}, store)
+	now := time.Unix(1600000000, 0)
+	l.now = func() time.Time { return now }
+	var slept []time.Duration
+	l.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	// Limited budgets are paused for every worker through the store
+	l.pause(eobBudget, 5*time.Second)
+	assert.Equal(t, 5*time.Second, store.paused[eobBudget])
+
+	// Unlimited budgets are paused within the process
+	l.pause(patientBudget, 3*time.Second)
+	_, ok := store.paused[patientBudget]
+	assert.False(t, ok)
+	now = now.Add(time.Second)
+	l.wait(patientBudget)
+	assert.Equal(t, []time.Duration{2 * time.Second}, slept)
+
+	now = now.Add(2 * time.Second)
+	l.wait(patientBudget)
+	assert.Len(t, slept, 1)
+}
+
+func TestBlueButtonClientHonorsRetryAfter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	origLocation := os.Getenv("BB_SERVER_LOCATION")
+	defer os.Setenv("BB_SERVER_LOCATION", origLocation)
+	os.Setenv("BB_SERVER_LOCATION", ts.URL)
+
+	store := newFakeLimiterStore()
+	bbc := &BlueButtonClient{
+		client:        fhir.NewClient(ts.Client(), 0),
+		maxTries:      1,
+		retryInterval: time.Millisecond,
+		breaker:       newCircuitBreaker(time.Minute, 1000, 100, time.Minute),
+		limiter:       newRateLimiter(map[string]rateBudget{eobBudget: {interval: time.Millisecond, burst: 1}}, store),
+	}
+
+	_, err := bbc.getBundleData(blueButtonBasePath+"/ExplanationOfBenefit/", url.Values{}, "", "")
+	assert.Error(t, err)
+	assert.Equal(t, 2, store.reserved[eobBudget])
+	assert.Equal(t, 2*time.Second, store.paused[eobBudget])
+}
+
+func TestPgLimiterStore(t *testing.T) {
+	store := &pgLimiterStore{}
+	name := "test-" + time.Now().Format(time.RFC3339Nano)
+	b := rateBudget{interval: time.Second, burst: 2}
+	defer func() {
+		_, _ = store.conn().Exec("DELETE FROM bb_rate_limits WHERE name = $1", name)
+	}()
+
+	// The burst can be sent immediately, after which requests are spaced by the interval
+	for i := 0; i < 2; i++ {
+		d, err := store.reserve(name, b)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), d)
+	}
+	d, err := store.reserve(name, b)
+	assert.NoError(t, err)
+	assert.InDelta(t, float64(time.Second), float64(d), float64(100*time.Millisecond))
+
+	// A pause holds back every request until it is over
+	assert.NoError(t, store.pause(name, b, 10*time.Second))
+	d, err = store.reserve(name, b)
+	assert.NoError(t, err)
+	assert.InDelta(t, float64(10*time.Second), float64(d), float64(100*time.Millisecond))
+}
@@ -9,5 +9,11 @@ const ImportInprog = "In-Progress"
 const ImportComplete = "Completed"
 const ImportFail = "Failed"
 
+// ImportPurging marks a CCLF file whose data is being purged, so it is no longer used while it is partly deleted
+const ImportPurging = "Purging"
+
+// ImportSuperseded marks a CCLF file that was replaced by another delivery, so it is no longer used
+const ImportSuperseded = "Superseded"
+
 // This is set during compilation.  See build_and_package.sh in the ops repo
 var Version = "latest"
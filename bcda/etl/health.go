@@ -0,0 +1,41 @@
+package etl
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/CMSgov/bcda-app/bcda/health"
+)
+
+type healthResponse struct {
+	Database string `json:"database"`
+	Status
+}
+
+// HealthCheck reports the database's health and the watcher's status. It responds with 502 Bad Gateway when the
+// database is unavailable or a source's directory cannot be polled.
+func (w *Watcher) HealthCheck(rw http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Database: "ok", Status: w.Status()}
+	code := http.StatusOK
+	if !health.IsDatabaseOK() {
+		resp.Database = "error"
+		code = http.StatusBadGateway
+	}
+	for _, s := range resp.Sources {
+		if s.Error != "" {
+			code = http.StatusBadGateway
+		}
+	}
+
+	respJSON, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	if _, err = rw.Write(respJSON); err != nil {
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
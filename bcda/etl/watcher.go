@@ -0,0 +1,306 @@
+// Package etl runs the CCLF and suppression imports continuously. A Watcher polls inbound directories and imports
+// their files once they have stopped changing, so files are ingested as soon as they are delivered instead of when
+// someone runs an import command.
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ImportFunc imports the files in a directory, like cclf.ImportCCLFDirectory
+type ImportFunc func(dir string) (success, failure, skipped int, err error)
+
+// Source is an inbound directory and the import that processes its files.
+type Source struct {
+	Name   string
+	Dir    string
+	Import ImportFunc
+	// LockID identifies the source's lock, so the source is only imported by one instance at a time
+	LockID int
+}
+
+// Locker takes the locks that stop more than one instance importing a source at a time.
+type Locker interface {
+	// TryLock takes the lock if it is free. It returns a function that releases the lock when it was taken.
+	TryLock(id int) (unlock func(), ok bool, err error)
+}
+
+// ImportResult is the outcome of an import.
+type ImportResult struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Success  int       `json:"success"`
+	Failure  int       `json:"failure"`
+	Skipped  int       `json:"skipped"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// SourceStatus describes what the watcher last saw and did for a source.
+type SourceStatus struct {
+	Name      string    `json:"name"`
+	Directory string    `json:"directory"`
+	LastPoll  time.Time `json:"last_poll"`
+	// Files is the number of files in the directory at the last poll, and Changed when the files last changed
+	Files   int       `json:"files"`
+	Changed time.Time `json:"changed"`
+	// Importing is set while the source's files are being imported
+	Importing  bool          `json:"importing"`
+	Imports    int           `json:"imports"`
+	LastImport *ImportResult `json:"last_import,omitempty"`
+	// Error is the last error polling the directory or taking its lock, cleared by the next successful poll
+	Error string `json:"error,omitempty"`
+}
+
+// Status describes the watcher and each of its sources.
+type Status struct {
+	Started  time.Time      `json:"started"`
+	Interval string         `json:"poll_interval"`
+	Stable   string         `json:"stable_period"`
+	Sources  []SourceStatus `json:"sources"`
+}
+
+// fileState is what is compared between polls to tell whether a file is still being written
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+type snapshot map[string]fileState
+
+func (s snapshot) equal(other snapshot) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for path, state := range s {
+		if o, ok := other[path]; !ok || o.size != state.size || !o.modTime.Equal(state.modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+type watchedSource struct {
+	Source
+	files   snapshot
+	changed time.Time
+	// processed are the files left in the directory by the last import, i.e. those that failed to import.
+	// They are imported again along with the next files to arrive, as they would be by the import command.
+	processed snapshot
+	status    SourceStatus
+}
+
+// Watcher polls the inbound directories of its sources. Once the files in a directory have not changed for the stable
+// period, it imports them while holding the source's lock. The import moves the files it processes out of the
+// directory, so after waiting for the lock another instance finds the files gone and does not import them again.
+type Watcher struct {
+	sources  []*watchedSource
+	locker   Locker
+	interval time.Duration
+	stable   time.Duration
+	started  time.Time
+	now      func() time.Time
+
+	mu sync.Mutex
+}
+
+// NewWatcher returns a watcher that polls the sources every interval and imports files that have not changed for the
+// stable period.
+func NewWatcher(locker Locker, interval, stable time.Duration, sources ...Source) *Watcher {
+	w := &Watcher{locker: locker, interval: interval, stable: stable, now: time.Now}
+	for _, s := range sources {
+		w.sources = append(w.sources, &watchedSource{
+			Source: s,
+			status: SourceStatus{Name: s.Name, Directory: s.Dir},
+		})
+	}
+	return w
+}
+
+// Run polls the sources until stop is closed. An import that is running when stop is closed is finished first.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	w.mu.Lock()
+	w.started = w.now()
+	w.mu.Unlock()
+
+	log.Infof("Watching %d ETL source(s) every %s", len(w.sources), w.interval)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		w.poll()
+		select {
+		case <-stop:
+			log.Info("Stopped watching ETL sources")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Watcher) poll() {
+	for _, s := range w.sources {
+		w.pollSource(s)
+	}
+}
+
+// pollSource imports the source's files when they are ready
+func (w *Watcher) pollSource(s *watchedSource) {
+	files, err := scan(s.Dir)
+	now := w.now()
+	w.update(s, func(st *SourceStatus) {
+		st.LastPoll = now
+		st.Error = ""
+		if err != nil {
+			st.Error = err.Error()
+		}
+	})
+	if err != nil {
+		log.Errorf("Unable to poll %s directory %s: %s", s.Name, s.Dir, err.Error())
+		return
+	}
+
+	if !files.equal(s.files) {
+		s.files, s.changed = files, now
+		w.update(s, func(st *SourceStatus) {
+			st.Files = len(files)
+			st.Changed = now
+		})
+		return
+	}
+
+	if len(files) == 0 || files.equal(s.processed) || now.Sub(s.changed) < w.stable {
+		return
+	}
+
+	unlock, ok, err := w.locker.TryLock(s.LockID)
+	if err != nil {
+		log.Errorf("Unable to lock %s directory %s: %s", s.Name, s.Dir, err.Error())
+		w.update(s, func(st *SourceStatus) { st.Error = err.Error() })
+		return
+	}
+	if !ok {
+		log.Infof("Another instance is importing %s directory %s", s.Name, s.Dir)
+		return
+	}
+	defer unlock()
+
+	// Another instance may have imported the files while this one waited for the lock
+	if current, err := scan(s.Dir); err != nil || !current.equal(files) {
+		return
+	}
+
+	w.importSource(s)
+}
+
+func (w *Watcher) importSource(s *watchedSource) {
+	result := &ImportResult{Started: w.now()}
+	w.update(s, func(st *SourceStatus) { st.Importing = true })
+	log.Infof("Importing %d file(s) from %s directory %s", len(s.files), s.Name, s.Dir)
+
+	success, failure, skipped, err := s.Import(s.Dir)
+	result.Success, result.Failure, result.Skipped = success, failure, skipped
+	if err != nil {
+		result.Error = err.Error()
+		log.Errorf("Failed to import %s directory %s: %s", s.Name, s.Dir, err.Error())
+	}
+	result.Finished = w.now()
+	log.Infof("Imported %s directory %s: %d succeeded, %d failed, %d skipped", s.Name, s.Dir, success, failure, skipped)
+
+	// Files that could not be imported stay in the directory; they are not imported again until new files arrive
+	remaining, err := scan(s.Dir)
+	if err != nil {
+		remaining = nil
+	}
+	s.files, s.processed, s.changed = remaining, remaining, result.Finished
+	w.update(s, func(st *SourceStatus) {
+		st.Importing = false
+		st.Imports++
+		st.LastImport = result
+		st.Files = len(remaining)
+		st.Changed = result.Finished
+	})
+}
+
+func (w *Watcher) update(s *watchedSource, f func(*SourceStatus)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f(&s.status)
+}
+
+// Status returns the current status of the watcher.
+func (w *Watcher) Status() Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := Status{Started: w.started, Interval: w.interval.String(), Stable: w.stable.String()}
+	for _, s := range w.sources {
+		st := s.status
+		if st.LastImport != nil {
+			result := *st.LastImport
+			st.LastImport = &result
+		}
+		status.Sources = append(status.Sources, st)
+	}
+	return status
+}
+
+// scan returns the state of each file under the directory
+func scan(dir string) (snapshot, error) {
+	files := make(snapshot)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files[path] = fileState{size: info.Size(), modTime: info.ModTime()}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// etlLockKey is the advisory lock key of the ETL sources, which use the source's LockID as the second key.
+// The two key form of the lock cannot collide with the job IDs locked by que.
+const etlLockKey = 20201001
+
+// pgLocker takes Postgres session advisory locks, each held on a connection of its own until it is released.
+type pgLocker struct {
+	db *sql.DB
+}
+
+// NewPostgresLocker returns a Locker backed by Postgres advisory locks, which are released if the instance holding
+// them dies.
+func NewPostgresLocker(db *sql.DB) Locker {
+	return &pgLocker{db: db}
+}
+
+func (l *pgLocker) TryLock(id int) (func(), bool, error) {
+	ctx := context.Background()
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1::int, $2::int)", etlLockKey, id).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	if !locked {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	return func() {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1::int, $2::int)", etlLockKey, id); err != nil {
+			log.Errorf("Unable to release ETL lock %d: %s", id, err.Error())
+		}
+		conn.Close()
+	}, true, nil
+}
@@ -0,0 +1,201 @@
+package etl
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type fakeLocker struct {
+	held  bool
+	locks int
+	err   error
+}
+
+func (l *fakeLocker) TryLock(id int) (func(), bool, error) {
+	if l.err != nil || l.held {
+		return nil, false, l.err
+	}
+	l.held = true
+	l.locks++
+	return func() { l.held = false }, true, nil
+}
+
+type WatcherTestSuite struct {
+	suite.Suite
+	dir     string
+	now     time.Time
+	locker  *fakeLocker
+	imports int
+	// keep lists the files the fake import leaves in the directory, as if they failed to import
+	keep    map[string]bool
+	watcher *Watcher
+}
+
+func (s *WatcherTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "etl")
+	s.NoError(err)
+	s.dir = dir
+	s.now = time.Now()
+	s.locker = &fakeLocker{}
+	s.imports = 0
+	s.keep = make(map[string]bool)
+
+	importDir := func(dir string) (success, failure, skipped int, err error) {
+		s.imports++
+		files, err := ioutil.ReadDir(dir)
+		s.NoError(err)
+		for _, f := range files {
+			if s.keep[f.Name()] {
+				failure++
+				continue
+			}
+			s.NoError(os.Remove(filepath.Join(dir, f.Name())))
+			success++
+		}
+		if failure > 0 {
+			err = errors.New("one or more files failed to import correctly")
+		}
+		return success, failure, 0, err
+	}
+
+	s.watcher = NewWatcher(s.locker, time.Minute, 5*time.Minute, Source{Name: "cclf", Dir: dir, Import: importDir, LockID: 1})
+	s.watcher.now = func() time.Time { return s.now }
+}
+
+func (s *WatcherTestSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func TestWatcherTestSuite(t *testing.T) {
+	suite.Run(t, new(WatcherTestSuite))
+}
+
+func (s *WatcherTestSuite) write(name, content string) {
+	s.NoError(ioutil.WriteFile(filepath.Join(s.dir, name), []byte(content), 0600))
+}
+
+// pollAfter advances the clock and polls
+func (s *WatcherTestSuite) pollAfter(d time.Duration) {
+	s.now = s.now.Add(d)
+	s.watcher.poll()
+}
+
+func (s *WatcherTestSuite) TestImportsStableFiles() {
+	s.pollAfter(0)
+	s.Equal(0, s.imports, "nothing to import")
+
+	s.write("a", "1")
+	s.pollAfter(time.Minute)
+	s.pollAfter(4 * time.Minute)
+	s.Equal(0, s.imports, "not stable for long enough")
+
+	// Still being written
+	s.write("a", "12")
+	s.pollAfter(time.Minute)
+	s.pollAfter(4 * time.Minute)
+	s.Equal(0, s.imports)
+
+	s.pollAfter(time.Minute)
+	s.Equal(1, s.imports)
+	s.False(s.locker.held, "lock is released")
+
+	status := s.watcher.Status().Sources[0]
+	s.Equal(1, status.Imports)
+	s.Equal(0, status.Files)
+	s.False(status.Importing)
+	s.Equal(1, status.LastImport.Success)
+	s.Empty(status.LastImport.Error)
+
+	// Nothing is imported again
+	s.pollAfter(10 * time.Minute)
+	s.pollAfter(10 * time.Minute)
+	s.Equal(1, s.imports)
+}
+
+func (s *WatcherTestSuite) TestFailedFilesWaitForNewFiles() {
+	s.keep["bad"] = true
+	s.write("bad", "1")
+	s.pollAfter(0)
+	s.pollAfter(5 * time.Minute)
+	s.Equal(1, s.imports)
+
+	status := s.watcher.Status().Sources[0]
+	s.Equal(1, status.LastImport.Failure)
+	s.Equal("one or more files failed to import correctly", status.LastImport.Error)
+	s.Equal(1, status.Files)
+
+	// The file that failed is not imported on its own again
+	s.pollAfter(10 * time.Minute)
+	s.pollAfter(10 * time.Minute)
+	s.Equal(1, s.imports)
+
+	s.write("good", "1")
+	s.pollAfter(time.Minute)
+	s.pollAfter(5 * time.Minute)
+	s.Equal(2, s.imports)
+	s.Equal(1, s.watcher.Status().Sources[0].LastImport.Success)
+}
+
+func (s *WatcherTestSuite) TestLockedByAnotherInstance() {
+	s.write("a", "1")
+	s.pollAfter(0)
+
+	s.locker.held = true
+	s.pollAfter(5 * time.Minute)
+	s.Equal(0, s.imports)
+
+	// The other instance imported the files
+	s.NoError(os.Remove(filepath.Join(s.dir, "a")))
+	s.locker.held = false
+	s.pollAfter(time.Minute)
+	s.pollAfter(5 * time.Minute)
+	s.Equal(0, s.imports)
+	s.Equal(0, s.locker.locks)
+
+	// The lock cannot be taken
+	s.write("b", "1")
+	s.locker.err = errors.New("connection refused")
+	s.pollAfter(time.Minute)
+	s.pollAfter(5 * time.Minute)
+	s.Equal(0, s.imports)
+	s.Equal("connection refused", s.watcher.Status().Sources[0].Error)
+
+	s.locker.err = nil
+	s.pollAfter(time.Minute)
+	s.Equal(1, s.imports)
+	s.Empty(s.watcher.Status().Sources[0].Error)
+}
+
+func (s *WatcherTestSuite) TestMissingDirectory() {
+	s.NoError(os.RemoveAll(s.dir))
+	s.pollAfter(0)
+	s.NotEmpty(s.watcher.Status().Sources[0].Error)
+	s.Equal(0, s.imports)
+}
+
+func (s *WatcherTestSuite) TestRun() {
+	s.write("a", "1")
+	s.watcher.stable = 0
+	s.watcher.interval = time.Millisecond
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.watcher.Run(stop)
+		close(done)
+	}()
+
+	for i := 0; i < 1000 && s.watcher.Status().Sources[0].Imports == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+	s.Equal(1, s.watcher.Status().Sources[0].Imports)
+	s.False(s.watcher.Status().Started.IsZero())
+}
@@ -0,0 +1,249 @@
+// Package fixedwidth parses the fixed-width records of the files BCDA imports (CCLF and 1-800-MEDICARE suppression
+// files) using declared record layouts, instead of slicing each line at hard-coded offsets.
+//
+// A Layout lists the fields of a record. Parsing a line checks every field and reports all of the fields that could
+// not be parsed, so a short or malformed line results in an error rather than a panic.
+package fixedwidth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldType is the type a field's value is parsed as.
+type FieldType int
+
+const (
+	// String fields hold the field's text with surrounding spaces removed
+	String FieldType = iota
+	// Int fields hold a (possibly signed) base 10 integer. A blank field is 0.
+	Int
+	// Date fields hold a date in the field's Format. A blank field is the zero time.
+	Date
+)
+
+// DefaultDateFormat is used for Date fields that do not declare a Format
+const DefaultDateFormat = "20060102"
+
+// Field describes one field of a record.
+type Field struct {
+	Name string
+	// Offset is the zero-based position of the field's first byte in the line
+	Offset int
+	Length int
+	Type   FieldType
+	// Format is the time layout of a Date field
+	Format string
+	// Required fields cannot be blank or missing from the line
+	Required bool
+}
+
+func (f Field) end() int {
+	return f.Offset + f.Length
+}
+
+// Layout describes the fields of a type of record.
+type Layout struct {
+	Name   string
+	fields []Field
+	byName map[string]int
+}
+
+// NewLayout returns the layout of the fields, which must have unique names, positive lengths and must not overlap.
+func NewLayout(name string, fields ...Field) (*Layout, error) {
+	l := &Layout{Name: name, byName: make(map[string]int, len(fields))}
+	for i, f := range fields {
+		if f.Name == "" {
+			return nil, fmt.Errorf("%s layout: field %d has no name", name, i)
+		}
+		if _, ok := l.byName[f.Name]; ok {
+			return nil, fmt.Errorf("%s layout: duplicate field %s", name, f.Name)
+		}
+		if f.Offset < 0 || f.Length <= 0 {
+			return nil, fmt.Errorf("%s layout: field %s has invalid offset %d or length %d", name, f.Name, f.Offset, f.Length)
+		}
+		if f.Type == Date && f.Format == "" {
+			f.Format = DefaultDateFormat
+		}
+		for _, other := range l.fields {
+			if f.Offset < other.end() && other.Offset < f.end() {
+				return nil, fmt.Errorf("%s layout: field %s overlaps field %s", name, f.Name, other.Name)
+			}
+		}
+		l.byName[f.Name] = len(l.fields)
+		l.fields = append(l.fields, f)
+	}
+	return l, nil
+}
+
+// MustLayout is like NewLayout but panics if the layout is invalid. It simplifies declaring layouts as variables.
+func MustLayout(name string, fields ...Field) *Layout {
+	l, err := NewLayout(name, fields...)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// Length is the length of a line holding every field of the layout.
+func (l *Layout) Length() int {
+	length := 0
+	for _, f := range l.fields {
+		if f.end() > length {
+			length = f.end()
+		}
+	}
+	return length
+}
+
+// Parse parses the fields of the line. The record holds every field that could be parsed even when an error is
+// returned, in which case the error is a *RecordError listing the fields that could not be.
+func (l *Layout) Parse(line []byte) (Record, error) {
+	r := Record{layout: l, values: make([]interface{}, len(l.fields))}
+	var errs []*FieldError
+	for i, f := range l.fields {
+		v, err := f.parse(line)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		r.values[i] = v
+	}
+	if len(errs) > 0 {
+		return r, &RecordError{Layout: l.Name, Fields: errs}
+	}
+	return r, nil
+}
+
+func (f Field) parse(line []byte) (interface{}, *FieldError) {
+	if f.Offset >= len(line) {
+		if f.Required {
+			return nil, f.error("", fmt.Errorf("line is too short (%d bytes)", len(line)))
+		}
+		return f.zero(), nil
+	}
+
+	end := f.end()
+	if end > len(line) {
+		end = len(line)
+	}
+	value := strings.TrimSpace(string(line[f.Offset:end]))
+	if value == "" {
+		if f.Required {
+			return nil, f.error(value, fmt.Errorf("value is required"))
+		}
+		return f.zero(), nil
+	}
+
+	switch f.Type {
+	case Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, f.error(value, fmt.Errorf("not an integer"))
+		}
+		return i, nil
+	case Date:
+		t, err := time.Parse(f.Format, value)
+		if err != nil {
+			return nil, f.error(value, err)
+		}
+		return t, nil
+	default:
+		return value, nil
+	}
+}
+
+func (f Field) zero() interface{} {
+	switch f.Type {
+	case Int:
+		return 0
+	case Date:
+		return time.Time{}
+	default:
+		return ""
+	}
+}
+
+func (f Field) error(value string, err error) *FieldError {
+	return &FieldError{Field: f.Name, Offset: f.Offset, Length: f.Length, Value: value, Err: err}
+}
+
+// Record holds the values of a parsed line.
+// Its accessors panic if the layout has no such field or the field is of another type.
+type Record struct {
+	layout *Layout
+	values []interface{}
+}
+
+func (r Record) value(name string, t FieldType) interface{} {
+	i, ok := r.layout.byName[name]
+	if !ok {
+		panic(fmt.Sprintf("fixedwidth: %s layout has no field %s", r.layout.Name, name))
+	}
+	if r.layout.fields[i].Type != t {
+		panic(fmt.Sprintf("fixedwidth: field %s of %s layout is of another type", name, r.layout.Name))
+	}
+	if r.values[i] == nil {
+		return r.layout.fields[i].zero()
+	}
+	return r.values[i]
+}
+
+// String returns the value of the String field.
+func (r Record) String(name string) string {
+	return r.value(name, String).(string)
+}
+
+// Int returns the value of the Int field.
+func (r Record) Int(name string) int {
+	return r.value(name, Int).(int)
+}
+
+// Time returns the value of the Date field.
+func (r Record) Time(name string) time.Time {
+	return r.value(name, Date).(time.Time)
+}
+
+// FieldError describes a field that could not be parsed.
+type FieldError struct {
+	Field  string
+	Offset int
+	Length int
+	// Value is the field's text, with surrounding spaces removed
+	Value string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field %s (offset %d, length %d) value '%s': %s", e.Field, e.Offset, e.Length, e.Value, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// RecordError lists the fields of a line that could not be parsed, in layout order.
+type RecordError struct {
+	Layout string
+	Fields []*FieldError
+}
+
+func (e *RecordError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return fmt.Sprintf("invalid %s record: %s", e.Layout, strings.Join(msgs, "; "))
+}
+
+// Field returns the error of the named field, or nil if the field was parsed.
+func (e *RecordError) Field(name string) *FieldError {
+	for _, f := range e.Fields {
+		if f.Field == name {
+			return f
+		}
+	}
+	return nil
+}
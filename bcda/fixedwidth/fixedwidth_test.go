@@ -0,0 +1,80 @@
+package fixedwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testLayout = MustLayout("test",
+	Field{Name: "id", Offset: 0, Length: 5, Required: true},
+	Field{Name: "count", Offset: 5, Length: 4, Type: Int},
+	Field{Name: "date", Offset: 9, Length: 8, Type: Date},
+	Field{Name: "isoDate", Offset: 17, Length: 10, Type: Date, Format: "2006-01-02"},
+	Field{Name: "note", Offset: 27, Length: 6},
+)
+
+func TestParse(t *testing.T) {
+	r, err := testLayout.Parse([]byte("A0001  12201912312020-01-02 hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "A0001", r.String("id"))
+	assert.Equal(t, 12, r.Int("count"))
+	assert.Equal(t, time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC), r.Time("date"))
+	assert.Equal(t, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), r.Time("isoDate"))
+	assert.Equal(t, "hello", r.String("note"))
+	assert.Equal(t, 33, testLayout.Length())
+
+	// Fields that are blank or beyond the end of the line are zero unless they are required
+	r, err = testLayout.Parse([]byte("A0001    "))
+	require.NoError(t, err)
+	assert.Equal(t, 0, r.Int("count"))
+	assert.True(t, r.Time("date").IsZero())
+	assert.Empty(t, r.String("note"))
+}
+
+func TestParseErrors(t *testing.T) {
+	r, err := testLayout.Parse([]byte("     12a 20191301"))
+	require.Error(t, err)
+	recordErr, ok := err.(*RecordError)
+	require.True(t, ok)
+	assert.Len(t, recordErr.Fields, 3)
+	assert.Equal(t, "value is required", recordErr.Field("id").Err.Error())
+	assert.Equal(t, "12a", recordErr.Field("count").Value)
+	assert.Equal(t, "20191301", recordErr.Field("date").Value)
+	assert.Nil(t, recordErr.Field("note"))
+	assert.Contains(t, err.Error(), "invalid test record: field id (offset 0, length 5) value '': value is required; field count (offset 5, length 4) value '12a': not an integer")
+
+	// The fields that were parsed are still available
+	assert.True(t, r.Time("isoDate").IsZero())
+	assert.Equal(t, 0, r.Int("count"))
+
+	_, err = testLayout.Parse([]byte("A00"))
+	assert.NoError(t, err, "a required field that is partly present is parsed")
+	_, err = testLayout.Parse(nil)
+	assert.EqualError(t, err, "invalid test record: field id (offset 0, length 5) value '': line is too short (0 bytes)")
+}
+
+func TestNewLayout(t *testing.T) {
+	_, err := NewLayout("bad", Field{Name: "a", Offset: 0, Length: 5}, Field{Name: "b", Offset: 4, Length: 2})
+	assert.EqualError(t, err, "bad layout: field b overlaps field a")
+
+	_, err = NewLayout("bad", Field{Name: "a", Offset: 0, Length: 5}, Field{Name: "a", Offset: 5, Length: 2})
+	assert.EqualError(t, err, "bad layout: duplicate field a")
+
+	_, err = NewLayout("bad", Field{Name: "a", Offset: 0, Length: 0})
+	assert.EqualError(t, err, "bad layout: field a has invalid offset 0 or length 0")
+
+	_, err = NewLayout("bad", Field{Offset: 0, Length: 1})
+	assert.EqualError(t, err, "bad layout: field 0 has no name")
+
+	assert.Panics(t, func() { MustLayout("bad", Field{Name: "a", Offset: -1, Length: 1}) })
+}
+
+func TestRecordAccessors(t *testing.T) {
+	r, err := testLayout.Parse([]byte("A0001"))
+	require.NoError(t, err)
+	assert.Panics(t, func() { r.String("missing") })
+	assert.Panics(t, func() { r.Int("id") })
+}
@@ -44,3 +44,8 @@ func IsBlueButtonOK() bool {
 
 	return true
 }
+
+// BlueButtonBreakerState returns the state of the circuit breaker guarding this process's Blue Button requests.
+func BlueButtonBreakerState() string {
+	return client.CircuitBreakerState()
+}
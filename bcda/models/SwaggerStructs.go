@@ -45,6 +45,13 @@ type NotFoundResponse struct {
 	Body OperationOutcomeResponse
 }
 
+// The beneficiaries added to, removed from and retained in the ACO's attribution between two CCLF8 files
+// swagger:response attributionDiffResponse
+type AttributionDiffResponse struct {
+	// in: body
+	Body AttributionDiff
+}
+
 // There was a problem with the request. The body will contain a FHIR OperationOutcome resource in JSON format. https://www.hl7.org/fhir/operationoutcome.html Please refer to the body of the response for details.
 // swagger:response badRequestResponse
 type BadRequestResponse struct {
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/CMSgov/bcda-app/bcda/constants"
+	fhirmodels "github.com/eug48/fhir/models"
+	"github.com/pkg/errors"
+)
+
+// ErrCCLFFileNotFound is the cause of the error returned when an ACO has no such imported CCLF8 file
+var ErrCCLFFileNotFound = errors.New("CCLF8 file not found")
+
+// mbiSystem is the identifier system of the MBIs in Group members
+const mbiSystem = "http://hl7.org/fhir/sid/us-mbi"
+
+// AttributionFile identifies a CCLF8 file in an attribution diff.
+type AttributionFile struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// AttributionDiff lists the MBIs of the beneficiaries that were added to, removed from and retained in an ACO's
+// attribution between two of its CCLF8 files.
+type AttributionDiff struct {
+	CMSID    string          `json:"aco_id"`
+	From     AttributionFile `json:"from"`
+	To       AttributionFile `json:"to"`
+	Added    []string        `json:"added"`
+	Removed  []string        `json:"removed"`
+	Retained []string        `json:"retained"`
+}
+
+func (s *service) GetAttributionDiff(cmsID string, fromFileID, toFileID uint) (*AttributionDiff, error) {
+	to, err := s.getAttributionFile(cmsID, toFileID, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	// The file before the latest one is the one with the latest timestamp before it
+	from, err := s.getAttributionFile(cmsID, fromFileID, to.Timestamp.Add(-time.Microsecond))
+	if err != nil {
+		return nil, err
+	}
+
+	fromBenes, err := s.getBenes(from.ID)
+	if err != nil {
+		return nil, err
+	}
+	toBenes, err := s.getBenes(to.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &AttributionDiff{
+		CMSID:    cmsID,
+		From:     AttributionFile{ID: from.ID, Name: from.Name, Timestamp: from.Timestamp},
+		To:       AttributionFile{ID: to.ID, Name: to.Name, Timestamp: to.Timestamp},
+		Added:    []string{},
+		Removed:  []string{},
+		Retained: []string{},
+	}
+
+	fromMBIs := make(map[string]struct{}, len(fromBenes))
+	for _, bene := range fromBenes {
+		fromMBIs[bene.MBI] = struct{}{}
+	}
+	toMBIs := make(map[string]struct{}, len(toBenes))
+	for _, bene := range toBenes {
+		toMBIs[bene.MBI] = struct{}{}
+		if _, ok := fromMBIs[bene.MBI]; ok {
+			diff.Retained = append(diff.Retained, bene.MBI)
+		} else {
+			diff.Added = append(diff.Added, bene.MBI)
+		}
+	}
+	for _, bene := range fromBenes {
+		if _, ok := toMBIs[bene.MBI]; !ok {
+			diff.Removed = append(diff.Removed, bene.MBI)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Retained)
+	return diff, nil
+}
+
+// getAttributionFile returns the ACO's imported CCLF8 file with the ID or, when there is no ID, its latest one at or
+// before the upper bound
+func (s *service) getAttributionFile(cmsID string, id uint, upperBound time.Time) (*CCLFFile, error) {
+	var (
+		cclfFile *CCLFFile
+		err      error
+	)
+	if id != 0 {
+		cclfFile, err = s.repository.GetCCLFFileByID(id)
+	} else {
+		cclfFile, err = s.repository.GetLatestCCLFFile(cmsID, cclf8FileNum, constants.ImportComplete, time.Time{}, upperBound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CCLF file for cmsID %s %s", cmsID, err.Error())
+	}
+
+	if cclfFile == nil || cclfFile.ACOCMSID != cmsID || cclfFile.CCLFNum != cclf8FileNum || cclfFile.ImportStatus != constants.ImportComplete {
+		if id != 0 {
+			return nil, errors.Wrapf(ErrCCLFFileNotFound, "no imported CCLF8 file %d for cmsID %s", id, cmsID)
+		}
+		return nil, errors.Wrapf(ErrCCLFFileNotFound, "no imported CCLF8 file for cmsID %s to compare", cmsID)
+	}
+	return cclfFile, nil
+}
+
+// Groups returns the added, removed and retained beneficiaries as FHIR Groups whose members are identified by MBI.
+func (d *AttributionDiff) Groups() []*fhirmodels.Group {
+	actual := true
+	group := func(category string, mbis []string) *fhirmodels.Group {
+		quantity := uint32(len(mbis))
+		g := &fhirmodels.Group{
+			Type:     "person",
+			Actual:   &actual,
+			Name:     fmt.Sprintf("Beneficiaries %s by ACO %s between CCLF8 files %s and %s", category, d.CMSID, d.From.Name, d.To.Name),
+			Quantity: &quantity,
+			Member:   make([]fhirmodels.GroupMemberComponent, len(mbis)),
+		}
+		g.ResourceType = "Group"
+		g.Id = fmt.Sprintf("%s-%s-%d-%d", d.CMSID, category, d.From.ID, d.To.ID)
+		for i, mbi := range mbis {
+			g.Member[i].Entity = &fhirmodels.Reference{Identifier: &fhirmodels.Identifier{System: mbiSystem, Value: mbi}}
+		}
+		return g
+	}
+
+	return []*fhirmodels.Group{
+		group("added", d.Added),
+		group("removed", d.Removed),
+		group("retained", d.Retained),
+	}
+}
+
+// WriteNDJSON writes the diff's Groups, one per line.
+func (d *AttributionDiff) WriteNDJSON(w io.Writer) error {
+	for _, g := range d.Groups() {
+		b, err := json.Marshal(g)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CMSgov/bcda-app/bcda/constants"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func (s *ServiceTestSuite) TestGetAttributionDiff() {
+	const cmsID = "A0001"
+	timestamp := time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC)
+	cclf8 := func(id uint, cmsID string, status string, timestamp time.Time) *CCLFFile {
+		f := getCCLFFile(id)
+		f.CCLFNum, f.ACOCMSID, f.ImportStatus, f.Timestamp = 8, cmsID, status, timestamp
+		f.Name = "T.BCD.A0001.ZC8Y20.D201001.T1000000"
+		return f
+	}
+	latest := cclf8(2, cmsID, constants.ImportComplete, timestamp)
+	previous := cclf8(1, cmsID, constants.ImportComplete, timestamp.AddDate(0, -1, 0))
+
+	tests := []struct {
+		name        string
+		from, to    uint
+		setup       func(r *MockRepository)
+		expectedErr string
+	}{
+		{
+			"LatestAndPrevious",
+			0, 0,
+			func(r *MockRepository) {
+				r.On("GetLatestCCLFFile", cmsID, cclf8FileNum, constants.ImportComplete, time.Time{}, time.Time{}).Return(latest, nil)
+				r.On("GetLatestCCLFFile", cmsID, cclf8FileNum, constants.ImportComplete, time.Time{}, timestamp.Add(-time.Microsecond)).Return(previous, nil)
+			},
+			"",
+		},
+		{
+			"FileIDs",
+			1, 2,
+			func(r *MockRepository) {
+				r.On("GetCCLFFileByID", uint(2)).Return(latest, nil)
+				r.On("GetCCLFFileByID", uint(1)).Return(previous, nil)
+			},
+			"",
+		},
+		{
+			"NoPreviousFile",
+			0, 0,
+			func(r *MockRepository) {
+				r.On("GetLatestCCLFFile", cmsID, cclf8FileNum, constants.ImportComplete, time.Time{}, time.Time{}).Return(latest, nil)
+				r.On("GetLatestCCLFFile", cmsID, cclf8FileNum, constants.ImportComplete, time.Time{}, mock.Anything).Return(nil, nil)
+			},
+			"no imported CCLF8 file for cmsID A0001 to compare",
+		},
+		{
+			"OtherACOsFile",
+			1, 0,
+			func(r *MockRepository) {
+				r.On("GetLatestCCLFFile", cmsID, cclf8FileNum, constants.ImportComplete, time.Time{}, time.Time{}).Return(latest, nil)
+				r.On("GetCCLFFileByID", uint(1)).Return(cclf8(1, "A0002", constants.ImportComplete, timestamp), nil)
+			},
+			"no imported CCLF8 file 1 for cmsID A0001",
+		},
+		{
+			"FailedFile",
+			0, 3,
+			func(r *MockRepository) {
+				r.On("GetCCLFFileByID", uint(3)).Return(cclf8(3, cmsID, constants.ImportFail, timestamp), nil)
+			},
+			"no imported CCLF8 file 3 for cmsID A0001",
+		},
+	}
+
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			repository := &MockRepository{}
+			tt.setup(repository)
+			repository.On("GetSuppressedMBIs", 30).Return([]string{"suppressedMBI"}, nil)
+			repository.On("GetCCLFBeneficiaries", previous.ID, []string{"suppressedMBI"}).Return([]*CCLFBeneficiary{
+				getCCLFBeneficiary(1, "MBI1"), getCCLFBeneficiary(2, "MBI2"), getCCLFBeneficiary(3, "MBI3"),
+			}, nil)
+			repository.On("GetCCLFBeneficiaries", latest.ID, []string{"suppressedMBI"}).Return([]*CCLFBeneficiary{
+				getCCLFBeneficiary(4, "MBI4"), getCCLFBeneficiary(5, "MBI3"), getCCLFBeneficiary(6, "MBI1"),
+			}, nil)
+
+			diff, err := newService(repository, time.Hour, 30).GetAttributionDiff(cmsID, tt.from, tt.to)
+			if tt.expectedErr != "" {
+				assert.EqualError(t, err, tt.expectedErr+": "+ErrCCLFFileNotFound.Error())
+				assert.Equal(t, ErrCCLFFileNotFound, errors.Cause(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, cmsID, diff.CMSID)
+			assert.Equal(t, AttributionFile{ID: previous.ID, Name: previous.Name, Timestamp: previous.Timestamp}, diff.From)
+			assert.Equal(t, AttributionFile{ID: latest.ID, Name: latest.Name, Timestamp: latest.Timestamp}, diff.To)
+			assert.Equal(t, []string{"MBI4"}, diff.Added)
+			assert.Equal(t, []string{"MBI2"}, diff.Removed)
+			assert.Equal(t, []string{"MBI1", "MBI3"}, diff.Retained)
+		})
+	}
+}
+
+func TestAttributionDiffNDJSON(t *testing.T) {
+	diff := &AttributionDiff{
+		CMSID:    "A0001",
+		From:     AttributionFile{ID: 1, Name: "from"},
+		To:       AttributionFile{ID: 2, Name: "to"},
+		Added:    []string{"MBI4"},
+		Removed:  []string{},
+		Retained: []string{"MBI1", "MBI3"},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, diff.WriteNDJSON(&buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 3)
+
+	type group struct {
+		ResourceType string `json:"resourceType"`
+		ID           string `json:"id"`
+		Type         string `json:"type"`
+		Actual       bool   `json:"actual"`
+		Quantity     int    `json:"quantity"`
+		Member       []struct {
+			Entity struct {
+				Identifier struct {
+					System string `json:"system"`
+					Value  string `json:"value"`
+				} `json:"identifier"`
+			} `json:"entity"`
+		} `json:"member"`
+	}
+	var groups []group
+	for _, line := range lines {
+		var g group
+		assert.NoError(t, json.Unmarshal([]byte(line), &g))
+		assert.Equal(t, "Group", g.ResourceType)
+		assert.Equal(t, "person", g.Type)
+		assert.True(t, g.Actual)
+		assert.Equal(t, g.Quantity, len(g.Member))
+		groups = append(groups, g)
+	}
+
+	assert.Equal(t, "A0001-added-1-2", groups[0].ID)
+	assert.Equal(t, "A0001-removed-1-2", groups[1].ID)
+	assert.Equal(t, "A0001-retained-1-2", groups[2].ID)
+	assert.Equal(t, "http://hl7.org/fhir/sid/us-mbi", groups[0].Member[0].Entity.Identifier.System)
+	assert.Equal(t, "MBI4", groups[0].Member[0].Entity.Identifier.Value)
+	assert.Empty(t, groups[1].Member)
+	assert.Equal(t, "MBI3", groups[2].Member[1].Entity.Identifier.Value)
+}
@@ -15,11 +15,13 @@ type Resource struct {
 
 type Bundle struct {
 	Resource
-	Links []struct {
-		Relation string `json:"relation"`
-		URL      string `json:"url"`
-	} `json:"link"`
+	Links   []Link        `json:"link"`
 	Entries []BundleEntry `json:"entry"`
 }
 
+type Link struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
 type BundleEntry map[string]interface{}
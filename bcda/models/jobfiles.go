@@ -0,0 +1,328 @@
+package models
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/CMSgov/bcda-app/bcda/storage"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// fileLimits bound the files a job's output is consolidated into. Zero means no limit.
+type fileLimits struct {
+	bytes int64
+	lines int
+}
+
+// exportFileLimits returns the limits from BCDA_EXPORT_MAX_FILE_BYTES and BCDA_EXPORT_MAX_FILE_LINES, which can be
+// overridden for a resource type by adding the type to the name (e.g. BCDA_EXPORT_MAX_FILE_LINES_PATIENT).
+func exportFileLimits(resourceType string) fileLimits {
+	l := fileLimits{
+		bytes: int64(utils.GetEnvInt("BCDA_EXPORT_MAX_FILE_BYTES", 0)),
+		lines: utils.GetEnvInt("BCDA_EXPORT_MAX_FILE_LINES", 0),
+	}
+	if resourceType != "" {
+		suffix := "_" + strings.ToUpper(resourceType)
+		l.bytes = int64(utils.GetEnvInt("BCDA_EXPORT_MAX_FILE_BYTES"+suffix, int(l.bytes)))
+		l.lines = utils.GetEnvInt("BCDA_EXPORT_MAX_FILE_LINES"+suffix, l.lines)
+	}
+	return l
+}
+
+// enabled reports whether the chunk files should be consolidated at all
+func (l fileLimits) enabled() bool {
+	return l.bytes > 0 || l.lines > 0
+}
+
+// full reports whether a file holding the given bytes and lines has no room for another line of size next.
+// A file always takes at least one line, even one larger than the limit.
+func (l fileLimits) full(bytes int64, lines int, next int) bool {
+	if lines == 0 {
+		return false
+	}
+	return (l.lines > 0 && lines >= l.lines) || (l.bytes > 0 && bytes+int64(next) > l.bytes)
+}
+
+// consolidation is the chunk files of a resource type and the files they were consolidated into
+type consolidation struct {
+	chunks []JobKey
+	names  []string
+}
+
+// consolidateJobFiles writes the chunk files of each resource type in the job's staging directory into new files
+// bounded by the limits for the type. Each chunk's error file is appended to the error file of the type's first new
+// file. The chunk files and the job keys are left as they are; replaceJobKeys publishes the new files.
+// When a type cannot be consolidated its chunk files are published as they are.
+func consolidateJobFiles(store storage.Storage, jobDir string, keys []JobKey) []consolidation {
+	var types []string
+	byType := make(map[string][]JobKey)
+	for _, key := range keys {
+		if _, ok := byType[key.ResourceType]; !ok {
+			types = append(types, key.ResourceType)
+		}
+		byType[key.ResourceType] = append(byType[key.ResourceType], key)
+	}
+
+	var consolidated []consolidation
+	for _, resourceType := range types {
+		chunks := byType[resourceType]
+		limits := exportFileLimits(resourceType)
+		if !limits.enabled() {
+			continue
+		}
+
+		names, err := consolidateFiles(store, jobDir, chunks, limits)
+		if err != nil {
+			log.Errorf("Failed to consolidate %s files in %s, publishing them unchanged: %s", resourceType, jobDir, err.Error())
+			continue
+		}
+		log.Infof("Consolidated %d %s files into %d in %s", len(chunks), resourceType, len(names), jobDir)
+		consolidated = append(consolidated, consolidation{chunks: chunks, names: names})
+	}
+	return consolidated
+}
+
+// consolidateFiles writes the lines of the chunk files into new files that are within the limits and returns
+// their names. Nothing is left behind if it fails.
+func consolidateFiles(store storage.Storage, jobDir string, chunks []JobKey, limits fileLimits) (names []string, err error) {
+	var (
+		w     io.WriteCloser
+		bytes int64
+		lines int
+	)
+	defer func() {
+		if w != nil {
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			for _, name := range names {
+				deleteJobFile(store, storage.Staging, jobDir, name)
+			}
+			names = nil
+		}
+	}()
+
+	next := func() error {
+		if w != nil {
+			err := w.Close()
+			w = nil
+			if err != nil {
+				return err
+			}
+		}
+		name := uuid.NewRandom().String() + ".ndjson"
+		f, err := store.Append(storage.Staging, jobDir+"/"+name)
+		if err != nil {
+			return err
+		}
+		w, bytes, lines = f, 0, 0
+		names = append(names, name)
+		return nil
+	}
+
+	for _, chunk := range chunks {
+		err = forEachLine(store, jobDir+"/"+strings.TrimSpace(chunk.FileName), func(line []byte) error {
+			if w == nil || limits.full(bytes, lines, len(line)) {
+				if err := next(); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			bytes += int64(len(line))
+			lines++
+			return nil
+		})
+		if err != nil {
+			return names, err
+		}
+	}
+
+	// Keep an (empty) file for the type when none of the chunks had data
+	if len(names) == 0 {
+		if err = next(); err != nil {
+			return names, err
+		}
+	}
+
+	err = appendErrorFiles(store, jobDir, chunks, names[0])
+	return names, err
+}
+
+// forEachLine calls f with each non-empty line of the staging file, including its trailing newline
+func forEachLine(store storage.Storage, name string, f func(line []byte) error) error {
+	r, err := store.Open(storage.Staging, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			if ferr := f(line); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// appendErrorFiles appends the chunks' error files, where there are any, to the error file of the named file
+func appendErrorFiles(store storage.Storage, jobDir string, chunks []JobKey, fileName string) (err error) {
+	var w io.WriteCloser
+	defer func() {
+		if w != nil {
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}()
+
+	for _, chunk := range chunks {
+		errorFile := jobDir + "/" + errorFileName(chunk.FileName)
+		exists, err := store.Exists(storage.Staging, errorFile)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if w == nil {
+			if w, err = store.Append(storage.Staging, jobDir+"/"+errorFileName(fileName)); err != nil {
+				return err
+			}
+		}
+		if err = forEachLine(store, errorFile, func(line []byte) error {
+			_, err := w.Write(line)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobFileNames returns the names of the files the job publishes, which are the consolidated files in place of the
+// chunk files they were consolidated from
+func jobFileNames(keys []JobKey, consolidated []consolidation) []string {
+	replaced := make(map[uint]bool)
+	var names []string
+	for _, c := range consolidated {
+		for _, chunk := range c.chunks {
+			replaced[chunk.ID] = true
+		}
+		names = append(names, c.names...)
+	}
+	for _, key := range keys {
+		if !replaced[key.ID] {
+			names = append(names, strings.TrimSpace(key.FileName))
+		}
+	}
+	return names
+}
+
+// replaceJobKeys replaces the keys of the consolidated chunk files with keys for the files they were consolidated
+// into. It should be called in the transaction that completes the job.
+func replaceJobKeys(db *gorm.DB, consolidated []consolidation) error {
+	for _, c := range consolidated {
+		var ids []uint
+		for _, chunk := range c.chunks {
+			ids = append(ids, chunk.ID)
+		}
+		if err := db.Unscoped().Where("id IN (?)", ids).Delete(&JobKey{}).Error; err != nil {
+			return err
+		}
+
+		for _, name := range c.names {
+			key := JobKey{JobID: c.chunks[0].JobID, FileName: name, ResourceType: c.chunks[0].ResourceType}
+			if err := db.Create(&key).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// publishJobFiles moves the job's files, and their error files, from staging to the payload. Files that are no longer
+// in staging were moved by an earlier attempt, so publishing can be retried after a move fails.
+func publishJobFiles(store storage.Storage, jobDir string, fileNames []string) error {
+	for _, fileName := range fileNames {
+		for _, name := range []string{fileName, errorFileName(fileName)} {
+			path := jobDir + "/" + name
+			staged, err := store.Exists(storage.Staging, path)
+			if err != nil {
+				return err
+			}
+			if !staged {
+				continue
+			}
+			if err = store.Move(storage.Staging, storage.Payload, path); err != nil {
+				return errors.Wrapf(err, "could not publish %s", path)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteConsolidatedFiles deletes the consolidated files, wherever they are, when the job could not be completed
+// with them
+func deleteConsolidatedFiles(store storage.Storage, jobDir string, consolidated []consolidation) {
+	for _, c := range consolidated {
+		for _, name := range c.names {
+			deleteJobFile(store, storage.Staging, jobDir, name)
+			deleteJobFile(store, storage.Payload, jobDir, name)
+		}
+	}
+}
+
+// removeStagingFiles removes the job's staging directory once the job has been completed. Besides the chunk files
+// that were consolidated, anything left in it was left behind by an abandoned attempt.
+func removeStagingFiles(store storage.Storage, jobID uint, jobDir string, consolidated []consolidation) {
+	for _, c := range consolidated {
+		for _, chunk := range c.chunks {
+			deleteJobFile(store, storage.Staging, jobDir, chunk.FileName)
+		}
+	}
+
+	files, err := store.List(storage.Staging, jobDir)
+	if err != nil {
+		log.Error(err)
+	}
+	for _, f := range files {
+		log.Warnf("Removing orphaned staging file %s for job %d", f, jobID)
+	}
+	if err = store.DeleteAll(storage.Staging, jobDir); err != nil {
+		log.Error(err)
+	}
+}
+
+// errorFileName returns the name of the file holding the OperationOutcomes for the data file
+func errorFileName(fileName string) string {
+	return strings.TrimSuffix(strings.TrimSpace(fileName), ".ndjson") + "-error.ndjson"
+}
+
+func deleteJobFile(store storage.Storage, loc storage.Location, jobDir, name string) {
+	for _, n := range []string{name, errorFileName(name)} {
+		if err := store.Delete(loc, jobDir+"/"+strings.TrimSpace(n)); err != nil {
+			log.Warn(err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/CMSgov/bcda-app/bcda/storage"
+)
+
+func TestExportFileLimits(t *testing.T) {
+	for _, k := range []string{"BCDA_EXPORT_MAX_FILE_BYTES", "BCDA_EXPORT_MAX_FILE_LINES", "BCDA_EXPORT_MAX_FILE_LINES_PATIENT"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Unsetenv(k)
+	}
+
+	assert.False(t, exportFileLimits("Patient").enabled())
+
+	os.Setenv("BCDA_EXPORT_MAX_FILE_BYTES", "1000")
+	os.Setenv("BCDA_EXPORT_MAX_FILE_LINES", "10")
+	os.Setenv("BCDA_EXPORT_MAX_FILE_LINES_PATIENT", "2")
+	assert.Equal(t, fileLimits{bytes: 1000, lines: 2}, exportFileLimits("Patient"))
+	assert.Equal(t, fileLimits{bytes: 1000, lines: 10}, exportFileLimits("Coverage"))
+
+	l := fileLimits{bytes: 10, lines: 2}
+	assert.False(t, l.full(0, 0, 100), "an empty file takes a line of any size")
+	assert.False(t, l.full(5, 1, 5))
+	assert.True(t, l.full(5, 1, 6))
+	assert.True(t, l.full(2, 2, 1))
+}
+
+func TestConsolidateFiles(t *testing.T) {
+	stagingDir, err := ioutil.TempDir("", "staging")
+	require.NoError(t, err)
+	defer os.RemoveAll(stagingDir)
+	defer os.Setenv("FHIR_STAGING_DIR", os.Getenv("FHIR_STAGING_DIR"))
+	os.Setenv("FHIR_STAGING_DIR", stagingDir)
+
+	jobDir := filepath.Join(stagingDir, "1")
+	require.NoError(t, os.MkdirAll(jobDir, os.ModePerm))
+	files := map[string]string{
+		"a.ndjson":       "{\"id\":\"1\"}\n{\"id\":\"2\"}\n",
+		"a-error.ndjson": "{\"resourceType\":\"OperationOutcome\",\"id\":\"a\"}\n",
+		"b.ndjson":       "{\"id\":\"3\"}",
+		"c.ndjson":       "",
+		"c-error.ndjson": "{\"resourceType\":\"OperationOutcome\",\"id\":\"c\"}\n",
+	}
+	for name, data := range files {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(jobDir, name), []byte(data), 0600))
+	}
+
+	store, err := storage.New()
+	require.NoError(t, err)
+	chunks := []JobKey{{FileName: "a.ndjson"}, {FileName: "b.ndjson"}, {FileName: "c.ndjson"}}
+
+	names, err := consolidateFiles(store, "1", chunks, fileLimits{lines: 2})
+	require.NoError(t, err)
+	require.Len(t, names, 2)
+
+	read := func(name string) string {
+		b, err := ioutil.ReadFile(filepath.Join(jobDir, name))
+		assert.NoError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "{\"id\":\"1\"}\n{\"id\":\"2\"}\n", read(names[0]))
+	assert.Equal(t, "{\"id\":\"3\"}\n", read(names[1]))
+	assert.Equal(t, files["a-error.ndjson"]+files["c-error.ndjson"], read(errorFileName(names[0])))
+	_, err = os.Stat(filepath.Join(jobDir, errorFileName(names[1])))
+	assert.True(t, os.IsNotExist(err))
+
+	// Nothing is left behind when a chunk cannot be read
+	before, err := ioutil.ReadDir(jobDir)
+	require.NoError(t, err)
+	_, err = consolidateFiles(store, "1", append(chunks, JobKey{FileName: "missing.ndjson"}), fileLimits{bytes: 1})
+	assert.Error(t, err)
+	after, err := ioutil.ReadDir(jobDir)
+	require.NoError(t, err)
+	assert.Equal(t, len(before), len(after))
+
+	// The type keeps a file when its chunks are empty
+	names, err = consolidateFiles(store, "1", []JobKey{{FileName: "c.ndjson"}}, fileLimits{lines: 2})
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	assert.Empty(t, read(names[0]))
+	assert.True(t, strings.HasSuffix(read(errorFileName(names[0])), "\"id\":\"c\"}\n"))
+}
+
+func TestPublishJobFiles(t *testing.T) {
+	stagingDir, err := ioutil.TempDir("", "staging")
+	require.NoError(t, err)
+	defer os.RemoveAll(stagingDir)
+	payloadDir, err := ioutil.TempDir("", "payload")
+	require.NoError(t, err)
+	defer os.RemoveAll(payloadDir)
+	defer os.Setenv("FHIR_STAGING_DIR", os.Getenv("FHIR_STAGING_DIR"))
+	defer os.Setenv("FHIR_PAYLOAD_DIR", os.Getenv("FHIR_PAYLOAD_DIR"))
+	os.Setenv("FHIR_STAGING_DIR", stagingDir)
+	os.Setenv("FHIR_PAYLOAD_DIR", payloadDir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(stagingDir, "1"), os.ModePerm))
+	require.NoError(t, os.MkdirAll(filepath.Join(payloadDir, "1"), os.ModePerm))
+	for _, name := range []string{"a.ndjson", "a-error.ndjson", "c.ndjson"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(stagingDir, "1", name), []byte("{}\n"), 0600))
+	}
+	// An earlier attempt had already moved b before failing
+	require.NoError(t, ioutil.WriteFile(filepath.Join(payloadDir, "1", "b.ndjson"), []byte("{}\n"), 0600))
+
+	store, err := storage.New()
+	require.NoError(t, err)
+	keys := []JobKey{{Model: gorm.Model{ID: 1}, FileName: "a.ndjson"}, {Model: gorm.Model{ID: 2}, FileName: "b.ndjson"},
+		{Model: gorm.Model{ID: 3}, FileName: "c.ndjson"}}
+	// c was consolidated into d
+	consolidated := []consolidation{{chunks: keys[2:], names: []string{"d.ndjson"}}}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(stagingDir, "1", "d.ndjson"), []byte("{}\n"), 0600))
+
+	names := jobFileNames(keys, consolidated)
+	assert.Equal(t, []string{"d.ndjson", "a.ndjson", "b.ndjson"}, names)
+	require.NoError(t, publishJobFiles(store, "1", names))
+
+	for _, name := range []string{"a.ndjson", "a-error.ndjson", "b.ndjson", "d.ndjson"} {
+		assert.FileExists(t, filepath.Join(payloadDir, "1", name))
+	}
+	// The consolidated chunk is left in staging until the job has been completed
+	assert.FileExists(t, filepath.Join(stagingDir, "1", "c.ndjson"))
+
+	deleteConsolidatedFiles(store, "1", consolidated)
+	_, err = os.Stat(filepath.Join(payloadDir, "1", "d.ndjson"))
+	assert.True(t, os.IsNotExist(err))
+}
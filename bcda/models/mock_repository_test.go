@@ -63,6 +63,29 @@ func (_m *MockRepository) GetCCLFBeneficiaryMBIs(cclfFileID uint) ([]string, err
 	return r0, r1
 }
 
+// GetCCLFFileByID provides a mock function with given fields: id
+func (_m *MockRepository) GetCCLFFileByID(id uint) (*CCLFFile, error) {
+	ret := _m.Called(id)
+
+	var r0 *CCLFFile
+	if rf, ok := ret.Get(0).(func(uint) *CCLFFile); ok {
+		r0 = rf(id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*CCLFFile)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(uint) error); ok {
+		r1 = rf(id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetLatestCCLFFile provides a mock function with given fields: cmsID, cclfNum, importStatus, lowerBound, upperBound
 func (_m *MockRepository) GetLatestCCLFFile(cmsID string, cclfNum int, importStatus string, lowerBound time.Time, upperBound time.Time) (*CCLFFile, error) {
 	ret := _m.Called(cmsID, cclfNum, importStatus, lowerBound, upperBound)
@@ -17,6 +17,29 @@ type MockService struct {
 	mock.Mock
 }
 
+// GetAttributionDiff provides a mock function with given fields: cmsID, fromFileID, toFileID
+func (_m *MockService) GetAttributionDiff(cmsID string, fromFileID uint, toFileID uint) (*AttributionDiff, error) {
+	ret := _m.Called(cmsID, fromFileID, toFileID)
+
+	var r0 *AttributionDiff
+	if rf, ok := ret.Get(0).(func(string, uint, uint) *AttributionDiff); ok {
+		r0 = rf(cmsID, fromFileID, toFileID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*AttributionDiff)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, uint, uint) error); ok {
+		r1 = rf(cmsID, fromFileID, toFileID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetBeneficiaries provides a mock function with given fields: cmsID
 func (_m *MockService) GetBeneficiaries(cmsID string) ([]*CCLFBeneficiary, error) {
 	ret := _m.Called(cmsID)
@@ -15,9 +15,11 @@ import (
 	authclient "github.com/CMSgov/bcda-app/bcda/auth/client"
 	"github.com/CMSgov/bcda-app/bcda/auth/rsautils"
 	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/queue"
+	"github.com/CMSgov/bcda-app/bcda/storage"
 	"github.com/CMSgov/bcda-app/bcda/utils"
-	"github.com/bgentry/que-go"
 	"github.com/jinzhu/gorm"
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
@@ -60,9 +62,15 @@ func InitializeGormModels() *gorm.DB {
 		&ACO{},
 		&Job{},
 		&JobKey{},
+		&JobCheckpoint{},
+		&DeadLetterJob{},
+		&JobUsage{},
+		&BBRateLimit{},
 		&CCLFBeneficiaryXref{},
 		&CCLFFile{},
 		&CCLFBeneficiary{},
+		&CCLFRejectedRecord{},
+		&UnresolvedBeneficiary{},
 		&Suppression{},
 		&SuppressionFile{},
 	)
@@ -82,6 +90,8 @@ type Job struct {
 	JobCount          int
 	CompletedJobCount int
 	JobKeys           []JobKey
+	// FailureReason explains why the job was marked Failed, when known
+	FailureReason string `json:"failure_reason"`
 }
 
 func (job *Job) CheckCompletedAndCleanup(db *gorm.DB) (bool, error) {
@@ -96,36 +106,73 @@ func (job *Job) CheckCompletedAndCleanup(db *gorm.DB) (bool, error) {
 
 	if int(completedJobs) >= job.JobCount {
 
-		staging := fmt.Sprintf("%s/%d", os.Getenv("FHIR_STAGING_DIR"), job.ID)
-		payload := fmt.Sprintf("%s/%d", os.Getenv("FHIR_PAYLOAD_DIR"), job.ID)
-
-		files, err := ioutil.ReadDir(staging)
+		store, err := storage.New()
 		if err != nil {
-			log.Error(err)
+			return false, err
 		}
 
-		for _, f := range files {
-			oldPath := fmt.Sprintf("%s/%s", staging, f.Name())
-			newPath := fmt.Sprintf("%s/%s", payload, f.Name())
-			err := os.Rename(oldPath, newPath)
-			if err != nil {
-				log.Error(err)
-			}
+		// Only the files of completed chunks are published. Anything else in staging was left behind
+		// by an abandoned attempt and is removed along with the staging directory.
+		var keys []JobKey
+		if err = db.Where("job_id = ?", job.ID).Order("id").Find(&keys).Error; err != nil {
+			return false, err
 		}
-		err = os.Remove(staging)
-		if err != nil {
+
+		// The consolidated files are written and the job's files are moved to the payload before the job is marked
+		// Completed, so its manifest never lists a file that cannot be downloaded. The chunk files that were
+		// consolidated are left in staging until then, so a failure leaves the job to be completed by a later check.
+		jobDir := strconv.FormatUint(uint64(job.ID), 10)
+		consolidated := consolidateJobFiles(store, jobDir, keys)
+		if err = publishJobFiles(store, jobDir, jobFileNames(keys, consolidated)); err != nil {
+			deleteConsolidatedFiles(store, jobDir, consolidated)
+			return false, err
+		}
+
+		// Lock the job so that only one of the workers finishing its last chunks completes it
+		tx := db.Begin()
+		abort := func(err error) (bool, error) {
+			tx.Rollback()
+			deleteConsolidatedFiles(store, jobDir, consolidated)
+			return false, err
+		}
+		var current Job
+		if err = tx.Set("gorm:query_option", "FOR UPDATE").First(&current, job.ID).Error; err != nil {
+			return abort(err)
+		}
+		if current.Status == "Completed" {
+			abort(nil)
+			job.Status = current.Status
+			return true, nil
+		}
+		if err = replaceJobKeys(tx, consolidated); err != nil {
+			return abort(err)
+		}
+		if err = tx.Model(&job).Update("status", "Completed").Error; err != nil {
+			return abort(err)
+		}
+		if err = tx.Commit().Error; err != nil {
+			deleteConsolidatedFiles(store, jobDir, consolidated)
+			return false, err
+		}
+
+		removeStagingFiles(store, job.ID, jobDir, consolidated)
+
+		if err = db.Unscoped().Where("job_id = ?", job.ID).Delete(&JobCheckpoint{}).Error; err != nil {
 			log.Error(err)
 		}
-		return true, db.Model(&job).Update("status", "Completed").Error
+		if err = db.Unscoped().Where("job_id = ?", job.ID).Delete(&UnresolvedBeneficiary{}).Error; err != nil {
+			log.Error(err)
+		}
+		return true, nil
 	}
 
 	return false, nil
 }
 
-func (job *Job) GetEnqueJobs(resourceTypes []string, since string, retrieveNewBeneHistData bool) (enqueJobs []*que.Job, err error) {
+func (job *Job) GetEnqueJobs(resourceTypes []string, since string, retrieveNewBeneHistData bool) (enqueJobs []*queue.Job, err error) {
 	db := database.GetGORMDbConnection()
 	defer database.Close(db)
-	var jobs []*que.Job
+	var jobs []*queue.Job
 	var aco ACO
 	err = db.Find(&aco, "uuid = ?", job.ACOID).Error
 	if err != nil {
@@ -179,12 +226,13 @@ func (job *Job) GetEnqueJobs(resourceTypes []string, since string, retrieveNewBe
 	return enqueJobs, nil
 }
 
-func AddJobsToQueue(job *Job, CMSID string, resourceTypes []string, since string, retrieveNewBeneHistData bool, beneficiaries []*CCLFBeneficiary) (jobs []*que.Job, err error) {
+func AddJobsToQueue(job *Job, CMSID string, resourceTypes []string, since string, retrieveNewBeneHistData bool, beneficiaries []*CCLFBeneficiary) (jobs []*queue.Job, err error) {
 
 	// persist in format ready for usage with _lastUpdated -- i.e., prepended with 'gt'
 	if since != "" {
 		since = "gt" + since
 	}
+	enqueuedAt := time.Now()
 	for _, rt := range resourceTypes {
 		var rowCount = 0
 		var jobIDs []string
@@ -204,12 +252,13 @@ func AddJobsToQueue(job *Job, CMSID string, resourceTypes []string, since string
 					ResourceType:    rt,
 					Since:           since,
 					TransactionTime: job.TransactionTime,
+					EnqueuedAt:      enqueuedAt,
 				})
 				if err != nil {
 					return nil, err
 				}
 
-				j := &que.Job{
+				j := &queue.Job{
 					Type:     "ProcessJob",
 					Args:     args,
 					Priority: setJobPriority(CMSID, rt, (len(since) != 0 || retrieveNewBeneHistData)),
@@ -294,6 +343,145 @@ type JobKey struct {
 	ResourceType string
 }
 
+// JobCheckpoint records the progress made on a single queued job (a chunk of beneficiaries for one resource type)
+// so a retry can append to the same file instead of starting over.
+type JobCheckpoint struct {
+	gorm.Model
+	QueJobID int64 `gorm:"unique_index"`
+	JobID    uint
+	FileUUID string `gorm:"type:char(36)"`
+	// NextBeneficiary is the index of the first beneficiary in the chunk that has not been processed
+	NextBeneficiary   int
+	LastBeneficiaryID string
+	ErrorCount        int
+	// DataSize and ErrorSize are the sizes of the data and error files when the checkpoint was taken.
+	// Anything written after the checkpoint is discarded when the chunk is resumed.
+	DataSize  int64
+	ErrorSize int64
+}
+
+// DeadLetterJob is a queued job that was removed from the queue after it exhausted its attempts.
+// It holds everything needed to put the job back on the queue.
+type DeadLetterJob struct {
+	gorm.Model
+	QueJobID   int64
+	JobID      uint `gorm:"index"`
+	Queue      string
+	Priority   int16
+	Type       string
+	Args       string
+	ErrorCount int32
+	LastError  string
+}
+
+// AddDeadLetterJob records the dead-lettered job and marks its parent job Failed.
+func AddDeadLetterJob(db *gorm.DB, dl *DeadLetterJob) error {
+	tx := db.Begin()
+	if err := tx.Create(dl).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if dl.JobID != 0 {
+		reason := fmt.Sprintf("Queued job %d failed %d time(s): %s", dl.QueJobID, dl.ErrorCount, dl.LastError)
+		err := tx.Model(&Job{}).Where("id = ? AND status IN (?)", dl.JobID, []string{"Pending", "In Progress", "Failed"}).
+			Updates(map[string]interface{}{"status": "Failed", "failure_reason": reason}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// JobUsage records the work done by a single queued job (a chunk of beneficiaries for one resource type).
+// Every attempt at the chunk adds to the same record, so retries are included.
+type JobUsage struct {
+	gorm.Model
+	QueJobID     int64 `gorm:"unique_index"`
+	JobID        uint  `gorm:"index"`
+	ResourceType string
+	Attempts     int
+	// BBRequests is the number of requests sent to Blue Button, including retried requests and additional pages
+	BBRequests int64
+	Resources  int64
+	// Bytes is the size of the data written to the chunk's file
+	Bytes      int64
+	DurationMS int64
+}
+
+// BBRateLimit is the token bucket of a Blue Button request budget, shared by every worker. The bucket is stored as
+// the theoretical arrival time of the budget's next request and is updated by the Blue Button client.
+type BBRateLimit struct {
+	Name string    `gorm:"primary_key;type:text"`
+	TAT  time.Time `gorm:"not null"`
+}
+
+// AddJobUsage adds the usage of an attempt at a chunk to the chunk's record.
+func AddJobUsage(db *gorm.DB, u JobUsage) error {
+	return db.Exec(`INSERT INTO job_usages (created_at, updated_at, que_job_id, job_id, resource_type, attempts, bb_requests, resources, bytes, duration_ms)
+		VALUES (now(), now(), ?, ?, ?, 1, ?, ?, ?, ?)
+		ON CONFLICT (que_job_id) DO UPDATE SET updated_at = now(),
+			attempts = job_usages.attempts + 1,
+			bb_requests = job_usages.bb_requests + EXCLUDED.bb_requests,
+			resources = job_usages.resources + EXCLUDED.resources,
+			bytes = job_usages.bytes + EXCLUDED.bytes,
+			duration_ms = job_usages.duration_ms + EXCLUDED.duration_ms`,
+		u.QueJobID, u.JobID, u.ResourceType, u.BBRequests, u.Resources, u.Bytes, u.DurationMS).Error
+}
+
+// UsageTotals sums the usage of one or more jobs.
+type UsageTotals struct {
+	Jobs       int     `json:"-"`
+	BBRequests int64   `json:"bbRequests"`
+	Resources  int64   `json:"resources"`
+	Bytes      int64   `json:"bytes"`
+	Seconds    float64 `json:"seconds"`
+}
+
+// GetJobUsage returns the usage of all of the job's chunks.
+func GetJobUsage(db *gorm.DB, jobID uint) (UsageTotals, error) {
+	var t UsageTotals
+	err := db.Raw(`SELECT count(DISTINCT job_id) AS jobs, coalesce(sum(bb_requests), 0) AS bb_requests, coalesce(sum(resources), 0) AS resources,
+			coalesce(sum(bytes), 0) AS bytes, coalesce(sum(duration_ms), 0) / 1000.0 AS seconds
+		FROM job_usages WHERE job_id = ? AND deleted_at IS NULL`, jobID).Scan(&t).Error
+	return t, err
+}
+
+// ACOMonthlyUsage is the usage of the jobs an ACO requested in a month.
+type ACOMonthlyUsage struct {
+	CMSID string
+	Month string
+	UsageTotals
+}
+
+// GetACOMonthlyUsage returns the usage of each ACO's jobs by the month they were requested, for jobs requested between
+// from (inclusive) and to (exclusive). A zero time leaves that end of the range open. If cmsID is set, only that
+// ACO's usage is returned.
+func GetACOMonthlyUsage(db *gorm.DB, from, to time.Time, cmsID string) ([]ACOMonthlyUsage, error) {
+	query := db.Table("job_usages AS u").
+		Select(`coalesce(a.cms_id, j.aco_id) AS cms_id, to_char(date_trunc('month', j.created_at), 'YYYY-MM') AS month,
+			count(DISTINCT j.id) AS jobs, sum(u.bb_requests) AS bb_requests, sum(u.resources) AS resources,
+			sum(u.bytes) AS bytes, sum(u.duration_ms) / 1000.0 AS seconds`).
+		Joins("JOIN jobs AS j ON j.id = u.job_id").
+		Joins("LEFT JOIN acos AS a ON a.uuid = j.aco_id").
+		Where("u.deleted_at IS NULL")
+	if !from.IsZero() {
+		query = query.Where("j.created_at >= ?", from)
+	}
+	if !to.IsZero() {
+		query = query.Where("j.created_at < ?", to)
+	}
+	if cmsID != "" {
+		query = query.Where("a.cms_id = ?", cmsID)
+	}
+
+	var usage []ACOMonthlyUsage
+	err := query.Group("1, 2").Order("2, 1").Scan(&usage).Error
+	return usage, err
+}
+
 // ACO represents an Accountable Care Organization.
 type ACO struct {
 	gorm.Model
@@ -307,11 +495,13 @@ type ACO struct {
 	PublicKey   string    `json:"public_key"`
 }
 
+// CCLFBeneficiaryXref is a record of a CCLF9 file, which cross references a beneficiary's current and previous
+// identifiers. XrefIndicator is "M" when the identifiers are MBIs and "H" when they are HICNs.
 type CCLFBeneficiaryXref struct {
 	gorm.Model
-	FileID        uint   `gorm:"not null"`
+	FileID        uint   `gorm:"not null;index:idx_cclf_beneficiary_xrefs_file_id"`
 	XrefIndicator string `json:"xref_indicator"`
-	CurrentNum    string `json:"current_number"`
+	CurrentNum    string `gorm:"index:idx_cclf_beneficiary_xrefs_current_num" json:"current_number"`
 	PrevNum       string `json:"previous_number"`
 	PrevsEfctDt   string `json:"effective_date"`
 	PrevsObsltDt  string `json:"obsolete_date"`
@@ -412,14 +602,27 @@ type CCLFFile struct {
 	ImportStatus    string    `gorm:"column:import_status"`
 }
 
+// Delete removes the file along with its beneficiaries, cross references and rejected records, all or none of them.
 func (cclfFile *CCLFFile) Delete() error {
 	db := database.GetGORMDbConnection()
 	defer db.Close()
-	err := db.Unscoped().Where("file_id = ?", cclfFile.ID).Delete(&CCLFBeneficiary{}).Error
+
+	tx := db.Begin()
+	err := tx.Unscoped().Where("file_id = ?", cclfFile.ID).Delete(&CCLFBeneficiary{}).Error
+	if err == nil {
+		err = tx.Unscoped().Where("file_id = ?", cclfFile.ID).Delete(&CCLFBeneficiaryXref{}).Error
+	}
+	if err == nil {
+		err = tx.Unscoped().Where("file_id = ?", cclfFile.ID).Delete(&CCLFRejectedRecord{}).Error
+	}
+	if err == nil {
+		err = tx.Unscoped().Delete(&cclfFile).Error
+	}
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	return db.Unscoped().Delete(&cclfFile).Error
+	return tx.Commit().Error
 }
 
 // "The MBI has 11 characters, like the Health Insurance Claim Number (HICN), which can have up to 11."
@@ -431,6 +634,113 @@ type CCLFBeneficiary struct {
 	HICN         string `gorm:"type:varchar(11);not null;index:idx_cclf_beneficiaries_hicn"`
 	MBI          string `gorm:"type:char(11);not null;index:idx_cclf_beneficiaries_mbi"`
 	BlueButtonID string `gorm:"type: text;index:idx_cclf_beneficiaries_bb_id"`
+	// BlueButtonIDResolvedAt is when BlueButtonID was last confirmed by Blue Button
+	BlueButtonIDResolvedAt *time.Time
+}
+
+// CCLFRejectedRecord is a line of a CCLF8 file that failed validation and was not imported. LineNumber counts the
+// lines of the file from 1, including blank ones.
+type CCLFRejectedRecord struct {
+	gorm.Model
+	FileID     uint   `gorm:"not null;index:idx_cclf_rejected_records_file_id" json:"file_id"`
+	LineNumber int    `json:"line_number"`
+	Record     string `json:"record"`
+	Reason     string `json:"reason"`
+}
+
+// UnresolvedBeneficiary records that a beneficiary's MBI could not be resolved to a Blue Button ID during a job,
+// so that it is only reported once in the job's error files rather than once for every resource type.
+type UnresolvedBeneficiary struct {
+	gorm.Model
+	JobID             uint `gorm:"unique_index:idx_unresolved_beneficiaries_job_bene"`
+	CCLFBeneficiaryID uint `gorm:"unique_index:idx_unresolved_beneficiaries_job_bene"`
+	Reason            string
+}
+
+// AddUnresolvedBeneficiary records that the beneficiary could not be resolved during the job.
+// It reports whether this is the first time the beneficiary has been recorded for the job.
+func AddUnresolvedBeneficiary(db *gorm.DB, jobID, cclfBeneficiaryID uint, reason string) (bool, error) {
+	result := db.Exec(`INSERT INTO unresolved_beneficiaries (created_at, updated_at, job_id, cclf_beneficiary_id, reason)
+		VALUES (now(), now(), ?, ?, ?) ON CONFLICT (job_id, cclf_beneficiary_id) DO NOTHING`,
+		jobID, cclfBeneficiaryID, reason)
+	return result.RowsAffected == 1, result.Error
+}
+
+// GetPreviousMBIs returns the MBIs that the beneficiaries had before their current ones, keyed by current MBI.
+// The cross references come from the most recent CCLF9 file imported for the ACO.
+func GetPreviousMBIs(db *gorm.DB, cmsID string, mbis []string) (map[string][]string, error) {
+	previous := make(map[string][]string)
+	if len(mbis) == 0 {
+		return previous, nil
+	}
+
+	var cclfFile CCLFFile
+	err := db.Where("aco_cms_id = ? AND cclf_num = 9 AND import_status = ?", cmsID, constants.ImportComplete).
+		Order("timestamp DESC").First(&cclfFile).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return previous, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var xrefs []CCLFBeneficiaryXref
+	err = db.Where("file_id = ? AND xref_indicator = 'M' AND current_num IN (?)", cclfFile.ID, mbis).Order("id").Find(&xrefs).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, xref := range xrefs {
+		if xref.PrevNum != "" && xref.PrevNum != xref.CurrentNum {
+			previous[xref.CurrentNum] = append(previous[xref.CurrentNum], xref.PrevNum)
+		}
+	}
+	return previous, nil
+}
+
+// UpdateBlueButtonIDs saves the Blue Button IDs (keyed by CCLF beneficiary ID) that have just been confirmed by
+// Blue Button, using a single statement for each batch of beneficiaries.
+func UpdateBlueButtonIDs(db *gorm.DB, bbIDs map[uint]string) error {
+	const batchSize = 500
+
+	var (
+		values []string
+		args   []interface{}
+	)
+	flush := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		err := db.Exec(fmt.Sprintf(`UPDATE cclf_beneficiaries AS b
+			SET blue_button_id = v.bb_id, blue_button_id_resolved_at = now(), updated_at = now()
+			FROM (VALUES %s) AS v(id, bb_id) WHERE b.id = v.id`, strings.Join(values, ", ")), args...).Error
+		values, args = nil, nil
+		return err
+	}
+
+	for id, bbID := range bbIDs {
+		values = append(values, "(?::integer, ?::text)")
+		args = append(args, id, bbID)
+		if len(values) >= batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// IsBlueButtonIDFresh reports whether the beneficiary's stored Blue Button ID can be used without asking Blue Button
+// again. IDs confirmed during the current job (i.e. since it was created) are always used. Otherwise an ID is used
+// for BCDA_BB_ID_MAX_AGE_HOURS after it was confirmed.
+func (cclfBeneficiary *CCLFBeneficiary) IsBlueButtonIDFresh(jobCreatedAt time.Time) bool {
+	resolvedAt := cclfBeneficiary.BlueButtonIDResolvedAt
+	if cclfBeneficiary.BlueButtonID == "" || resolvedAt == nil {
+		return false
+	}
+	if !jobCreatedAt.IsZero() && !resolvedAt.Before(jobCreatedAt) {
+		return true
+	}
+	maxAge := time.Duration(utils.GetEnvInt("BCDA_BB_ID_MAX_AGE_HOURS", 24)) * time.Hour
+	return time.Since(*resolvedAt) < maxAge
 }
 
 type SuppressionFile struct {
@@ -478,6 +788,12 @@ func (cclfBeneficiary *CCLFBeneficiary) GetBlueButtonID(bb client.APIClient) (bl
 	return blueButtonID, nil
 }
 
+// UnresolvableError is returned when Blue Button does not have a patient matching a beneficiary's identifier.
+// Unlike a failed request, asking again will not help.
+type UnresolvableError struct {
+	error
+}
+
 func GetBlueButtonID(bb client.APIClient, modelIdentifier, reqType string, modelID uint) (blueButtonID string, err error) {
 	hashedIdentifier := client.HashIdentifier(modelIdentifier)
 
@@ -494,7 +810,7 @@ func GetBlueButtonID(bb client.APIClient, modelIdentifier, reqType string, model
 
 	if len(patient.Entry) == 0 {
 
-		err = fmt.Errorf("patient identifier not found at Blue Button for CCLF %s ID: %v", reqType, modelID)
+		err = UnresolvableError{fmt.Errorf("patient identifier not found at Blue Button for CCLF %s ID: %v", reqType, modelID)}
 
 		log.Error(err)
 		return "", err
@@ -512,12 +828,12 @@ func GetBlueButtonID(bb client.APIClient, modelIdentifier, reqType string, model
 		}
 	}
 	if !foundIdentifier {
-		err = fmt.Errorf("Identifier not found")
+		err = UnresolvableError{fmt.Errorf("Identifier not found")}
 		log.Error(err)
 		return "", err
 	}
 	if !foundBlueButtonID {
-		err = fmt.Errorf("Blue Button identifier not found in the identifiers")
+		err = UnresolvableError{fmt.Errorf("Blue Button identifier not found in the identifiers")}
 		log.Error(err)
 		return "", err
 	}
@@ -534,4 +850,5 @@ type jobEnqueueArgs struct {
 	ResourceType    string
 	Since           string
 	TransactionTime time.Time
+	EnqueuedAt      time.Time
 }
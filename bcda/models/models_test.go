@@ -7,11 +7,14 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"io/ioutil"
 	"log"
 	random "math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -398,6 +401,127 @@ func (s *ModelsTestSuite) TestJobCompleted() {
 	assert.True(s.T(), completed)
 	s.db.Delete(&j)
 }
+func (s *ModelsTestSuite) TestJobCompletedRemovesOrphanedFiles() {
+	stagingDir, err := ioutil.TempDir("", "staging")
+	assert.NoError(s.T(), err)
+	defer os.RemoveAll(stagingDir)
+	payloadDir, err := ioutil.TempDir("", "payload")
+	assert.NoError(s.T(), err)
+	defer os.RemoveAll(payloadDir)
+
+	origStaging, origPayload := os.Getenv("FHIR_STAGING_DIR"), os.Getenv("FHIR_PAYLOAD_DIR")
+	defer func() {
+		os.Setenv("FHIR_STAGING_DIR", origStaging)
+		os.Setenv("FHIR_PAYLOAD_DIR", origPayload)
+	}()
+	os.Setenv("FHIR_STAGING_DIR", stagingDir)
+	os.Setenv("FHIR_PAYLOAD_DIR", payloadDir)
+
+	j := Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Patient/$export",
+		Status:     "Pending",
+		JobCount:   1,
+	}
+	s.db.Save(&j)
+	defer s.db.Delete(&j)
+
+	jobDir := filepath.Join(stagingDir, strconv.FormatUint(uint64(j.ID), 10))
+	assert.NoError(s.T(), os.MkdirAll(jobDir, os.ModePerm))
+	for _, name := range []string{"completed.ndjson", "completed-error.ndjson", "abandoned.ndjson", "abandoned-error.ndjson"} {
+		assert.NoError(s.T(), ioutil.WriteFile(filepath.Join(jobDir, name), []byte("{}\n"), 0600))
+	}
+
+	cp := JobCheckpoint{QueJobID: time.Now().UnixNano(), JobID: j.ID, FileUUID: "abandoned"}
+	assert.NoError(s.T(), s.db.Create(&cp).Error)
+	assert.NoError(s.T(), s.db.Create(&JobKey{JobID: j.ID, FileName: "completed.ndjson"}).Error)
+
+	completed, err := j.CheckCompletedAndCleanup(s.db)
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), completed)
+
+	files, err := ioutil.ReadDir(filepath.Join(payloadDir, strconv.FormatUint(uint64(j.ID), 10)))
+	assert.NoError(s.T(), err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.ElementsMatch(s.T(), []string{"completed.ndjson", "completed-error.ndjson"}, names)
+
+	_, err = os.Stat(jobDir)
+	assert.True(s.T(), os.IsNotExist(err), "staging directory should be removed")
+
+	var count int
+	s.db.Model(&JobCheckpoint{}).Where("job_id = ?", j.ID).Count(&count)
+	assert.Zero(s.T(), count)
+}
+
+func (s *ModelsTestSuite) TestJobCompletedConsolidatesFiles() {
+	stagingDir, err := ioutil.TempDir("", "staging")
+	assert.NoError(s.T(), err)
+	defer os.RemoveAll(stagingDir)
+	payloadDir, err := ioutil.TempDir("", "payload")
+	assert.NoError(s.T(), err)
+	defer os.RemoveAll(payloadDir)
+
+	for k, v := range map[string]string{
+		"FHIR_STAGING_DIR":                   stagingDir,
+		"FHIR_PAYLOAD_DIR":                   payloadDir,
+		"BCDA_EXPORT_MAX_FILE_LINES_PATIENT": "3",
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	j := Job{
+		ACOID:      uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"),
+		RequestURL: "/api/v1/Group/all/$export",
+		Status:     "In Progress",
+		JobCount:   3,
+	}
+	s.db.Save(&j)
+	defer s.db.Delete(&j)
+
+	jobDir := filepath.Join(stagingDir, strconv.FormatUint(uint64(j.ID), 10))
+	assert.NoError(s.T(), os.MkdirAll(jobDir, os.ModePerm))
+	for name, data := range map[string]string{
+		"patient1.ndjson":       "{\"id\":\"1\"}\n{\"id\":\"2\"}\n",
+		"patient1-error.ndjson": "{\"resourceType\":\"OperationOutcome\"}\n",
+		"patient2.ndjson":       "{\"id\":\"3\"}\n{\"id\":\"4\"}\n",
+		"coverage.ndjson":       "{\"id\":\"1\"}\n",
+	} {
+		assert.NoError(s.T(), ioutil.WriteFile(filepath.Join(jobDir, name), []byte(data), 0600))
+	}
+	assert.NoError(s.T(), s.db.Create(&JobKey{JobID: j.ID, FileName: "patient1.ndjson", ResourceType: "Patient"}).Error)
+	assert.NoError(s.T(), s.db.Create(&JobKey{JobID: j.ID, FileName: "patient2.ndjson", ResourceType: "Patient"}).Error)
+	assert.NoError(s.T(), s.db.Create(&JobKey{JobID: j.ID, FileName: "coverage.ndjson", ResourceType: "Coverage"}).Error)
+
+	completed, err := j.CheckCompletedAndCleanup(s.db)
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), completed)
+
+	// Patient is split into files of at most 3 lines; Coverage has no limit and is published as it is
+	var keys []JobKey
+	s.db.Where("job_id = ?", j.ID).Order("id").Find(&keys)
+	assert.Len(s.T(), keys, 3)
+	expected := []string{"coverage.ndjson"}
+	for _, key := range keys {
+		if key.ResourceType == "Patient" {
+			expected = append(expected, strings.TrimSpace(key.FileName))
+		}
+	}
+	assert.Len(s.T(), expected, 3)
+	expected = append(expected, errorFileName(expected[1]))
+
+	files, err := ioutil.ReadDir(filepath.Join(payloadDir, strconv.FormatUint(uint64(j.ID), 10)))
+	assert.NoError(s.T(), err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.ElementsMatch(s.T(), expected, names)
+}
+
 func (s *ModelsTestSuite) TestJobDefaultCompleted() {
 
 	// Job is completed, but no keys exist.  This is fine, it is still complete
@@ -674,6 +798,7 @@ func (s *ModelsTestSuite) TestGetEnqueueJobs() {
 				assert.Equal(t, expected.since, jobArgs.Since)
 				assert.Equal(t, expected.priority, enqueueJobs[i].Priority)
 				assert.Equal(t, expected.numBenes, len(jobArgs.BeneficiaryIDs))
+				assert.WithinDuration(t, time.Now(), jobArgs.EnqueuedAt, time.Minute)
 			}
 
 			s.service.AssertExpectations(t)
@@ -767,3 +892,32 @@ func (s *ModelsTestSuite) TestGetBlueButtonID_CCLFBeneficiary() {
 	// This is due to the fact that we are not relying on cached identifiers
 	bbc.AssertNumberOfCalls(s.T(), "GetPatientByIdentifierHash", 2)
 }
+
+func (s *ModelsTestSuite) TestIsBlueButtonIDFresh() {
+	assert := s.Assert()
+	defer os.Setenv("BCDA_BB_ID_MAX_AGE_HOURS", os.Getenv("BCDA_BB_ID_MAX_AGE_HOURS"))
+	os.Unsetenv("BCDA_BB_ID_MAX_AGE_HOURS")
+
+	jobCreatedAt := time.Now().Add(-time.Hour)
+	resolvedAt := func(d time.Duration) *time.Time {
+		t := time.Now().Add(-d)
+		return &t
+	}
+
+	// IDs that have never been confirmed are always looked up
+	assert.False((&CCLFBeneficiary{}).IsBlueButtonIDFresh(jobCreatedAt))
+	assert.False((&CCLFBeneficiary{BlueButtonID: "BB_VALUE"}).IsBlueButtonIDFresh(jobCreatedAt))
+	assert.False((&CCLFBeneficiary{BlueButtonIDResolvedAt: resolvedAt(0)}).IsBlueButtonIDFresh(jobCreatedAt))
+
+	// IDs confirmed during the job are used regardless of their age
+	os.Setenv("BCDA_BB_ID_MAX_AGE_HOURS", "0")
+	assert.True((&CCLFBeneficiary{BlueButtonID: "BB_VALUE", BlueButtonIDResolvedAt: resolvedAt(time.Minute)}).IsBlueButtonIDFresh(jobCreatedAt))
+	assert.False((&CCLFBeneficiary{BlueButtonID: "BB_VALUE", BlueButtonIDResolvedAt: resolvedAt(2 * time.Hour)}).IsBlueButtonIDFresh(jobCreatedAt))
+
+	// Older IDs are used until they reach the maximum age
+	os.Unsetenv("BCDA_BB_ID_MAX_AGE_HOURS")
+	assert.True((&CCLFBeneficiary{BlueButtonID: "BB_VALUE", BlueButtonIDResolvedAt: resolvedAt(2 * time.Hour)}).IsBlueButtonIDFresh(jobCreatedAt))
+	assert.False((&CCLFBeneficiary{BlueButtonID: "BB_VALUE", BlueButtonIDResolvedAt: resolvedAt(25 * time.Hour)}).IsBlueButtonIDFresh(time.Time{}))
+	os.Setenv("BCDA_BB_ID_MAX_AGE_HOURS", "48")
+	assert.True((&CCLFBeneficiary{BlueButtonID: "BB_VALUE", BlueButtonIDResolvedAt: resolvedAt(25 * time.Hour)}).IsBlueButtonIDFresh(time.Time{}))
+}
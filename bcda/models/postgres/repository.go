@@ -59,6 +59,16 @@ func (r *Repository) GetLatestCCLFFile(cmsID string, cclfNum int, importStatus s
 	return &cclfFile, result.Error
 }
 
+func (r *Repository) GetCCLFFileByID(id uint) (*models.CCLFFile, error) {
+	var cclfFile models.CCLFFile
+	result := r.db.First(&cclfFile, id)
+	if result.RecordNotFound() {
+		return nil, nil
+	}
+
+	return &cclfFile, result.Error
+}
+
 func (r *Repository) GetCCLFBeneficiaryMBIs(cclfFileID uint) ([]string, error) {
 	var mbis []string
 
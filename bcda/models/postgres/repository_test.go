@@ -125,6 +125,50 @@ func (r *RepositoryTestSuite) TestGetLatestCCLFFile() {
 	}
 }
 
+func (r *RepositoryTestSuite) TestGetCCLFFileByID() {
+	tests := []struct {
+		name   string
+		result *models.CCLFFile
+	}{
+		{"Found", getCCLFFile(8, "cmsID", constants.ImportComplete)},
+		{"NotFound", nil},
+	}
+
+	for _, tt := range tests {
+		r.T().Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			gdb, err := gorm.Open("postgres", db)
+			if err != nil {
+				t.Fatalf("Failed to instantiate gorm db %s", err.Error())
+			}
+
+			defer func() {
+				err = mock.ExpectationsWereMet()
+				assert.NoError(t, err)
+				gdb.Close()
+				db.Close()
+			}()
+			repository := NewRepository(gdb)
+
+			id := uint(42)
+			query := mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(`SELECT * FROM "cclf_files" WHERE "cclf_files"."deleted_at" IS NULL AND (("cclf_files"."id" = %d)) ORDER BY "cclf_files"."id" ASC LIMIT 1`, id)))
+			if tt.result == nil {
+				query.WillReturnError(gorm.ErrRecordNotFound)
+			} else {
+				query.WillReturnRows(sqlmock.
+					NewRows([]string{"id", "cclf_num", "name", "aco_cms_id", "timestamp", "performance_year", "import_status"}).
+					AddRow(tt.result.ID, tt.result.CCLFNum, tt.result.Name, tt.result.ACOCMSID, tt.result.Timestamp, tt.result.PerformanceYear, tt.result.ImportStatus))
+			}
+			cclfFile, err := repository.GetCCLFFileByID(id)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.result, cclfFile)
+		})
+	}
+}
+
 func (r *RepositoryTestSuite) TestGetCCLFBeneficiaryMBIs() {
 	tests := []struct {
 		name          string
@@ -17,6 +17,9 @@ type cclfFileRepository interface {
 	// The returned CCLF file will fall between the provided time window.
 	// If any of the time values equals time.Time (default value), then the time value IS NOT used in the filtering.
 	GetLatestCCLFFile(cmsID string, cclfNum int, importStatus string, lowerBound, upperBound time.Time) (*CCLFFile, error)
+
+	// GetCCLFFileByID returns the CCLF File with the ID, or nil if there is none.
+	GetCCLFFileByID(id uint) (*CCLFFile, error)
 }
 
 // CCLFBeneficiaryRepository contains methods need to interact with CCLF Beneficiary data.
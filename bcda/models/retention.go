@@ -0,0 +1,251 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/CMSgov/bcda-app/bcda/constants"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// RetentionPolicy decides which CCLF and suppression data is kept when it is purged. A CCLF file is kept when it is
+// one of the newest KeepFiles imported files of its type for its ACO, when it is less than KeepDays old, or when it
+// may be used by a job requested in the last JobDays days or still running.
+type RetentionPolicy struct {
+	KeepFiles int
+	KeepDays  int
+	JobDays   int
+	// SuppressionLookbackDays is how far back suppressions are used; older ones are purged once KeepDays have passed
+	SuppressionLookbackDays int
+	// BatchSize is the number of rows deleted by each statement, which keeps the time locks are held short
+	BatchSize int
+	// DryRun reports what would be purged without deleting anything
+	DryRun bool
+}
+
+// Validate checks that the policy keeps the data the API needs. Exports of new beneficiaries compare the latest
+// CCLF8 file with the one before it, so at least two files are kept.
+func (p RetentionPolicy) Validate() error {
+	if p.KeepFiles < 2 {
+		return errors.New("at least 2 CCLF files must be kept for each ACO")
+	}
+	if p.KeepDays < 0 || p.JobDays < 0 || p.SuppressionLookbackDays < 0 {
+		return errors.New("retention periods cannot be negative")
+	}
+	if p.BatchSize < 1 {
+		return errors.New("batch size must be at least 1")
+	}
+	return nil
+}
+
+// PurgedCCLFFile is a CCLF file removed by a purge and the number of its records that were removed with it.
+type PurgedCCLFFile struct {
+	ID              uint
+	Name            string
+	ACOCMSID        string
+	CCLFNum         int
+	Timestamp       time.Time
+	ImportStatus    string
+	Beneficiaries   int64
+	Xrefs           int64
+	RejectedRecords int64
+}
+
+// PurgedSuppressionFile is a suppression file removed by a purge.
+type PurgedSuppressionFile struct {
+	ID        uint
+	Name      string
+	Timestamp time.Time
+}
+
+// PurgeReport lists what a purge removed, or would have removed when it was a dry run.
+type PurgeReport struct {
+	DryRun           bool
+	CCLFFiles        []PurgedCCLFFile
+	Suppressions     int64
+	SuppressionFiles []PurgedSuppressionFile
+}
+
+// jobReference is a job that may use the CCLF8 files its ACO had imported when it was requested
+type jobReference struct {
+	CMSID     string
+	CreatedAt time.Time
+}
+
+// PurgeCCLFData deletes the CCLF files, and their beneficiaries, cross references and rejected records, and the
+// suppressions that the policy does not keep. Each file is marked as being purged before its records are deleted in
+// batches, so a purge that is interrupted leaves no partly deleted file in use; it is finished by the next purge.
+func PurgeCCLFData(db *gorm.DB, policy RetentionPolicy, now time.Time) (*PurgeReport, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	var files []CCLFFile
+	if err := db.Order("id").Find(&files).Error; err != nil {
+		return nil, errors.Wrap(err, "could not get CCLF files")
+	}
+
+	var jobs []jobReference
+	err := db.Table("jobs AS j").Select("a.cms_id, j.created_at").
+		Joins("JOIN acos AS a ON a.uuid = j.aco_id").
+		Where("j.deleted_at IS NULL AND (j.created_at >= ? OR j.status IN (?))", now.AddDate(0, 0, -policy.JobDays), []string{"Pending", "In Progress"}).
+		Scan(&jobs).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get recent jobs")
+	}
+
+	report := &PurgeReport{DryRun: policy.DryRun, CCLFFiles: []PurgedCCLFFile{}, SuppressionFiles: []PurgedSuppressionFile{}}
+	for _, f := range purgeableCCLFFiles(files, jobs, policy, now) {
+		purged, err := purgeCCLFFile(db, f, policy)
+		if err != nil {
+			return report, errors.Wrapf(err, "could not purge CCLF file %s", f.Name)
+		}
+		report.CCLFFiles = append(report.CCLFFiles, purged)
+	}
+
+	if err := purgeSuppressions(db, policy, now, report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// purgeableCCLFFiles returns the files that the policy does not keep
+func purgeableCCLFFiles(files []CCLFFile, jobs []jobReference, policy RetentionPolicy, now time.Time) []CCLFFile {
+	type fileType struct {
+		cmsID   string
+		cclfNum int
+	}
+	imported := make(map[fileType][]CCLFFile)
+	for _, f := range files {
+		if f.ImportStatus == constants.ImportComplete {
+			t := fileType{f.ACOCMSID, f.CCLFNum}
+			imported[t] = append(imported[t], f)
+		}
+	}
+
+	kept := make(map[uint]bool)
+	for t, typeFiles := range imported {
+		sort.Slice(typeFiles, func(i, j int) bool { return typeFiles[i].Timestamp.After(typeFiles[j].Timestamp) })
+		for i := 0; i < len(typeFiles) && i < policy.KeepFiles; i++ {
+			kept[typeFiles[i].ID] = true
+		}
+		if t.cclfNum != cclf8FileNum {
+			continue
+		}
+
+		// A job uses the latest CCLF8 file imported before it was requested, and the one before that to find new
+		// beneficiaries
+		for _, job := range jobs {
+			if job.CMSID != t.cmsID {
+				continue
+			}
+			used := 0
+			for _, f := range typeFiles {
+				if used < 2 && !f.CreatedAt.After(job.CreatedAt) {
+					kept[f.ID] = true
+					used++
+				}
+			}
+		}
+	}
+
+	cutoff := now.AddDate(0, 0, -policy.KeepDays)
+	var purgeable []CCLFFile
+	for _, f := range files {
+		// Files still being imported are left alone, while files already being purged are always finished
+		if f.ImportStatus == constants.ImportInprog || kept[f.ID] {
+			continue
+		}
+		if f.ImportStatus != constants.ImportPurging && !f.Timestamp.Before(cutoff) {
+			continue
+		}
+		purgeable = append(purgeable, f)
+	}
+	return purgeable
+}
+
+func purgeCCLFFile(db *gorm.DB, f CCLFFile, policy RetentionPolicy) (PurgedCCLFFile, error) {
+	purged := PurgedCCLFFile{ID: f.ID, Name: f.Name, ACOCMSID: f.ACOCMSID, CCLFNum: f.CCLFNum, Timestamp: f.Timestamp, ImportStatus: f.ImportStatus}
+
+	if !policy.DryRun && f.ImportStatus != constants.ImportPurging {
+		if err := db.Model(&f).Update("import_status", constants.ImportPurging).Error; err != nil {
+			return purged, err
+		}
+	}
+
+	var err error
+	if purged.Beneficiaries, err = deleteInBatches(db, "cclf_beneficiaries", policy, "file_id = ?", f.ID); err != nil {
+		return purged, err
+	}
+	if purged.Xrefs, err = deleteInBatches(db, "cclf_beneficiary_xrefs", policy, "file_id = ?", f.ID); err != nil {
+		return purged, err
+	}
+	if purged.RejectedRecords, err = deleteInBatches(db, "cclf_rejected_records", policy, "file_id = ?", f.ID); err != nil {
+		return purged, err
+	}
+
+	if !policy.DryRun {
+		if err = db.Unscoped().Delete(&f).Error; err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// purgeSuppressions deletes the suppressions that are older than both the lookback and the retention period, then the
+// suppression files that have no suppressions left
+func purgeSuppressions(db *gorm.DB, policy RetentionPolicy, now time.Time, report *PurgeReport) error {
+	days := policy.KeepDays
+	if policy.SuppressionLookbackDays > days {
+		days = policy.SuppressionLookbackDays
+	}
+	cutoff := now.AddDate(0, 0, -days)
+
+	var err error
+	if report.Suppressions, err = deleteInBatches(db, "suppressions", policy, "effective_date < ?", cutoff); err != nil {
+		return errors.Wrap(err, "could not purge suppressions")
+	}
+
+	var files []SuppressionFile
+	// In a dry run the suppressions are still there, so the files are those that would have none left
+	err = db.Where("timestamp < ? AND import_status != ?", now.AddDate(0, 0, -policy.KeepDays), constants.ImportInprog).
+		Where("NOT EXISTS (SELECT 1 FROM suppressions s WHERE s.file_id = suppression_files.id AND (s.effective_date >= ? OR s.effective_date IS NULL))", cutoff).
+		Order("id").Find(&files).Error
+	if err != nil {
+		return errors.Wrap(err, "could not get suppression files")
+	}
+	for _, f := range files {
+		if !policy.DryRun {
+			if err = db.Unscoped().Delete(&f).Error; err != nil {
+				return errors.Wrapf(err, "could not purge suppression file %s", f.Name)
+			}
+		}
+		report.SuppressionFiles = append(report.SuppressionFiles, PurgedSuppressionFile{ID: f.ID, Name: f.Name, Timestamp: f.Timestamp})
+	}
+	return nil
+}
+
+// deleteInBatches deletes the table's rows that match the condition, BatchSize rows at a time, and returns the number
+// of rows deleted. In a dry run it counts them instead.
+func deleteInBatches(db *gorm.DB, table string, policy RetentionPolicy, condition string, args ...interface{}) (int64, error) {
+	var total int64
+	if policy.DryRun {
+		err := db.Table(table).Where(condition, args...).Count(&total).Error
+		return total, err
+	}
+
+	// #nosec G201
+	query := fmt.Sprintf("DELETE FROM %s WHERE id IN (SELECT id FROM %s WHERE %s LIMIT %d)", table, table, condition, policy.BatchSize)
+	for {
+		result := db.Exec(query, args...)
+		if result.Error != nil {
+			return total, result.Error
+		}
+		total += result.RowsAffected
+		if result.RowsAffected < int64(policy.BatchSize) {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CMSgov/bcda-app/bcda/constants"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionPolicyValidate(t *testing.T) {
+	policy := RetentionPolicy{KeepFiles: 2, KeepDays: 90, JobDays: 30, SuppressionLookbackDays: 60, BatchSize: 1000}
+	assert.NoError(t, policy.Validate())
+
+	p := policy
+	p.KeepFiles = 1
+	assert.EqualError(t, p.Validate(), "at least 2 CCLF files must be kept for each ACO")
+
+	p = policy
+	p.JobDays = -1
+	assert.EqualError(t, p.Validate(), "retention periods cannot be negative")
+
+	p = policy
+	p.BatchSize = 0
+	assert.EqualError(t, p.Validate(), "batch size must be at least 1")
+}
+
+func TestPurgeableCCLFFiles(t *testing.T) {
+	now := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	monthsAgo := func(months int) time.Time { return now.AddDate(0, -months, 0) }
+	file := func(id uint, cmsID string, cclfNum int, status string, months int) CCLFFile {
+		return CCLFFile{Model: gorm.Model{ID: id, CreatedAt: monthsAgo(months)}, ACOCMSID: cmsID, CCLFNum: cclfNum,
+			ImportStatus: status, Timestamp: monthsAgo(months)}
+	}
+
+	files := []CCLFFile{
+		file(1, "A0001", 8, constants.ImportComplete, 12),
+		file(2, "A0001", 8, constants.ImportComplete, 9),
+		file(3, "A0001", 8, constants.ImportComplete, 6),
+		file(4, "A0001", 8, constants.ImportComplete, 5),
+		file(5, "A0001", 8, constants.ImportComplete, 4),
+		file(6, "A0001", 8, constants.ImportFail, 7),
+		file(7, "A0001", 8, constants.ImportInprog, 7),
+		file(8, "A0001", 8, constants.ImportPurging, 1),
+		file(9, "A0001", 9, constants.ImportComplete, 12),
+		file(10, "A0001", 9, constants.ImportComplete, 6),
+		file(11, "A0001", 9, constants.ImportComplete, 4),
+		file(12, "A0002", 8, constants.ImportComplete, 12),
+		// Newer than KeepDays
+		file(13, "A0001", 8, constants.ImportFail, 2),
+	}
+	jobs := []jobReference{
+		// Uses files 2 and 1
+		{CMSID: "A0001", CreatedAt: monthsAgo(8)},
+		{CMSID: "A0002", CreatedAt: monthsAgo(1)},
+	}
+	policy := RetentionPolicy{KeepFiles: 2, KeepDays: 90, JobDays: 30, BatchSize: 1000}
+
+	var ids []uint
+	for _, f := range purgeableCCLFFiles(files, jobs, policy, now) {
+		ids = append(ids, f.ID)
+	}
+	assert.Equal(t, []uint{3, 6, 8, 9}, ids)
+
+	// Without jobs, the files they used are purged too
+	ids = nil
+	for _, f := range purgeableCCLFFiles(files, nil, policy, now) {
+		ids = append(ids, f.ID)
+	}
+	assert.Equal(t, []uint{1, 2, 3, 6, 8, 9}, ids)
+}
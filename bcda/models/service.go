@@ -24,6 +24,10 @@ type cclfBeneficiaryService interface {
 
 	// GetBeneficiaries retrieves all beneficiaries associated with the ACO, contained in one array
 	GetBeneficiaries(cmsID string) ([]*CCLFBeneficiary, error)
+
+	// GetAttributionDiff compares the beneficiaries attributed to the ACO by two of its imported CCLF8 files.
+	// Without a toFileID the latest file is used, and without a fromFileID the file before the "to" file.
+	GetAttributionDiff(cmsID string, fromFileID, toFileID uint) (*AttributionDiff, error)
 }
 
 const (
@@ -0,0 +1,143 @@
+package queue
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryQueue keeps jobs in memory. It follows the same rules as QueQueue for ordering, retrying and
+// removing jobs, so it can stand in for it in tests.
+type MemoryQueue struct {
+	mu     sync.Mutex
+	jobs   []*Job
+	locked map[int64]bool
+	nextID int64
+	now    func() time.Time
+}
+
+// Ensure MemoryQueue satisfies the interface
+var _ Queue = &MemoryQueue{}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{locked: make(map[int64]bool), now: time.Now}
+}
+
+func (q *MemoryQueue) Enqueue(j *Job) error {
+	if j.Type == "" {
+		return ErrMissingType
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.nextID++
+	j.ID = q.nextID
+	if j.Priority == 0 {
+		j.Priority = 100
+	}
+	if j.RunAt.IsZero() {
+		j.RunAt = q.now()
+	}
+	if len(j.Args) == 0 {
+		j.Args = []byte("[]")
+	}
+
+	stored := *j
+	q.jobs = append(q.jobs, &stored)
+	return nil
+}
+
+// WorkOne works the due job with the lowest priority, then RunAt, then ID that is not already being worked.
+func (q *MemoryQueue) WorkOne(wm WorkMap) bool {
+	q.mu.Lock()
+	var next *Job
+	now := q.now()
+	for _, j := range q.jobs {
+		if q.locked[j.ID] || j.RunAt.After(now) {
+			continue
+		}
+		if next == nil || before(j, next) {
+			next = j
+		}
+	}
+	if next == nil {
+		q.mu.Unlock()
+		return false
+	}
+	q.locked[next.ID] = true
+	j := *next
+	q.mu.Unlock()
+
+	err := work(wm, &j)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.locked, j.ID)
+	switch {
+	case err != nil:
+		next.ErrorCount++
+		next.LastError = err.Error()
+		next.RunAt = q.now().Add(retryDelay(next.ErrorCount))
+	case j.retried:
+		next.RunAt, next.LastError = j.RunAt, j.LastError
+	default:
+		q.remove(next.ID)
+	}
+	return true
+}
+
+func (q *MemoryQueue) Retry(j *Job, delay time.Duration, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.locked[j.ID] {
+		return fmt.Errorf("job %d is not being worked", j.ID)
+	}
+	j.RunAt = q.now().Add(delay)
+	j.LastError = reason
+	j.retried = true
+	return nil
+}
+
+func (q *MemoryQueue) Depth() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs), nil
+}
+
+func (q *MemoryQueue) Close() {}
+
+// Jobs returns a copy of the jobs on the queue in the order they will be worked.
+func (q *MemoryQueue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]Job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return before(&jobs[i], &jobs[k]) })
+	return jobs
+}
+
+func (q *MemoryQueue) remove(id int64) {
+	for i, j := range q.jobs {
+		if j.ID == id {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// before orders jobs the same way as que
+func before(a, b *Job) bool {
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	if !a.RunAt.Equal(b.RunAt) {
+		return a.RunAt.Before(b.RunAt)
+	}
+	return a.ID < b.ID
+}
@@ -0,0 +1,203 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	log "github.com/sirupsen/logrus"
+)
+
+// QueQueue stores jobs in the que_jobs table using que-go.
+// Jobs are taken from the queue named by QUE_QUEUE, matching que's workers.
+type QueQueue struct {
+	pool   *pgx.ConnPool
+	client *que.Client
+	name   string
+}
+
+// Ensure QueQueue satisfies the interfaces
+var (
+	_ Queue    = &QueQueue{}
+	_ Balancer = &QueQueue{}
+)
+
+// NewQueQueue connects to the queue database.
+func NewQueQueue(databaseURL string) (*QueQueue, error) {
+	pgxcfg, err := pgx.ParseURI(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
+		ConnConfig:   pgxcfg,
+		AfterConnect: que.PrepareStatements,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueQueue{pool: pool, client: que.NewClient(pool), name: os.Getenv("QUE_QUEUE")}, nil
+}
+
+// Enqueue adds the job to que_jobs. que.Client.Enqueue does not return the new job, so the insert is done here.
+func (q *QueQueue) Enqueue(j *Job) error {
+	if j.Type == "" {
+		return ErrMissingType
+	}
+
+	queue := &pgtype.Text{String: j.Queue, Status: pgtype.Present}
+	priority := &pgtype.Int2{Int: j.Priority, Status: pgtype.Null}
+	if j.Priority != 0 {
+		priority.Status = pgtype.Present
+	}
+	runAt := &pgtype.Timestamptz{Time: j.RunAt, Status: pgtype.Null}
+	if !j.RunAt.IsZero() {
+		runAt.Status = pgtype.Present
+	}
+	args := &pgtype.JSON{Bytes: j.Args, Status: pgtype.Null}
+	if len(j.Args) != 0 {
+		args.Status = pgtype.Present
+	}
+
+	return q.pool.QueryRow(`INSERT INTO que_jobs (queue, priority, run_at, job_class, args)
+		VALUES ($1::text, coalesce($2::smallint, 100::smallint), coalesce($3::timestamptz, now()), $4::text, coalesce($5::json, '[]'::json))
+		RETURNING priority, run_at, job_id`,
+		queue, priority, runAt, j.Type, args).Scan(&j.Priority, &j.RunAt, &j.ID)
+}
+
+// WorkOne locks the next job using que, which holds an advisory lock on the job until it has been worked.
+func (q *QueQueue) WorkOne(wm WorkMap) bool {
+	qj, err := q.client.LockJob(q.name)
+	if err != nil {
+		log.Errorf("Unable to lock job: %s", err.Error())
+		return false
+	}
+	if qj == nil {
+		return false
+	}
+	defer qj.Done()
+
+	j := &Job{
+		ID:         qj.ID,
+		Queue:      qj.Queue,
+		Priority:   qj.Priority,
+		RunAt:      qj.RunAt,
+		Type:       qj.Type,
+		Args:       qj.Args,
+		ErrorCount: qj.ErrorCount,
+		que:        qj,
+	}
+
+	if err := work(wm, j); err != nil {
+		if err := qj.Error(err.Error()); err != nil {
+			log.Errorf("Unable to save error on job %d: %s", j.ID, err.Error())
+		}
+		return true
+	}
+
+	if !j.retried {
+		if err := qj.Delete(); err != nil {
+			log.Errorf("Unable to delete job %d: %s", j.ID, err.Error())
+		}
+	}
+	return true
+}
+
+// Retry moves the job's run_at while it is still locked by the worker.
+func (q *QueQueue) Retry(j *Job, delay time.Duration, reason string) error {
+	if j.que == nil || j.que.Conn() == nil {
+		return fmt.Errorf("job %d is not being worked", j.ID)
+	}
+
+	_, err := j.que.Conn().Exec(`UPDATE que_jobs SET run_at = now() + $1::bigint * '1 microsecond'::interval, last_error = $2::text
+		WHERE queue = $3::text AND priority = $4::smallint AND run_at = $5::timestamptz AND job_id = $6::bigint`,
+		delay.Microseconds(), reason, j.Queue, j.Priority, j.RunAt, j.ID)
+	if err != nil {
+		return err
+	}
+
+	j.retried = true
+	return nil
+}
+
+func (q *QueQueue) Depth() (int, error) {
+	var count int
+	err := q.pool.QueryRow("SELECT count(*) FROM que_jobs").Scan(&count)
+	return count, err
+}
+
+func (q *QueQueue) Close() {
+	q.pool.Close()
+}
+
+// rebalanceLockKey is the advisory lock that stops more than one worker from rebalancing the queue at a time.
+// It uses the two key form of the lock so that it cannot collide with the job IDs locked by que.
+const rebalanceLockKey = 20200902
+
+// rebalanceSQL reorders the jobs waiting to run so that que, which takes jobs by priority then run_at,
+// hands them out round-robin: one chunk from each ACO in turn, and within an ACO one chunk from each of its jobs
+// in turn. ACOs and jobs that have been waiting the longest go first in each round.
+//
+// Only jobs that are already due are moved, and only into the past, so nothing runs later than it would have.
+// Each job is locked the same way que locks it while its run_at changes, which skips the jobs that are running.
+const rebalanceSQL = `WITH waiting AS (
+	SELECT queue, priority, run_at, job_id,
+		coalesce(args->>'ACOID', '') AS aco_id,
+		coalesce(args->>'ID', '') AS parent_id
+	FROM que_jobs
+	WHERE run_at <= now()
+), by_job AS (
+	SELECT *,
+		row_number() OVER (PARTITION BY queue, priority, aco_id, parent_id ORDER BY run_at, job_id) AS job_turn,
+		min(run_at) OVER (PARTITION BY queue, priority, aco_id, parent_id) AS job_since
+	FROM waiting
+), by_aco AS (
+	SELECT *,
+		row_number() OVER (PARTITION BY queue, priority, aco_id ORDER BY job_turn, job_since, job_id) AS aco_turn,
+		min(run_at) OVER (PARTITION BY queue, priority, aco_id) AS aco_since
+	FROM by_job
+), ordered AS (
+	SELECT queue, priority, run_at, job_id,
+		row_number() OVER (PARTITION BY queue, priority ORDER BY aco_turn, aco_since, job_id) AS position,
+		count(*) OVER (PARTITION BY queue, priority) AS total
+	FROM by_aco
+)
+UPDATE que_jobs AS q
+SET run_at = date_trunc('milliseconds', now()) - (o.total - o.position + 1) * interval '1 millisecond'
+FROM ordered AS o
+WHERE q.queue = o.queue AND q.priority = o.priority AND q.run_at = o.run_at AND q.job_id = o.job_id
+	AND pg_try_advisory_lock(q.job_id)`
+
+// Rebalance reorders the waiting jobs and returns how many were moved.
+// If another worker is already rebalancing the queue, nothing is moved.
+func (q *QueQueue) Rebalance() (int64, error) {
+	conn, err := q.pool.Acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer q.pool.Release(conn)
+	// The job locks are held by this connection's session, so they must be released before it is returned to the pool
+	defer func() {
+		if _, err := conn.Exec("SELECT pg_advisory_unlock_all()"); err != nil {
+			log.Errorf("Unable to release job queue locks: %s", err.Error())
+		}
+	}()
+
+	var locked bool
+	if err := conn.QueryRow("SELECT pg_try_advisory_lock($1::int, 0)", rebalanceLockKey).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	tag, err := conn.Exec(rebalanceSQL)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
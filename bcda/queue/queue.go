@@ -0,0 +1,116 @@
+// Package queue hands the chunks of an export job from the API to the workers.
+//
+// The API and the workers only depend on the Queue interface. Jobs are stored in Postgres by the que-go
+// implementation, while the in-memory implementation lets the code that enqueues and works jobs be tested
+// without a database.
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/bgentry/que-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrMissingType is returned when enqueuing a job without a type
+var ErrMissingType = errors.New("job type must be specified")
+
+// Job is a unit of work on the queue.
+type Job struct {
+	ID       int64
+	Queue    string
+	Priority int16
+	// RunAt is the earliest time the job will be worked
+	RunAt time.Time
+	// Type selects the WorkFunc used to work the job
+	Type string
+	Args []byte
+	// ErrorCount is the number of times the job has failed
+	ErrorCount int32
+	LastError  string
+
+	// retried is set when the job has been rescheduled while it is being worked
+	retried bool
+	// que is the locked job when it was taken from que
+	que *que.Job
+}
+
+// WorkFunc works a job. If it returns an error, the job is retried later with a backoff and its error count
+// is incremented. Otherwise the job is removed from the queue, unless it has been rescheduled using Retry.
+type WorkFunc func(j *Job) error
+
+// WorkMap holds the WorkFunc for each type of job.
+type WorkMap map[string]WorkFunc
+
+// Queue stores jobs until a worker is ready to work them.
+type Queue interface {
+	// Enqueue adds the job to the queue, setting its ID.
+	// Jobs are worked in order of priority (lowest first) and then RunAt.
+	Enqueue(j *Job) error
+	// WorkOne takes the next job that is due off the queue and works it using the WorkMap.
+	// It reports whether a job was worked.
+	WorkOne(wm WorkMap) bool
+	// Retry reschedules a job that is being worked to run again after the delay, without counting as a failed attempt.
+	// The job stays on the queue when its WorkFunc returns.
+	Retry(j *Job, delay time.Duration, reason string) error
+	// Depth returns the number of jobs on the queue, including those being worked.
+	Depth() (int, error)
+	// Close releases the queue's resources.
+	Close()
+}
+
+// Balancer is implemented by queues that can reorder the jobs waiting to run so that every ACO gets a fair share
+// of the workers. See QueQueue.Rebalance.
+type Balancer interface {
+	Rebalance() (int64, error)
+}
+
+// New returns the Queue configured by BCDA_QUEUE_BACKEND.
+// Supported values are "que" (default), which uses the database at QUEUE_DATABASE_URL, and "memory", which
+// can only be shared within a single process.
+func New() (Queue, error) {
+	backend := strings.ToLower(os.Getenv("BCDA_QUEUE_BACKEND"))
+	switch backend {
+	case "", "que":
+		q, err := NewQueQueue(os.Getenv("QUEUE_DATABASE_URL"))
+		if err != nil {
+			return nil, err
+		}
+		return q, nil
+	case "memory":
+		return NewMemoryQueue(), nil
+	default:
+		return nil, fmt.Errorf("unsupported queue backend %s", backend)
+	}
+}
+
+// retryDelay returns how long to wait before working a job again once it has failed errorCount times.
+// It matches the backoff used by que.
+func retryDelay(errorCount int32) time.Duration {
+	n := time.Duration(errorCount)
+	return (n*n*n*n + 3) * time.Second
+}
+
+// work runs the job's WorkFunc, turning a panic into an error so the job is retried.
+func work(wm WorkMap, j *Job) (err error) {
+	wf, ok := wm[j.Type]
+	if !ok {
+		err = fmt.Errorf("unknown job type: %q", j.Type)
+		log.Error(err)
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v\n%s", r, debug.Stack())
+			log.Errorf("Job %d panicked: %s", j.ID, err.Error())
+		}
+	}()
+
+	return wf(j)
+}
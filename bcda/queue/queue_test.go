@@ -0,0 +1,224 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type QueueTestSuite struct {
+	suite.Suite
+	q       Queue
+	name    string
+	cleanup func()
+}
+
+// MemoryQueueTestSuite runs the common queue tests against the in-memory queue.
+type MemoryQueueTestSuite struct {
+	QueueTestSuite
+}
+
+// QueQueueTestSuite runs the common queue tests against que, using a queue of its own.
+type QueQueueTestSuite struct {
+	QueueTestSuite
+}
+
+func (s *MemoryQueueTestSuite) SetupTest() {
+	s.q = NewMemoryQueue()
+	s.cleanup = func() {}
+}
+
+func (s *QueQueueTestSuite) SetupTest() {
+	s.name = fmt.Sprintf("test-%d", time.Now().UnixNano())
+	origQueue := os.Getenv("QUE_QUEUE")
+	os.Setenv("QUE_QUEUE", s.name)
+
+	q, err := NewQueQueue(os.Getenv("QUEUE_DATABASE_URL"))
+	os.Setenv("QUE_QUEUE", origQueue)
+	if err != nil {
+		s.FailNow("failed to connect to queue", err.Error())
+	}
+	s.q = q
+	s.cleanup = func() {
+		_, _ = q.pool.Exec("DELETE FROM que_jobs WHERE queue = $1", s.name)
+		q.Close()
+	}
+}
+
+func (s *QueueTestSuite) TearDownTest() {
+	s.cleanup()
+}
+
+func (s *QueueTestSuite) enqueue(priority int16, args string) *Job {
+	j := &Job{Queue: s.name, Type: "ProcessJob", Priority: priority, Args: []byte(args)}
+	s.NoError(s.q.Enqueue(j))
+	s.NotZero(j.ID)
+	return j
+}
+
+func (s *QueueTestSuite) TestWorkInOrder() {
+	depth, err := s.q.Depth()
+	s.NoError(err)
+
+	s.enqueue(100, `{"ID":1}`)
+	s.enqueue(20, `{"ID":2}`)
+	s.enqueue(100, `{"ID":3}`)
+
+	newDepth, err := s.q.Depth()
+	s.NoError(err)
+	s.Equal(depth+3, newDepth)
+
+	var worked []string
+	wm := WorkMap{"ProcessJob": func(j *Job) error {
+		worked = append(worked, string(j.Args))
+		return nil
+	}}
+	for s.q.WorkOne(wm) {
+	}
+
+	s.Equal([]string{`{"ID":2}`, `{"ID":1}`, `{"ID":3}`}, worked)
+	newDepth, err = s.q.Depth()
+	s.NoError(err)
+	s.Equal(depth, newDepth)
+}
+
+func (s *QueueTestSuite) TestWorkError() {
+	j := s.enqueue(100, `{"ID":1}`)
+
+	var attempts []int32
+	wm := WorkMap{"ProcessJob": func(j *Job) error {
+		attempts = append(attempts, j.ErrorCount)
+		return errors.New("job failed")
+	}}
+
+	// The job is not due again until its backoff has passed
+	s.True(s.q.WorkOne(wm))
+	s.False(s.q.WorkOne(wm))
+	s.Equal([]int32{0}, attempts)
+	s.Equal(int32(1), s.errorCount(j.ID))
+}
+
+func (s *QueueTestSuite) TestWorkPanic() {
+	j := s.enqueue(100, `{"ID":1}`)
+
+	s.True(s.q.WorkOne(WorkMap{"ProcessJob": func(j *Job) error { panic("job panicked") }}))
+	s.Equal(int32(1), s.errorCount(j.ID))
+}
+
+func (s *QueueTestSuite) TestWorkUnknownType() {
+	j := s.enqueue(100, `{"ID":1}`)
+
+	s.True(s.q.WorkOne(WorkMap{}))
+	s.Equal(int32(1), s.errorCount(j.ID))
+}
+
+func (s *QueueTestSuite) TestRetry() {
+	j := s.enqueue(100, `{"ID":1}`)
+
+	var retryErr error
+	wm := WorkMap{"ProcessJob": func(j *Job) error {
+		retryErr = s.q.Retry(j, time.Hour, "paused")
+		return nil
+	}}
+
+	// The job stays on the queue without counting as a failure
+	s.True(s.q.WorkOne(wm))
+	s.NoError(retryErr)
+	s.False(s.q.WorkOne(wm))
+	s.Equal(int32(0), s.errorCount(j.ID))
+
+	// Jobs that are not being worked cannot be retried
+	s.Error(s.q.Retry(j, time.Hour, "paused"))
+}
+
+func (s *QueueTestSuite) TestEnqueueMissingType() {
+	s.Equal(ErrMissingType, s.q.Enqueue(&Job{Queue: s.name}))
+}
+
+// errorCount returns the error count of the job on the queue, or -1 if it has been removed
+func (s *QueueTestSuite) errorCount(id int64) int32 {
+	switch q := s.q.(type) {
+	case *MemoryQueue:
+		for _, j := range q.Jobs() {
+			if j.ID == id {
+				return j.ErrorCount
+			}
+		}
+	case *QueQueue:
+		var count int32
+		if err := q.pool.QueryRow("SELECT error_count FROM que_jobs WHERE job_id = $1", id).Scan(&count); err == nil {
+			return count
+		}
+	}
+	return -1
+}
+
+func (s *QueQueueTestSuite) TestRebalance() {
+	q := s.q.(*QueQueue)
+
+	// ACO A requests two jobs before ACO B requests one, all with the same priority
+	runAt := time.Now().Add(-time.Hour)
+	for _, chunk := range []struct {
+		acoID string
+		jobID int
+		count int
+	}{
+		{"A", 1, 3},
+		{"A", 2, 2},
+		{"B", 3, 2},
+	} {
+		for i := 0; i < chunk.count; i++ {
+			args, err := json.Marshal(map[string]interface{}{"ID": chunk.jobID, "ACOID": chunk.acoID})
+			s.NoError(err)
+			runAt = runAt.Add(time.Second)
+			s.NoError(q.Enqueue(&Job{Queue: s.name, Type: "ProcessJob", Priority: 100, RunAt: runAt, Args: args}))
+		}
+	}
+
+	// A job that is not due yet keeps its place
+	s.NoError(q.Enqueue(&Job{Queue: s.name, Type: "ProcessJob", Priority: 100, RunAt: time.Now().Add(time.Hour),
+		Args: []byte(`{"ID":4,"ACOID":"C"}`)}))
+
+	moved, err := q.Rebalance()
+	s.NoError(err)
+	s.True(moved >= 7)
+
+	rows, err := q.pool.Query("SELECT args->>'ACOID', args->>'ID' FROM que_jobs WHERE queue = $1 ORDER BY priority, run_at, job_id", s.name)
+	s.Require().NoError(err)
+	defer rows.Close()
+	var order []string
+	for rows.Next() {
+		var acoID, jobID string
+		s.NoError(rows.Scan(&acoID, &jobID))
+		order = append(order, acoID+jobID)
+	}
+	s.Equal([]string{"A1", "B3", "A2", "B3", "A1", "A2", "A1", "C4"}, order)
+}
+
+func TestMemoryQueueTestSuite(t *testing.T) {
+	suite.Run(t, new(MemoryQueueTestSuite))
+}
+
+func TestQueQueueTestSuite(t *testing.T) {
+	suite.Run(t, new(QueQueueTestSuite))
+}
+
+func TestNew(t *testing.T) {
+	defer os.Setenv("BCDA_QUEUE_BACKEND", os.Getenv("BCDA_QUEUE_BACKEND"))
+
+	os.Setenv("BCDA_QUEUE_BACKEND", "memory")
+	q, err := New()
+	assert.NoError(t, err)
+	assert.IsType(t, &MemoryQueue{}, q)
+
+	os.Setenv("BCDA_QUEUE_BACKEND", "other")
+	q, err = New()
+	assert.EqualError(t, err, "unsupported queue backend other")
+	assert.Nil(t, q)
+}
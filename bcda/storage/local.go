@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// localStorage stores files on a (possibly shared) POSIX filesystem rooted at the FHIR_*_DIR directories.
+// The roots are resolved on every call so changes to the environment are honored.
+type localStorage struct{}
+
+// Ensure localStorage satisfies the interface
+var _ Storage = &localStorage{}
+
+func (s *localStorage) path(loc Location, name string) (string, error) {
+	cleaned, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(loc.root(), filepath.FromSlash(cleaned)), nil
+}
+
+func (s *localStorage) Put(loc Location, name string, r io.Reader) error {
+	p, err := s.path(loc, name)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	/* #nosec -- path is cleaned and rooted in the configured directory */
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+
+	// The data may only reach the disk when the file is closed
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *localStorage) Append(loc Location, name string) (io.WriteCloser, error) {
+	p, err := s.path(loc, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	/* #nosec -- path is cleaned and rooted in the configured directory */
+	return os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+}
+
+func (s *localStorage) Open(loc Location, name string) (io.ReadCloser, error) {
+	p, err := s.path(loc, name)
+	if err != nil {
+		return nil, err
+	}
+	/* #nosec -- path is cleaned and rooted in the configured directory */
+	return os.Open(p)
+}
+
+func (s *localStorage) Exists(loc Location, name string) (bool, error) {
+	p, err := s.path(loc, name)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *localStorage) Size(loc Location, name string) (int64, error) {
+	p, err := s.path(loc, name)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *localStorage) Truncate(loc Location, name string, size int64) error {
+	current, err := s.Size(loc, name)
+	if err != nil {
+		return err
+	}
+	if current < size {
+		return fmt.Errorf("cannot truncate %s to %d bytes, it only contains %d bytes", name, size, current)
+	}
+	if current == size {
+		return nil
+	}
+
+	p, err := s.path(loc, name)
+	if err != nil {
+		return err
+	}
+	return os.Truncate(p, size)
+}
+
+func (s *localStorage) Move(from, to Location, name string) error {
+	oldPath, err := s.path(from, name)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.path(to, name)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(newPath), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (s *localStorage) List(loc Location, dir string) ([]string, error) {
+	p, err := s.path(loc, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *localStorage) Delete(loc Location, name string) error {
+	p, err := s.path(loc, name)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStorage) DeleteAll(loc Location, dir string) error {
+	p, err := s.path(loc, dir)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (s *localStorage) Serve(w http.ResponseWriter, r *http.Request, loc Location, name string) {
+	p, err := s.path(loc, name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, p)
+}
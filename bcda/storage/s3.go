@@ -0,0 +1,536 @@
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// s3Storage stores files in an S3 compatible object store (AWS S3, MinIO, etc.) using path-style requests.
+// The FHIR_*_DIR values are used as key prefixes for each location.
+type s3Storage struct {
+	httpClient *http.Client
+	signer     *v4.Signer
+
+	endpoint string
+	bucket   string
+	region   string
+}
+
+// Ensure s3Storage satisfies the interface
+var _ Storage = &s3Storage{}
+
+func newS3Storage() (*s3Storage, error) {
+	bucket := os.Getenv("BCDA_S3_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("BCDA_S3_BUCKET must be set when using the s3 storage backend")
+	}
+
+	region := utils.FromEnv("BCDA_S3_REGION", "us-east-1")
+	endpoint := utils.FromEnv("BCDA_S3_ENDPOINT", fmt.Sprintf("https://s3.%s.amazonaws.com", region))
+
+	// Payloads are streamed from temporary files so we do not want to read them twice to compute the hash.
+	signer := v4.NewSigner(credentials.NewEnvCredentials(), func(s *v4.Signer) {
+		s.DisableURIPathEscaping = true
+		s.DisableRequestBodyOverwrite = true
+		s.UnsignedPayload = true
+	})
+
+	timeout := time.Duration(utils.GetEnvInt("BCDA_S3_TIMEOUT_SEC", 300)) * time.Second
+	return &s3Storage{
+		httpClient: &http.Client{Timeout: timeout},
+		signer:     signer,
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		bucket:     bucket,
+		region:     region,
+	}, nil
+}
+
+func (s *s3Storage) key(loc Location, name string) (string, error) {
+	cleaned, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := strings.Trim(path.Clean("/"+loc.root()), "/")
+	if prefix == "" {
+		return cleaned, nil
+	}
+	return prefix + "/" + cleaned, nil
+}
+
+func (s *s3Storage) Put(loc Location, name string, r io.Reader) error {
+	key, err := s.key(loc, name)
+	if err != nil {
+		return err
+	}
+
+	// S3 requires the content length up front, so spool the content to disk first.
+	f, err := ioutil.TempFile("", "bcda-s3-put")
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(f)
+
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	return s.putFile(key, f)
+}
+
+func (s *s3Storage) putFile(key string, f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(http.MethodPut, key, nil, ioutil.NopCloser(f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+
+	resp, err := s.do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to put %s", key)
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3Storage) Append(loc Location, name string) (io.WriteCloser, error) {
+	key, err := s.key(loc, name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "bcda-s3-append")
+	if err != nil {
+		return nil, err
+	}
+
+	// Objects are immutable, so we start from the existing content (if any) and upload the result on Close.
+	rc, err := s.get(key)
+	if err == nil {
+		_, err = io.Copy(f, rc)
+		rc.Close()
+		if err != nil {
+			removeTempFile(f)
+			return nil, err
+		}
+	} else if !isNotFound(err) {
+		removeTempFile(f)
+		return nil, err
+	}
+
+	return &s3Appender{File: f, s: s, key: key}, nil
+}
+
+// s3Appender buffers appended data in a temporary file that is uploaded when the writer is closed.
+type s3Appender struct {
+	*os.File
+	s   *s3Storage
+	key string
+}
+
+func (a *s3Appender) Close() error {
+	defer removeTempFile(a.File)
+	return a.s.putFile(a.key, a.File)
+}
+
+func (s *s3Storage) Open(loc Location, name string) (io.ReadCloser, error) {
+	key, err := s.key(loc, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.get(key)
+}
+
+func (s *s3Storage) get(key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Exists(loc Location, name string) (bool, error) {
+	key, err := s.key(loc, name)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := s.newRequest(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, resp.Body.Close()
+}
+
+func (s *s3Storage) Size(loc Location, name string) (int64, error) {
+	key, err := s.key(loc, name)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := s.newRequest(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		if isNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return resp.ContentLength, resp.Body.Close()
+}
+
+func (s *s3Storage) Truncate(loc Location, name string, size int64) error {
+	key, err := s.key(loc, name)
+	if err != nil {
+		return err
+	}
+
+	current, err := s.Size(loc, name)
+	if err != nil {
+		return err
+	}
+	if current < size {
+		return fmt.Errorf("cannot truncate %s to %d bytes, it only contains %d bytes", key, size, current)
+	}
+	if current == size {
+		return nil
+	}
+
+	f, err := ioutil.TempFile("", "bcda-s3-truncate")
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(f)
+
+	// Objects are immutable, so the retained content is downloaded and uploaded in its place.
+	if size > 0 {
+		req, err := s.newRequest(http.MethodGet, key, nil, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+
+		resp, err := s.do(req)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get %s", key)
+		}
+		n, err := io.Copy(f, io.LimitReader(resp.Body, size))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return fmt.Errorf("failed to truncate %s, received %d of %d bytes", key, n, size)
+		}
+	}
+
+	return s.putFile(key, f)
+}
+
+func (s *s3Storage) Move(from, to Location, name string) error {
+	src, err := s.key(from, name)
+	if err != nil {
+		return err
+	}
+	dst, err := s.key(to, name)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(http.MethodPut, dst, nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Amz-Copy-Source", escapeKey(s.bucket+"/"+src))
+
+	resp, err := s.do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to copy %s to %s", src, dst)
+	}
+	if err = resp.Body.Close(); err != nil {
+		return err
+	}
+
+	return s.deleteKey(src)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Storage) List(loc Location, dir string) ([]string, error) {
+	prefix, err := s.key(loc, dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix += "/"
+
+	keys, err := s.listKeys(prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, k := range keys {
+		names = append(names, strings.TrimPrefix(k, prefix))
+	}
+	return names, nil
+}
+
+// listKeys returns all of the keys that start with prefix. When shallow is set, keys in
+// "sub directories" of the prefix are excluded.
+func (s *s3Storage) listKeys(prefix string, shallow bool) ([]string, error) {
+	var (
+		keys  []string
+		token string
+	)
+
+	for {
+		params := url.Values{}
+		params.Set("list-type", "2")
+		params.Set("prefix", prefix)
+		if shallow {
+			params.Set("delimiter", "/")
+		}
+		if token != "" {
+			params.Set("continuation-token", token)
+		}
+
+		req, err := s.newRequest(http.MethodGet, "", params, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list %s", prefix)
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode listing for %s", prefix)
+		}
+
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) Delete(loc Location, name string) error {
+	key, err := s.key(loc, name)
+	if err != nil {
+		return err
+	}
+	return s.deleteKey(key)
+}
+
+func (s *s3Storage) deleteKey(key string) error {
+	req, err := s.newRequest(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to delete %s", key)
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3Storage) DeleteAll(loc Location, dir string) error {
+	prefix, err := s.key(loc, dir)
+	if err != nil {
+		return err
+	}
+
+	keys, err := s.listKeys(prefix+"/", false)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err = s.deleteKey(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Storage) Serve(w http.ResponseWriter, r *http.Request, loc Location, name string) {
+	key, err := s.key(loc, name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	req, err := s.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// Pass along headers that allow clients to resume downloads
+	for _, h := range []string{"Range", "If-None-Match", "If-Modified-Since"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		if isNotFound(err) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if se, ok := err.(*statusError); ok && se.code == http.StatusNotModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		log.Error(err)
+	}
+}
+
+func (s *s3Storage) newRequest(method, key string, params url.Values, body io.ReadCloser) (*http.Request, error) {
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid S3 endpoint %s", s.endpoint)
+	}
+
+	p := "/" + s.bucket
+	if key != "" {
+		p += "/" + key
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + p
+	u.RawPath = escapeKey(u.Path)
+	if params != nil {
+		u.RawQuery = strings.Replace(params.Encode(), "+", "%20", -1)
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = body
+	}
+	return req, nil
+}
+
+// do signs and sends the request. Any non-2xx response is returned as a *statusError.
+func (s *s3Storage) do(req *http.Request) (*http.Response, error) {
+	if _, err := s.signer.Sign(req, nil, "s3", s.region, time.Now()); err != nil {
+		return nil, errors.Wrap(err, "failed to sign S3 request")
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &statusError{code: resp.StatusCode, body: string(body)}
+	}
+	return resp, nil
+}
+
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return "received status code " + strconv.Itoa(e.code) + " from object store: " + e.body
+}
+
+func isNotFound(err error) bool {
+	se, ok := errors.Cause(err).(*statusError)
+	return ok && se.code == http.StatusNotFound
+}
+
+// escapeKey escapes each segment of a slash separated key.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+func removeTempFile(f *os.File) {
+	utils.CloseFileAndLogError(f)
+	if err := os.Remove(f.Name()); err != nil {
+		log.Error(err)
+	}
+}
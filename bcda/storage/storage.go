@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Location identifies one of the file areas used while exporting data.
+// Staging holds files that are still being written by the workers, Payload holds files
+// that are available for download and Archive holds files for expired jobs.
+type Location string
+
+const (
+	Staging Location = "staging"
+	Payload Location = "payload"
+	Archive Location = "archive"
+)
+
+// root returns the configured root (directory or key prefix) for the location
+func (l Location) root() string {
+	switch l {
+	case Staging:
+		return os.Getenv("FHIR_STAGING_DIR")
+	case Payload:
+		return os.Getenv("FHIR_PAYLOAD_DIR")
+	case Archive:
+		return os.Getenv("FHIR_ARCHIVE_DIR")
+	}
+	return ""
+}
+
+// Storage abstracts the location of staging, payload, and archive files so that the API and the
+// workers do not need to share a filesystem.
+//
+// Names are slash separated paths relative to the root of a Location, e.g. "42/<uuid>.ndjson".
+type Storage interface {
+	// Put writes the contents of r to name, replacing any existing file.
+	Put(loc Location, name string, r io.Reader) error
+
+	// Append returns a writer that appends to name, creating it if it does not exist.
+	// The data is only guaranteed to be stored once Close returns without error.
+	// S3 objects cannot be appended to, so there each call downloads the file and Close uploads all of it again;
+	// callers should buffer what they append rather than opening the file for each small write.
+	Append(loc Location, name string) (io.WriteCloser, error)
+
+	// Open returns a reader for the contents of name.
+	Open(loc Location, name string) (io.ReadCloser, error)
+
+	// Exists reports whether name is present.
+	Exists(loc Location, name string) (bool, error)
+
+	// Size returns the size of name in bytes. A file that does not exist has a size of 0.
+	Size(loc Location, name string) (int64, error)
+
+	// Truncate discards everything after the first size bytes of name.
+	// It is an error to truncate a file to a size larger than its current size.
+	Truncate(loc Location, name string, size int64) error
+
+	// Move moves name from one location to another, keeping the same name.
+	Move(from, to Location, name string) error
+
+	// List returns the names (relative to dir) of the files directly under dir.
+	// A missing dir results in an empty list.
+	List(loc Location, dir string) ([]string, error)
+
+	// Delete removes name. Removing a file that does not exist is not an error.
+	Delete(loc Location, name string) error
+
+	// DeleteAll removes dir and everything under it.
+	DeleteAll(loc Location, dir string) error
+
+	// Serve writes the contents of name to the response.
+	Serve(w http.ResponseWriter, r *http.Request, loc Location, name string)
+}
+
+// New returns the Storage configured by BCDA_STORAGE_BACKEND.
+// Supported values are "local" (default) and "s3".
+func New() (Storage, error) {
+	backend := strings.ToLower(os.Getenv("BCDA_STORAGE_BACKEND"))
+	switch backend {
+	case "", "local":
+		return &localStorage{}, nil
+	case "s3":
+		return newS3Storage()
+	default:
+		return nil, fmt.Errorf("unsupported storage backend %s", backend)
+	}
+}
+
+// cleanName normalizes name and rejects names that would escape the location root.
+func cleanName(name string) (string, error) {
+	cleaned := path.Clean("/" + strings.Replace(name, "\\", "/", -1))
+	cleaned = strings.TrimPrefix(cleaned, "/")
+	if cleaned == "" || cleaned == "." || strings.HasPrefix(cleaned, "..") {
+		return "", fmt.Errorf("invalid file name %s", name)
+	}
+	return cleaned, nil
+}
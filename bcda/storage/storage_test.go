@@ -0,0 +1,378 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type StorageTestSuite struct {
+	suite.Suite
+	store   Storage
+	cleanup func()
+}
+
+// LocalStorageTestSuite runs the common storage tests against the local filesystem.
+type LocalStorageTestSuite struct {
+	StorageTestSuite
+}
+
+// S3StorageTestSuite runs the common storage tests against an in-memory S3 stand-in.
+type S3StorageTestSuite struct {
+	StorageTestSuite
+	fake *fakeS3
+	ts   *httptest.Server
+}
+
+func setLocationEnv(root string) func() {
+	vars := map[string]string{
+		"FHIR_STAGING_DIR": root + "/staging",
+		"FHIR_PAYLOAD_DIR": root + "/payload",
+		"FHIR_ARCHIVE_DIR": root + "/archive",
+	}
+	orig := make(map[string]string)
+	for k, v := range vars {
+		orig[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range orig {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+func (s *LocalStorageTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "bcda-storage")
+	if err != nil {
+		s.FailNow(err.Error())
+	}
+	reset := setLocationEnv(dir)
+	s.cleanup = func() {
+		reset()
+		os.RemoveAll(dir)
+	}
+
+	origBackend := os.Getenv("BCDA_STORAGE_BACKEND")
+	defer os.Setenv("BCDA_STORAGE_BACKEND", origBackend)
+	os.Setenv("BCDA_STORAGE_BACKEND", "local")
+	s.store, err = New()
+	if err != nil {
+		s.FailNow(err.Error())
+	}
+}
+
+func (s *S3StorageTestSuite) SetupTest() {
+	s.fake = &fakeS3{bucket: "bcda", objects: make(map[string][]byte)}
+	s.ts = httptest.NewServer(s.fake)
+
+	vars := map[string]string{
+		"BCDA_STORAGE_BACKEND":  "s3",
+		"BCDA_S3_ENDPOINT":      s.ts.URL,
+		"BCDA_S3_BUCKET":        "bcda",
+		"AWS_ACCESS_KEY_ID":     "minio",
+		"AWS_SECRET_ACCESS_KEY": "minio-secret",
+	}
+	orig := make(map[string]string)
+	for k, v := range vars {
+		orig[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+	reset := setLocationEnv("/var/local")
+	s.cleanup = func() {
+		reset()
+		for k, v := range orig {
+			os.Setenv(k, v)
+		}
+		s.ts.Close()
+	}
+
+	var err error
+	s.store, err = New()
+	if err != nil {
+		s.FailNow(err.Error())
+	}
+}
+
+func (s *StorageTestSuite) TearDownTest() {
+	s.cleanup()
+}
+
+func (s *StorageTestSuite) read(loc Location, name string) string {
+	rc, err := s.store.Open(loc, name)
+	if err != nil {
+		s.FailNow(err.Error())
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	assert.NoError(s.T(), err)
+	return string(b)
+}
+
+func (s *StorageTestSuite) TestPutAndOpen() {
+	assert.NoError(s.T(), s.store.Put(Staging, "1/a.ndjson", strings.NewReader("line1\n")))
+	assert.Equal(s.T(), "line1\n", s.read(Staging, "1/a.ndjson"))
+
+	// Put replaces the existing content
+	assert.NoError(s.T(), s.store.Put(Staging, "1/a.ndjson", strings.NewReader("line2\n")))
+	assert.Equal(s.T(), "line2\n", s.read(Staging, "1/a.ndjson"))
+
+	_, err := s.store.Open(Payload, "1/a.ndjson")
+	assert.Error(s.T(), err)
+}
+
+func (s *StorageTestSuite) TestAppend() {
+	for _, line := range []string{"line1\n", "line2\n"} {
+		w, err := s.store.Append(Staging, "2/a.ndjson")
+		assert.NoError(s.T(), err)
+		_, err = w.Write([]byte(line))
+		assert.NoError(s.T(), err)
+		assert.NoError(s.T(), w.Close())
+	}
+	assert.Equal(s.T(), "line1\nline2\n", s.read(Staging, "2/a.ndjson"))
+}
+
+func (s *StorageTestSuite) TestExists() {
+	exists, err := s.store.Exists(Payload, "3/a.ndjson")
+	assert.NoError(s.T(), err)
+	assert.False(s.T(), exists)
+
+	assert.NoError(s.T(), s.store.Put(Payload, "3/a.ndjson", strings.NewReader("data")))
+	exists, err = s.store.Exists(Payload, "3/a.ndjson")
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), exists)
+}
+
+func (s *StorageTestSuite) TestSizeAndTruncate() {
+	size, err := s.store.Size(Staging, "8/a.ndjson")
+	assert.NoError(s.T(), err)
+	assert.EqualValues(s.T(), 0, size)
+	assert.NoError(s.T(), s.store.Truncate(Staging, "8/a.ndjson", 0), "truncating a missing file to 0 bytes should not fail")
+
+	assert.NoError(s.T(), s.store.Put(Staging, "8/a.ndjson", strings.NewReader("line1\nline2\n")))
+	size, err = s.store.Size(Staging, "8/a.ndjson")
+	assert.NoError(s.T(), err)
+	assert.EqualValues(s.T(), 12, size)
+
+	assert.Error(s.T(), s.store.Truncate(Staging, "8/a.ndjson", 13))
+
+	assert.NoError(s.T(), s.store.Truncate(Staging, "8/a.ndjson", 6))
+	assert.Equal(s.T(), "line1\n", s.read(Staging, "8/a.ndjson"))
+
+	assert.NoError(s.T(), s.store.Truncate(Staging, "8/a.ndjson", 0))
+	assert.Equal(s.T(), "", s.read(Staging, "8/a.ndjson"))
+}
+
+func (s *StorageTestSuite) TestMoveAndList() {
+	assert.NoError(s.T(), s.store.Put(Staging, "4/a.ndjson", strings.NewReader("a")))
+	assert.NoError(s.T(), s.store.Put(Staging, "4/b.ndjson", strings.NewReader("b")))
+	assert.NoError(s.T(), s.store.Put(Staging, "40/c.ndjson", strings.NewReader("c")))
+
+	names, err := s.store.List(Staging, "4")
+	assert.NoError(s.T(), err)
+	sort.Strings(names)
+	assert.Equal(s.T(), []string{"a.ndjson", "b.ndjson"}, names)
+
+	for _, name := range names {
+		assert.NoError(s.T(), s.store.Move(Staging, Payload, "4/"+name))
+	}
+
+	names, err = s.store.List(Staging, "4")
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), names)
+
+	names, err = s.store.List(Payload, "4")
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), names, 2)
+	assert.Equal(s.T(), "b", s.read(Payload, "4/b.ndjson"))
+
+	names, err = s.store.List(Archive, "does-not-exist")
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), names)
+}
+
+func (s *StorageTestSuite) TestDelete() {
+	assert.NoError(s.T(), s.store.Put(Archive, "5/a.ndjson", strings.NewReader("a")))
+	assert.NoError(s.T(), s.store.Put(Archive, "5/b.ndjson", strings.NewReader("b")))
+
+	assert.NoError(s.T(), s.store.Delete(Archive, "5/a.ndjson"))
+	assert.NoError(s.T(), s.store.Delete(Archive, "5/a.ndjson"), "deleting a missing file should not fail")
+	exists, err := s.store.Exists(Archive, "5/a.ndjson")
+	assert.NoError(s.T(), err)
+	assert.False(s.T(), exists)
+
+	assert.NoError(s.T(), s.store.DeleteAll(Archive, "5"))
+	names, err := s.store.List(Archive, "5")
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), names)
+}
+
+func (s *StorageTestSuite) TestServe() {
+	assert.NoError(s.T(), s.store.Put(Payload, "6/a.ndjson", strings.NewReader("served\n")))
+
+	rr := httptest.NewRecorder()
+	s.store.Serve(rr, httptest.NewRequest("GET", "/data/6/a.ndjson", nil), Payload, "6/a.ndjson")
+	assert.Equal(s.T(), http.StatusOK, rr.Code)
+	assert.Equal(s.T(), "served\n", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	s.store.Serve(rr, httptest.NewRequest("GET", "/data/6/missing.ndjson", nil), Payload, "6/missing.ndjson")
+	assert.Equal(s.T(), http.StatusNotFound, rr.Code)
+}
+
+func (s *StorageTestSuite) TestInvalidName() {
+	assert.Error(s.T(), s.store.Put(Payload, "", strings.NewReader("a")))
+	assert.Error(s.T(), s.store.Put(Payload, "/", strings.NewReader("a")))
+}
+
+func (s *S3StorageTestSuite) TestKeysArePrefixedAndSigned() {
+	assert.NoError(s.T(), s.store.Put(Payload, "7/a.ndjson", strings.NewReader("a")))
+
+	s.fake.Lock()
+	defer s.fake.Unlock()
+	_, ok := s.fake.objects["var/local/payload/7/a.ndjson"]
+	assert.True(s.T(), ok)
+	assert.True(s.T(), strings.HasPrefix(s.fake.lastAuth, "AWS4-HMAC-SHA256 Credential=minio/"))
+}
+
+func TestNewUnsupportedBackend(t *testing.T) {
+	orig := os.Getenv("BCDA_STORAGE_BACKEND")
+	defer os.Setenv("BCDA_STORAGE_BACKEND", orig)
+
+	os.Setenv("BCDA_STORAGE_BACKEND", "ftp")
+	_, err := New()
+	assert.EqualError(t, err, "unsupported storage backend ftp")
+}
+
+func TestNewS3MissingBucket(t *testing.T) {
+	origBackend, origBucket := os.Getenv("BCDA_STORAGE_BACKEND"), os.Getenv("BCDA_S3_BUCKET")
+	defer func() {
+		os.Setenv("BCDA_STORAGE_BACKEND", origBackend)
+		os.Setenv("BCDA_S3_BUCKET", origBucket)
+	}()
+
+	os.Setenv("BCDA_STORAGE_BACKEND", "s3")
+	os.Setenv("BCDA_S3_BUCKET", "")
+	_, err := New()
+	assert.Error(t, err)
+}
+
+func TestLocalStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(LocalStorageTestSuite))
+}
+
+func TestS3StorageTestSuite(t *testing.T) {
+	suite.Run(t, new(S3StorageTestSuite))
+}
+
+// fakeS3 is a minimal, MinIO-style stand-in for an S3 compatible object store.
+// It supports the path-style subset of the API used by s3Storage.
+type fakeS3 struct {
+	sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	lastAuth string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	f.lastAuth = auth
+
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if p != f.bucket && !strings.HasPrefix(p, f.bucket+"/") {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(p, f.bucket), "/")
+
+	if key == "" {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+			f.list(w, r.URL.Query())
+			return
+		}
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(src)
+			b, ok := f.objects[strings.TrimPrefix(strings.TrimPrefix(src, "/"), f.bucket+"/")]
+			if !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			f.objects[key] = append([]byte(nil), b...)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.objects[key] = b
+	case http.MethodGet, http.MethodHead:
+		b, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		// Handles Content-Length and Range requests
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(b))
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	type contents struct {
+		Key string `xml:"Key"`
+	}
+	type result struct {
+		XMLName     xml.Name   `xml:"ListBucketResult"`
+		Contents    []contents `xml:"Contents"`
+		IsTruncated bool       `xml:"IsTruncated"`
+	}
+
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	var res result
+	for k := range f.objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if delimiter != "" && strings.Contains(strings.TrimPrefix(k, prefix), delimiter) {
+			continue
+		}
+		res.Contents = append(res.Contents, contents{k})
+	}
+
+	var buf bytes.Buffer
+	if err := xml.NewEncoder(&buf).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(buf.Bytes())
+}
@@ -8,9 +8,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"time"
 
+	"github.com/CMSgov/bcda-app/bcda/fixedwidth"
 	"github.com/CMSgov/bcda-app/bcda/utils"
 
 	"github.com/jinzhu/gorm"
@@ -35,6 +35,35 @@ const (
 	trailerCode = "TRL_BENEDATASHR"
 )
 
+// headTrailLayout identifies the header and trailer lines of a suppression file
+var headTrailLayout = fixedwidth.MustLayout("suppression header/trailer",
+	fixedwidth.Field{Name: "code", Offset: 0, Length: 15},
+)
+
+var trailerLayout = fixedwidth.MustLayout("suppression trailer",
+	fixedwidth.Field{Name: "code", Offset: 0, Length: 15, Required: true},
+	fixedwidth.Field{Name: "recordCount", Offset: 23, Length: 10, Type: fixedwidth.Int, Required: true},
+)
+
+// suppressionLayout describes the fields of a suppression record that are imported
+var suppressionLayout = fixedwidth.MustLayout("suppression",
+	fixedwidth.Field{Name: "mbi", Offset: 0, Length: 11},
+	fixedwidth.Field{Name: "beneficiaryLinkKey", Offset: 11, Length: 10, Type: fixedwidth.Int},
+	fixedwidth.Field{Name: "effectiveDt", Offset: 354, Length: 8, Type: fixedwidth.Date},
+	fixedwidth.Field{Name: "sourceCode", Offset: 362, Length: 5},
+	fixedwidth.Field{Name: "prefIndicator", Offset: 368, Length: 1},
+	fixedwidth.Field{Name: "samhsaEffectiveDt", Offset: 369, Length: 8, Type: fixedwidth.Date},
+	fixedwidth.Field{Name: "samhsaSourceCode", Offset: 377, Length: 5},
+	fixedwidth.Field{Name: "samhsaPrefIndicator", Offset: 383, Length: 1},
+	fixedwidth.Field{Name: "acoCMSID", Offset: 384, Length: 5},
+)
+
+// headTrailCode returns the header or trailer code of the line, if it has one
+func headTrailCode(b []byte) string {
+	record, _ := headTrailLayout.Parse(b)
+	return record.String("code")
+}
+
 func ImportSuppressionDirectory(filePath string) (success, failure, skipped int, err error) {
 	var suppresslist []*suppressionFileMetadata
 
@@ -164,16 +193,11 @@ func validate(metadata *suppressionFileMetadata) error {
 	}
 	defer utils.CloseFileAndLogError(f)
 
-	var (
-		headTrailStart, headTrailEnd = 0, 15
-		recCountStart, recCountEnd   = 23, 33
-	)
-
 	sc := bufio.NewScanner(f)
 	count := 0
 	for sc.Scan() {
 		b := sc.Bytes()
-		metaInfo := string(bytes.TrimSpace(b[headTrailStart:headTrailEnd]))
+		metaInfo := headTrailCode(b)
 		if count == 0 {
 			if metaInfo != headerCode {
 				// invalid file header found
@@ -190,13 +214,14 @@ func validate(metadata *suppressionFileMetadata) error {
 			count++
 		} else {
 			// trailer info
-			expectedCount, err := strconv.Atoi(string(bytes.TrimSpace(b[recCountStart:recCountEnd])))
+			trailer, err := trailerLayout.Parse(b)
 			if err != nil {
 				fmt.Printf("Failed to parse record count from file: %s.\n", metadata.filePath)
 				err = fmt.Errorf("failed to parse record count from file: %s", metadata.filePath)
 				log.Error(err)
 				return err
 			}
+			expectedCount := trailer.Int("recordCount")
 			// subtract the single count from the header
 			count--
 			if count != expectedCount {
@@ -214,56 +239,40 @@ func validate(metadata *suppressionFileMetadata) error {
 
 func importSuppressionData(metadata *suppressionFileMetadata) error {
 	err := importSuppressionMetadata(metadata, func(fileID uint, b []byte, db *gorm.DB) error {
-		var (
-			mbiStart, mbiEnd                             = 0, 11
-			lKeyStart, lKeyEnd                           = 11, 21
-			effectiveDtStart, effectiveDtEnd             = 354, 362
-			sourceCdeStart, sourceCdeEnd                 = 362, 367
-			prefIndtorStart, prefIndtorEnd               = 368, 369
-			samhsaEffectiveDtStart, samhsaEffectiveDtEnd = 369, 377
-			samhsaSourceCdeStart, samhsaSourceCdeEnd     = 377, 382
-			samhsaPrefIndtorStart, samhsaPrefIndtorEnd   = 383, 384
-			acoIdStart, acoIdEnd                         = 384, 389
-		)
-		ds := string(bytes.TrimSpace(b[effectiveDtStart:effectiveDtEnd]))
-		dt, err := convertDt(ds)
-		if err != nil {
-			fmt.Printf("Failed to parse the effective date '%s' from file: %s.\n", ds, metadata.filePath)
-			err = errors.Wrapf(err, "failed to parse the effective date '%s' from file: %s", ds, metadata.filePath)
-			log.Error(err)
-			return err
-		}
-		ds = string(bytes.TrimSpace(b[samhsaEffectiveDtStart:samhsaEffectiveDtEnd]))
-		samhsaDt, err := convertDt(ds)
-		if err != nil {
-			fmt.Printf("Failed to parse the samhsa effective date '%s' from file: %s.\n", ds, metadata.filePath)
-			err = errors.Wrapf(err, "failed to parse the samhsa effective date '%s' from file: %s", ds, metadata.filePath)
-			log.Error(err)
-			return err
-		}
-		keyval := string(bytes.TrimSpace(b[lKeyStart:lKeyEnd]))
-		if keyval == "" {
-			keyval = "0"
-		}
-		lk, err := strconv.Atoi(keyval)
+		record, err := suppressionLayout.Parse(b)
 		if err != nil {
-			fmt.Printf("Failed to parse beneficiary link key from file: %s.\n", metadata.filePath)
-			err = errors.Wrapf(err, "failed to parse beneficiary link key from file: %s", metadata.filePath)
+			recordErr, ok := err.(*fixedwidth.RecordError)
+			if !ok {
+				return err
+			}
+			if fe := recordErr.Field("effectiveDt"); fe != nil {
+				fmt.Printf("Failed to parse the effective date '%s' from file: %s.\n", fe.Value, metadata.filePath)
+				err = errors.Wrapf(fe, "failed to parse the effective date '%s' from file: %s", fe.Value, metadata.filePath)
+			} else if fe := recordErr.Field("samhsaEffectiveDt"); fe != nil {
+				fmt.Printf("Failed to parse the samhsa effective date '%s' from file: %s.\n", fe.Value, metadata.filePath)
+				err = errors.Wrapf(fe, "failed to parse the samhsa effective date '%s' from file: %s", fe.Value, metadata.filePath)
+			} else if fe := recordErr.Field("beneficiaryLinkKey"); fe != nil {
+				fmt.Printf("Failed to parse beneficiary link key from file: %s.\n", metadata.filePath)
+				err = errors.Wrapf(fe, "failed to parse beneficiary link key from file: %s", metadata.filePath)
+			} else {
+				fmt.Printf("Failed to parse suppression record from file: %s.\n", metadata.filePath)
+				err = errors.Wrapf(err, "failed to parse suppression record from file: %s", metadata.filePath)
+			}
 			log.Error(err)
 			return err
 		}
 
 		suppression := &models.Suppression{
 			FileID:              fileID,
-			MBI:                 string(bytes.TrimSpace(b[mbiStart:mbiEnd])),
-			SourceCode:          string(bytes.TrimSpace(b[sourceCdeStart:sourceCdeEnd])),
-			EffectiveDt:         dt,
-			PrefIndicator:       string(bytes.TrimSpace(b[prefIndtorStart:prefIndtorEnd])),
-			SAMHSASourceCode:    string(bytes.TrimSpace(b[samhsaSourceCdeStart:samhsaSourceCdeEnd])),
-			SAMHSAEffectiveDt:   samhsaDt,
-			SAMHSAPrefIndicator: string(bytes.TrimSpace(b[samhsaPrefIndtorStart:samhsaPrefIndtorEnd])),
-			BeneficiaryLinkKey:  lk,
-			ACOCMSID:            string(bytes.TrimSpace(b[acoIdStart:acoIdEnd])),
+			MBI:                 record.String("mbi"),
+			SourceCode:          record.String("sourceCode"),
+			EffectiveDt:         record.Time("effectiveDt"),
+			PrefIndicator:       record.String("prefIndicator"),
+			SAMHSASourceCode:    record.String("samhsaSourceCode"),
+			SAMHSAEffectiveDt:   record.Time("samhsaEffectiveDt"),
+			SAMHSAPrefIndicator: record.String("samhsaPrefIndicator"),
+			BeneficiaryLinkKey:  record.Int("beneficiaryLinkKey"),
+			ACOCMSID:            record.String("acoCMSID"),
 		}
 		err = db.Create(suppression).Error
 		if err != nil {
@@ -286,10 +295,6 @@ func importSuppressionMetadata(metadata *suppressionFileMetadata, importFunc fun
 	fmt.Printf("Importing suppression file %s...\n", metadata)
 	log.Infof("Importing suppression file %s...", metadata)
 
-	var (
-		headTrailStart, headTrailEnd = 0, 15
-	)
-
 	suppressionMetaFile := &models.SuppressionFile{
 		Name:         metadata.name,
 		Timestamp:    metadata.timestamp,
@@ -324,7 +329,7 @@ func importSuppressionMetadata(metadata *suppressionFileMetadata, importFunc fun
 	for sc.Scan() {
 		b := sc.Bytes()
 		if len(bytes.TrimSpace(b)) > 0 {
-			metaInfo := string(bytes.TrimSpace(b[headTrailStart:headTrailEnd]))
+			metaInfo := headTrailCode(b)
 			if metaInfo == headerCode || metaInfo == trailerCode {
 				continue
 			}
@@ -389,17 +394,6 @@ func cleanupSuppression(suppresslist []*suppressionFileMetadata) error {
 	return nil
 }
 
-func convertDt(s string) (time.Time, error) {
-	if s == "" {
-		return time.Time{}, nil
-	}
-	t, err := time.Parse("20060102", s)
-	if err != nil || t.IsZero() {
-		return t, err
-	}
-	return t, nil
-}
-
 func (m suppressionFileMetadata) String() string {
 	if m.filePath != "" {
 		return m.filePath
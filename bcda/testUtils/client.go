@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/CMSgov/bcda-app/bcda/client/fhir"
 	models "github.com/CMSgov/bcda-app/bcda/models/fhir"
 
 	"github.com/stretchr/testify/mock"
@@ -41,6 +42,40 @@ func (bbc *BlueButtonClient) GetCoverage(beneficiaryID, jobID, cmsID, since stri
 	return args.Get(0).(*models.Bundle), args.Error(1)
 }
 
+// The Stream* methods are backed by the mocked Get* methods so existing expectations apply to both.
+func (bbc *BlueButtonClient) StreamExplanationOfBenefit(patientID, jobID, cmsID, since string, transactionTime time.Time, handler fhir.ResourceHandler) error {
+	return streamBundle(handler)(bbc.GetExplanationOfBenefit(patientID, jobID, cmsID, since, transactionTime))
+}
+
+func (bbc *BlueButtonClient) StreamPatient(patientID, jobID, cmsID, since string, transactionTime time.Time, handler fhir.ResourceHandler) error {
+	return streamBundle(handler)(bbc.GetPatient(patientID, jobID, cmsID, since, transactionTime))
+}
+
+func (bbc *BlueButtonClient) StreamCoverage(beneficiaryID, jobID, cmsID, since string, transactionTime time.Time, handler fhir.ResourceHandler) error {
+	return streamBundle(handler)(bbc.GetCoverage(beneficiaryID, jobID, cmsID, since, transactionTime))
+}
+
+func streamBundle(handler fhir.ResourceHandler) func(b *models.Bundle, err error) error {
+	return func(b *models.Bundle, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, entry := range b.Entries {
+			if entry["resource"] == nil {
+				continue
+			}
+			resource, err := json.Marshal(entry["resource"])
+			if err != nil {
+				return err
+			}
+			if err := handler(resource); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
 // Returns copy of a static json file (From Blue Button Sandbox originally) after replacing the patient ID of 20000000000001 with the requested identifier
 // This is private in the real function and should remain so, but in the test client it makes maintenance easier to expose it.
 func (bbc *BlueButtonClient) GetData(endpoint, patientID string) (string, error) {
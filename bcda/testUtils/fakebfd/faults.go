@@ -0,0 +1,117 @@
+package fakebfd
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Faults are injected into the responses to FHIR requests.
+type Faults struct {
+	// LatencyMS delays every response
+	LatencyMS int `json:"latency_ms"`
+	// ErrorRate is the fraction (0 to 1) of requests that fail with ErrorStatus, which defaults to 500
+	ErrorRate   float64 `json:"error_rate"`
+	ErrorStatus int     `json:"error_status"`
+	// ThrottleRate is the fraction (0 to 1) of requests that are turned away with a 429.
+	// When RetryAfterSec is set, the response asks the client to wait that long before trying again.
+	ThrottleRate  float64 `json:"throttle_rate"`
+	RetryAfterSec int     `json:"retry_after_sec"`
+}
+
+func (f Faults) validate() error {
+	if f.LatencyMS < 0 || f.RetryAfterSec < 0 {
+		return fmt.Errorf("latency_ms and retry_after_sec cannot be negative")
+	}
+	if f.ErrorRate < 0 || f.ThrottleRate < 0 || f.ErrorRate+f.ThrottleRate > 1 {
+		return fmt.Errorf("error_rate and throttle_rate must be between 0 and 1 and add up to at most 1")
+	}
+	if f.ErrorStatus != 0 && (f.ErrorStatus < 400 || f.ErrorStatus > 599) {
+		return fmt.Errorf("error_status must be a 4xx or 5xx status")
+	}
+	return nil
+}
+
+// SetFaults replaces the faults that are injected.
+func (s *Server) SetFaults(f Faults) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = f
+	return nil
+}
+
+// Faults returns the faults that are being injected.
+func (s *Server) Faults() Faults {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.faults
+}
+
+// serveFaults returns the faults being injected (GET) or replaces them (PUT).
+func (s *Server) serveFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var f Faults
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.SetFaults(f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("%s is not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.Faults())
+}
+
+// injector decides which requests fail
+type injector struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newInjector() *injector {
+	return &injector{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// inject delays the response and, if the request should fail, writes the failure.
+// It reports whether a response was written.
+func (i *injector) inject(w http.ResponseWriter, f Faults) bool {
+	if f.LatencyMS > 0 {
+		time.Sleep(time.Duration(f.LatencyMS) * time.Millisecond)
+	}
+
+	i.mu.Lock()
+	roll := i.rand.Float64()
+	i.mu.Unlock()
+
+	switch {
+	case roll < f.ThrottleRate:
+		if f.RetryAfterSec > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(f.RetryAfterSec))
+		}
+		writeOperationOutcome(w, http.StatusTooManyRequests, "throttled", "Injected throttling")
+		return true
+	case roll < f.ThrottleRate+f.ErrorRate:
+		status := f.ErrorStatus
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		writeOperationOutcome(w, status, "exception", "Injected error")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,426 @@
+/*
+Package fakebfd is a stand-in for the Blue Button (BFD) FHIR server, for use when developing locally and in tests.
+
+It serves the synthetic beneficiary data in shared_files/synthetic_beneficiary_data for every beneficiary it is
+told about, so that a BlueButtonClient created by client.NewBlueButtonClient can be pointed at it through
+BB_SERVER_LOCATION. Each beneficiary is looked up by the hash of their MBI, which uses the same BB_HASH_PEPPER and
+BB_HASH_ITER as the client, and gets a copy of the synthetic data under a Blue Button ID derived from the MBI.
+
+Searches support _lastUpdated ranges, paging with _count and startIndex (including next links), and excludeSAMHSA.
+Latency and error responses can be injected with SetFaults or by PUTting Faults as JSON to /fakebfd/faults.
+*/
+package fakebfd
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+
+	"github.com/CMSgov/bcda-app/bcda/client"
+)
+
+const (
+	// The synthetic data belongs to this beneficiary. It is replaced with the requested beneficiary's IDs.
+	templateBBID = "20000000000001"
+	templateMBI  = "-1Q03Z002871"
+
+	basePath       = "/v1/fhir"
+	mbiHashSystem  = "https://bluebutton.cms.gov/resources/identifier/mbi-hash"
+	fhirJSONFormat = "application/fhir+json"
+)
+
+// Substance abuse diagnosis codes (ICD-9 291-292 and 303-305, ICD-10 F10-F19). Claims with a matching diagnosis
+// are left out when excludeSAMHSA is requested.
+var defaultSAMHSACodes = []string{"291", "292", "303", "304", "305", "F10", "F11", "F12", "F13", "F14", "F15", "F16", "F17", "F18", "F19"}
+
+// Options configures the server.
+type Options struct {
+	// DataDir holds the Patient, Coverage and ExplanationOfBenefit bundles to serve
+	DataDir string
+	// LastUpdated is given to the first resource of each type that has no lastUpdated of its own.
+	// Each following resource was updated an hour after the one before it. Defaults to 2020-01-01T00:00:00Z.
+	LastUpdated time.Time
+	// SAMHSACodes are the diagnosis code prefixes that mark a claim as SAMHSA data. Defaults to substance abuse codes.
+	SAMHSACodes []string
+}
+
+// Server serves Blue Button's FHIR API for the beneficiaries that have been added to it.
+type Server struct {
+	templates   map[string][]resource
+	samhsaCodes []string
+
+	mu       sync.RWMutex
+	byHash   map[string]beneficiary
+	byBBID   map[string]beneficiary
+	faults   Faults
+	injector *injector
+}
+
+type beneficiary struct {
+	mbi  string
+	bbID string
+}
+
+type resource struct {
+	data        []byte
+	lastUpdated time.Time
+	samhsa      bool
+}
+
+// New loads the synthetic data and returns a server without any beneficiaries.
+func New(opts Options) (*Server, error) {
+	if opts.LastUpdated.IsZero() {
+		opts.LastUpdated = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if opts.SAMHSACodes == nil {
+		opts.SAMHSACodes = defaultSAMHSACodes
+	}
+
+	s := &Server{
+		templates:   make(map[string][]resource),
+		samhsaCodes: opts.SAMHSACodes,
+		byHash:      make(map[string]beneficiary),
+		byBBID:      make(map[string]beneficiary),
+		injector:    newInjector(),
+	}
+	for _, resourceType := range []string{"Patient", "Coverage", "ExplanationOfBenefit"} {
+		resources, err := s.loadTemplate(filepath.Join(opts.DataDir, resourceType), opts.LastUpdated)
+		if err != nil {
+			return nil, fmt.Errorf("could not load %s data: %w", resourceType, err)
+		}
+		s.templates[resourceType] = resources
+	}
+	return s, nil
+}
+
+// loadTemplate reads the resources in the bundle. Resources without a lastUpdated are given one so that they can be
+// filtered by _lastUpdated.
+func (s *Server) loadTemplate(path string, lastUpdated time.Time) ([]resource, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var bundle struct {
+		Entry []struct {
+			Resource map[string]interface{} `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, err
+	}
+
+	var resources []resource
+	for i, e := range bundle.Entry {
+		meta, _ := e.Resource["meta"].(map[string]interface{})
+		if meta == nil {
+			meta = make(map[string]interface{})
+			e.Resource["meta"] = meta
+		}
+
+		r := resource{samhsa: s.isSAMHSA(e.Resource)}
+		if v, ok := meta["lastUpdated"].(string); ok {
+			if r.lastUpdated, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				return nil, err
+			}
+		} else {
+			r.lastUpdated = lastUpdated.Add(time.Duration(i) * time.Hour)
+			meta["lastUpdated"] = r.lastUpdated.Format(time.RFC3339Nano)
+		}
+
+		if r.data, err = json.Marshal(e.Resource); err != nil {
+			return nil, err
+		}
+		resources = append(resources, r)
+	}
+	return resources, nil
+}
+
+// isSAMHSA reports whether any of the claim's diagnoses is for substance abuse.
+func (s *Server) isSAMHSA(res map[string]interface{}) bool {
+	diagnoses, _ := res["diagnosis"].([]interface{})
+	for _, d := range diagnoses {
+		concept, _ := d.(map[string]interface{})["diagnosisCodeableConcept"].(map[string]interface{})
+		codings, _ := concept["coding"].([]interface{})
+		for _, c := range codings {
+			code, _ := c.(map[string]interface{})["code"].(string)
+			for _, prefix := range s.samhsaCodes {
+				if strings.HasPrefix(code, prefix) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// AddBeneficiary makes the synthetic data available for the beneficiary and returns their Blue Button ID.
+func (s *Server) AddBeneficiary(mbi string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(mbi))
+	b := beneficiary{mbi: mbi, bbID: fmt.Sprintf("-%014d", h.Sum64()%1e14)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byHash[client.HashIdentifier(mbi)] = b
+	s.byBBID[b.bbID] = b
+	return b.bbID
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path == "/fakebfd/faults" {
+		s.serveFaults(w, r)
+		return
+	}
+	if !strings.HasPrefix(path, basePath+"/") {
+		writeOperationOutcome(w, http.StatusNotFound, "not-found", fmt.Sprintf("Unknown path %s", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeOperationOutcome(w, http.StatusMethodNotAllowed, "not-supported", fmt.Sprintf("%s is not supported", r.Method))
+		return
+	}
+	if s.injector.inject(w, s.Faults()) {
+		return
+	}
+
+	params := r.URL.Query()
+	switch resourceType := strings.TrimPrefix(path, basePath+"/"); resourceType {
+	case "metadata":
+		w.Header().Set("Content-Type", fhirJSONFormat)
+		_, _ = w.Write([]byte(`{"resourceType":"CapabilityStatement","status":"active","kind":"instance","fhirVersion":"3.0.1"}`))
+	case "Patient":
+		if identifier := params.Get("identifier"); identifier != "" {
+			s.search(w, r, resourceType, s.findByIdentifier(identifier))
+		} else {
+			s.search(w, r, resourceType, s.findByBBID(params.Get("_id")))
+		}
+	case "Coverage":
+		s.search(w, r, resourceType, s.findByBBID(params.Get("beneficiary")))
+	case "ExplanationOfBenefit":
+		s.search(w, r, resourceType, s.findByBBID(params.Get("patient")))
+	default:
+		writeOperationOutcome(w, http.StatusNotFound, "not-found", fmt.Sprintf("Unknown resource type %s", resourceType))
+	}
+}
+
+// findByIdentifier finds the beneficiary with the hashed MBI in an identifier search, e.g. <mbi-hash system>|<hash>.
+func (s *Server) findByIdentifier(identifier string) *beneficiary {
+	parts := strings.SplitN(identifier, "|", 2)
+	if len(parts) != 2 || parts[0] != mbiHashSystem {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if b, ok := s.byHash[parts[1]]; ok {
+		return &b
+	}
+	return nil
+}
+
+// findByBBID finds the beneficiary by their Blue Button ID, which may be given as a reference (Patient/<id>).
+func (s *Server) findByBBID(id string) *beneficiary {
+	id = strings.TrimPrefix(id, "Patient/")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if b, ok := s.byBBID[id]; ok {
+		return &b
+	}
+	return nil
+}
+
+// search writes a searchset bundle with the page of the beneficiary's resources that match the search.
+func (s *Server) search(w http.ResponseWriter, r *http.Request, resourceType string, b *beneficiary) {
+	params := r.URL.Query()
+	filters, err := parseLastUpdated(params["_lastUpdated"])
+	if err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	excludeSAMHSA := strings.EqualFold(params.Get("excludeSAMHSA"), "true")
+
+	var matches []resource
+	if b != nil {
+		for _, res := range s.templates[resourceType] {
+			if excludeSAMHSA && res.samhsa || !filters.match(res.lastUpdated) {
+				continue
+			}
+			matches = append(matches, res)
+		}
+	}
+
+	start, count := 0, len(matches)
+	if v := params.Get("startIndex"); v != "" {
+		if start, err = strconv.Atoi(v); err != nil || start < 0 {
+			writeOperationOutcome(w, http.StatusBadRequest, "invalid", fmt.Sprintf("Invalid startIndex %s", v))
+			return
+		}
+	}
+	if v := params.Get("_count"); v != "" {
+		if count, err = strconv.Atoi(v); err != nil || count < 1 {
+			writeOperationOutcome(w, http.StatusBadRequest, "invalid", fmt.Sprintf("Invalid _count %s", v))
+			return
+		}
+	}
+	if start > len(matches) {
+		start = len(matches)
+	}
+	end := start + count
+	if end > len(matches) {
+		end = len(matches)
+	}
+
+	bundle := searchBundle{
+		ResourceType: "Bundle",
+		ID:           uuid.NewRandom().String(),
+		Meta:         bundleMeta{LastUpdated: time.Now().Format(time.RFC3339Nano)},
+		Type:         "searchset",
+		Total:        len(matches),
+		Link:         pageLinks(r, start, count, len(matches)),
+		Entry:        []bundleEntry{},
+	}
+	for _, res := range matches[start:end] {
+		data := strings.NewReplacer(templateBBID, b.bbID, templateMBI, b.mbi).Replace(string(res.data))
+		bundle.Entry = append(bundle.Entry, bundleEntry{Resource: json.RawMessage(data)})
+	}
+
+	w.Header().Set("Content-Type", fhirJSONFormat)
+	if err := json.NewEncoder(w).Encode(bundle); err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "exception", err.Error())
+	}
+}
+
+type searchBundle struct {
+	ResourceType string        `json:"resourceType"`
+	ID           string        `json:"id"`
+	Meta         bundleMeta    `json:"meta"`
+	Type         string        `json:"type"`
+	Total        int           `json:"total"`
+	Link         []bundleLink  `json:"link"`
+	Entry        []bundleEntry `json:"entry"`
+}
+
+type bundleMeta struct {
+	LastUpdated string `json:"lastUpdated"`
+}
+
+type bundleLink struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
+type bundleEntry struct {
+	Resource json.RawMessage `json:"resource"`
+}
+
+// pageLinks returns the links between the pages of the search. Only a search that was paged gets links to other pages.
+func pageLinks(r *http.Request, start, count, total int) []bundleLink {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	pageURL := func(startIndex int) string {
+		params := r.URL.Query()
+		if startIndex >= 0 {
+			params.Set("startIndex", strconv.Itoa(startIndex))
+		}
+		u := url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawQuery: params.Encode()}
+		return u.String()
+	}
+
+	links := []bundleLink{{"self", pageURL(-1)}}
+	if r.URL.Query().Get("_count") == "" {
+		return links
+	}
+
+	last := 0
+	if total > 0 {
+		last = (total - 1) / count * count
+	}
+	links = append(links, bundleLink{"first", pageURL(0)})
+	if start > 0 {
+		prev := start - count
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, bundleLink{"previous", pageURL(prev)})
+	}
+	if start+count < total {
+		links = append(links, bundleLink{"next", pageURL(start + count)})
+	}
+	return append(links, bundleLink{"last", pageURL(last)})
+}
+
+// lastUpdatedFilter is a single _lastUpdated comparison, e.g. gt2020-01-01T00:00:00Z
+type lastUpdatedFilter struct {
+	prefix string
+	t      time.Time
+}
+
+type lastUpdatedFilters []lastUpdatedFilter
+
+func parseLastUpdated(values []string) (lastUpdatedFilters, error) {
+	var filters lastUpdatedFilters
+	for _, v := range values {
+		prefix := "eq"
+		if len(v) > 2 {
+			switch v[:2] {
+			case "eq", "gt", "ge", "lt", "le":
+				prefix, v = v[:2], v[2:]
+			}
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", v); err != nil {
+				return nil, fmt.Errorf("Invalid _lastUpdated %s%s", prefix, v)
+			}
+		}
+		filters = append(filters, lastUpdatedFilter{prefix, t})
+	}
+	return filters, nil
+}
+
+// match reports whether the time satisfies every filter
+func (filters lastUpdatedFilters) match(t time.Time) bool {
+	for _, f := range filters {
+		var ok bool
+		switch f.prefix {
+		case "gt":
+			ok = t.After(f.t)
+		case "ge":
+			ok = !t.Before(f.t)
+		case "lt":
+			ok = t.Before(f.t)
+		case "le":
+			ok = !t.After(f.t)
+		default:
+			ok = t.Equal(f.t)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func writeOperationOutcome(w http.ResponseWriter, status int, code, diagnostics string) {
+	w.Header().Set("Content-Type", fhirJSONFormat)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"resourceType": "OperationOutcome",
+		"issue": []map[string]string{
+			{"severity": "error", "code": code, "diagnostics": diagnostics},
+		},
+	})
+}
@@ -0,0 +1,170 @@
+package fakebfd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/models"
+)
+
+type FakeBFDTestSuite struct {
+	suite.Suite
+	server *Server
+	ts     *httptest.Server
+	bb     *client.BlueButtonClient
+	env    map[string]string
+}
+
+func (s *FakeBFDTestSuite) SetupTest() {
+	server, err := New(Options{DataDir: "../../../shared_files/synthetic_beneficiary_data", SAMHSACodes: []string{"486"}})
+	s.Require().NoError(err)
+	s.server = server
+	s.ts = httptest.NewTLSServer(server)
+
+	s.env = make(map[string]string)
+	for k, v := range map[string]string{
+		// The fake does not ask for a client certificate
+		"BB_CLIENT_CERT_FILE":          "",
+		"BB_CLIENT_KEY_FILE":           "",
+		"BB_CHECK_CERT":                "false",
+		"BB_SERVER_LOCATION":           s.ts.URL,
+		"BB_CLIENT_PAGE_SIZE":          "10",
+		"BB_REQUEST_MAX_TRIES":         "1",
+		"BB_REQUEST_RETRY_INTERVAL_MS": "10",
+		// The fault tests fail on purpose; keep them from opening the shared circuit breaker
+		"BB_BREAKER_MIN_REQUESTS": "1000000",
+	} {
+		s.env[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+
+	s.bb, err = client.NewBlueButtonClient()
+	s.Require().NoError(err)
+}
+
+func (s *FakeBFDTestSuite) TearDownTest() {
+	s.ts.Close()
+	for k, v := range s.env {
+		os.Setenv(k, v)
+	}
+}
+
+func (s *FakeBFDTestSuite) TestBlueButtonClient() {
+	bbID := s.server.AddBeneficiary("1A00A00AA00")
+
+	// Beneficiaries are found by the hash of their MBI
+	cclfBeneficiary := models.CCLFBeneficiary{MBI: "1A00A00AA00"}
+	blueButtonID, err := cclfBeneficiary.GetBlueButtonID(s.bb)
+	s.NoError(err)
+	s.Equal(bbID, blueButtonID)
+
+	_, err = (&models.CCLFBeneficiary{MBI: "9Z99Z99ZZ99"}).GetBlueButtonID(s.bb)
+	var unresolvable models.UnresolvableError
+	s.True(errors.As(err, &unresolvable))
+
+	// The beneficiary's data is the synthetic data with their ID
+	coverage, err := s.bb.GetCoverage(bbID, "1", "A0000", "", time.Now())
+	s.NoError(err)
+	s.Len(coverage.Entries, 3)
+	beneficiary := coverage.Entries[0]["resource"].(map[string]interface{})["beneficiary"]
+	s.Equal(map[string]interface{}{"reference": "Patient/" + bbID}, beneficiary)
+
+	// Each page follows the next link of the one before it, leaving out the 6 SAMHSA claims
+	requests := s.bb.RequestCount()
+	var eobs int
+	err = s.bb.StreamExplanationOfBenefit(bbID, "1", "A0000", "", time.Now(), func(resource json.RawMessage) error {
+		eobs++
+		s.Contains(string(resource), "Patient/"+bbID)
+		return nil
+	})
+	s.NoError(err)
+	s.Equal(27, eobs)
+	s.EqualValues(3, s.bb.RequestCount()-requests)
+}
+
+func (s *FakeBFDTestSuite) TestLastUpdated() {
+	bbID := s.server.AddBeneficiary("1A00A00AA00")
+
+	// Claims were updated an hour apart starting at 2020-01-01T00:00:00Z. Four of the first 29 are SAMHSA claims.
+	transactionTime := time.Date(2020, 1, 2, 4, 0, 0, 0, time.UTC)
+	eob, err := s.bb.GetExplanationOfBenefit(bbID, "1", "A0000", "", transactionTime)
+	s.NoError(err)
+	s.Len(eob.Entries, 25)
+
+	eob, err = s.bb.GetExplanationOfBenefit(bbID, "1", "A0000", "gt2020-01-01T10:30:00Z", transactionTime)
+	s.NoError(err)
+	s.Len(eob.Entries, 14)
+
+	resp, err := s.ts.Client().Get(s.ts.URL + "/v1/fhir/ExplanationOfBenefit/?patient=" + bbID + "&_lastUpdated=yesterday")
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *FakeBFDTestSuite) TestPaging() {
+	bbID := s.server.AddBeneficiary("1A00A00AA00")
+
+	resp, err := s.ts.Client().Get(s.ts.URL + "/v1/fhir/ExplanationOfBenefit/?patient=" + bbID + "&_count=10&startIndex=30")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+
+	var bundle searchBundle
+	s.NoError(json.NewDecoder(resp.Body).Decode(&bundle))
+	s.Equal(33, bundle.Total)
+	s.Len(bundle.Entry, 3)
+
+	links := make(map[string]string)
+	for _, l := range bundle.Link {
+		links[l.Relation] = l.URL
+	}
+	s.Contains(links["first"], "startIndex=0")
+	s.Contains(links["previous"], "startIndex=20")
+	s.Contains(links["last"], "startIndex=30")
+	s.NotContains(links, "next")
+}
+
+func (s *FakeBFDTestSuite) TestFaults() {
+	bbID := s.server.AddBeneficiary("1A00A00AA00")
+
+	s.NoError(s.server.SetFaults(Faults{ErrorRate: 1, ErrorStatus: http.StatusServiceUnavailable}))
+	_, err := s.bb.GetPatient(bbID, "1", "A0000", "", time.Now())
+	s.Equal(client.ServerError, client.Categorize(err))
+
+	s.NoError(s.server.SetFaults(Faults{ThrottleRate: 1}))
+	_, err = s.bb.GetPatient(bbID, "1", "A0000", "", time.Now())
+	s.Equal(client.ThrottledError, client.Categorize(err))
+
+	// Faults can be changed while the server is running
+	req, err := http.NewRequest(http.MethodPut, s.ts.URL+"/fakebfd/faults", strings.NewReader(`{"latency_ms":50}`))
+	s.Require().NoError(err)
+	resp, err := s.ts.Client().Do(req)
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.Equal(Faults{LatencyMS: 50}, s.server.Faults())
+
+	start := time.Now()
+	_, err = s.bb.GetPatient(bbID, "1", "A0000", "", time.Now())
+	s.NoError(err)
+	s.True(time.Since(start) >= 50*time.Millisecond)
+
+	req, err = http.NewRequest(http.MethodPut, s.ts.URL+"/fakebfd/faults", strings.NewReader(`{"error_rate":2}`))
+	s.Require().NoError(err)
+	resp, err = s.ts.Client().Do(req)
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestFakeBFDTestSuite(t *testing.T) {
+	suite.Run(t, new(FakeBFDTestSuite))
+}
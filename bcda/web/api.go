@@ -16,7 +16,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/bgentry/que-go"
 	fhirmodels "github.com/eug48/fhir/models"
 
 	"github.com/go-chi/chi"
@@ -28,13 +27,17 @@ import (
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/health"
 	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/queue"
 	"github.com/CMSgov/bcda-app/bcda/responseutils"
 	"github.com/CMSgov/bcda-app/bcda/servicemux"
+	"github.com/CMSgov/bcda-app/bcda/storage"
 	"github.com/CMSgov/bcda-app/bcda/utils"
 )
 
 var (
-	qc *que.Client
+	q queue.Queue
+	// service is the models service created when the package is initialized
+	service models.Service
 )
 
 const (
@@ -51,7 +54,7 @@ func init() {
 	db.DB().SetMaxIdleConns(utils.GetEnvInt("BCDA_DB_MAX_IDLE_CONNS", 25))
 	db.DB().SetConnMaxLifetime(time.Duration(utils.GetEnvInt("BCDA_DB_CONN_MAX_LIFETIME_MIN", 5)) * time.Minute)
 	repository := postgres.NewRepository(db)
-	models.GetService(repository, cutoffDuration, utils.GetEnvInt("BCDA_SUPPRESSION_LOOKBACK_DAYS", 60))
+	service = models.GetService(repository, cutoffDuration, utils.GetEnvInt("BCDA_SUPPRESSION_LOOKBACK_DAYS", 60))
 }
 
 /*
@@ -141,8 +144,8 @@ func bulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	if qc == nil {
-		err = errors.New("queue client not initialized")
+	if q == nil {
+		err = errors.New("queue not initialized")
 		log.Error(err)
 		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
 		responseutils.WriteError(oo, w, http.StatusInternalServerError)
@@ -245,7 +248,7 @@ func bulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request,
 		decodedSince, _ = url.QueryUnescape(params[0])
 	}
 
-	var enqueueJobs []*que.Job
+	var enqueueJobs []*queue.Job
 	enqueueJobs, err = newJob.GetEnqueJobs(resourceTypes, decodedSince, retrieveNewBeneHistData)
 	if err != nil {
 		log.Error(err)
@@ -267,7 +270,7 @@ func bulkRequest(resourceTypes []string, w http.ResponseWriter, r *http.Request,
 	// error where the job does not exist. Since queuejobs are retried, the transient error will be resolved
 	// once we finish inserting the job.
 	for _, j := range enqueueJobs {
-		if err = qc.Enqueue(j); err != nil {
+		if err = q.Enqueue(j); err != nil {
 			log.Error(err)
 			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
 			responseutils.WriteError(oo, w, http.StatusInternalServerError)
@@ -444,6 +447,21 @@ func jobStatus(w http.ResponseWriter, r *http.Request) {
 			JobID:               job.ID,
 		}
 
+		// Usage is informational, so the manifest is still returned without it
+		if usage, err := models.GetJobUsage(db, job.ID); err != nil {
+			log.Error(err)
+		} else {
+			rb.Extension = map[string]interface{}{"usage": usage}
+		}
+
+		store, err := storage.New()
+		if err != nil {
+			log.Error(err)
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
+			responseutils.WriteError(oo, w, http.StatusInternalServerError)
+			return
+		}
+
 		var jobKeysObj []models.JobKey
 		db.Find(&jobKeysObj, "job_id = ?", job.ID)
 		for _, jobKey := range jobKeysObj {
@@ -457,8 +475,10 @@ func jobStatus(w http.ResponseWriter, r *http.Request) {
 
 			// error files
 			errFileName := strings.Split(jobKey.FileName, ".")[0]
-			errFilePath := fmt.Sprintf("%s/%s/%s-error.ndjson", os.Getenv("FHIR_PAYLOAD_DIR"), jobID, errFileName)
-			if _, err := os.Stat(errFilePath); !os.IsNotExist(err) {
+			errFilePath := fmt.Sprintf("%s/%s-error.ndjson", jobID, errFileName)
+			if exists, err := store.Exists(storage.Payload, errFilePath); err != nil {
+				log.Error(err)
+			} else if exists {
 				errFI := fileItem{
 					Type: "OperationOutcome",
 					URL:  fmt.Sprintf("%s://%s/data/%s/%s-error.ndjson", scheme, r.Host, jobID, errFileName),
@@ -514,11 +534,19 @@ func jobStatus(w http.ResponseWriter, r *http.Request) {
 		500: errorResponse
 */
 func serveData(w http.ResponseWriter, r *http.Request) {
-	dataDir := os.Getenv("FHIR_PAYLOAD_DIR")
 	fileName := chi.URLParam(r, "fileName")
 	jobID := chi.URLParam(r, "jobID")
+
+	store, err := storage.New()
+	if err != nil {
+		log.Error(err)
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.Processing, "")
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/fhir+ndjson")
-	http.ServeFile(w, r, fmt.Sprintf("%s/%s/%s", dataDir, jobID, fileName))
+	store.Serve(w, r, storage.Payload, fmt.Sprintf("%s/%s", jobID, fileName))
 }
 
 /*
@@ -673,6 +701,82 @@ type bulkResponseBody struct {
 	// Information about error files, including URLs for downloading
 	Errors []fileItem `json:"error"`
 	JobID  uint
+	// Additional information about the job, such as the resources used to complete it
+	Extension map[string]interface{} `json:"extension,omitempty"`
+}
+
+/*
+	swagger:route GET /api/v1/attribution/diff attribution attributionDiff
+
+	Compare the beneficiaries attributed to your ACO by two CCLF8 files
+
+	Returns the MBIs of the beneficiaries that were added to, removed from and retained in your ACO's attribution between two of its CCLF8 files. By default the latest file is compared with the one before it; the `from` and `to` parameters select other files by ID. With `_format=ndjson` the result is three FHIR Groups (added, removed and retained), one per line.
+
+	Produces:
+	- application/json
+	- application/fhir+ndjson
+
+	Security:
+		bearer_token:
+
+	Responses:
+		200: attributionDiffResponse
+		400: badRequestResponse
+		401: invalidCredentials
+		404: notFoundResponse
+		500: errorResponse
+*/
+func attributionDiff(w http.ResponseWriter, r *http.Request) {
+	ad, err := readAuthData(r)
+	if err != nil {
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.TokenErr, "")
+		responseutils.WriteError(oo, w, http.StatusUnauthorized)
+		return
+	}
+
+	var fileIDs [2]uint
+	for i, param := range []string{"from", "to"} {
+		if v := r.URL.Query().Get(param); v != "" {
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, fmt.Sprintf("Invalid %s parameter. It must be the ID of a CCLF8 file.", param))
+				responseutils.WriteError(oo, w, http.StatusBadRequest)
+				return
+			}
+			fileIDs[i] = uint(id)
+		}
+	}
+
+	format := r.URL.Query().Get("_format")
+	if format != "" && format != "json" && format != "ndjson" {
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, "Invalid _format parameter. It must be json or ndjson.")
+		responseutils.WriteError(oo, w, http.StatusBadRequest)
+		return
+	}
+
+	diff, err := service.GetAttributionDiff(ad.CMSID, fileIDs[0], fileIDs[1])
+	if err != nil {
+		log.Error(err)
+		if errors.Cause(err) == models.ErrCCLFFileNotFound {
+			oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.RequestErr, "CCLF8 file not found.")
+			responseutils.WriteError(oo, w, http.StatusNotFound)
+			return
+		}
+		oo := responseutils.CreateOpOutcome(responseutils.Error, responseutils.Exception, responseutils.DbErr, "")
+		responseutils.WriteError(oo, w, http.StatusInternalServerError)
+		return
+	}
+
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/fhir+ndjson")
+		err = diff.WriteNDJSON(w)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(diff)
+	}
+	if err != nil {
+		log.Error(err)
+	}
 }
 
 func readAuthData(r *http.Request) (data auth.AuthData, err error) {
@@ -688,6 +792,7 @@ func GetJobTimeout() time.Duration {
 	return time.Hour * time.Duration(utils.GetEnvInt("ARCHIVE_THRESHOLD_HR", 24))
 }
 
-func SetQC(client *que.Client) {
-	qc = client
+// SetQueue sets the queue that export jobs are added to.
+func SetQueue(jobQueue queue.Queue) {
+	q = jobQueue
 }
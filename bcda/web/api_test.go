@@ -13,10 +13,8 @@ import (
 	"testing"
 	"time"
 
-	"github.com/bgentry/que-go"
 	fhirmodels "github.com/eug48/fhir/models"
 	"github.com/go-chi/chi"
-	"github.com/jackc/pgx"
 	"github.com/jinzhu/gorm"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
@@ -26,6 +24,7 @@ import (
 	"github.com/CMSgov/bcda-app/bcda/constants"
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/queue"
 	"github.com/CMSgov/bcda-app/bcda/responseutils"
 	"github.com/CMSgov/bcda-app/bcda/testUtils"
 )
@@ -330,28 +329,24 @@ func bulkEOBRequestHelper(endpoint, since string, s *APITestSuite) {
 	ad := makeContextValues(acoID)
 	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
 
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-	if err != nil {
-		s.T().Error(err)
-	}
-
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: que.PrepareStatements,
-	})
-	if err != nil {
-		s.T().Error(err)
-	}
-	defer pgxpool.Close()
-
-	qc = que.NewClient(pgxpool)
+	memQueue := queue.NewMemoryQueue()
+	q = memQueue
 
 	handler := http.HandlerFunc(handlerFunc)
 	handler.ServeHTTP(s.rr, req)
 
 	assert.Equal(s.T(), http.StatusAccepted, s.rr.Code)
 
+	jobs := memQueue.Jobs()
+	assert.NotEmpty(s.T(), jobs)
+	for _, j := range jobs {
+		var args map[string]interface{}
+		assert.NoError(s.T(), json.Unmarshal(j.Args, &args))
+		assert.Equal(s.T(), "ProcessJob", j.Type)
+		assert.Equal(s.T(), acoID, args["ACOID"])
+		assert.Equal(s.T(), "ExplanationOfBenefit", args["ResourceType"])
+	}
+
 	s.db.Unscoped().Where("request_url = ?", requestUrl).Delete(models.Job{})
 	s.db.Unscoped().Where("aco_id = ?", acoID).Delete(models.Job{})
 }
@@ -366,22 +361,7 @@ func bulkEOBRequestInvalidSinceFormatHelper(endpoint, since string, s *APITestSu
 	ad := makeContextValues(acoID)
 	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
 
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-	if err != nil {
-		s.T().Error(err)
-	}
-
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: que.PrepareStatements,
-	})
-	if err != nil {
-		s.T().Error(err)
-	}
-	defer pgxpool.Close()
-
-	qc = que.NewClient(pgxpool)
+	q = queue.NewMemoryQueue()
 
 	handler := http.HandlerFunc(handlerFunc)
 	handler.ServeHTTP(s.rr, req)
@@ -412,22 +392,7 @@ func bulkEOBRequestNoBeneficiariesInACOHelper(endpoint string, s *APITestSuite)
 	ad := makeContextValues(acoID)
 	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
 
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-	if err != nil {
-		s.T().Error(err)
-	}
-
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: que.PrepareStatements,
-	})
-	if err != nil {
-		s.T().Error(err)
-	}
-	defer pgxpool.Close()
-
-	qc = que.NewClient(pgxpool)
+	q = queue.NewMemoryQueue()
 
 	handler := http.HandlerFunc(handlerFunc)
 	handler.ServeHTTP(s.rr, req)
@@ -456,7 +421,7 @@ func bulkEOBRequestMissingTokenHelper(endpoint string, s *APITestSuite) {
 }
 
 func bulkEOBRequestNoQueueHelper(endpoint string, s *APITestSuite) {
-	qc = nil
+	q = nil
 
 	acoID := constants.SmallACOUUID
 	jobCount, err := s.getJobCount(acoID)
@@ -503,22 +468,7 @@ func bulkPatientRequestHelper(endpoint, since string, s *APITestSuite) {
 	ad := makeContextValues(acoID)
 	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
 
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-	if err != nil {
-		s.T().Error(err)
-	}
-
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: que.PrepareStatements,
-	})
-	if err != nil {
-		s.T().Error(err)
-	}
-	defer pgxpool.Close()
-
-	qc = que.NewClient(pgxpool)
+	q = queue.NewMemoryQueue()
 
 	handler := http.HandlerFunc(handlerFunc)
 	handler.ServeHTTP(s.rr, req)
@@ -537,22 +487,7 @@ func bulkPatientRequestInvalidSinceFormatHelper(endpoint, since string, s *APITe
 	ad := makeContextValues(acoID)
 	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
 
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-	if err != nil {
-		s.T().Error(err)
-	}
-
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: que.PrepareStatements,
-	})
-	if err != nil {
-		s.T().Error(err)
-	}
-	defer pgxpool.Close()
-
-	qc = que.NewClient(pgxpool)
+	q = queue.NewMemoryQueue()
 
 	handler := http.HandlerFunc(handlerFunc)
 	handler.ServeHTTP(s.rr, req)
@@ -582,22 +517,7 @@ func bulkCoverageRequestHelper(endpoint string, requestParams RequestParams, s *
 	ad := makeContextValues(acoID)
 	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
 
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-	if err != nil {
-		s.T().Error(err)
-	}
-
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: que.PrepareStatements,
-	})
-	if err != nil {
-		s.T().Error(err)
-	}
-	defer pgxpool.Close()
-
-	qc = que.NewClient(pgxpool)
+	q = queue.NewMemoryQueue()
 
 	handler := http.HandlerFunc(handlerFunc)
 	handler.ServeHTTP(s.rr, req)
@@ -616,22 +536,7 @@ func bulkCoverageRequestInvalidSinceFormatHelper(endpoint, since string, s *APIT
 	ad := makeContextValues(acoID)
 	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
 
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-	if err != nil {
-		s.T().Error(err)
-	}
-
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: que.PrepareStatements,
-	})
-	if err != nil {
-		s.T().Error(err)
-	}
-	defer pgxpool.Close()
-
-	qc = que.NewClient(pgxpool)
+	q = queue.NewMemoryQueue()
 
 	handler := http.HandlerFunc(handlerFunc)
 	handler.ServeHTTP(s.rr, req)
@@ -658,22 +563,7 @@ func bulkCoverageRequestInvalidSinceDateHelper(endpoint, since string, s *APITes
 	ad := makeContextValues(acoID)
 	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
 
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-	if err != nil {
-		s.T().Error(err)
-	}
-
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: que.PrepareStatements,
-	})
-	if err != nil {
-		s.T().Error(err)
-	}
-	defer pgxpool.Close()
-
-	qc = que.NewClient(pgxpool)
+	q = queue.NewMemoryQueue()
 
 	handler := http.HandlerFunc(handlerFunc)
 	handler.ServeHTTP(s.rr, req)
@@ -700,22 +590,7 @@ func bulkCoverageRequestInvalidOutputHelper(endpoint, outputFormat string, s *AP
 	ad := makeContextValues(acoID)
 	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
 
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-	if err != nil {
-		s.T().Error(err)
-	}
-
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: que.PrepareStatements,
-	})
-	if err != nil {
-		s.T().Error(err)
-	}
-	defer pgxpool.Close()
-
-	qc = que.NewClient(pgxpool)
+	q = queue.NewMemoryQueue()
 
 	handler := http.HandlerFunc(handlerFunc)
 	handler.ServeHTTP(s.rr, req)
@@ -790,8 +665,7 @@ func bulkConcurrentRequestHelper(endpoint string, s *APITestSuite) {
 
 	ad := makeContextValues(acoID)
 	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
-	pool := makeConnPool(s)
-	defer pool.Close()
+	q = queue.NewMemoryQueue()
 
 	// serve job
 	handler := http.HandlerFunc(handlerFunc)
@@ -909,8 +783,7 @@ func bulkConcurrentRequestTimeHelper(endpoint string, s *APITestSuite) {
 
 	ad := makeContextValues(acoID)
 	req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
-	pool := makeConnPool(s)
-	defer pool.Close()
+	q = queue.NewMemoryQueue()
 
 	// serve job
 	handler := http.HandlerFunc(handlerFunc)
@@ -1202,6 +1075,12 @@ func (s *APITestSuite) TestJobStatusCompleted() {
 	}
 	assert.Equal(s.T(), 10, len(expectedUrls))
 
+	for i, resourceType := range []string{"ExplanationOfBenefit", "Patient"} {
+		u := models.JobUsage{QueJobID: time.Now().UnixNano() + int64(i), JobID: j.ID, ResourceType: resourceType, BBRequests: 12, Resources: 30, Bytes: 4000, DurationMS: 1500}
+		assert.NoError(s.T(), models.AddJobUsage(s.db, u))
+	}
+	defer s.db.Unscoped().Where("job_id = ?", j.ID).Delete(&models.JobUsage{})
+
 	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/jobs/%d", j.ID), nil)
 	req.TLS = &tls.ConnectionState{}
 
@@ -1244,6 +1123,7 @@ func (s *APITestSuite) TestJobStatusCompleted() {
 
 	}
 	assert.Empty(s.T(), rb.Errors)
+	assert.Equal(s.T(), map[string]interface{}{"bbRequests": 24.0, "resources": 60.0, "bytes": 8000.0, "seconds": 3.0}, rb.Extension["usage"])
 	s.db.Unscoped().Delete(&j)
 }
 
@@ -1569,27 +1449,67 @@ func TestAPITestSuite(t *testing.T) {
 	suite.Run(t, new(APITestSuite))
 }
 
-func makeContextValues(acoID string) (data auth.AuthData) {
-	return auth.AuthData{ACOID: acoID, TokenID: uuid.NewRandom().String()}
-}
+func (s *APITestSuite) TestAttributionDiff() {
+	cmsID := "A9990"
+	now := time.Now().Round(time.Second)
+	var files []models.CCLFFile
+	for i, mbis := range [][]string{{"1A0000AA001", "1A0000AA002"}, {"1A0000AA002", "1A0000AA003"}} {
+		f := models.CCLFFile{CCLFNum: 8, Name: fmt.Sprintf("T.BCD.%s.ZC8Y20.D2010%02d.T1000000", cmsID, i+1), ACOCMSID: cmsID,
+			Timestamp: now.AddDate(0, i-1, 0), PerformanceYear: 20, ImportStatus: constants.ImportComplete}
+		assert.NoError(s.T(), s.db.Create(&f).Error)
+		for _, mbi := range mbis {
+			assert.NoError(s.T(), s.db.Create(&models.CCLFBeneficiary{FileID: f.ID, MBI: mbi}).Error)
+		}
+		files = append(files, f)
+		defer func() { assert.NoError(s.T(), f.Delete()) }()
+	}
 
-func makeConnPool(s *APITestSuite) *pgx.ConnPool {
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-	if err != nil {
-		s.T().Error(err)
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{"Latest", "", http.StatusOK},
+		{"FileIDs", fmt.Sprintf("?from=%d&to=%d", files[0].ID, files[1].ID), http.StatusOK},
+		{"NDJSON", "?_format=ndjson", http.StatusOK},
+		{"InvalidFileID", "?from=abc", http.StatusBadRequest},
+		{"InvalidFormat", "?_format=xml", http.StatusBadRequest},
+		{"NoPreviousFile", fmt.Sprintf("?to=%d", files[0].ID), http.StatusNotFound},
 	}
 
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: que.PrepareStatements,
-	})
-	if err != nil {
-		s.T().Error(err)
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/api/v1/attribution/diff"+tt.query, nil)
+			ad := makeContextValues(constants.DevACOUUID)
+			ad.CMSID = cmsID
+			req = req.WithContext(context.WithValue(req.Context(), auth.AuthDataContextKey, ad))
+
+			http.HandlerFunc(attributionDiff).ServeHTTP(rr, req)
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			if tt.name == "NDJSON" {
+				assert.Equal(t, "application/fhir+ndjson", rr.Header().Get("Content-Type"))
+				assert.Len(t, strings.Split(strings.TrimSpace(rr.Body.String()), "\n"), 3)
+				return
+			}
+
+			var diff models.AttributionDiff
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &diff))
+			assert.Equal(t, files[0].ID, diff.From.ID)
+			assert.Equal(t, files[1].ID, diff.To.ID)
+			assert.Equal(t, []string{"1A0000AA003"}, diff.Added)
+			assert.Equal(t, []string{"1A0000AA001"}, diff.Removed)
+			assert.Equal(t, []string{"1A0000AA002"}, diff.Retained)
+		})
 	}
-	qc = que.NewClient(pgxpool)
+}
 
-	return pgxpool
+func makeContextValues(acoID string) (data auth.AuthData) {
+	return auth.AuthData{ACOID: acoID, TokenID: uuid.NewRandom().String()}
 }
 
 // Compare expiry header against the expected time value.
@@ -32,6 +32,7 @@ func NewAPIRouter() http.Handler {
 		r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders).Get(m.WrapHandler("/Patient/$export", bulkPatientRequest))
 		r.With(auth.RequireTokenAuth, ValidateBulkRequestHeaders).Get(m.WrapHandler("/Group/{groupId}/$export", bulkGroupRequest))
 		r.With(auth.RequireTokenAuth, auth.RequireTokenJobMatch).Get(m.WrapHandler("/jobs/{jobID}", jobStatus))
+		r.With(auth.RequireTokenAuth).Get(m.WrapHandler("/attribution/diff", attributionDiff))
 		r.Get(m.WrapHandler("/metadata", metadata))
 	})
 	r.Get(m.WrapHandler("/_version", getVersion))
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// beneResult holds the outcome of retrieving the data for a single beneficiary
+type beneResult struct {
+	index      int
+	cclfBeneID string
+	data       *spool
+	err        error
+	errMsg     string
+	// writeErr is set when the retrieved data could not be spooled
+	writeErr error
+	// resources is the number of resources spooled
+	resources int
+	// invalid describes each resource that failed validation and was not spooled
+	invalid []string
+	// skipped is set when the beneficiary's data is not retrieved and nothing needs to be written
+	skipped bool
+}
+
+// release frees any data held by the result.
+func (r beneResult) release() {
+	if r.data == nil {
+		return
+	}
+	if err := r.data.Close(); err != nil {
+		log.Error(err)
+	}
+}
+
+// benePool retrieves beneficiary data using a bounded number of goroutines.
+//
+// A beneficiary holds one of the pool's permits from the time its data is requested until the caller
+// signals (via done) that the result has been processed. This bounds both the number of in-flight requests
+// and the number of results buffered while waiting to be written in order. It also guarantees that
+// a call to stop made while processing a result prevents any further beneficiaries from being requested.
+type benePool struct {
+	ordered bool
+
+	permits  chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newBenePool(concurrency int, ordered bool) *benePool {
+	return &benePool{
+		ordered: ordered,
+		permits: make(chan struct{}, concurrency),
+		stopped: make(chan struct{}),
+	}
+}
+
+// run starts retrieving the data for the supplied beneficiaries. The caller must receive from the returned channel
+// until it is closed and must call done once for every result it receives.
+func (p *benePool) run(cclfBeneficiaryIDs []string, fetch func(cclfBeneficiaryID string) beneResult) <-chan beneResult {
+	indexes := make(chan int)
+	results := make(chan beneResult)
+
+	go func() {
+		defer close(indexes)
+		for i := range cclfBeneficiaryIDs {
+			select {
+			case p.permits <- struct{}{}:
+			case <-p.stopped:
+				return
+			}
+
+			// The permit may have been released after the pool was stopped
+			select {
+			case <-p.stopped:
+				<-p.permits
+				return
+			default:
+			}
+
+			indexes <- i
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for n := 0; n < cap(p.permits); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				result := fetch(cclfBeneficiaryIDs[i])
+				result.index = i
+				results <- result
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	if !p.ordered {
+		return results
+	}
+	return orderResults(results)
+}
+
+// orderResults emits the results in the order the beneficiaries were supplied.
+func orderResults(results <-chan beneResult) <-chan beneResult {
+	ordered := make(chan beneResult)
+
+	go func() {
+		defer close(ordered)
+		pending := make(map[int]beneResult)
+		next := 0
+		for result := range results {
+			pending[result.index] = result
+			for {
+				r, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				ordered <- r
+				next++
+			}
+		}
+	}()
+
+	return ordered
+}
+
+// done signals that the caller has finished processing a result.
+func (p *benePool) done() {
+	<-p.permits
+}
+
+// stop prevents any beneficiaries that have not been requested yet from being requested.
+// Results for requests that are already in flight are still delivered.
+func (p *benePool) stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopped)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func beneIDs(n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		ids = append(ids, fmt.Sprint(i))
+	}
+	return ids
+}
+
+func TestBenePoolOrdered(t *testing.T) {
+	ids := beneIDs(50)
+	pool := newBenePool(8, true)
+
+	var received []string
+	for result := range pool.run(ids, func(id string) beneResult {
+		time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		return beneResult{cclfBeneID: id}
+	}) {
+		received = append(received, result.cclfBeneID)
+		pool.done()
+	}
+
+	assert.Equal(t, ids, received)
+}
+
+func TestBenePoolUnordered(t *testing.T) {
+	ids := beneIDs(50)
+	pool := newBenePool(8, false)
+
+	received := make(map[string]bool)
+	for result := range pool.run(ids, func(id string) beneResult {
+		return beneResult{cclfBeneID: id}
+	}) {
+		received[result.cclfBeneID] = true
+		pool.done()
+	}
+
+	assert.Len(t, received, len(ids))
+}
+
+func TestBenePoolBoundsConcurrency(t *testing.T) {
+	const concurrency = 4
+	var inFlight, maxInFlight int32
+
+	pool := newBenePool(concurrency, false)
+	for range pool.run(beneIDs(40), func(id string) beneResult {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		return beneResult{cclfBeneID: id}
+	}) {
+		pool.done()
+	}
+
+	assert.True(t, maxInFlight <= concurrency, "at most %d beneficiaries should be fetched at once, found %d", concurrency, maxInFlight)
+	assert.True(t, maxInFlight > 1, "beneficiaries should be fetched concurrently")
+}
+
+func TestBenePoolStop(t *testing.T) {
+	for _, concurrency := range []int{1, 4} {
+		var (
+			mu        sync.Mutex
+			requested []string
+		)
+
+		pool := newBenePool(concurrency, true)
+		errorCount := 0
+		for result := range pool.run(beneIDs(100), func(id string) beneResult {
+			mu.Lock()
+			requested = append(requested, id)
+			mu.Unlock()
+			return beneResult{cclfBeneID: id, err: errors.New("error")}
+		}) {
+			if result.err != nil {
+				errorCount++
+			}
+			if errorCount >= 2 {
+				pool.stop()
+			}
+			pool.done()
+		}
+
+		// Every beneficiary that was requested holds a permit until it is processed,
+		// so at most concurrency - 1 requests can be made after the pool is stopped.
+		assert.True(t, len(requested) <= 2+concurrency-1, "concurrency %d: unexpected number of requests %d", concurrency, len(requested))
+		if concurrency == 1 {
+			assert.Equal(t, []string{"0", "1"}, requested)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/queue"
+	"github.com/CMSgov/bcda-app/bcda/storage"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// retryableError indicates that the chunk stopped part way through and can be resumed from its checkpoint
+// by retrying the queued job.
+type retryableError struct {
+	error
+}
+
+// requeueError indicates that the chunk was paused for reasons outside of its control, e.g. Blue Button being
+// unavailable or the worker shutting down. The queued job is resumed from its checkpoint after the delay without
+// counting as a failed attempt.
+type requeueError struct {
+	error
+	delay time.Duration
+}
+
+// requeueJob reschedules the queued job to run after the delay without incrementing its error count.
+// If the job cannot be rescheduled, the requeueError is returned so the queue retries it using its usual backoff
+// instead, without it being dead-lettered.
+func requeueJob(j *queue.Job, rerr requeueError) error {
+	if q == nil {
+		return rerr
+	}
+
+	if err := q.Retry(j, rerr.delay, rerr.Error()); err != nil {
+		log.Error(err)
+		return rerr
+	}
+
+	log.Infof("Requeued job %d to run in %s: %s", j.ID, rerr.delay, rerr.Error())
+	return nil
+}
+
+// getRequeueDelay returns how long to wait before resuming a chunk paused by the Blue Button circuit breaker.
+// The chunk waits at least BCDA_WORKER_BREAKER_REQUEUE_SEC, or until the breaker lets requests through if that is later.
+func getRequeueDelay() time.Duration {
+	delay := time.Duration(utils.GetEnvInt("BCDA_WORKER_BREAKER_REQUEUE_SEC", 30)) * time.Second
+	if d := client.CircuitBreakerRetryAfter(); d > delay {
+		delay = d.Round(time.Second)
+	}
+	return delay
+}
+
+// chunkCheckpoint persists the progress made while writing a chunk's data and error files.
+type chunkCheckpoint struct {
+	db    *gorm.DB
+	store storage.Storage
+	jobID string
+	model *models.JobCheckpoint
+}
+
+// loadCheckpoint returns the checkpoint for the queued job, or an empty checkpoint if this is the first attempt.
+func loadCheckpoint(db *gorm.DB, queJobID int64, jobID uint) (*models.JobCheckpoint, error) {
+	var cp models.JobCheckpoint
+	err := db.Where("que_job_id = ?", queJobID).First(&cp).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return &models.JobCheckpoint{QueJobID: queJobID, JobID: jobID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+func (c *chunkCheckpoint) dataFile() string {
+	return fmt.Sprintf("%s/%s.ndjson", c.jobID, c.model.FileUUID)
+}
+
+func (c *chunkCheckpoint) errorFile() string {
+	return fmt.Sprintf("%s/%s-error.ndjson", c.jobID, c.model.FileUUID)
+}
+
+// resume prepares the chunk's files for writing. The files from a previous attempt are reused and anything written
+// after its last checkpoint is discarded. It returns the file UUID along with the index of the first beneficiary
+// to process and the number of errors already encountered.
+func (c *chunkCheckpoint) resume(cclfBeneficiaryIDs []string) (fileUUID string, start, errorCount int, err error) {
+	m := c.model
+
+	if m.FileUUID != "" {
+		if err := c.rewind(cclfBeneficiaryIDs); err != nil {
+			log.Warnf("Unable to resume chunk from checkpoint for job %s, starting over: %s", c.jobID, err.Error())
+			c.abandon()
+		}
+	}
+
+	if m.FileUUID == "" {
+		m.FileUUID = uuid.NewRandom().String()
+		m.NextBeneficiary, m.LastBeneficiaryID, m.ErrorCount, m.DataSize, m.ErrorSize = 0, "", 0, 0, 0
+
+		// Record the file before anything is written to it so a retry never leaves it orphaned
+		if err := c.db.Save(m).Error; err != nil {
+			return "", 0, 0, err
+		}
+	} else if m.NextBeneficiary > 0 {
+		log.Infof("Resuming chunk for job %s at beneficiary %d of %d", c.jobID, m.NextBeneficiary, len(cclfBeneficiaryIDs))
+	}
+
+	return m.FileUUID, m.NextBeneficiary, m.ErrorCount, nil
+}
+
+// rewind truncates the chunk's files to the sizes recorded by the checkpoint.
+func (c *chunkCheckpoint) rewind(cclfBeneficiaryIDs []string) error {
+	m := c.model
+	if m.NextBeneficiary > len(cclfBeneficiaryIDs) ||
+		(m.NextBeneficiary > 0 && cclfBeneficiaryIDs[m.NextBeneficiary-1] != m.LastBeneficiaryID) {
+		return fmt.Errorf("checkpoint at beneficiary %s does not match the chunk", m.LastBeneficiaryID)
+	}
+
+	if err := c.store.Truncate(storage.Staging, c.dataFile(), m.DataSize); err != nil {
+		return err
+	}
+	return c.store.Truncate(storage.Staging, c.errorFile(), m.ErrorSize)
+}
+
+// abandon removes the files written by a previous attempt that cannot be resumed.
+func (c *chunkCheckpoint) abandon() {
+	for _, name := range []string{c.dataFile(), c.errorFile()} {
+		if err := c.store.Delete(storage.Staging, name); err != nil {
+			log.Error(err)
+		}
+	}
+	c.model.FileUUID = ""
+}
+
+// save records that every beneficiary before next has been processed.
+// The chunk's files must be closed so their contents have been persisted.
+func (c *chunkCheckpoint) save(cclfBeneficiaryIDs []string, next, errorCount int) error {
+	dataSize, err := c.store.Size(storage.Staging, c.dataFile())
+	if err != nil {
+		return err
+	}
+	errorSize, err := c.store.Size(storage.Staging, c.errorFile())
+	if err != nil {
+		return err
+	}
+
+	m := c.model
+	m.NextBeneficiary, m.ErrorCount, m.DataSize, m.ErrorSize = next, errorCount, dataSize, errorSize
+	if next > 0 {
+		m.LastBeneficiaryID = cclfBeneficiaryIDs[next-1]
+	}
+	return c.db.Save(m).Error
+}
+
+// clearCheckpoint removes the checkpoint once the chunk no longer needs to be resumed.
+func clearCheckpoint(db *gorm.DB, cp *models.JobCheckpoint) {
+	if cp == nil || cp.ID == 0 {
+		return
+	}
+	if err := db.Unscoped().Delete(cp).Error; err != nil {
+		log.Error(err)
+	}
+}
+
+// chunkRecorded reports whether an earlier attempt at the chunk exported every beneficiary and recorded its file,
+// or the job has been completed without it.
+func chunkRecorded(db *gorm.DB, cp *models.JobCheckpoint, exportJob models.Job, beneficiaries int) (bool, error) {
+	if exportJob.Status == "Completed" {
+		return true, nil
+	}
+	if cp.FileUUID == "" || cp.NextBeneficiary < beneficiaries {
+		return false, nil
+	}
+
+	var count int
+	err := db.Model(&models.JobKey{}).Where("job_id = ? AND file_name = ?", exportJob.ID, cp.FileUUID+".ndjson").Count(&count).Error
+	return count > 0, err
+}
+
+// getCheckpointInterval returns the number of beneficiaries processed between checkpoints.
+// Each checkpoint persists the chunk's files, so larger values trade redundant work on retry for fewer writes.
+func getCheckpointInterval() int {
+	interval := utils.GetEnvInt("BCDA_WORKER_CHECKPOINT_INTERVAL", 100)
+	if interval < 1 {
+		interval = 1
+	}
+	return interval
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/queue"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// getMaxJobAttempts returns the number of times a queued job is attempted before it is dead-lettered.
+func getMaxJobAttempts() int32 {
+	attempts := utils.GetEnvInt("BCDA_WORKER_MAX_JOB_ATTEMPTS", 10)
+	if attempts < 1 {
+		attempts = 1
+	}
+	return int32(attempts)
+}
+
+// withDeadLetter stops a queued job from being retried forever. When the job fails on its final attempt,
+// it is moved to the dead letter table along with its error and its parent job is marked Failed.
+// Jobs that were paused or interrupted by a shutdown did not fail, so they are never dead-lettered.
+func withDeadLetter(wf queue.WorkFunc) queue.WorkFunc {
+	return func(j *queue.Job) error {
+		err := wf(j)
+		if _, ok := err.(requeueError); ok {
+			return err
+		}
+		if err == nil || j.ErrorCount+1 < getMaxJobAttempts() {
+			return err
+		}
+
+		if dlErr := deadLetterJob(j, err); dlErr != nil {
+			log.Errorf("Unable to dead-letter job %d, leaving it on the queue: %s", j.ID, dlErr.Error())
+			return err
+		}
+
+		log.Errorf("Job %d failed %d time(s), moved to the dead letter table: %s", j.ID, j.ErrorCount+1, err.Error())
+		// By returning a nil error response, we're signaling to the queue to remove this job from the jobqueue.
+		return nil
+	}
+}
+
+func deadLetterJob(j *queue.Job, jobErr error) error {
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	// The parent job can only be failed if the arguments can be read
+	var jobArgs jobEnqueueArgs
+	if err := json.Unmarshal(j.Args, &jobArgs); err != nil {
+		log.Warnf("Unable to read arguments of job %d: %s", j.ID, err.Error())
+	}
+
+	dl := models.DeadLetterJob{
+		QueJobID:   j.ID,
+		JobID:      uint(jobArgs.ID),
+		Queue:      j.Queue,
+		Priority:   j.Priority,
+		Type:       j.Type,
+		Args:       string(j.Args),
+		ErrorCount: j.ErrorCount + 1,
+		LastError:  jobErr.Error(),
+	}
+	return models.AddDeadLetterJob(db, &dl)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/CMSgov/bcda-app/bcda/constants"
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/queue"
+)
+
+func TestWithDeadLetterRetries(t *testing.T) {
+	jobErr := errors.New("job failed")
+	wf := withDeadLetter(func(j *queue.Job) error { return jobErr })
+
+	// Errors are returned to que until the final attempt
+	assert.Equal(t, jobErr, wf(&queue.Job{ErrorCount: 0}))
+	assert.Equal(t, jobErr, wf(&queue.Job{ErrorCount: getMaxJobAttempts() - 2}))
+
+	assert.Nil(t, withDeadLetter(func(j *queue.Job) error { return nil })(&queue.Job{ErrorCount: 100}))
+
+	// Paused and interrupted jobs are never dead-lettered
+	requeued := requeueError{errors.New("chunk interrupted by worker shutdown"), 0}
+	assert.Equal(t, requeued, withDeadLetter(func(j *queue.Job) error { return requeued })(&queue.Job{ErrorCount: 100}))
+}
+
+func TestWithDeadLetterExhausted(t *testing.T) {
+	defer func(orig string) { os.Setenv("BCDA_WORKER_MAX_JOB_ATTEMPTS", orig) }(os.Getenv("BCDA_WORKER_MAX_JOB_ATTEMPTS"))
+	os.Setenv("BCDA_WORKER_MAX_JOB_ATTEMPTS", "3")
+
+	db := database.GetGORMDbConnection()
+	defer database.Close(db)
+
+	j := models.Job{ACOID: uuid.Parse(constants.DevACOUUID), RequestURL: "/api/v1/Patient/$export", Status: "In Progress", JobCount: 1}
+	assert.NoError(t, db.Create(&j).Error)
+	defer db.Unscoped().Delete(&j)
+
+	queJob := &queue.Job{ID: time.Now().UnixNano(), Type: "ProcessJob", Priority: 100, ErrorCount: 2,
+		Args: []byte(fmt.Sprintf(`{"ID":%d,"ResourceType":"Patient"}`, j.ID))}
+	wf := withDeadLetter(func(j *queue.Job) error { return errors.New("Blue Button request failed") })
+
+	// The job is removed from the queue once it has been dead-lettered
+	assert.Nil(t, wf(queJob))
+
+	var dl models.DeadLetterJob
+	assert.NoError(t, db.First(&dl, "que_job_id = ?", queJob.ID).Error)
+	defer db.Unscoped().Delete(&dl)
+	assert.Equal(t, j.ID, dl.JobID)
+	assert.Equal(t, int32(3), dl.ErrorCount)
+	assert.Equal(t, "ProcessJob", dl.Type)
+	assert.Equal(t, string(queJob.Args), dl.Args)
+	assert.Equal(t, "Blue Button request failed", dl.LastError)
+
+	assert.NoError(t, db.First(&j, j.ID).Error)
+	assert.Equal(t, "Failed", j.Status)
+	assert.Contains(t, j.FailureReason, "failed 3 time(s): Blue Button request failed")
+}
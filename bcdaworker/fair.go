@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/metrics"
+	"github.com/CMSgov/bcda-app/bcda/queue"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// getFairQueueInterval returns how often the queue is rebalanced. An interval of 0 turns rebalancing off.
+func getFairQueueInterval() time.Duration {
+	return time.Duration(utils.GetEnvInt("BCDA_WORKER_FAIR_QUEUE_INTERVAL_SEC", 15)) * time.Second
+}
+
+// balanceQueue rebalances the queue until the worker is shut down, so that workers take turns between the chunks
+// of every ACO and job instead of working through them in the order they were requested.
+func balanceQueue(b queue.Balancer, s *workerShutdown) {
+	interval := getFairQueueInterval()
+	if interval <= 0 {
+		log.Info("Fair scheduling of queued jobs is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case <-ticker.C:
+			if _, err := b.Rebalance(); err != nil {
+				log.Errorf("Unable to rebalance job queue: %s", err.Error())
+			}
+		}
+	}
+}
+
+// recordQueueWait reports how long a chunk waited on the queue before a worker started it, broken down by ACO.
+func recordQueueWait(jobArgs jobEnqueueArgs, cmsID string, attempt int32) {
+	if jobArgs.EnqueuedAt.IsZero() {
+		return
+	}
+	wait := time.Since(jobArgs.EnqueuedAt)
+
+	log.WithFields(log.Fields{
+		"jobID":          jobArgs.ID,
+		"cms_id":         cmsID,
+		"attempt":        attempt,
+		"queue_wait_sec": wait.Seconds(),
+	}).Info("Worker started job chunk")
+
+	env := os.Getenv("DEPLOYMENT_TARGET")
+	if env == "" {
+		return
+	}
+	sampler, err := metrics.NewSampler("BCDA", "Seconds")
+	if err != nil {
+		fmt.Println("Warning: failed to create new metric sampler...")
+		return
+	}
+	err = sampler.PutSample("JobQueueWait", wait.Seconds(), []metrics.Dimension{
+		{Name: "Environment", Value: env},
+		{Name: "ACO", Value: cmsID},
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
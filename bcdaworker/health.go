@@ -48,6 +48,7 @@ func (l *HealthLogger) Log() {
 	} else {
 		logFields["bb"] = "error"
 	}
+	logFields["bb_breaker"] = health.BlueButtonBreakerState()
 
 	entry.Logger.WithFields(logFields).Info()
 }
@@ -2,17 +2,16 @@ package main
 
 import (
 	"bufio"
-	"database/sql"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"strconv"
 	"syscall"
 	"time"
 
-	"github.com/bgentry/que-go"
-	"github.com/jackc/pgx"
 	"github.com/jinzhu/gorm"
 	newrelic "github.com/newrelic/go-agent"
 	"github.com/pborman/uuid"
@@ -20,17 +19,19 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/client/fhir"
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/metrics"
 	"github.com/CMSgov/bcda-app/bcda/models"
-	fhirmodels "github.com/CMSgov/bcda-app/bcda/models/fhir"
 	"github.com/CMSgov/bcda-app/bcda/monitoring"
+	"github.com/CMSgov/bcda-app/bcda/queue"
 	"github.com/CMSgov/bcda-app/bcda/responseutils"
+	"github.com/CMSgov/bcda-app/bcda/storage"
 	"github.com/CMSgov/bcda-app/bcda/utils"
 )
 
 var (
-	qc  *que.Client
+	q   queue.Queue
 	txn newrelic.Transaction
 )
 
@@ -41,6 +42,7 @@ type jobEnqueueArgs struct {
 	ResourceType    string
 	Since           string
 	TransactionTime time.Time
+	EnqueuedAt      time.Time
 }
 
 func init() {
@@ -66,7 +68,7 @@ func createWorkerDirs() {
 	}
 }
 
-func processJob(j *que.Job) error {
+func processJob(j *queue.Job) error {
 	m := monitoring.GetMonitor()
 	txn = m.Start("processJob", nil, nil)
 	defer m.End(txn)
@@ -95,7 +97,7 @@ func processJob(j *que.Job) error {
 		if j.ErrorCount >= maxNotFoundRetries {
 			log.Errorf("No job found for ID: %d acoID: %s. Retries exhausted. Removing job from queue.", jobArgs.ID, 
 			jobArgs.ACOID)
-			// By returning a nil error response, we're singaling to que-go to remove this job from the jobqueue.
+			// By returning a nil error response, we're singaling to the queue to remove this job from the jobqueue.
 			return nil
 		}
 
@@ -113,6 +115,12 @@ func processJob(j *que.Job) error {
 		return errors.Wrap(err, "could not retrieve ACO from database")
 	}
 
+	cmsID := jobArgs.ACOID
+	if aco.CMSID != nil {
+		cmsID = *aco.CMSID
+	}
+	recordQueueWait(jobArgs, cmsID, j.ErrorCount+1)
+
 	err = db.Model(&exportJob).Where("status = ?", "Pending").Update("status", "In Progress").Error
 	if err != nil {
 		return errors.Wrap(err, "could not update job status in database")
@@ -126,41 +134,60 @@ func processJob(j *que.Job) error {
 	}
 
 	jobID := strconv.Itoa(jobArgs.ID)
-	stagingPath := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
-	payloadPath := fmt.Sprintf("%s/%s", os.Getenv("FHIR_PAYLOAD_DIR"), jobID)
-
-	if err = createDir(stagingPath); err != nil {
-		log.Error(err)
-		return err
-	}
 
-	if err = createDir(payloadPath); err != nil {
-		log.Error(err)
-		return err
+	cp, err := loadCheckpoint(db, j.ID, exportJob.ID)
+	if err != nil {
+		return errors.Wrap(err, "could not retrieve job checkpoint from database")
 	}
 
-	fileUUID, err := writeBBDataToFile(bb, db, jobArgs.ACOID, *aco.CMSID, jobArgs.BeneficiaryIDs, jobID, jobArgs.ResourceType, jobArgs.Since, jobArgs.TransactionTime)
-	fileName := fileUUID + ".ndjson"
-
-	// This is only run AFTER completion of all the collection
+	recorded, err := chunkRecorded(db, cp, exportJob, len(jobArgs.BeneficiaryIDs))
 	if err != nil {
-		err = db.Model(&exportJob).Update("status", "Failed").Error
-		if err != nil {
+		return errors.Wrap(err, "could not check whether the chunk was recorded")
+	}
+
+	// An earlier attempt may have exported the chunk but failed to complete the job, in which case only the job
+	// is left to complete
+	if !recorded {
+		usage := &chunkUsage{}
+		started, requests := time.Now(), requestCount(bb)
+		fileUUID, err := resumeBBDataToFile(bb, db, cp, usage, jobArgs.ACOID, *aco.CMSID, jobArgs.BeneficiaryIDs, jobID, jobArgs.ResourceType, jobArgs.Since, jobArgs.TransactionTime)
+		recordChunkUsage(db, models.JobUsage{QueJobID: j.ID, JobID: exportJob.ID, ResourceType: jobArgs.ResourceType,
+			BBRequests: requestCount(bb) - requests, Resources: usage.resources, Bytes: usage.bytes,
+			DurationMS: time.Since(started).Milliseconds()})
+		fileName := fileUUID + ".ndjson"
+
+		// The chunk was paused, put it back on the queue to resume from the last checkpoint once the delay has passed
+		if rerr, ok := err.(requeueError); ok {
+			return requeueJob(j, rerr)
+		}
+
+		// The chunk stopped part way through, let the queue retry it from the last checkpoint
+		if _, ok := err.(retryableError); ok {
 			return err
 		}
-	} else {
-		err = addJobFileName(fileName, jobArgs.ResourceType, exportJob, db)
+
+		// This is only run AFTER completion of all the collection
 		if err != nil {
-			log.Error(err)
-			return err
+			err = db.Model(&exportJob).Updates(map[string]interface{}{"status": "Failed", "failure_reason": err.Error()}).Error
+			if err != nil {
+				return err
+			}
+		} else {
+			err = addJobFileName(fileName, jobArgs.ResourceType, exportJob, db)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
 		}
 	}
 
+	// The checkpoint is kept until the job has been checked, so a retry does not export the chunk again
 	_, err = exportJob.CheckCompletedAndCleanup(db)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
+	clearCheckpoint(db, cp)
 
 	updateJobStats(exportJob.ID, db)
 
@@ -169,16 +196,14 @@ func processJob(j *que.Job) error {
 	return nil
 }
 
-func createDir(path string) error {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		if err = os.MkdirAll(path, os.ModePerm); err != nil {
-			return err
-		}
-	}
-	return nil
+func writeBBDataToFile(bb client.APIClient, db *gorm.DB, acoID string, acoCMSID string, cclfBeneficiaryIDs []string, jobID, t, since string, transactionTime time.Time) (fileUUID string, error error) {
+	return resumeBBDataToFile(bb, db, nil, nil, acoID, acoCMSID, cclfBeneficiaryIDs, jobID, t, since, transactionTime)
 }
 
-func writeBBDataToFile(bb client.APIClient, db *gorm.DB, acoID string, acoCMSID string, cclfBeneficiaryIDs []string, jobID, t, since string, transactionTime time.Time) (fileUUID string, error error) {
+// resumeBBDataToFile writes the beneficiaries' data to the chunk's file. When a checkpoint is supplied, the chunk
+// resumes from it and progress is periodically recorded in it so that a retry does not have to start over.
+// When usage is supplied, the resources and bytes written are added to it.
+func resumeBBDataToFile(bb client.APIClient, db *gorm.DB, cp *models.JobCheckpoint, usage *chunkUsage, acoID string, acoCMSID string, cclfBeneficiaryIDs []string, jobID, t, since string, transactionTime time.Time) (fileUUID string, err error) {
 	segment := newrelic.StartSegment(txn, "writeBBDataToFile")
 
 	if bb == nil {
@@ -187,7 +212,7 @@ func writeBBDataToFile(bb client.APIClient, db *gorm.DB, acoID string, acoCMSID
 		return "", err
 	}
 
-	bbFunc := bbFuncByType(bb, t)
+	bbFunc := bbStreamFuncByType(bb, t)
 	if bbFunc == nil {
 		err := fmt.Errorf("Invalid resource type requested: %s", t)
 		log.Error(err)
@@ -200,47 +225,240 @@ func writeBBDataToFile(bb client.APIClient, db *gorm.DB, acoID string, acoCMSID
 		return "", err
 	}
 
-	dataDir := os.Getenv("FHIR_STAGING_DIR")
-	fileUUID = uuid.NewRandom().String()
-	f, err := os.Create(fmt.Sprintf("%s/%s/%s.ndjson", dataDir, jobID, fileUUID))
+	store, err := storage.New()
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
 
-	defer utils.CloseFileAndLogError(f)
+	var (
+		checkpoint *chunkCheckpoint
+		start      int
+		errorCount int
+	)
+	if cp != nil {
+		checkpoint = &chunkCheckpoint{db: db, store: store, jobID: jobID, model: cp}
+		fileUUID, start, errorCount, err = checkpoint.resume(cclfBeneficiaryIDs)
+		if err != nil {
+			log.Error(err)
+			return "", retryableError{err}
+		}
+	} else {
+		fileUUID = uuid.NewRandom().String()
+	}
+
+	dataFile := fmt.Sprintf("%s/%s.ndjson", jobID, fileUUID)
+	f, err := store.Append(storage.Staging, dataFile)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
 
 	w := bufio.NewWriter(f)
-	errorCount := 0
+	errs := newChunkErrors(store, jobID, fileUUID)
 	totalBeneIDs := float64(len(cclfBeneficiaryIDs))
 	failThreshold := getFailureThreshold()
 	failed := false
+	ordered := getOrderedWrites()
+	checkpointInterval := getCheckpointInterval()
+	validator := newResourceValidator(t)
+
+	// takeCheckpoint persists the data file and records that every beneficiary before next has been processed
+	var interrupted error
+	takeCheckpoint := func(next int) error {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if err := errs.flush(); err != nil {
+			return err
+		}
+		err := f.Close()
+		f = nil
+		if err != nil {
+			return err
+		}
+		if err := checkpoint.save(cclfBeneficiaryIDs, next, errorCount); err != nil {
+			return err
+		}
+		if f, err = store.Append(storage.Staging, dataFile); err != nil {
+			f = nil
+			return err
+		}
+		w.Reset(f)
+		return nil
+	}
 
-	for _, cclfBeneficiaryID := range cclfBeneficiaryIDs {
-		blueButtonID, err := beneBBID(cclfBeneficiaryID, bb, db)
+	resolution, err := resolveBeneficiaries(bb, db, jobID, cclfBeneficiaryIDs[start:])
+	if err != nil {
+		log.Error(err)
+		if cerr := f.Close(); cerr != nil {
+			log.Error(cerr)
+		}
+		return "", retryableError{err}
+	}
+	// Claims made while beneficiaries had a previous MBI are recorded under that identity
+	if t == "ExplanationOfBenefit" {
+		if err = resolution.resolvePreviousIDs(bb, db, acoCMSID); err != nil {
+			log.Error(err)
+			if cerr := f.Close(); cerr != nil {
+				log.Error(cerr)
+			}
+			return "", retryableError{err}
+		}
+	}
 
-		if err != nil {
-			handleBBError(err, &errorCount, fileUUID, fmt.Sprintf("Error retrieving BlueButton ID for cclfBeneficiary %s", cclfBeneficiaryID), jobID)
-		} else {
-			b, err := bbFunc(blueButtonID, jobID, acoCMSID, since, transactionTime)
-			if err != nil {
-				handleBBError(err, &errorCount, fileUUID, fmt.Sprintf("Error retrieving %s for beneficiary %s in ACO %s", t, blueButtonID, acoID), jobID)
-			} else {
-				fhirBundleToResourceNDJSON(w, b, t, cclfBeneficiaryID, acoCMSID, jobID, fileUUID)
+	fetch := func(cclfBeneficiaryID string) beneResult {
+		result := beneResult{cclfBeneID: cclfBeneficiaryID}
+		// Another chunk of the job has already reported that the beneficiary is unknown to Blue Button
+		if resolution.reported[cclfBeneficiaryID] {
+			result.skipped = true
+			return result
+		}
+		blueButtonID, ok := resolution.bbIDs[cclfBeneficiaryID]
+		if !ok {
+			result.err = resolution.errs[cclfBeneficiaryID]
+			if result.err == nil {
+				result.err = fmt.Errorf("no CCLF beneficiary found with ID %s", cclfBeneficiaryID)
+			}
+			result.errMsg = fmt.Sprintf("Error retrieving BlueButton ID for cclfBeneficiary %s", cclfBeneficiaryID)
+			return result
+		}
+
+		// Resources are written to the spool as they are received so that only a single page
+		// is held in memory at any time.
+		result.data = newSpool()
+		result.err = bbFunc(blueButtonID, jobID, acoCMSID, since, transactionTime, spoolResources(&result, validator))
+		for _, previousID := range resolution.previousIDs[cclfBeneficiaryID] {
+			if result.err != nil || result.writeErr != nil {
+				break
+			}
+			blueButtonID = previousID
+			result.err = bbFunc(previousID, jobID, acoCMSID, since, transactionTime, spoolResources(&result, validator))
+		}
+		if result.writeErr != nil {
+			// The data was retrieved successfully, it just could not be stored
+			result.err = nil
+		} else if result.err != nil {
+			result.errMsg = fmt.Sprintf("Error retrieving %s for beneficiary %s in ACO %s", t, blueButtonID, acoID)
+		}
+		return result
+	}
+
+	// Only the current goroutine writes to the files and tracks the error count.
+	// The fetching goroutines hand their results over through the pool.
+	pool := newBenePool(getBeneConcurrency(), ordered)
+	for result := range pool.run(cclfBeneficiaryIDs[start:], fetch) {
+		// Requests that were already in flight when the threshold was reached are discarded
+		if failed || interrupted != nil {
+			result.release()
+			pool.done()
+			continue
+		}
+
+		// Progress can only be recorded when beneficiaries are written in order, otherwise there is
+		// no single position in the chunk that separates the processed beneficiaries from the rest.
+		next := start + result.index + 1
+		canCheckpoint := checkpoint != nil && ordered
+
+		// Blue Button is unavailable, so this beneficiary has not been processed. Rather than counting it as a failure,
+		// pause the chunk until the circuit breaker lets requests through again.
+		if client.IsCircuitOpen(result.err) {
+			delay := getRequeueDelay()
+			log.WithField("bb_breaker", client.CircuitBreakerState()).Warnf("Blue Button circuit breaker is open, pausing chunk for job %s at beneficiary %d of %d for %s", jobID, next-1, len(cclfBeneficiaryIDs), delay)
+			interrupted = requeueError{errors.New("chunk paused while Blue Button circuit breaker is open"), delay}
+			pool.stop()
+			if canCheckpoint {
+				if err := takeCheckpoint(next - 1); err != nil {
+					log.Error(err)
+				}
 			}
+			result.release()
+			pool.done()
+			continue
+		}
+
+		if result.err != nil {
+			handleBBError(result.err, &errorCount, errs, result.errMsg)
+		} else if len(result.invalid) > 0 {
+			handleInvalidResources(result, &errorCount, errs, acoCMSID)
 		}
+		if result.err == nil && !result.skipped {
+			n := writeBeneData(w, errs, result, t, acoCMSID)
+			if result.writeErr == nil {
+				usage.add(result.resources, n)
+			}
+		}
+		result.release()
+
 		failPct := (float64(errorCount) / totalBeneIDs) * 100
 		if failPct >= failThreshold {
 			failed = true
-			break
+			pool.stop()
+		} else if shutdown.isInterrupted() {
+			log.Warnf("Worker is shutting down, stopping chunk for job %s after %d of %d beneficiaries", jobID, next, len(cclfBeneficiaryIDs))
+			// Requeued rather than retried, so being interrupted does not use up one of the chunk's attempts
+			interrupted = requeueError{errors.New("chunk interrupted by worker shutdown"), 0}
+			pool.stop()
+			if canCheckpoint {
+				if err := takeCheckpoint(next); err != nil {
+					log.Error(err)
+				}
+			}
+		} else if canCheckpoint && next%checkpointInterval == 0 {
+			if err := takeCheckpoint(next); err != nil {
+				log.Error(err)
+				interrupted = retryableError{errors.Wrap(err, "could not checkpoint chunk")}
+				pool.stop()
+			}
 		}
+		pool.done()
+	}
+
+	if interrupted != nil {
+		// Leave the files in a consistent state. Anything after the last checkpoint is discarded on retry.
+		if f != nil {
+			if err := w.Flush(); err != nil {
+				log.Error(err)
+			}
+			if err := f.Close(); err != nil {
+				log.Error(err)
+			}
+		}
+		if err := errs.flush(); err != nil {
+			log.Error(err)
+		}
+		return "", interrupted
 	}
 
 	err = w.Flush()
+	if err != nil {
+		if cerr := f.Close(); cerr != nil {
+			log.Error(cerr)
+		}
+		return "", err
+	}
+
+	if err = errs.flush(); err != nil {
+		if cerr := f.Close(); cerr != nil {
+			log.Error(cerr)
+		}
+		return "", err
+	}
+
+	// The file is only guaranteed to be persisted once it has been closed
+	err = f.Close()
 	if err != nil {
 		return "", err
 	}
 
+	// Record the completed chunk so a retry (e.g. if the job key cannot be saved) does not process it again
+	if checkpoint != nil && !failed {
+		if err = checkpoint.save(cclfBeneficiaryIDs, len(cclfBeneficiaryIDs), errorCount); err != nil {
+			log.Error(err)
+			return "", retryableError{err}
+		}
+	}
+
 	err = segment.End()
 	if err != nil {
 		log.Error(err)
@@ -253,36 +471,67 @@ func writeBBDataToFile(bb client.APIClient, db *gorm.DB, acoID string, acoCMSID
 	return fileUUID, nil
 }
 
-func bbFuncByType(bb client.APIClient, t string) client.BeneDataFunc {
-	return map[string]client.BeneDataFunc{
-		"ExplanationOfBenefit": bb.GetExplanationOfBenefit,
-		"Patient":              bb.GetPatient,
-		"Coverage":             bb.GetCoverage,
+// getBeneConcurrency returns the number of beneficiaries whose data can be retrieved concurrently within a single job.
+func getBeneConcurrency() int {
+	concurrency := utils.GetEnvInt("BCDA_WORKER_BENE_CONCURRENCY", 1)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return concurrency
+}
+
+// getOrderedWrites indicates whether beneficiary data must be written in the order the beneficiaries were supplied.
+func getOrderedWrites() bool {
+	return utils.GetEnvBool("BCDA_WORKER_ORDERED_WRITES", true)
+}
+
+func bbStreamFuncByType(bb client.APIClient, t string) client.BeneDataStreamFunc {
+	return map[string]client.BeneDataStreamFunc{
+		"ExplanationOfBenefit": bb.StreamExplanationOfBenefit,
+		"Patient":              bb.StreamPatient,
+		"Coverage":             bb.StreamCoverage,
 	}[t]
 }
 
-// beneBBID returns the beneficiary's Blue Button ID. The ID value is retrieved from BB and saved.
-func beneBBID(cclfBeneID string, bb client.APIClient, db *gorm.DB) (string, error) {
+func handleBBError(err error, errorCount *int, errs *chunkErrors, msg string) {
+	log.Error(err)
+	(*errorCount)++
 
-	var cclfBeneficiary models.CCLFBeneficiary
-	db.First(&cclfBeneficiary, cclfBeneID)
-	bbID, err := cclfBeneficiary.GetBlueButtonID(bb)
-	if err != nil {
-		return "", err
+	// Record why the request failed so that failures can be told apart in the error file
+	category := client.Categorize(err)
+	if category != client.UnknownError {
+		msg = fmt.Sprintf("%s (%s error)", msg, category)
 	}
+	errs.add(bbErrorIssueType(category), responseutils.BbErr, msg)
+}
 
-	// Update the value in the DB only if necessary
-	if cclfBeneficiary.BlueButtonID != bbID {
-		db.Model(&cclfBeneficiary).Update("blue_button_id", bbID)
+// handleInvalidResources reports each of the beneficiary's invalid resources in the error file.
+// A beneficiary with invalid resources counts as a failure, even though their valid resources are still written.
+func handleInvalidResources(result beneResult, errorCount *int, errs *chunkErrors, acoID string) {
+	(*errorCount)++
+	for _, reason := range result.invalid {
+		msg := fmt.Sprintf("Invalid resource received for beneficiary %s in ACO %s: %s", result.cclfBeneID, acoID, reason)
+		log.Error(msg)
+		errs.add(responseutils.Structure, responseutils.FormatErr, msg)
 	}
-
-	return bbID, nil
 }
 
-func handleBBError(err error, errorCount *int, fileUUID, msg, jobID string) {
-	log.Error(err)
-	(*errorCount)++
-	appendErrorToFile(fileUUID, responseutils.Exception, responseutils.BbErr, msg, jobID)
+// bbErrorIssueType returns the OperationOutcome issue type that best describes the category of Blue Button error.
+func bbErrorIssueType(category client.ErrorCategory) string {
+	switch category {
+	case client.TransportError:
+		return responseutils.Transient
+	case client.TimeoutError:
+		return responseutils.Timeout
+	case client.ThrottledError:
+		return responseutils.Throttled
+	case client.ClientError:
+		return responseutils.Processing
+	case client.DecodeError:
+		return responseutils.Structure
+	default:
+		return responseutils.Exception
+	}
 }
 
 func getFailureThreshold() float64 {
@@ -298,142 +547,153 @@ func getFailureThreshold() float64 {
 	return float64(exportFailPct)
 }
 
-func appendErrorToFile(fileUUID, code, detailsCode, detailsDisplay string, jobID string) {
-	segment := newrelic.StartSegment(txn, "appendErrorToFile")
-
-	oo := responseutils.CreateOpOutcome(responseutils.Error, code, detailsCode, detailsDisplay)
-
-	dataDir := os.Getenv("FHIR_STAGING_DIR")
-	fileName := fmt.Sprintf("%s/%s/%s-error.ndjson", dataDir, jobID, fileUUID)
-	/* #nosec -- opening file defined by variable */
-	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-
-	if err != nil {
-		log.Error(err)
-	}
+// chunkErrors holds the OperationOutcomes for a chunk's error file until they are flushed. Appending to a file in S3
+// uploads the whole file again, so the errors are written once per checkpoint rather than once per error.
+type chunkErrors struct {
+	store storage.Storage
+	name  string
+	buf   bytes.Buffer
+}
 
-	defer utils.CloseFileAndLogError(f)
+func newChunkErrors(store storage.Storage, jobID, fileUUID string) *chunkErrors {
+	return &chunkErrors{store: store, name: fmt.Sprintf("%s/%s-error.ndjson", jobID, fileUUID)}
+}
 
+func (e *chunkErrors) add(code, detailsCode, detailsDisplay string) {
+	oo := responseutils.CreateOpOutcome(responseutils.Error, code, detailsCode, detailsDisplay)
 	ooBytes, err := json.Marshal(oo)
 	if err != nil {
 		log.Error(err)
+		return
 	}
+	e.buf.Write(append(ooBytes, '\n'))
+}
 
-	if _, err = f.WriteString(string(ooBytes) + "\n"); err != nil {
-		log.Error(err)
+// flush appends the errors added since the last flush to the error file
+func (e *chunkErrors) flush() error {
+	if e.buf.Len() == 0 {
+		return nil
 	}
 
-	err = segment.End()
+	segment := newrelic.StartSegment(txn, "appendErrorToFile")
+	defer func() {
+		if err := segment.End(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	f, err := e.store.Append(storage.Staging, e.name)
 	if err != nil {
-		log.Error(err)
+		return err
+	}
+	if _, err = e.buf.WriteTo(f); err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
 }
 
-func fhirBundleToResourceNDJSON(w *bufio.Writer, b *fhirmodels.Bundle, jsonType, beneficiaryID, acoID, jobID, fileUUID string) {
-	segment := newrelic.StartSegment(txn, "fhirBundleToResourceNDJSON")
-
-	for _, entry := range b.Entries {
-		if entry["resource"] == nil {
-			continue
+// spoolResources returns a handler that writes each valid resource to the result's spool.
+// Invalid resources are recorded in the result, as is the first error encountered while writing.
+func spoolResources(result *beneResult, validator *resourceValidator) fhir.ResourceHandler {
+	return func(resource json.RawMessage) error {
+		if err := validator.validate(resource); err != nil {
+			result.invalid = append(result.invalid, err.Error())
+			return nil
 		}
-
-		entryJSON, err := json.Marshal(entry["resource"])
-		// This is unlikely to happen because we just unmarshalled this data a few lines above.
-		if err != nil {
-			log.Error(err)
-			appendErrorToFile(fileUUID, responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error marshaling %s to JSON for beneficiary %s in ACO %s", jsonType, beneficiaryID, acoID), jobID)
-			continue
+		result.writeErr = writeResourceNDJSON(result.data, resource)
+		if result.writeErr == nil {
+			result.resources++
 		}
-		_, err = w.WriteString(string(entryJSON) + "\n")
-		if err != nil {
+		return result.writeErr
+	}
+}
+
+// writeResourceNDJSON writes the resource to w as a single line of NDJSON.
+func writeResourceNDJSON(w io.Writer, resource json.RawMessage) error {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, resource); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// writeBeneData copies the beneficiary's spooled data to the chunk's file and returns the number of bytes written.
+func writeBeneData(w *bufio.Writer, errs *chunkErrors, result beneResult, jsonType, acoID string) int64 {
+	segment := newrelic.StartSegment(txn, "writeBeneData")
+	defer func() {
+		if err := segment.End(); err != nil {
 			log.Error(err)
-			appendErrorToFile(fileUUID, responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error writing %s to file for beneficiary %s in ACO %s", jsonType, beneficiaryID, acoID), jobID)
 		}
-	}
+	}()
 
-	err := segment.End()
+	var n int64
+	err := result.writeErr
+	if err == nil {
+		n, err = result.data.WriteTo(w)
+	}
 	if err != nil {
 		log.Error(err)
+		errs.add(responseutils.Exception, responseutils.InternalErr, fmt.Sprintf("Error writing %s to file for beneficiary %s in ACO %s", jsonType, result.cclfBeneID, acoID))
 	}
+	return n
 }
 
+// waitForSig blocks until the worker is asked to stop. A second signal exits immediately.
 func waitForSig() {
-	signalChan := make(chan os.Signal, 1)
-	defer close(signalChan)
+	signalChan := make(chan os.Signal, 2)
 
 	signal.Notify(signalChan,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
-	exitChan := make(chan int)
-	defer close(exitChan)
+	switch <-signalChan {
+	case syscall.SIGINT:
+		fmt.Println("interrupt")
+	case syscall.SIGTERM:
+		fmt.Println("stop")
+	case syscall.SIGQUIT:
+		fmt.Println("stop and core dump")
+	}
 
 	go func() {
-		for {
-			s := <-signalChan
-			switch s {
-			case syscall.SIGINT:
-				fmt.Println("interrupt")
-				exitChan <- 0
-			case syscall.SIGTERM:
-				fmt.Println("force stop")
-				exitChan <- 0
-			case syscall.SIGQUIT:
-				fmt.Println("stop and core dump")
-				exitChan <- 0
-			}
-		}
+		<-signalChan
+		fmt.Println("force stop")
+		os.Exit(1)
 	}()
-
-	code := <-exitChan
-	os.Exit(code)
 }
 
-func setupQueue() *pgx.ConnPool {
-	queueDatabaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	pgxcfg, err := pgx.ParseURI(queueDatabaseURL)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: que.PrepareStatements,
-	})
+func setupQueue() *workerPool {
+	var err error
+	q, err = queue.New()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	qc = que.NewClient(pgxpool)
-	wm := que.WorkMap{
-		"ProcessJob": processJob,
+	wm := queue.WorkMap{
+		"ProcessJob": withDeadLetter(processJob),
 	}
 
 	workerPoolSize := utils.GetEnvInt("WORKER_POOL_SIZE", 2)
-	workers := que.NewWorkerPool(qc, wm, workerPoolSize)
-	go workers.Start()
+	workers := newWorkerPool(q, wm, workerPoolSize, shutdown)
+	workers.start()
+	if b, ok := q.(queue.Balancer); ok {
+		go balanceQueue(b, shutdown)
+	}
 
-	return pgxpool
+	return workers
 }
 
 func getQueueJobCount() float64 {
-	databaseURL := os.Getenv("QUEUE_DATABASE_URL")
-	db, err := sql.Open("postgres", databaseURL)
-	if err != nil {
-		log.Error(err)
-	}
-
-	pingErr := db.Ping()
-	if pingErr != nil {
-		log.Error(pingErr)
+	if q == nil {
+		return 0
 	}
-	defer db.Close()
 
-	row := db.QueryRow(`select count(*) from que_jobs;`)
-
-	var count int
-	if err := row.Scan(&count); err != nil {
+	count, err := q.Depth()
+	if err != nil {
 		log.Error(err)
 	}
 
@@ -450,7 +710,9 @@ func updateJobStats(jID uint, db *gorm.DB) {
 }
 
 func addJobFileName(fileName, resourceType string, exportJob models.Job, db *gorm.DB) error {
-	err := db.Create(&models.JobKey{JobID: exportJob.ID, FileName: fileName, ResourceType: resourceType}).Error
+	// A retried chunk may have already recorded its file
+	err := db.Where(models.JobKey{JobID: exportJob.ID, FileName: fileName, ResourceType: resourceType}).
+		FirstOrCreate(&models.JobKey{}).Error
 	if err != nil {
 		log.Error(err)
 		return err
@@ -480,8 +742,7 @@ func updateJobQueueCountCloudwatchMetric() {
 func main() {
 	fmt.Println("Starting bcdaworker...")
 
-	workerPool := setupQueue()
-	defer workerPool.Close()
+	workers := setupQueue()
 
 	if hInt, err := strconv.Atoi(os.Getenv("WORKER_HEALTH_INT_SEC")); err == nil {
 		healthLogger := NewHealthLogger()
@@ -501,4 +762,12 @@ func main() {
 	}
 
 	waitForSig()
+
+	code := 0
+	if !gracefulShutdown(workers) {
+		code = 1
+	}
+	q.Close()
+	fmt.Println("bcdaworker stopped")
+	os.Exit(code)
 }
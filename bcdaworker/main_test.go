@@ -9,12 +9,12 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/mock"
 
-	"github.com/bgentry/que-go"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -22,6 +22,8 @@ import (
 	"github.com/CMSgov/bcda-app/bcda/client"
 	"github.com/CMSgov/bcda-app/bcda/database"
 	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/queue"
+	"github.com/CMSgov/bcda-app/bcda/storage"
 	"github.com/CMSgov/bcda-app/bcda/testUtils"
 )
 
@@ -187,6 +189,71 @@ func (s *MainTestSuite) TestWriteEOBDataToFileWithErrorsBelowFailureThreshold()
 	os.Remove(errorFilePath)
 }
 
+func (s *MainTestSuite) TestWriteEOBDataToFile_InvalidResources() {
+	origFailPct := os.Getenv("EXPORT_FAIL_PCT")
+	defer os.Setenv("EXPORT_FAIL_PCT", origFailPct)
+	os.Setenv("EXPORT_FAIL_PCT", "60")
+
+	bbc := testUtils.BlueButtonClient{}
+	beneficiaryIDs := []string{"abcdef10000", "abcdef11000"}
+	bbc.On("GetExplanationOfBenefit", beneficiaryIDs[0]).Return(bbc.GetBundleData("ExplanationOfBenefit", beneficiaryIDs[0]))
+	// Two of the second beneficiary's resources are malformed
+	invalid, err := bbc.GetBundleData("ExplanationOfBenefit", beneficiaryIDs[1])
+	assert.NoError(s.T(), err)
+	invalid.Entries[0]["resource"].(map[string]interface{})["resourceType"] = "Patient"
+	delete(invalid.Entries[1]["resource"].(map[string]interface{}), "id")
+	bbc.On("GetExplanationOfBenefit", beneficiaryIDs[1]).Return(invalid, nil)
+	acoID := "387c3a62-96fa-4d93-a5d0-fd8725509dd9"
+	cmsID := "A00234"
+	var cclfBeneficiaryIDs []string
+
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC8Y19.D191120.T1012315"}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+
+	for i := range beneficiaryIDs {
+		bbc.MBI = &beneficiaryIDs[i]
+		cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryIDs[i], BlueButtonID: beneficiaryIDs[i]}
+		db.Create(&cclfBeneficiary)
+		defer db.Delete(&cclfBeneficiary)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
+		bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(cclfBeneficiary.MBI)).Return(bbc.GetData("Patient", beneficiaryIDs[i]))
+	}
+	jobID := "1"
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+
+	fileUUID, err := writeBBDataToFile(&bbc, db, acoID, cmsID, cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	assert.NoError(s.T(), err)
+
+	// The valid resources are written, the invalid ones are reported
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s.ndjson", stagingDir, fileUUID))
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"), 64)
+	assert.NotContains(s.T(), string(data), `"resourceType":"Patient"`)
+
+	errData, err := ioutil.ReadFile(fmt.Sprintf("%s/%s-error.ndjson", stagingDir, fileUUID))
+	assert.NoError(s.T(), err)
+	errLines := strings.Split(strings.TrimSuffix(string(errData), "\n"), "\n")
+	assert.Len(s.T(), errLines, 2)
+	prefix := fmt.Sprintf("Invalid resource received for beneficiary %s in ACO %s: ", cclfBeneficiaryIDs[1], cmsID)
+	assert.Contains(s.T(), errLines[0], `"code":"structure"`)
+	assert.Contains(s.T(), errLines[0], prefix+"Patient resource carrier-")
+	assert.Contains(s.T(), errLines[0], "found in ExplanationOfBenefit file")
+	assert.Contains(s.T(), errLines[1], prefix+"ExplanationOfBenefit resource is missing id")
+
+	// A beneficiary with invalid resources counts towards the failure threshold
+	os.Setenv("EXPORT_FAIL_PCT", "50")
+	_, err = writeBBDataToFile(&bbc, db, acoID, cmsID, cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	assert.EqualError(s.T(), err, "number of failed requests has exceeded threshold")
+	bbc.AssertExpectations(s.T())
+
+	os.RemoveAll(stagingDir)
+}
+
 func (s *MainTestSuite) TestWriteEOBDataToFileWithErrorsAboveFailureThreshold() {
 	origFailPct := os.Getenv("EXPORT_FAIL_PCT")
 	defer os.Setenv("EXPORT_FAIL_PCT", origFailPct)
@@ -201,6 +268,9 @@ func (s *MainTestSuite) TestWriteEOBDataToFileWithErrorsAboveFailureThreshold()
 	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryIDs[0])).Return(bbc.GetData("Patient", beneficiaryIDs[0]))
 	bbc.MBI = &beneficiaryIDs[1]
 	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryIDs[1])).Return(bbc.GetData("Patient", beneficiaryIDs[1]))
+	// Every beneficiary in the chunk is resolved before any data is requested
+	bbc.MBI = &beneficiaryIDs[2]
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryIDs[2])).Return(bbc.GetData("Patient", beneficiaryIDs[2]))
 	acoID := "387c3a62-96fa-4d93-a5d0-fd8725509dd9"
 	cmsID := "A00234"
 	var cclfBeneficiaryIDs []string
@@ -319,6 +389,197 @@ func (s *MainTestSuite) TestWriteEOBDataToFile_BlueButtonIDNotFound() {
 	os.Remove(errorFilePath)
 }
 
+func (s *MainTestSuite) TestResumeBBDataToFileFromCheckpoint() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	bbc := testUtils.BlueButtonClient{}
+	acoID := "9c05c1f8-349d-400f-9b69-7963f2262b07"
+	cmsID := "A00234"
+	jobID := "1"
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC8Y19.D191120.T1012313"}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+
+	beneficiaryIDs := []string{"a1000003701", "a1000050699"}
+	var cclfBeneficiaryIDs []string
+	for _, beneficiaryID := range beneficiaryIDs {
+		cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+		db.Create(&cclfBeneficiary)
+		defer db.Delete(&cclfBeneficiary)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
+	}
+
+	// Only the beneficiary after the checkpoint should be requested
+	bbc.MBI = &beneficiaryIDs[1]
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryIDs[1])).Return(bbc.GetData("Patient", beneficiaryIDs[1]))
+	bbc.On("GetExplanationOfBenefit", beneficiaryIDs[1]).Return(bbc.GetBundleData("ExplanationOfBenefit", beneficiaryIDs[1]))
+
+	// Data written after the checkpoint was taken must be discarded
+	fileUUID := uuid.NewRandom().String()
+	filePath := fmt.Sprintf("%s/%s.ndjson", stagingDir, fileUUID)
+	checkpointed := `{"resourceType":"ExplanationOfBenefit","id":"checkpointed"}` + "\n"
+	assert.NoError(s.T(), ioutil.WriteFile(filePath, []byte(checkpointed+`{"resourceType":"Explanation`), 0600))
+	defer os.Remove(filePath)
+
+	cp := models.JobCheckpoint{QueJobID: time.Now().UnixNano(), JobID: 1, FileUUID: fileUUID, NextBeneficiary: 1,
+		LastBeneficiaryID: cclfBeneficiaryIDs[0], DataSize: int64(len(checkpointed))}
+	assert.NoError(s.T(), db.Create(&cp).Error)
+	defer db.Unscoped().Delete(&cp)
+
+	usage := &chunkUsage{}
+	resultUUID, err := resumeBBDataToFile(&bbc, db, &cp, usage, acoID, cmsID, cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), fileUUID, resultUUID, "the chunk should append to the file from the previous attempt")
+	bbc.AssertExpectations(s.T())
+	bbc.AssertNotCalled(s.T(), "GetExplanationOfBenefit", beneficiaryIDs[0])
+
+	data, err := ioutil.ReadFile(filePath)
+	assert.NoError(s.T(), err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	// The checkpointed resource followed by the 33 entries in test EOB data
+	assert.Len(s.T(), lines, 34)
+	assert.Equal(s.T(), strings.TrimSuffix(checkpointed, "\n"), lines[0])
+	// Only the data written by this attempt counts towards its usage
+	assert.EqualValues(s.T(), 33, usage.resources)
+	assert.EqualValues(s.T(), len(data)-len(checkpointed), usage.bytes)
+	for _, line := range lines {
+		var jsonOBJ map[string]interface{}
+		assert.NoError(s.T(), json.Unmarshal([]byte(line), &jsonOBJ))
+	}
+
+	var saved models.JobCheckpoint
+	assert.NoError(s.T(), db.First(&saved, cp.ID).Error)
+	assert.Equal(s.T(), len(cclfBeneficiaryIDs), saved.NextBeneficiary)
+	assert.Equal(s.T(), cclfBeneficiaryIDs[1], saved.LastBeneficiaryID)
+	assert.EqualValues(s.T(), len(data), saved.DataSize)
+}
+
+func (s *MainTestSuite) TestResumeBBDataToFileInterruptedByShutdown() {
+	defer func(orig *workerShutdown) { shutdown = orig }(shutdown)
+	shutdown = newWorkerShutdown()
+	shutdown.interrupt()
+
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	bbc := testUtils.BlueButtonClient{}
+	jobID := "1"
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC8Y19.D191120.T1012314"}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	beneficiaryIDs := []string{"a1000003701", "a1000050699"}
+	var cclfBeneficiaryIDs []string
+	for _, beneficiaryID := range beneficiaryIDs {
+		cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+		db.Create(&cclfBeneficiary)
+		defer db.Delete(&cclfBeneficiary)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
+	}
+
+	// The chunk stops after the beneficiary that was in flight when the worker was interrupted
+	for i := range beneficiaryIDs {
+		bbc.MBI = &beneficiaryIDs[i]
+		bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryIDs[i])).Return(bbc.GetData("Patient", beneficiaryIDs[i]))
+	}
+	bbc.On("GetExplanationOfBenefit", beneficiaryIDs[0]).Return(bbc.GetBundleData("ExplanationOfBenefit", beneficiaryIDs[0]))
+
+	cp := models.JobCheckpoint{QueJobID: time.Now().UnixNano(), JobID: 1}
+	defer db.Unscoped().Delete(&cp)
+
+	_, err := resumeBBDataToFile(&bbc, db, &cp, nil, "9c05c1f8-349d-400f-9b69-7963f2262b07", "A00234", cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	assert.IsType(s.T(), requeueError{}, err)
+	bbc.AssertExpectations(s.T())
+	bbc.AssertNotCalled(s.T(), "GetExplanationOfBenefit", beneficiaryIDs[1])
+
+	var saved models.JobCheckpoint
+	assert.NoError(s.T(), db.First(&saved, cp.ID).Error)
+	assert.Equal(s.T(), 1, saved.NextBeneficiary)
+	assert.Equal(s.T(), cclfBeneficiaryIDs[0], saved.LastBeneficiaryID)
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s.ndjson", stagingDir, saved.FileUUID))
+	assert.NoError(s.T(), err)
+	assert.EqualValues(s.T(), len(data), saved.DataSize)
+	assert.Equal(s.T(), 33, strings.Count(string(data), "\n"))
+}
+
+func (s *MainTestSuite) TestResumeBBDataToFilePausedByCircuitBreaker() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	bbc := testUtils.BlueButtonClient{}
+	jobID := "1"
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC8Y19.D191120.T1012314"}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+	defer os.RemoveAll(stagingDir)
+
+	beneficiaryIDs := []string{"a1000003701", "a1000050699"}
+	var cclfBeneficiaryIDs []string
+	for _, beneficiaryID := range beneficiaryIDs {
+		cclfBeneficiary := models.CCLFBeneficiary{FileID: cclfFile.ID, HICN: "whatever", MBI: beneficiaryID, BlueButtonID: beneficiaryID}
+		db.Create(&cclfBeneficiary)
+		defer db.Delete(&cclfBeneficiary)
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(cclfBeneficiary.ID), 10))
+	}
+
+	// The breaker opens before the second beneficiary can be retrieved
+	bbc.MBI = &beneficiaryIDs[0]
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryIDs[0])).Return(bbc.GetData("Patient", beneficiaryIDs[0]))
+	bbc.On("GetExplanationOfBenefit", beneficiaryIDs[0]).Return(bbc.GetBundleData("ExplanationOfBenefit", beneficiaryIDs[0]))
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(beneficiaryIDs[1])).Return("", fmt.Errorf("Blue Button request not sent: %w", client.ErrCircuitOpen))
+
+	cp := models.JobCheckpoint{QueJobID: time.Now().UnixNano(), JobID: 1}
+	defer db.Unscoped().Delete(&cp)
+
+	_, err := resumeBBDataToFile(&bbc, db, &cp, nil, "9c05c1f8-349d-400f-9b69-7963f2262b07", "A00234", cclfBeneficiaryIDs, jobID, "ExplanationOfBenefit", "", time.Now())
+	assert.IsType(s.T(), requeueError{}, err)
+	assert.True(s.T(), err.(requeueError).delay > 0)
+	bbc.AssertExpectations(s.T())
+
+	// The beneficiary that could not be retrieved is not counted as an error
+	var saved models.JobCheckpoint
+	assert.NoError(s.T(), db.First(&saved, cp.ID).Error)
+	assert.Equal(s.T(), 1, saved.NextBeneficiary)
+	assert.Equal(s.T(), 0, saved.ErrorCount)
+	assert.EqualValues(s.T(), 0, saved.ErrorSize)
+}
+
+func (s *MainTestSuite) TestResumeBBDataToFileMismatchedCheckpoint() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+	jobID := "1"
+	stagingDir := fmt.Sprintf("%s/%s", os.Getenv("FHIR_STAGING_DIR"), jobID)
+	os.RemoveAll(stagingDir)
+	testUtils.CreateStaging(jobID)
+
+	// The files from an attempt that cannot be resumed are removed and the chunk starts over
+	fileUUID := uuid.NewRandom().String()
+	orphan := fmt.Sprintf("%s/%s.ndjson", stagingDir, fileUUID)
+	assert.NoError(s.T(), ioutil.WriteFile(orphan, []byte("{}\n"), 0600))
+
+	cp := models.JobCheckpoint{QueJobID: time.Now().UnixNano(), JobID: 1, FileUUID: fileUUID, NextBeneficiary: 1,
+		LastBeneficiaryID: "does-not-match", DataSize: 3}
+	assert.NoError(s.T(), db.Create(&cp).Error)
+	defer db.Unscoped().Delete(&cp)
+
+	bbc := testUtils.BlueButtonClient{}
+	resultUUID, err := resumeBBDataToFile(&bbc, db, &cp, nil, "9c05c1f8-349d-400f-9b69-7963f2262b07", "A00234", []string{}, jobID, "ExplanationOfBenefit", "", time.Now())
+	assert.NoError(s.T(), err)
+	assert.NotEqual(s.T(), fileUUID, resultUUID)
+	_, err = os.Stat(orphan)
+	assert.True(s.T(), os.IsNotExist(err))
+	os.RemoveAll(stagingDir)
+}
+
 func (s *MainTestSuite) TestGetFailureThreshold() {
 	origFailPct := os.Getenv("EXPORT_FAIL_PCT")
 	defer os.Setenv("EXPORT_FAIL_PCT", origFailPct)
@@ -336,14 +597,23 @@ func (s *MainTestSuite) TestGetFailureThreshold() {
 	assert.Equal(s.T(), 50.0, getFailureThreshold())
 }
 
-func (s *MainTestSuite) TestAppendErrorToFile() {
+func (s *MainTestSuite) TestChunkErrors() {
 
 	acoID := "328e83c3-bc46-4827-836c-0ba0c713dc7d"
 	jobID := "1"
 	testUtils.CreateStaging(jobID)
-	appendErrorToFile(acoID, "", "", "", jobID)
+	store, err := storage.New()
+	assert.NoError(s.T(), err)
+	errs := newChunkErrors(store, jobID, acoID)
+	errs.add("", "", "")
 
+	// Nothing is written until the errors are flushed
 	filePath := fmt.Sprintf("%s/%s/%s-error.ndjson", os.Getenv("FHIR_STAGING_DIR"), jobID, acoID)
+	_, err = os.Stat(filePath)
+	assert.True(s.T(), os.IsNotExist(err))
+
+	assert.NoError(s.T(), errs.flush())
+	assert.NoError(s.T(), errs.flush())
 	fData, err := ioutil.ReadFile(filePath)
 	assert.NoError(s.T(), err)
 
@@ -354,6 +624,28 @@ func (s *MainTestSuite) TestAppendErrorToFile() {
 	os.Remove(filePath)
 }
 
+func (s *MainTestSuite) TestHandleBBErrorRecordsCategory() {
+	fileUUID := uuid.NewRandom().String()
+	jobID := "1"
+	testUtils.CreateStaging(jobID)
+	filePath := fmt.Sprintf("%s/%s/%s-error.ndjson", os.Getenv("FHIR_STAGING_DIR"), jobID, fileUUID)
+	defer os.Remove(filePath)
+
+	errorCount := 0
+	bbErr := &client.RequestError{QueryID: "1", Attempts: 4, Category: client.TimeoutError, Err: errors.New("timeout")}
+	store, err := storage.New()
+	assert.NoError(s.T(), err)
+	errs := newChunkErrors(store, jobID, fileUUID)
+	handleBBError(bbErr, &errorCount, errs, "Error retrieving Patient for beneficiary 1")
+	assert.Equal(s.T(), 1, errorCount)
+	assert.NoError(s.T(), errs.flush())
+
+	fData, err := ioutil.ReadFile(filePath)
+	assert.NoError(s.T(), err)
+	ooResp := `{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"timeout","details":{"coding":[{"system":"http://hl7.org/fhir/ValueSet/operation-outcome","code":"Blue Button Error","display":"Error retrieving Patient for beneficiary 1 (timeout error)"}],"text":"Error retrieving Patient for beneficiary 1 (timeout error)"}}]}`
+	assert.Equal(s.T(), ooResp+"\n", string(fData))
+}
+
 func (s *MainTestSuite) TestProcessJobEOB() {
 	db := database.GetGORMDbConnection()
 	defer database.Close(db)
@@ -378,7 +670,7 @@ func (s *MainTestSuite) TestProcessJobEOB() {
 	}
 	args, _ := json.Marshal(jobArgs)
 
-	job := &que.Job{
+	job := &queue.Job{
 		Type: "ProcessJob",
 		Args: args,
 	}
@@ -395,7 +687,7 @@ func (s *MainTestSuite) TestProcessJobEOB() {
 }
 
 func (s *MainTestSuite) TestProcessJob_InvalidArgs() {
-	j := que.Job{Args: []byte("{ this is not valid JSON }")}
+	j := queue.Job{Args: []byte("{ this is not valid JSON }")}
 	assert.EqualError(s.T(), processJob(&j), "invalid character 't' looking for beginning of object key string")
 }
 
@@ -407,7 +699,7 @@ func (s *MainTestSuite) TestProcessJob_InvalidJobID() {
 		ResourceType:   "Patient",
 	})
 
-	qj := que.Job{
+	qj := queue.Job{
 		Type: "ProcessJob",
 		Args: qjArgs,
 	}
@@ -434,7 +726,7 @@ func (s *MainTestSuite) TestProcessJob_NoBBClient() {
 		ResourceType:   "Patient",
 	})
 
-	qj := que.Job{
+	qj := queue.Job{
 		Type: "ProcessJob",
 		Args: qjArgs,
 	}
@@ -492,7 +784,7 @@ func (s *MainTestSuite) TestQueueJobWithNoParent() {
 				ResourceType:   "Patient",
 			})
 
-			qj := &que.Job{
+			qj := &queue.Job{
 				Type:       "ProcessJob",
 				Args:       qjArgs,
 				Priority:   1,
@@ -508,3 +800,29 @@ func (s *MainTestSuite) TestQueueJobWithNoParent() {
 		})
 	}
 }
+
+func TestRequeueJob(t *testing.T) {
+	defer func(orig queue.Queue) { q = orig }(q)
+	memQueue := queue.NewMemoryQueue()
+	q = memQueue
+
+	assert.NoError(t, q.Enqueue(&queue.Job{Type: "ProcessJob", Args: []byte(`{"ID":1}`)}))
+	rerr := requeueError{errors.New("Blue Button unavailable"), time.Minute}
+	var requeueErr error
+	assert.True(t, q.WorkOne(queue.WorkMap{"ProcessJob": func(j *queue.Job) error {
+		requeueErr = requeueJob(j, rerr)
+		return requeueErr
+	}}))
+	assert.NoError(t, requeueErr)
+
+	// The job waits on the queue without counting as a failed attempt
+	jobs := memQueue.Jobs()
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, int32(0), jobs[0].ErrorCount)
+		assert.Equal(t, "Blue Button unavailable", jobs[0].LastError)
+		assert.True(t, jobs[0].RunAt.After(time.Now()))
+	}
+
+	// Jobs that are not being worked are retried with the usual backoff instead
+	assert.Equal(t, rerr, requeueJob(&jobs[0], rerr))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/client/fhir"
+	"github.com/CMSgov/bcda-app/bcda/models"
+)
+
+// beneResolution holds the Blue Button IDs of a chunk's beneficiaries.
+type beneResolution struct {
+	bbIDs map[string]string
+	// errs holds the beneficiaries that could not be resolved and should be reported in this chunk's error file
+	errs map[string]error
+	// reported holds the unresolvable beneficiaries that have already been reported by another chunk of the job
+	reported map[string]bool
+	// previousIDs holds the Blue Button IDs of the beneficiaries' previous MBIs that differ from their current one
+	previousIDs map[string][]string
+	mbis        map[string]string
+}
+
+// resolveLockKey is the advisory lock key held by a chunk while it resolves its beneficiaries, with the job's ID as
+// the second key. The two key form of the lock cannot collide with the job IDs locked by que.
+const resolveLockKey = 20201019
+
+// isUnresolvable reports whether Blue Button does not know the beneficiary, rather than the request having failed.
+// Other 4xx responses, e.g. from bad credentials, are failures.
+func isUnresolvable(err error) bool {
+	var unresolvable models.UnresolvableError
+	var statusErr *fhir.StatusError
+	return errors.As(err, &unresolvable) || errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+// resolveBeneficiaries resolves the MBIs of the beneficiaries to Blue Button IDs before their data is requested.
+//
+// Every chunk of a job (one per resource type) contains the same beneficiaries. Stored IDs that are fresh
+// (see CCLFBeneficiary.IsBlueButtonIDFresh) are used as is, and the chunks of a job take turns resolving their
+// beneficiaries, so the IDs looked up by one chunk are saved before the next reads them and each beneficiary is
+// looked up at most once per job. A beneficiary that cannot be resolved is only reported by the first chunk of
+// the job to try it.
+func resolveBeneficiaries(bb client.APIClient, db *gorm.DB, jobID string, cclfBeneficiaryIDs []string) (*beneResolution, error) {
+	r := &beneResolution{
+		bbIDs:       make(map[string]string),
+		errs:        make(map[string]error),
+		reported:    make(map[string]bool),
+		previousIDs: make(map[string][]string),
+		mbis:        make(map[string]string),
+	}
+	if len(cclfBeneficiaryIDs) == 0 {
+		return r, nil
+	}
+
+	// The job may not exist, e.g. when testing, in which case only the stored IDs' age is considered
+	var job models.Job
+	if err := db.First(&job, "id = ?", jobID).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+
+	// The lock is held until the looked up IDs have been saved
+	if job.ID != 0 {
+		tx := db.Begin()
+		defer tx.Rollback()
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?::int, ?::int)", resolveLockKey, job.ID).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	var benes []models.CCLFBeneficiary
+	if err := db.Where("id in (?)", cclfBeneficiaryIDs).Find(&benes).Error; err != nil {
+		return nil, err
+	}
+
+	var unresolved []models.UnresolvedBeneficiary
+	if job.ID != 0 {
+		err := db.Where("job_id = ? AND cclf_beneficiary_id in (?)", job.ID, cclfBeneficiaryIDs).Find(&unresolved).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range unresolved {
+		r.reported[strconv.FormatUint(uint64(u.CCLFBeneficiaryID), 10)] = true
+	}
+
+	var stale []models.CCLFBeneficiary
+	stored := 0
+	for _, b := range benes {
+		id := strconv.FormatUint(uint64(b.ID), 10)
+		r.mbis[id] = b.MBI
+		if r.reported[id] {
+			continue
+		}
+		if b.IsBlueButtonIDFresh(job.CreatedAt) {
+			r.bbIDs[id] = b.BlueButtonID
+			stored++
+		} else {
+			stale = append(stale, b)
+		}
+	}
+
+	resolved := lookupBlueButtonIDs(bb, stale)
+
+	updated := make(map[uint]string)
+	for _, b := range stale {
+		id := strconv.FormatUint(uint64(b.ID), 10)
+		res := resolved[b.ID]
+		if res.err == nil {
+			r.bbIDs[id] = res.bbID
+			updated[b.ID] = res.bbID
+			continue
+		}
+
+		if !isUnresolvable(res.err) || job.ID == 0 {
+			r.errs[id] = res.err
+			continue
+		}
+		first, err := models.AddUnresolvedBeneficiary(db, job.ID, b.ID, res.err.Error())
+		if err != nil {
+			log.Error(err)
+		}
+		if first || err != nil {
+			r.errs[id] = res.err
+		} else {
+			r.reported[id] = true
+		}
+	}
+
+	// The IDs have been resolved either way, so failing to save them only means they are looked up again later
+	if err := models.UpdateBlueButtonIDs(db, updated); err != nil {
+		log.Errorf("Unable to save Blue Button IDs for job %s: %s", jobID, err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"jobID":     jobID,
+		"stored":    stored,
+		"looked_up": len(stale),
+		"failed":    len(r.errs),
+		"reported":  len(r.reported),
+	}).Info("Resolved Blue Button IDs for chunk")
+
+	return r, nil
+}
+
+// resolvePreviousIDs looks up the Blue Button IDs of the resolved beneficiaries' previous MBIs, taken from the ACO's
+// CCLF9 cross references, so that data recorded under them is exported too. Previous MBIs that Blue Button does
+// not know, or that lead to the beneficiary's current ID, are ignored. A beneficiary whose previous MBI cannot be
+// looked up is reported as failed rather than exported without some of their data.
+func (r *beneResolution) resolvePreviousIDs(bb client.APIClient, db *gorm.DB, acoCMSID string) error {
+	ids := make(map[string]string)
+	var mbis []string
+	for id := range r.bbIDs {
+		mbis = append(mbis, r.mbis[id])
+		ids[r.mbis[id]] = id
+	}
+
+	previous, err := models.GetPreviousMBIs(db, acoCMSID, mbis)
+	if err != nil {
+		return err
+	}
+
+	for mbi, previousMBIs := range previous {
+		id := ids[mbi]
+		modelID, _ := strconv.ParseUint(id, 10, 64)
+		for _, previousMBI := range previousMBIs {
+			bbID, err := models.GetBlueButtonID(bb, previousMBI, "beneficiary", uint(modelID))
+			if err != nil {
+				if isUnresolvable(err) {
+					continue
+				}
+				delete(r.bbIDs, id)
+				delete(r.previousIDs, id)
+				r.errs[id] = err
+				break
+			}
+			if bbID != r.bbIDs[id] {
+				r.previousIDs[id] = append(r.previousIDs[id], bbID)
+			}
+		}
+	}
+
+	if len(previous) > 0 {
+		log.WithFields(log.Fields{
+			"aco":           acoCMSID,
+			"beneficiaries": len(previous),
+			"previous_ids":  len(r.previousIDs),
+		}).Info("Resolved Blue Button IDs of previous MBIs")
+	}
+	return nil
+}
+
+type bbIDResult struct {
+	bbID string
+	err  error
+}
+
+// lookupBlueButtonIDs asks Blue Button for the beneficiaries' IDs, sending up to BCDA_WORKER_BENE_CONCURRENCY
+// requests at once.
+func lookupBlueButtonIDs(bb client.APIClient, benes []models.CCLFBeneficiary) map[uint]bbIDResult {
+	results := make(map[uint]bbIDResult, len(benes))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	permits := make(chan struct{}, getBeneConcurrency())
+
+	for i := range benes {
+		b := benes[i]
+		permits <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-permits
+				wg.Done()
+			}()
+			bbID, err := b.GetBlueButtonID(bb)
+			mu.Lock()
+			results[b.ID] = bbIDResult{bbID, err}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
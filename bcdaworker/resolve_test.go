@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/client/fhir"
+	"github.com/CMSgov/bcda-app/bcda/constants"
+	"github.com/CMSgov/bcda-app/bcda/database"
+	"github.com/CMSgov/bcda-app/bcda/models"
+	"github.com/CMSgov/bcda-app/bcda/testUtils"
+)
+
+func TestIsUnresolvable(t *testing.T) {
+	assert.True(t, isUnresolvable(models.UnresolvableError{}))
+	assert.True(t, isUnresolvable(&client.RequestError{Category: client.ClientError, Err: &fhir.StatusError{StatusCode: http.StatusNotFound}}))
+	// Bad credentials are a failure, not an unknown beneficiary
+	assert.False(t, isUnresolvable(&client.RequestError{Category: client.ClientError, Err: &fhir.StatusError{StatusCode: http.StatusUnauthorized}}))
+	assert.False(t, isUnresolvable(&fhir.StatusError{StatusCode: http.StatusForbidden}))
+	assert.False(t, isUnresolvable(&fhir.StatusError{StatusCode: http.StatusInternalServerError}))
+}
+
+func (s *MainTestSuite) TestResolveBeneficiaries() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	j := models.Job{ACOID: uuid.Parse("DBBD1CE1-AE24-435C-807D-ED45953077D3"), RequestURL: "/api/v1/Patient/$export", Status: "In Progress", JobCount: 2}
+	assert.NoError(s.T(), db.Save(&j).Error)
+	defer db.Unscoped().Delete(&j)
+	defer db.Unscoped().Where("job_id = ?", j.ID).Delete(&models.UnresolvedBeneficiary{})
+	jobID := strconv.FormatUint(uint64(j.ID), 10)
+
+	cclfFile := models.CCLFFile{CCLFNum: 8, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC8Y19.D191120.T1012314"}
+	db.Create(&cclfFile)
+	defer db.Delete(&cclfFile)
+
+	// One beneficiary was confirmed recently, one has never been looked up and one is unknown to Blue Button
+	recently := time.Now().Add(-time.Hour)
+	benes := []models.CCLFBeneficiary{
+		{FileID: cclfFile.ID, HICN: "whatever", MBI: "a1000003701", BlueButtonID: "fresh", BlueButtonIDResolvedAt: &recently},
+		{FileID: cclfFile.ID, HICN: "whatever", MBI: "a1000050699"},
+		{FileID: cclfFile.ID, HICN: "whatever", MBI: "a1000099999"},
+	}
+	var cclfBeneficiaryIDs []string
+	for i := range benes {
+		db.Create(&benes[i])
+		defer db.Unscoped().Delete(&benes[i])
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(benes[i].ID), 10))
+	}
+
+	bbc := testUtils.BlueButtonClient{}
+	bbc.MBI = &benes[1].MBI
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(benes[1].MBI)).Return(bbc.GetData("Patient", "BB_VALUE"))
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier(benes[2].MBI)).Return("", &fhir.StatusError{StatusCode: http.StatusNotFound})
+
+	r, err := resolveBeneficiaries(&bbc, db, jobID, cclfBeneficiaryIDs)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), map[string]string{cclfBeneficiaryIDs[0]: "fresh", cclfBeneficiaryIDs[1]: "BB_VALUE"}, r.bbIDs)
+	assert.Contains(s.T(), r.errs, cclfBeneficiaryIDs[2])
+	assert.Empty(s.T(), r.reported)
+	bbc.AssertNumberOfCalls(s.T(), "GetPatientByIdentifierHash", 2)
+
+	var saved models.CCLFBeneficiary
+	assert.NoError(s.T(), db.First(&saved, benes[1].ID).Error)
+	assert.Equal(s.T(), "BB_VALUE", saved.BlueButtonID)
+	assert.NotNil(s.T(), saved.BlueButtonIDResolvedAt)
+
+	// The job's next chunk reuses the IDs and does not report the unknown beneficiary again
+	r, err = resolveBeneficiaries(&bbc, db, jobID, cclfBeneficiaryIDs)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), map[string]string{cclfBeneficiaryIDs[0]: "fresh", cclfBeneficiaryIDs[1]: "BB_VALUE"}, r.bbIDs)
+	assert.Empty(s.T(), r.errs)
+	assert.Equal(s.T(), map[string]bool{cclfBeneficiaryIDs[2]: true}, r.reported)
+	bbc.AssertNumberOfCalls(s.T(), "GetPatientByIdentifierHash", 2)
+}
+
+func (s *MainTestSuite) TestResolvePreviousIDs() {
+	db := database.GetGORMDbConnection()
+	defer db.Close()
+
+	cclf8 := models.CCLFFile{CCLFNum: 8, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC8Y19.D191120.T1012315", ImportStatus: constants.ImportComplete}
+	db.Create(&cclf8)
+	defer db.Unscoped().Delete(&cclf8)
+	cclf9 := models.CCLFFile{CCLFNum: 9, ACOCMSID: "12345", Timestamp: time.Now(), PerformanceYear: 19, Name: "T.A12345.ACO.ZC9Y19.D191120.T1012315", ImportStatus: constants.ImportComplete}
+	db.Create(&cclf9)
+	defer db.Unscoped().Delete(&cclf9)
+
+	// The first beneficiary had two previous MBIs, one of which Blue Button does not know.
+	// Looking up the second beneficiary's previous MBI fails.
+	recently := time.Now().Add(-time.Hour)
+	benes := []models.CCLFBeneficiary{
+		{FileID: cclf8.ID, HICN: "whatever", MBI: "a1000003701", BlueButtonID: "current1", BlueButtonIDResolvedAt: &recently},
+		{FileID: cclf8.ID, HICN: "whatever", MBI: "a1000050699", BlueButtonID: "current2", BlueButtonIDResolvedAt: &recently},
+	}
+	var cclfBeneficiaryIDs []string
+	for i := range benes {
+		db.Create(&benes[i])
+		defer db.Unscoped().Delete(&benes[i])
+		cclfBeneficiaryIDs = append(cclfBeneficiaryIDs, strconv.FormatUint(uint64(benes[i].ID), 10))
+	}
+	defer db.Unscoped().Where("file_id = ?", cclf9.ID).Delete(&models.CCLFBeneficiaryXref{})
+	for _, xref := range []models.CCLFBeneficiaryXref{
+		{FileID: cclf9.ID, XrefIndicator: "M", CurrentNum: "a1000003701", PrevNum: "b1000003701"},
+		{FileID: cclf9.ID, XrefIndicator: "M", CurrentNum: "a1000003701", PrevNum: "c1000003701"},
+		{FileID: cclf9.ID, XrefIndicator: "H", CurrentNum: "a1000003701", PrevNum: "123456789A"},
+		{FileID: cclf9.ID, XrefIndicator: "M", CurrentNum: "a1000050699", PrevNum: "b1000050699"},
+	} {
+		db.Create(&xref)
+	}
+
+	bbc := testUtils.BlueButtonClient{}
+	previousMBI := "b1000003701"
+	bbc.MBI = &previousMBI
+	patient, err := bbc.GetData("Patient", "previous1")
+	assert.NoError(s.T(), err)
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier("b1000003701")).Return(patient, nil)
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier("c1000003701")).Return("", &fhir.StatusError{StatusCode: http.StatusNotFound})
+	bbc.On("GetPatientByIdentifierHash", client.HashIdentifier("b1000050699")).Return("", &fhir.StatusError{StatusCode: http.StatusInternalServerError})
+
+	r, err := resolveBeneficiaries(&bbc, db, "0", cclfBeneficiaryIDs)
+	assert.NoError(s.T(), err)
+	assert.NoError(s.T(), r.resolvePreviousIDs(&bbc, db, "12345"))
+
+	assert.Equal(s.T(), map[string]string{cclfBeneficiaryIDs[0]: "current1"}, r.bbIDs)
+	assert.Equal(s.T(), map[string][]string{cclfBeneficiaryIDs[0]: {"previous1"}}, r.previousIDs)
+	assert.Contains(s.T(), r.errs, cclfBeneficiaryIDs[1])
+	bbc.AssertNumberOfCalls(s.T(), "GetPatientByIdentifierHash", 3)
+}
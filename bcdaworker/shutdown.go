@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/queue"
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// workerShutdown coordinates a graceful shutdown of the worker.
+// Once stopped, no new jobs are taken off the queue. Once interrupted, jobs that are still running
+// record a checkpoint and return so they can be resumed by another worker.
+type workerShutdown struct {
+	stopped       chan struct{}
+	interrupted   chan struct{}
+	stopOnce      sync.Once
+	interruptOnce sync.Once
+}
+
+var shutdown = newWorkerShutdown()
+
+func newWorkerShutdown() *workerShutdown {
+	return &workerShutdown{
+		stopped:     make(chan struct{}),
+		interrupted: make(chan struct{}),
+	}
+}
+
+func (s *workerShutdown) stop() {
+	s.stopOnce.Do(func() { close(s.stopped) })
+}
+
+func (s *workerShutdown) interrupt() {
+	s.interruptOnce.Do(func() { close(s.interrupted) })
+}
+
+func (s *workerShutdown) isStopped() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *workerShutdown) isInterrupted() bool {
+	select {
+	case <-s.interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// workerPool runs workers until the worker is shut down. Each worker checks for a shutdown request between jobs.
+// When the queue is empty, workers sleep for QUE_WAKE_INTERVAL seconds before checking again.
+type workerPool struct {
+	queue    queue.Queue
+	wm       queue.WorkMap
+	count    int
+	interval time.Duration
+	shutdown *workerShutdown
+	wg       sync.WaitGroup
+}
+
+func newWorkerPool(q queue.Queue, wm queue.WorkMap, count int, s *workerShutdown) *workerPool {
+	interval := time.Duration(utils.GetEnvInt("QUE_WAKE_INTERVAL", 5)) * time.Second
+	return &workerPool{queue: q, wm: wm, count: count, interval: interval, shutdown: s}
+}
+
+func (p *workerPool) start() {
+	for i := 0; i < p.count; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.work()
+		}()
+	}
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case <-p.shutdown.stopped:
+			return
+		case <-time.After(p.interval):
+			for !p.shutdown.isStopped() && p.queue.WorkOne(p.wm) {
+			}
+		}
+	}
+}
+
+// wait blocks until every worker has finished its current job, or the timeout elapses.
+// It reports whether the workers finished.
+func (p *workerPool) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// gracefulShutdown stops the pool from taking new jobs and waits for running jobs to complete.
+// Jobs still running after BCDA_WORKER_SHUTDOWN_TIMEOUT_SEC are interrupted and given
+// BCDA_WORKER_SHUTDOWN_CHECKPOINT_SEC to record their progress.
+// It reports whether every job finished or checkpointed in time.
+func gracefulShutdown(p *workerPool) bool {
+	drainTimeout := time.Duration(utils.GetEnvInt("BCDA_WORKER_SHUTDOWN_TIMEOUT_SEC", 30)) * time.Second
+	checkpointTimeout := time.Duration(utils.GetEnvInt("BCDA_WORKER_SHUTDOWN_CHECKPOINT_SEC", 10)) * time.Second
+
+	log.Infof("Worker shutting down, waiting up to %s for running jobs to finish", drainTimeout)
+	p.shutdown.stop()
+	if p.wait(drainTimeout) {
+		return true
+	}
+
+	log.Warnf("Jobs still running after %s, interrupting them", drainTimeout)
+	p.shutdown.interrupt()
+	if p.wait(checkpointTimeout) {
+		return true
+	}
+
+	log.Errorf("Jobs still running after %s, exiting anyway", drainTimeout+checkpointTimeout)
+	return false
+}
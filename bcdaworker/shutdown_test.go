@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setShutdownTimeouts(t *testing.T, drain, checkpoint string) {
+	os.Setenv("BCDA_WORKER_SHUTDOWN_TIMEOUT_SEC", drain)
+	os.Setenv("BCDA_WORKER_SHUTDOWN_CHECKPOINT_SEC", checkpoint)
+	t.Cleanup(func() {
+		os.Unsetenv("BCDA_WORKER_SHUTDOWN_TIMEOUT_SEC")
+		os.Unsetenv("BCDA_WORKER_SHUTDOWN_CHECKPOINT_SEC")
+	})
+}
+
+// runningJob simulates a job that returns once the supplied channel is closed
+func runningJob(p *workerPool, until func(s *workerShutdown) <-chan struct{}) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if ch := until(p.shutdown); ch != nil {
+			<-ch
+		} else {
+			select {}
+		}
+	}()
+}
+
+func TestGracefulShutdownDrains(t *testing.T) {
+	setShutdownTimeouts(t, "5", "5")
+	p := &workerPool{shutdown: newWorkerShutdown()}
+	runningJob(p, func(s *workerShutdown) <-chan struct{} { return s.stopped })
+
+	assert.True(t, gracefulShutdown(p))
+	assert.True(t, p.shutdown.isStopped())
+	assert.False(t, p.shutdown.isInterrupted(), "jobs that finish in time should not be interrupted")
+}
+
+func TestGracefulShutdownInterrupts(t *testing.T) {
+	setShutdownTimeouts(t, "0", "5")
+	p := &workerPool{shutdown: newWorkerShutdown()}
+	runningJob(p, func(s *workerShutdown) <-chan struct{} { return s.interrupted })
+
+	assert.True(t, gracefulShutdown(p))
+	assert.True(t, p.shutdown.isInterrupted())
+}
+
+func TestGracefulShutdownTimesOut(t *testing.T) {
+	setShutdownTimeouts(t, "0", "0")
+	p := &workerPool{shutdown: newWorkerShutdown()}
+	runningJob(p, func(s *workerShutdown) <-chan struct{} { return nil })
+
+	assert.False(t, gracefulShutdown(p))
+}
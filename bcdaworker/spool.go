@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// spool holds the data retrieved for a single beneficiary until it can be written to the job's file.
+// Data is kept in memory until it exceeds maxMemory bytes, at which point it is moved to a temporary file.
+// This keeps the worker's memory usage flat regardless of the number of resources a beneficiary has.
+type spool struct {
+	maxMemory int
+	buf       bytes.Buffer
+	f         *os.File
+}
+
+func newSpool() *spool {
+	return &spool{maxMemory: utils.GetEnvInt("BCDA_WORKER_SPOOL_MEMORY_KB", 1024) * 1024}
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.f != nil {
+		return s.f.Write(p)
+	}
+
+	if s.buf.Len()+len(p) <= s.maxMemory {
+		return s.buf.Write(p)
+	}
+
+	f, err := ioutil.TempFile("", "bcda-spool-")
+	if err != nil {
+		return 0, err
+	}
+	s.f = f
+
+	if _, err = s.buf.WriteTo(f); err != nil {
+		return 0, err
+	}
+	return f.Write(p)
+}
+
+// WriteTo copies the spooled data to w.
+func (s *spool) WriteTo(w io.Writer) (int64, error) {
+	if s.f == nil {
+		return io.Copy(w, bytes.NewReader(s.buf.Bytes()))
+	}
+
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.f)
+}
+
+// Close releases the spooled data, removing the temporary file if one was created.
+func (s *spool) Close() error {
+	s.buf.Reset()
+	if s.f == nil {
+		return nil
+	}
+
+	name := s.f.Name()
+	err := s.f.Close()
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	s.f = nil
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolInMemory(t *testing.T) {
+	s := &spool{maxMemory: 64}
+	_, err := s.Write([]byte("small\n"))
+	assert.NoError(t, err)
+	assert.Nil(t, s.f, "data under the limit should stay in memory")
+
+	var out bytes.Buffer
+	_, err = s.WriteTo(&out)
+	assert.NoError(t, err)
+	assert.Equal(t, "small\n", out.String())
+	assert.NoError(t, s.Close())
+}
+
+func TestSpoolSpillsToFile(t *testing.T) {
+	s := &spool{maxMemory: 16}
+	var expected strings.Builder
+	for i := 0; i < 10; i++ {
+		line := strings.Repeat("x", i) + "\n"
+		expected.WriteString(line)
+		_, err := s.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	assert.NotNil(t, s.f, "data over the limit should be moved to a file")
+	assert.Zero(t, s.buf.Len())
+	name := s.f.Name()
+
+	// Data can be copied out more than once
+	for i := 0; i < 2; i++ {
+		var out bytes.Buffer
+		_, err := s.WriteTo(&out)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.String(), out.String())
+	}
+
+	assert.NoError(t, s.Close())
+	_, err := os.Stat(name)
+	assert.True(t, os.IsNotExist(err), "temporary file should be removed")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/CMSgov/bcda-app/bcda/client"
+	"github.com/CMSgov/bcda-app/bcda/models"
+)
+
+// chunkUsage accumulates the data written while exporting a chunk.
+// Only the goroutine writing the chunk's file updates it.
+type chunkUsage struct {
+	resources int64
+	bytes     int64
+}
+
+func (u *chunkUsage) add(resources int, bytes int64) {
+	if u == nil {
+		return
+	}
+	u.resources += int64(resources)
+	u.bytes += bytes
+}
+
+// requestCounter is implemented by Blue Button clients that count the requests they send.
+type requestCounter interface {
+	RequestCount() int64
+}
+
+// requestCount returns the number of requests sent by the client, or 0 if it does not count them.
+func requestCount(bb client.APIClient) int64 {
+	if c, ok := bb.(requestCounter); ok {
+		return c.RequestCount()
+	}
+	return 0
+}
+
+// recordChunkUsage adds the usage of an attempt at a chunk to the job's usage. The usage is only for reporting,
+// so failing to record it does not fail the chunk.
+func recordChunkUsage(db *gorm.DB, u models.JobUsage) {
+	if err := models.AddJobUsage(db, u); err != nil {
+		log.Errorf("Unable to record usage of queued job %d for job %d: %s", u.QueJobID, u.JobID, err.Error())
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"jobID":         u.JobID,
+		"resource_type": u.ResourceType,
+		"bb_requests":   u.BBRequests,
+		"resources":     u.Resources,
+		"bytes":         u.Bytes,
+		"duration_ms":   u.DurationMS,
+	}).Info("Recorded job chunk usage")
+}
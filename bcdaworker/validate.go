@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/CMSgov/bcda-app/bcda/utils"
+)
+
+// fhirID matches the ids allowed by FHIR
+var fhirID = regexp.MustCompile(`^[A-Za-z0-9\-.]{1,64}$`)
+
+// resourceValidator checks that each resource received from Blue Button is structurally sound and of the type
+// expected in the file before it is written, so that malformed resources do not reach the file.
+type resourceValidator struct {
+	resourceType string
+}
+
+// newResourceValidator returns a validator for the files of the resource type, or nil when
+// BCDA_WORKER_VALIDATE_RESOURCES turns validation off.
+func newResourceValidator(resourceType string) *resourceValidator {
+	if !utils.GetEnvBool("BCDA_WORKER_VALIDATE_RESOURCES", true) {
+		return nil
+	}
+	return &resourceValidator{resourceType: resourceType}
+}
+
+// validate returns an error describing why the resource cannot be written, if it cannot.
+func (v *resourceValidator) validate(resource json.RawMessage) error {
+	if v == nil {
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(resource, &fields); err != nil || fields == nil {
+		return fmt.Errorf("resource is not a JSON object")
+	}
+
+	var resourceType, id string
+	if err := json.Unmarshal(fields["resourceType"], &resourceType); err != nil || resourceType == "" {
+		return fmt.Errorf("resource is missing resourceType")
+	}
+	if err := json.Unmarshal(fields["id"], &id); err != nil || id == "" {
+		return fmt.Errorf("%s resource is missing id", resourceType)
+	}
+	if !fhirID.MatchString(id) {
+		return fmt.Errorf("%s resource has invalid id %q", resourceType, id)
+	}
+	if resourceType != v.resourceType {
+		return fmt.Errorf("%s resource %s found in %s file", resourceType, id, v.resourceType)
+	}
+	if meta, ok := fields["meta"]; ok {
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(meta, &m); err != nil {
+			return fmt.Errorf("%s resource %s has invalid meta", resourceType, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceValidator(t *testing.T) {
+	v := newResourceValidator("Coverage")
+
+	tests := []struct {
+		resource string
+		err      string
+	}{
+		{`{"resourceType":"Coverage","id":"part-a-20000000000001","meta":{"lastUpdated":"2020-01-01T00:00:00Z"}}`, ""},
+		{`{"resourceType":"Coverage","id":"-20000000000001"}`, ""},
+		{`["Coverage"]`, "resource is not a JSON object"},
+		{`null`, "resource is not a JSON object"},
+		{`{"id":"part-a-20000000000001"}`, "resource is missing resourceType"},
+		{`{"resourceType":"Coverage"}`, "Coverage resource is missing id"},
+		{`{"resourceType":"Coverage","id":12}`, "Coverage resource is missing id"},
+		{`{"resourceType":"Coverage","id":"part a"}`, `Coverage resource has invalid id "part a"`},
+		{`{"resourceType":"Patient","id":"20000000000001"}`, "Patient resource 20000000000001 found in Coverage file"},
+		{`{"resourceType":"Coverage","id":"part-a-20000000000001","meta":[]}`, "Coverage resource part-a-20000000000001 has invalid meta"},
+	}
+	for _, tt := range tests {
+		err := v.validate(json.RawMessage(tt.resource))
+		if tt.err == "" {
+			assert.NoError(t, err, tt.resource)
+		} else {
+			assert.EqualError(t, err, tt.err, tt.resource)
+		}
+	}
+
+	defer os.Setenv("BCDA_WORKER_VALIDATE_RESOURCES", os.Getenv("BCDA_WORKER_VALIDATE_RESOURCES"))
+	os.Setenv("BCDA_WORKER_VALIDATE_RESOURCES", "false")
+	v = newResourceValidator("Coverage")
+	assert.Nil(t, v)
+	assert.NoError(t, v.validate(json.RawMessage(`{"resourceType":"Patient"}`)))
+}
+
+func TestSpoolResourcesSkipsInvalidResources(t *testing.T) {
+	result := beneResult{data: newSpool()}
+	defer result.release()
+	handler := spoolResources(&result, newResourceValidator("Patient"))
+
+	assert.NoError(t, handler(json.RawMessage(`{"resourceType":"Patient","id":"1"}`)))
+	assert.NoError(t, handler(json.RawMessage(`{"resourceType":"Patient"}`)))
+	assert.NoError(t, handler(json.RawMessage(`{"resourceType":"Patient","id":"2"}`)))
+
+	assert.Equal(t, 2, result.resources)
+	assert.Equal(t, []string{"Patient resource is missing id"}, result.invalid)
+}
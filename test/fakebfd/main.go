@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/CMSgov/bcda-app/bcda/testUtils/fakebfd"
+)
+
+// Runs a fake Blue Button server for local development. Point the API and worker at it with
+// BB_SERVER_LOCATION=http://localhost:<port> (or https when -cert and -key are given) and BB_CHECK_CERT=false.
+// The same BB_HASH_PEPPER and BB_HASH_ITER must be used by the server and the client.
+var (
+	addr, dataDir, mbiList, mbiFile, certFile, keyFile string
+	faults                                             fakebfd.Faults
+)
+
+func init() {
+	flag.StringVar(&addr, "addr", ":8443", "address to listen on")
+	flag.StringVar(&dataDir, "data", filepath.Join("shared_files", "synthetic_beneficiary_data"), "directory holding the synthetic Patient, Coverage and ExplanationOfBenefit bundles")
+	flag.StringVar(&mbiList, "mbis", "", "comma separated MBIs of the beneficiaries to serve")
+	flag.StringVar(&mbiFile, "mbi-file", "", "file with the MBI of a beneficiary to serve on each line")
+	flag.StringVar(&certFile, "cert", "", "certificate to serve TLS with")
+	flag.StringVar(&keyFile, "key", "", "key to serve TLS with")
+	flag.IntVar(&faults.LatencyMS, "latency-ms", 0, "delay added to every response")
+	flag.Float64Var(&faults.ErrorRate, "error-rate", 0, "fraction of requests that fail with -error-status")
+	flag.IntVar(&faults.ErrorStatus, "error-status", 500, "status of failed requests")
+	flag.Float64Var(&faults.ThrottleRate, "throttle-rate", 0, "fraction of requests that are throttled with a 429")
+	flag.IntVar(&faults.RetryAfterSec, "retry-after-sec", 0, "Retry-After sent with throttled requests")
+}
+
+func main() {
+	flag.Parse()
+
+	server, err := fakebfd.New(fakebfd.Options{DataDir: dataDir})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = server.SetFaults(faults); err != nil {
+		log.Fatal(err)
+	}
+
+	mbis, err := readMBIs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(mbis) == 0 {
+		log.Fatal("no beneficiaries to serve, use -mbis or -mbi-file")
+	}
+	for _, mbi := range mbis {
+		fmt.Printf("%s\t%s\n", mbi, server.AddBeneficiary(mbi))
+	}
+
+	log.Printf("Serving %d beneficiaries on %s", len(mbis), addr)
+	if certFile != "" || keyFile != "" {
+		log.Fatal(http.ListenAndServeTLS(addr, certFile, keyFile, server))
+	}
+	log.Fatal(http.ListenAndServe(addr, server))
+}
+
+func readMBIs() ([]string, error) {
+	var mbis []string
+	for _, mbi := range strings.Split(mbiList, ",") {
+		if mbi = strings.TrimSpace(mbi); mbi != "" {
+			mbis = append(mbis, mbi)
+		}
+	}
+
+	if mbiFile == "" {
+		return mbis, nil
+	}
+	f, err := os.Open(filepath.Clean(mbiFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if mbi := strings.TrimSpace(sc.Text()); mbi != "" {
+			mbis = append(mbis, mbi)
+		}
+	}
+	return mbis, sc.Err()
+}